@@ -24,7 +24,8 @@ func TestAddIndex(t *testing.T) {
 	harness.verify(t, map[string][]helpers.OTRMessage{})
 }
 
-// We should ignore commands like dropCollection
+// Dropping a collection should publish a resync message on the collection
+// channel
 func TestDropCollection(t *testing.T) {
 	harness := startHarness()
 	defer harness.stop()
@@ -43,5 +44,63 @@ func TestDropCollection(t *testing.T) {
 		panic(err)
 	}
 
-	harness.verify(t, map[string][]helpers.OTRMessage{})
+	harness.verify(t, map[string][]helpers.OTRMessage{
+		"tests.Foo": {{
+			Event:    "resync",
+			Document: map[string]interface{}{},
+			Fields:   []string{},
+		}},
+	})
+}
+
+// Renaming a collection should publish a resync message on the channels of
+// both the old and new collection, and a remove and insert message for each of
+// its documents
+func TestRenameCollection(t *testing.T) {
+	harness := startHarness()
+	defer harness.stop()
+
+	_, err := harness.mongoClient.Collection("Foo").InsertOne(context.Background(), bson.M{
+		"_id":   "someid",
+		"hello": "world",
+	})
+	if err != nil {
+		panic(err)
+	}
+	harness.resetMessages()
+
+	err = harness.mongoClient.Client().Database("admin").RunCommand(context.Background(), bson.D{
+		{Key: "renameCollection", Value: "tests.Foo"},
+		{Key: "to", Value: "tests.Bar"},
+	}).Err()
+	if err != nil {
+		panic(err)
+	}
+
+	resyncMessage := helpers.OTRMessage{
+		Event:    "resync",
+		Document: map[string]interface{}{},
+		Fields:   []string{},
+	}
+	removeMessage := helpers.OTRMessage{
+		Event: "r",
+		Document: map[string]interface{}{
+			"_id": "someid",
+		},
+		Fields: []string{},
+	}
+	insertMessage := helpers.OTRMessage{
+		Event: "i",
+		Document: map[string]interface{}{
+			"_id": "someid",
+		},
+		Fields: []string{"_id"},
+	}
+
+	harness.verify(t, map[string][]helpers.OTRMessage{
+		"tests.Foo":         {resyncMessage, removeMessage},
+		"tests.Foo::someid": {removeMessage},
+		"tests.Bar":         {resyncMessage, insertMessage},
+		"tests.Bar::someid": {insertMessage},
+	})
 }
@@ -42,6 +42,10 @@ func startHarness() *harness {
 	h.legacySubscription = h.legacyRedisClient.PSubscribe(context.Background(), "*")
 	h.legacySubscriptionC = h.legacySubscription.Channel()
 
+	// Dropping the database publishes resync messages (since OTR_DDL_EVENTS is
+	// set), which may arrive after we've subscribed
+	h.resetMessages()
+
 	return &h
 }
 
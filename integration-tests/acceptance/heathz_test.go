@@ -40,8 +40,10 @@ func TestHealthz(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(data, map[string]interface{}{
-		"mongoOK": true,
-		"redisOK": true,
+		"mongoOK":           true,
+		"redisOK":           true,
+		"status":            "ok",
+		"bufferFullSeconds": 0.0,
 	}) {
 		t.Errorf("Got incorrect response.\n    Expected: {\"ok\": true}\n    Got: %#v", data)
 	}
@@ -0,0 +1,135 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisClusterPorts are the ports of the nodes of the RedisCluster. There
+// are three because that's the smallest cluster redis-cli will create.
+var redisClusterPorts = []int{7000, 7001, 7002}
+
+// RedisCluster represents a running Redis Cluster, with a primary on each of
+// redisClusterPorts and no replicas
+type RedisCluster struct {
+	Addr  string
+	dir   string
+	nodes []*exec.Cmd
+}
+
+// StartRedisCluster starts a Redis Cluster and returns a RedisCluster for
+// further operations. Addr is a redis-cluster:// URL for oplogtoredis.
+func StartRedisCluster() *RedisCluster {
+	var endpoints []string
+	for _, port := range redisClusterPorts {
+		endpoints = append(endpoints, fmt.Sprintf("127.0.0.1:%d", port))
+	}
+
+	cluster := RedisCluster{
+		Addr: "redis-cluster://" + strings.Join(endpoints, ","),
+	}
+
+	cluster.Start()
+
+	return &cluster
+}
+
+// Start starts up the nodes and creates the cluster, which starts out empty.
+//
+// This function does not return until every slot is served and the cluster
+// is ready to accept connections.
+func (cluster *RedisCluster) Start() {
+	log.Print("Starting up Redis Cluster")
+
+	dir, err := os.MkdirTemp("", "redis-cluster")
+	if err != nil {
+		panic("Error creating Redis Cluster directory: " + err.Error())
+	}
+	cluster.dir = dir
+
+	var endpoints []string
+	for _, port := range redisClusterPorts {
+		node := exec.Command("redis-server", // #nosec
+			"--port", fmt.Sprint(port),
+			"--cluster-enabled", "yes",
+			"--cluster-config-file", fmt.Sprintf("nodes-%d.conf", port),
+			"--dir", dir,
+			"--save", "",
+			"--loglevel", "debug")
+		node.Stdout = makeLogStreamer(fmt.Sprintf("redis:%d", port), "stdout")
+		node.Stderr = makeLogStreamer(fmt.Sprintf("redis:%d", port), "stderr")
+
+		if err := node.Start(); err != nil {
+			panic("Error starting up Redis Cluster node: " + err.Error())
+		}
+		cluster.nodes = append(cluster.nodes, node)
+
+		endpoint := fmt.Sprintf("127.0.0.1:%d", port)
+		waitTCP(endpoint)
+		endpoints = append(endpoints, endpoint)
+	}
+
+	args := append([]string{"--cluster", "create"}, endpoints...)
+	args = append(args, "--cluster-replicas", "0", "--cluster-yes")
+	output, err := exec.Command("redis-cli", args...).CombinedOutput() // #nosec
+	if err != nil {
+		panic(fmt.Sprintf("Error creating Redis Cluster: %s\n%s", err, output))
+	}
+
+	// The nodes take a moment to agree on the slots after they're assigned
+	client := cluster.Client()
+	defer client.Close()
+	for startTime := time.Now(); ; time.Sleep(500 * time.Millisecond) {
+		info, err := client.ClusterInfo(context.Background()).Result()
+		if err == nil && strings.Contains(info, "cluster_state:ok") {
+			break
+		}
+		if time.Since(startTime) > 30*time.Second {
+			panic(fmt.Sprintf("Timed out waiting for Redis Cluster to be ready: %v %s", err, info))
+		}
+	}
+
+	log.Print("Started up Redis Cluster")
+}
+
+// Stop kills the nodes and removes their data, so that the cluster can be
+// created again by Start.
+func (cluster *RedisCluster) Stop() {
+	log.Print("Shutting down Redis Cluster")
+
+	for _, node := range cluster.nodes {
+		if err := node.Process.Kill(); err != nil {
+			log.Printf("Error killing redis cluster node: %s", err)
+		}
+	}
+	cluster.nodes = nil
+
+	for _, port := range redisClusterPorts {
+		waitTCPDown(fmt.Sprintf("127.0.0.1:%d", port))
+	}
+
+	if err := os.RemoveAll(cluster.dir); err != nil {
+		log.Printf("Error removing Redis Cluster directory: %s", err)
+	}
+
+	log.Print("Shut down Redis Cluster")
+}
+
+// Client returns a go-redis cluster client for this cluster
+func (cluster *RedisCluster) Client() redis.UniversalClient {
+	var addrs []string
+	for _, port := range redisClusterPorts {
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", port))
+	}
+
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: addrs,
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tulip/oplogtoredis/integration-tests/fault-injection/harness"
+)
+
+// This test runs two copies of oplogtoredis against a three-node Redis
+// Cluster, to ensure that every message is published exactly once and in
+// order, with each write shard's keys kept in one slot.
+func TestRedisCluster(t *testing.T) {
+	mongo := harness.StartMongoServer()
+	defer mongo.Stop()
+
+	redis := harness.StartRedisCluster()
+	defer redis.Stop()
+
+	env := []string{"OTR_WRITE_PARALLELISM=4"}
+
+	otr := harness.StartOTRProcessWithEnv(mongo.Addr, redis.Addr, 9000, env)
+	defer otr.Stop()
+
+	otr2 := harness.StartOTRProcessWithEnv(mongo.Addr, redis.Addr, 9001, env)
+	defer otr2.Stop()
+
+	mongoClient := mongo.Client()
+	defer func() { _ = mongoClient.Disconnect(context.Background()) }()
+
+	// PUBLISH is broadcast to every node, so it doesn't matter which node
+	// the verifier subscribes on
+	redisClient := redis.Client()
+	defer redisClient.Close()
+
+	verifier := harness.NewRedisVerifier(redisClient, true)
+	inserter := harness.Run100InsertsInBackground(mongoClient.Database(mongo.DBName))
+
+	insertedIDs := inserter.Result()
+
+	if len(insertedIDs) != 100 {
+		t.Errorf("Expected 100 inserted IDs, got %d", len(insertedIDs))
+	}
+
+	verifier.Verify(t, insertedIDs)
+
+	// The checkpoint of the write shard testdb is in is kept under its hash
+	// tag. It's saved every flush interval, so give it a moment.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		found := false
+		for i := 0; i < 4; i++ {
+			n, err := redisClient.Exists(context.Background(), fmt.Sprintf("oplogtoredis::{%d}lastProcessedEntry", i)).Result()
+			if err != nil {
+				t.Fatalf("Error checking for the checkpoint: %s", err)
+			}
+			found = found || n == 1
+		}
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a checkpoint under a write shard's hash tag")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	metrics := otr.GetPromMetrics()
+	nPermFail := harness.FindPromMetricCounter(metrics, "otr_redispub_processed_messages", map[string]string{
+		"status": "failed",
+	})
+	if nPermFail != 0 {
+		t.Errorf("Metric otr_redispub_processed_messages(status: failed) = %d, expected 0", nPermFail)
+	}
+}
@@ -15,6 +15,11 @@ func SortOTRMessagesByID(msgs []OTRMessage) {
 	idForMsg := func(msg OTRMessage) string {
 		id := msg.Document["_id"]
 
+		// Collection-level messages (like resyncs) don't have an ID
+		if id == nil {
+			return ""
+		}
+
 		// See if it's just a string ID
 		stringID, ok := id.(string)
 		if ok {
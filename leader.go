@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/lease"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricLeader = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "leader",
+	Help:      "Gauge that is 1 while this instance is the leader, and 0 while it's a standby.",
+})
+
+var metricElections = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "elections",
+	Help:      "Number of times this instance has been elected leader.",
+})
+
+var metricFencingToken = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "fencing_token",
+	Help:      "Gauge indicating the fencing token this instance was last elected with.",
+})
+
+var metricLeaseErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "errors",
+	Help:      "Number of errors encountered while acquiring or renewing leases.",
+})
+
+// coordination is how we divide the work with the other copies of
+// oplogtoredis: leader election, or write shard leases
+type coordination interface {
+	// run competes for leases until stop is closed, publishing the write
+	// shards we have leases for with setShards (see tailing.setShards). It
+	// calls setShards on one goroutine at a time.
+	run(setShards func(shards shardSet) error, stop <-chan bool)
+
+	// redisClient is the client for the Redis the leases are in
+	redisClient() redis.UniversalClient
+
+	// describe adds what we're doing to a /healthz response
+	describe(response map[string]interface{})
+
+	close()
+}
+
+// leaseHolder returns a name for us that's unique among the copies competing
+// for leases
+func leaseHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// election competes for the leader lease (see config.LeaderElection) in the
+// first Redis in OTR_REDIS_URL
+type election struct {
+	client redis.UniversalClient
+	lease  *lease.Lease
+	leader int32
+}
+
+func newElection() (*election, error) {
+	client, err := createRedisClient(config.RedisURL()[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &election{
+		client: client,
+		lease:  lease.New(client, config.RedisMetadataPrefix()+"leader", leaseHolder(), config.LeaseTTL()),
+	}, nil
+}
+
+// run implements coordination. While we're the leader, we tail every write
+// shard, with our fencing token.
+func (e *election) run(setShards func(shards shardSet) error, stop <-chan bool) {
+	elected := func(token int64) error {
+		log.Log.Infow("Elected leader; starting to tail the oplog", "fencingToken", token)
+		metricElections.Inc()
+		metricFencingToken.Set(float64(token))
+
+		err := setShards(allShards(redispub.Fencing{Key: e.lease.TokenKey(), Token: token}))
+		if err != nil {
+			return errors.Wrap(err, "starting to tail the oplog after being elected leader")
+		}
+
+		atomic.StoreInt32(&e.leader, 1)
+		metricLeader.Set(1)
+		return nil
+	}
+
+	demoted := func() {
+		log.Log.Warn("Lost the leader lease; stopping tailing the oplog")
+		atomic.StoreInt32(&e.leader, 0)
+		metricLeader.Set(0)
+
+		if err := setShards(nil); err != nil {
+			log.Log.Errorw("Error stopping tailing the oplog", "error", err)
+		}
+	}
+
+	onError := func(err error) {
+		log.Log.Errorw("Error with the leader lease; will retry", "error", err)
+		metricLeaseErrors.Inc()
+	}
+
+	log.Log.Infow("Competing for the leader lease", "key", e.lease.Key())
+	e.lease.Run(config.LeaseTTL()/3, elected, demoted, onError, stop)
+}
+
+func (e *election) redisClient() redis.UniversalClient {
+	return e.client
+}
+
+// describe implements coordination, with our role
+func (e *election) describe(response map[string]interface{}) {
+	if atomic.LoadInt32(&e.leader) == 1 {
+		response["role"] = "leader"
+	} else {
+		response["role"] = "standby"
+	}
+}
+
+func (e *election) close() {
+	if err := e.client.Close(); err != nil {
+		log.Log.Errorw("Error closing leader lease Redis client", "error", err)
+	}
+}
@@ -4,10 +4,13 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
 )
 
 type oplogtoredisConfiguration struct {
@@ -33,12 +36,98 @@ type oplogtoredisConfiguration struct {
 	ResumeTsReadRetryDelay        time.Duration `default:"500ms" split_words:"true"`
 	ResumeFromEndOnFailure        bool          `default:"false" split_words:"true"`
 	RedisBatchSize		            int           `default:"1" split_words:"true"`
+	TailMode                      string        `default:"oplog" split_words:"true"`
+	OplogProjection               bool          `default:"false" split_words:"true"`
+	ShardedCluster                bool          `default:"false" split_words:"true"`
+	ShardDiscoveryInterval        time.Duration `default:"30s" split_words:"true"`
+	DDLEvents                     string        `default:"" envconfig:"DDL_EVENTS"`
+	MongoReadPreference           string        `default:"" split_words:"true"`
+	MongoReadPreferenceTags       string        `default:"" split_words:"true"`
+	ReplicationLagInterval        time.Duration `default:"10s" split_words:"true"`
+	BufferOverflowPolicy          string        `default:"block" split_words:"true"`
+	BufferSpillDir                string        `default:"" split_words:"true"`
+	BufferDegradedAfter           time.Duration `default:"30s" split_words:"true"`
+	BufferMaxBytes                int64         `default:"0" split_words:"true"`
+	CatchUpMode                   string        `default:"skip" split_words:"true"`
+	CatchUpRate                   float64       `default:"1000" split_words:"true"`
+	CatchUpByteRate               float64       `default:"0" split_words:"true"`
+	HeartbeatInterval             time.Duration `default:"1s" split_words:"true"`
+	OplogWindowInterval           time.Duration `default:"1m" split_words:"true"`
+	OplogHeadroomThreshold        float64       `default:"0.25" split_words:"true"`
+	AdminToken                    string        `default:"" split_words:"true"`
+	ReplayRate                    float64       `default:"1000" split_words:"true"`
+	CheckpointStore               string        `default:"redis" split_words:"true"`
+	CheckpointMongoURL            string        `default:"" envconfig:"CHECKPOINT_MONGO_URL"`
+	CheckpointMongoCollection     string        `default:"oplogtoredis.checkpoints" split_words:"true"`
+	CheckpointDir                 string        `default:"" split_words:"true"`
+	AtomicCheckpoint              bool          `default:"false" split_words:"true"`
+	DedupeMode                    string        `default:"keys" split_words:"true"`
+	LeaderElection                bool          `default:"false" split_words:"true"`
+	LeaseTTL                      time.Duration `default:"10s" envconfig:"LEASE_TTL"`
+	ShardLeases                   bool          `default:"false" split_words:"true"`
+	ResyncMessages                bool          `default:"true" split_words:"true"`
 }
 
+const (
+	// TailModeOplog reads local.oplog.rs directly with a tailable cursor.
+	TailModeOplog = "oplog"
+
+	// TailModeChangeStream reads a cluster-wide change stream.
+	TailModeChangeStream = "changestream"
+)
+
+// The policies that can be set as BufferOverflowPolicy
+const (
+	// BufferOverflowBlock makes the tailer wait for room in the buffer.
+	BufferOverflowBlock = "block"
+
+	// BufferOverflowDropOldest drops the oldest publication in the buffer,
+	// and publishes a resync message for its collection instead (with
+	// ResyncMessages).
+	BufferOverflowDropOldest = "drop-oldest"
+
+	// BufferOverflowSpill writes publications that don't fit in the buffer to
+	// a file on disk, and reads them back once there's room.
+	BufferOverflowSpill = "spill"
+)
+
+// The modes that can be set as CatchUpMode
+const (
+	// CatchUpModeSkip starts from the end of the oplog.
+	CatchUpModeSkip = "skip"
+
+	// CatchUpModeThrottle replays the gap at a limited rate.
+	CatchUpModeThrottle = "throttle"
+)
+
+// The stores that can be set as CheckpointStore
+const (
+	CheckpointStoreRedis    = "redis"
+	CheckpointStorePostgres = "postgres"
+	CheckpointStoreMongo    = "mongo"
+	CheckpointStoreFile     = "file"
+)
+
+// The modes that can be set as DedupeMode
+const (
+	DedupeModeKeys      = "keys"
+	DedupeModeBuckets   = "buckets"
+	DedupeModeWatermark = "watermark"
+	DedupeModeOff       = "off"
+)
+
+// The DDL commands that can be listed in DDLEvents
+const (
+	DDLEventDrop             = "drop"
+	DDLEventDropDatabase     = "dropDatabase"
+	DDLEventRenameCollection = "renameCollection"
+)
+
 var globalConfig *oplogtoredisConfiguration
 
 // RedisURL is the configuration for connecting to a Redis instance using the 'OTR_REDIS_URL' environment variable.
-// For TLS, use 'rediss://'; for non-TLS, use 'redis://'.
+// For TLS, use 'rediss://'; for non-TLS, use 'redis://'. For a Redis Cluster,
+// use 'redis-cluster://[password@]host:port[,host:port...]'.
 // Multiple URLs can be configured by separating them with commas.
 func RedisURL() []string {
 	return strings.Split(globalConfig.RedisURL, ",")
@@ -58,9 +147,10 @@ func HTTPServerAddr() string {
 	return globalConfig.HTTPServerAddr
 }
 
-// BufferSize is the size of the internal buffers that hold oplog messages while
-// they're being processed. It is set via the environment variable
-// `OTR_BUFFER_SIZE` and defaults to 10,000.
+// BufferSize is the maximum number of publications in each of the internal
+// buffers that hold oplog messages while they're being processed (see also
+// BufferMaxBytes). It is set via the environment variable `OTR_BUFFER_SIZE`
+// and defaults to 10,000.
 func BufferSize() int {
 	return globalConfig.BufferSize
 }
@@ -77,10 +167,11 @@ func TimestampFlushInterval() time.Duration {
 // MaxCatchUp is the maximum length of time for which we process old oplog
 // entries. When starting up, if the timestamp of the last entry processes is
 // more than MaxCatchUp ago, we don't try to catch up and just start processing
-// the oplog from the end. If it's less than MaxCatchUp, we process oplog
-// entries starting from the timestamp. This allows us to catch up if
-// oplogtoredis exists and then starts back up. It is set via the environment
-// variable `OTR_MAX_CATCH_UP` and defaults to 60s.
+// the oplog from the end (or, with CatchUpMode "throttle", replay the gap
+// slowly). If it's less than MaxCatchUp, we process oplog entries starting
+// from the timestamp. This allows us to catch up if oplogtoredis exists and
+// then starts back up. It is set via the environment variable
+// `OTR_MAX_CATCH_UP` and defaults to 60s.
 func MaxCatchUp() time.Duration {
 	return globalConfig.MaxCatchUp
 }
@@ -150,10 +241,10 @@ func WriteParallelism() int {
 	return globalConfig.WriteParallelism
 }
 
-// ReadParallelism controls how many parallel read loops will be run. Each read loop has its own mongo
-// connection. Each loop consumes the entire oplog, but will hash the database name and discard any
-// messages that don't match the loop's ordinal (effectively the same shard algorithm the write loops use).
-// Healthz endpoint will report fail if anyone of them dies.
+// ReadParallelism controls how many workers decode oplog entries in parallel. The oplog is read by a
+// single cursor, and the entries it returns are decoded by the workers and then put back in oplog order
+// before they're sent to the write loops. Change streams (OTR_TAIL_MODE=changestream) are always decoded
+// by a single worker.
 func ReadParallelism() int {
 	return globalConfig.ReadParallelism
 }
@@ -224,6 +315,388 @@ func RedisBatchSize() int {
 	return globalConfig.RedisBatchSize
 }
 
+// TailMode controls where oplogtoredis reads changes from. The default,
+// "oplog", tails `local.oplog.rs` directly, which requires read access to the
+// `local` database. Setting it to "changestream" instead opens a cluster-wide
+// MongoDB change stream (MongoDB 4.2+), which only requires the `find` and
+// `changeStream` privileges and so works on managed offerings that don't
+// expose the oplog. In change stream mode, the resume token of the last
+// published event is stored next to the last-processed timestamp and used to
+// resume. Both modes publish identical messages. It is set via the environment
+// variable `OTR_TAIL_MODE`.
+func TailMode() string {
+	return globalConfig.TailMode
+}
+
+// OplogProjection controls whether the oplog query asks Mongo to strip the
+// field values out of inserted and replacement documents before sending them
+// to us. oplogtoredis only needs the top-level field names (and the _id) of
+// those documents, so this can substantially reduce network and CPU usage when
+// large documents are written. It requires MongoDB 4.4+; on older versions (or
+// if the projection fails for any other reason), oplogtoredis logs a warning
+// and falls back to querying the full oplog entries. It is set via the
+// environment variable `OTR_OPLOG_PROJECTION` and defaults to false.
+func OplogProjection() bool {
+	return globalConfig.OplogProjection
+}
+
+// ShardedCluster enables support for sharded clusters. When set, MongoURL must
+// point to a mongos. oplogtoredis reads the list of shards from the
+// config.shards collection, connects to each shard's replica set directly
+// (using the credentials and options from MongoURL), and tails each shard's
+// oplog separately. Each shard gets its own set of publishers, and its
+// last-processed timestamps are stored under
+// `<RedisMetadataPrefix><shard name>::`. It is set via the environment
+// variable `OTR_SHARDED_CLUSTER` and defaults to false.
+func ShardedCluster() bool {
+	return globalConfig.ShardedCluster
+}
+
+// ShardDiscoveryInterval is how often oplogtoredis re-reads the list of shards
+// when ShardedCluster is set, so that it starts tailing shards that were added
+// to the cluster (and stops tailing shards that were removed). It is set via
+// the environment variable `OTR_SHARD_DISCOVERY_INTERVAL` and defaults to 30s.
+func ShardDiscoveryInterval() time.Duration {
+	return globalConfig.ShardDiscoveryInterval
+}
+
+// DDLEvents is the list of DDL commands that oplogtoredis publishes resync
+// messages for, on the channels of the affected collections: `drop`,
+// `dropDatabase`, and `renameCollection`. It is set via the environment
+// variable `OTR_DDL_EVENTS` as a comma-separated list, and defaults to none,
+// since stock redis-oplog doesn't understand resync messages. Only enable it
+// if your subscribers handle them.
+func DDLEvents() []string {
+	return splitList(globalConfig.DDLEvents)
+}
+
+// ResyncMessages controls whether oplogtoredis publishes resync messages when
+// it knows subscribers missed changes it can't describe document by document:
+// skipped oplog entries and publications dropped by the "drop-oldest"
+// BufferOverflowPolicy. Stock redis-oplog ignores resync messages, but
+// they're harmless to it. With this off, those changes are only logged and
+// counted. It is set via the environment variable
+// `OTR_RESYNC_MESSAGES` and defaults to true. The resync messages for DDL
+// commands are controlled by DDLEvents instead, and the ones for time-series
+// bucket writes we can't tell the measurements of are always published.
+func ResyncMessages() bool {
+	return globalConfig.ResyncMessages
+}
+
+// MongoReadPreference is the read preference used to tail the oplog: one of
+// `primary`, `primaryPreferred`, `secondary`, `secondaryPreferred`, or
+// `nearest`. Tailing from a secondary takes load off of the primary, at the
+// cost of the replication lag between the primary and the secondary (see the
+// otr_oplog_replication_lag_seconds metric). It is set via the environment
+// variable `OTR_MONGO_READ_PREFERENCE`, and defaults to the read preference
+// in MongoURL (which is primary if MongoURL doesn't have one).
+//
+// Hidden members can't be selected with a read preference. To tail from a
+// hidden member, point MongoURL directly at it, with `directConnection=true`.
+func MongoReadPreference() string {
+	return globalConfig.MongoReadPreference
+}
+
+// MongoReadPreferenceTags are the tag sets used to select the member to tail
+// from, along with MongoReadPreference. Tags within a tag set are separated
+// by commas, and tag sets by semicolons, with an empty tag set matching any
+// member: for example, `dc:east,use:reporting;dc:west;` prefers members
+// tagged with both dc:east and use:reporting, then members tagged with
+// dc:west, then any member. It is set via the environment variable
+// `OTR_MONGO_READ_PREFERENCE_TAGS` and defaults to no tags. Tags can't be used
+// with the primary read preference.
+func MongoReadPreferenceTags() string {
+	return globalConfig.MongoReadPreferenceTags
+}
+
+// MongoReadPref builds the read preference from MongoReadPreference and
+// MongoReadPreferenceTags. Returns nil if MongoReadPreference isn't set, in
+// which case the read preference in MongoURL should be used.
+func MongoReadPref() (*readpref.ReadPref, error) {
+	return buildReadPref(globalConfig.MongoReadPreference, globalConfig.MongoReadPreferenceTags)
+}
+
+func buildReadPref(mode string, tags string) (*readpref.ReadPref, error) {
+	if mode == "" {
+		if tags != "" {
+			return nil, fmt.Errorf("OTR_MONGO_READ_PREFERENCE_TAGS requires OTR_MONGO_READ_PREFERENCE")
+		}
+		return nil, nil
+	}
+
+	parsedMode, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTR_MONGO_READ_PREFERENCE %q: %s", mode, err)
+	}
+
+	var opts []readpref.Option
+	if tags != "" {
+		var sets []tag.Set
+		for _, rawSet := range strings.Split(tags, ";") {
+			set := tag.Set{}
+			for _, rawTag := range splitList(rawSet) {
+				parts := strings.SplitN(rawTag, ":", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("invalid tag %q in OTR_MONGO_READ_PREFERENCE_TAGS: must be name:value", rawTag)
+				}
+				set = append(set, tag.Tag{Name: parts[0], Value: parts[1]})
+			}
+			sets = append(sets, set)
+		}
+		opts = append(opts, readpref.WithTagSets(sets...))
+	}
+
+	readPref, err := readpref.New(parsedMode, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTR_MONGO_READ_PREFERENCE_TAGS for read preference %q: %s", mode, err)
+	}
+
+	return readPref, nil
+}
+
+// ReplicationLagInterval is how often oplogtoredis measures the replication
+// lag between the member it's tailing and the primary, for the
+// otr_oplog_replication_lag_seconds metric. It is set via the environment
+// variable `OTR_REPLICATION_LAG_INTERVAL` and defaults to 10s. Set it to 0 to
+// disable the measurement.
+func ReplicationLagInterval() time.Duration {
+	return globalConfig.ReplicationLagInterval
+}
+
+// BufferOverflowPolicy controls what happens when oplogtoredis reads oplog
+// entries faster than it can publish them to Redis, and a publication buffer
+// (see BufferSize) fills up:
+//
+//   - "block" (the default) stops reading the oplog until there's room. If
+//     Redis is slow for long enough, the oplog position we're waiting at can
+//     fall out of the oplog window.
+//   - "drop-oldest" drops the oldest publication in the buffer to make room,
+//     and with ResyncMessages, publishes a resync message on the collection
+//     channel of each collection it dropped publications for, so that
+//     subscribers re-query.
+//   - "spill" writes the publications that don't fit to a file in
+//     BufferSpillDir, and reads them back in order once there's room.
+//
+// It is set via the environment variable `OTR_BUFFER_OVERFLOW_POLICY`.
+func BufferOverflowPolicy() string {
+	return globalConfig.BufferOverflowPolicy
+}
+
+// BufferSpillDir is the directory that the "spill" BufferOverflowPolicy
+// writes publications to. It is set via the environment variable
+// `OTR_BUFFER_SPILL_DIR` and defaults to the system temporary directory.
+func BufferSpillDir() string {
+	return globalConfig.BufferSpillDir
+}
+
+// BufferDegradedAfter is how long a publication buffer can stay full before
+// the `/healthz` endpoint reports oplogtoredis as degraded. It is set via the
+// environment variable `OTR_BUFFER_DEGRADED_AFTER` and defaults to 30s. Set it
+// to 0 to never report degraded.
+func BufferDegradedAfter() time.Duration {
+	return globalConfig.BufferDegradedAfter
+}
+
+// BufferMaxBytes is the maximum total size, in bytes, of the messages held in
+// each internal buffer. A buffer is full when it reaches either BufferSize or
+// BufferMaxBytes. It is set via the environment variable
+// `OTR_BUFFER_MAX_BYTES` and defaults to 0, which sizes the buffers
+// automatically: together they may use a quarter of the memory limit from
+// GOMEMLIMIT or the container's cgroup, or 1 GiB if there's no limit.
+func BufferMaxBytes() int64 {
+	return globalConfig.BufferMaxBytes
+}
+
+// CatchUpMode controls what happens when the last processed timestamp is more
+// than MaxCatchUp ago:
+//
+//   - "skip" (the default) starts from the end of the oplog, so the writes in
+//     between are never published.
+//   - "throttle" replays the gap from the last processed timestamp, limited
+//     to CatchUpRate and CatchUpByteRate so that subscribers aren't flooded,
+//     and goes back to tailing at full speed once it reaches the entry that
+//     was at the end of the oplog when it started.
+//
+// It is set via the environment variable `OTR_CATCH_UP_MODE`.
+func CatchUpMode() string {
+	return globalConfig.CatchUpMode
+}
+
+// CatchUpRate is the maximum number of oplog entries per second that are
+// replayed with CatchUpMode "throttle". It is set via the environment variable
+// `OTR_CATCH_UP_RATE` and defaults to 1000. Set it to 0 for no limit.
+func CatchUpRate() float64 {
+	return globalConfig.CatchUpRate
+}
+
+// CatchUpByteRate is the maximum number of bytes of oplog entries per second
+// that are replayed with CatchUpMode "throttle". It is set via the environment
+// variable `OTR_CATCH_UP_BYTE_RATE` and defaults to 0, for no limit.
+func CatchUpByteRate() float64 {
+	return globalConfig.CatchUpByteRate
+}
+
+// HeartbeatInterval is how often the tailer sends the position of the last
+// oplog entry it read to every write shard, even if the entries it read didn't
+// produce any publications for the shard (because they were no-ops, or writes
+// to other databases). This keeps each shard's last processed timestamp up to
+// date, so that resuming after a quiet period isn't mistaken for a gap longer
+// than MaxCatchUp. It is set via the environment variable
+// `OTR_HEARTBEAT_INTERVAL` and defaults to 1s. 0 disables heartbeats.
+func HeartbeatInterval() time.Duration {
+	return globalConfig.HeartbeatInterval
+}
+
+// OplogWindowInterval is how often oplogtoredis samples the oldest and newest
+// entries of the oplog and the earliest last processed timestamp, for the
+// otr_oplog_window_seconds, otr_oplog_checkpoint_headroom_seconds, and
+// otr_oplog_checkpoint_headroom_ratio metrics. It is set via the environment
+// variable `OTR_OPLOG_WINDOW_INTERVAL` and defaults to 1m. Set it to 0 to
+// disable the sampling.
+func OplogWindowInterval() time.Duration {
+	return globalConfig.OplogWindowInterval
+}
+
+// OplogHeadroomThreshold is the checkpoint headroom ratio (the time between the
+// oldest oplog entry and the last processed timestamp, as a fraction of the
+// oplog window) below which the `/healthz` endpoint reports oplogtoredis as
+// degraded, because it's getting close to losing entries it hasn't processed
+// yet. It is set via the environment variable `OTR_OPLOG_HEADROOM_THRESHOLD`
+// and defaults to 0.25. Set it to 0 to never report degraded.
+func OplogHeadroomThreshold() float64 {
+	return globalConfig.OplogHeadroomThreshold
+}
+
+// AdminToken is the bearer token that requests to the admin API (such as
+// `/replay`) must present in their Authorization header. It is set via the
+// environment variable `OTR_ADMIN_TOKEN`. The admin API is disabled when it's
+// empty, which is the default.
+func AdminToken() string {
+	return globalConfig.AdminToken
+}
+
+// ReplayRate is the maximum number of oplog entries per second that a replay
+// requested through the admin API reads. Requests can ask for a lower rate,
+// but not a higher one. It is set via the environment variable
+// `OTR_REPLAY_RATE` and defaults to 1000.
+func ReplayRate() float64 {
+	return globalConfig.ReplayRate
+}
+
+// CheckpointStore is where the last processed position of each write shard is
+// stored, which oplogtoredis resumes from when it restarts. It is set via the
+// environment variable `OTR_CHECKPOINT_STORE`, and is one of:
+//
+//   - "redis" (the default): in Redis, under RedisMetadataPrefix. With several
+//     Redis URLs, each one stores its own copy.
+//   - "postgres": in the Postgres database at `OTR_PG_PERSISTENCE_URL`, which
+//     is then required.
+//   - "mongo": in the collection CheckpointMongoCollection of the Mongo
+//     cluster at CheckpointMongoURL.
+//   - "file": in a file in CheckpointDir, which is then required. Only use it
+//     with a directory on a persistent volume.
+func CheckpointStore() string {
+	return globalConfig.CheckpointStore
+}
+
+// CheckpointMongoURL is the Mongo cluster the checkpoints are stored in with
+// CheckpointStore "mongo". It is set via the environment variable
+// `OTR_CHECKPOINT_MONGO_URL` and defaults to MongoURL.
+func CheckpointMongoURL() string {
+	if globalConfig.CheckpointMongoURL == "" {
+		return globalConfig.MongoURL
+	}
+	return globalConfig.CheckpointMongoURL
+}
+
+// CheckpointMongoCollection is the "database.collection" the checkpoints are
+// stored in with CheckpointStore "mongo". It is set via the environment
+// variable `OTR_CHECKPOINT_MONGO_COLLECTION` and defaults to
+// "oplogtoredis.checkpoints".
+func CheckpointMongoCollection() string {
+	return globalConfig.CheckpointMongoCollection
+}
+
+// CheckpointDir is the directory the checkpoints are stored in with
+// CheckpointStore "file". It is set via the environment variable
+// `OTR_CHECKPOINT_DIR`.
+func CheckpointDir() string {
+	return globalConfig.CheckpointDir
+}
+
+// AtomicCheckpoint makes each Redis publish save the checkpoint in the same
+// script call that publishes the messages, instead of saving it every
+// TimestampFlushInterval. A crash or a Redis failover then can't leave the
+// checkpoint behind or ahead of what was published. The checkpoint only ever
+// moves forward, so several copies of oplogtoredis can share it. It requires
+// the "redis" CheckpointStore. It is set via the environment variable
+// `OTR_ATOMIC_CHECKPOINT` and defaults to false.
+func AtomicCheckpoint() bool {
+	return globalConfig.AtomicCheckpoint
+}
+
+// DedupeMode is how oplogtoredis makes sure that when several copies of it
+// are running, each message is only published once. It is set via the
+// environment variable `OTR_DEDUPE_MODE`, and is one of:
+//
+//   - "keys" (the default): a key is set in Redis for every message, and
+//     expires after RedisDedupeExpiration.
+//   - "buckets": every message is added to a set per second of oplog time,
+//     which expires after RedisDedupeExpiration. There are far fewer keys,
+//     but as many set members.
+//   - "watermark": the position of the last message published is kept for each
+//     write shard, and only later messages are published. This uses a single
+//     key per write shard, but every copy must have the same WriteParallelism.
+//     Replays and resync messages are deduplicated like with "keys".
+//   - "off": messages aren't deduplicated. Only use it if there's a single
+//     copy of oplogtoredis.
+func DedupeMode() string {
+	return globalConfig.DedupeMode
+}
+
+// LeaderElection makes the copies of oplogtoredis that share a
+// RedisMetadataPrefix elect a leader with a lease in the first Redis in
+// RedisURL. Only the leader tails the oplog and publishes; the others wait as
+// standbys, and one of them takes over from the checkpoint if the leader stops
+// renewing the lease. Every publish to the first Redis checks the leader's
+// fencing token, so that a leader that lost the lease can't publish anymore.
+// It is set via the environment variable `OTR_LEADER_ELECTION` and defaults to
+// false.
+func LeaderElection() bool {
+	return globalConfig.LeaderElection
+}
+
+// LeaseTTL is how long the leader's lease (see LeaderElection), or a write
+// shard's lease (see ShardLeases), lasts without being renewed. Leases are
+// renewed every third of LeaseTTL, so another copy takes over within LeaseTTL
+// plus a third of it of the copy holding the lease going away. It is set via
+// the environment variable `OTR_LEASE_TTL` and defaults to 10 seconds.
+func LeaseTTL() time.Duration {
+	return globalConfig.LeaseTTL
+}
+
+// ShardLeases spreads the write shards (see WriteParallelism) across the
+// copies of oplogtoredis that share a RedisMetadataPrefix, with a lease per
+// write shard in the first Redis in RedisURL. Each copy claims an equal share
+// of the write shards, and only publishes the databases that hash to its
+// shards; the shards are rebalanced as copies join and leave. Every copy must
+// have the same WriteParallelism. It can't be used with LeaderElection. It is
+// set via the environment variable `OTR_SHARD_LEASES` and defaults to false.
+func ShardLeases() bool {
+	return globalConfig.ShardLeases
+}
+
+// splitList splits a comma-separated list, ignoring empty elements
+func splitList(list string) []string {
+	elems := []string{}
+	for _, elem := range strings.Split(list, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
 // ParseEnv parses the current environment variables and updates the stored
 // configuration. It is *not* threadsafe, and should just be called once
 // at the start of the program.
@@ -235,6 +708,100 @@ func ParseEnv() error {
 		return err
 	}
 
+	if config.TailMode != TailModeOplog && config.TailMode != TailModeChangeStream {
+		return fmt.Errorf("invalid OTR_TAIL_MODE %q: must be %q or %q", config.TailMode, TailModeOplog, TailModeChangeStream)
+	}
+
+	if config.ShardedCluster && config.TailMode == TailModeChangeStream {
+		// A change stream opened through a mongos already covers every shard
+		return fmt.Errorf("OTR_SHARDED_CLUSTER can't be used with OTR_TAIL_MODE=%s", TailModeChangeStream)
+	}
+
+	for _, event := range splitList(config.DDLEvents) {
+		if event != DDLEventDrop && event != DDLEventDropDatabase && event != DDLEventRenameCollection {
+			return fmt.Errorf("invalid DDL command %q in OTR_DDL_EVENTS: must be %q, %q, or %q",
+				event, DDLEventDrop, DDLEventDropDatabase, DDLEventRenameCollection)
+		}
+	}
+
+	if _, err := buildReadPref(config.MongoReadPreference, config.MongoReadPreferenceTags); err != nil {
+		return err
+	}
+
+	switch config.BufferOverflowPolicy {
+	case BufferOverflowBlock, BufferOverflowDropOldest, BufferOverflowSpill:
+	default:
+		return fmt.Errorf("invalid OTR_BUFFER_OVERFLOW_POLICY %q: must be %q, %q, or %q",
+			config.BufferOverflowPolicy, BufferOverflowBlock, BufferOverflowDropOldest, BufferOverflowSpill)
+	}
+
+	if config.CatchUpMode != CatchUpModeSkip && config.CatchUpMode != CatchUpModeThrottle {
+		return fmt.Errorf("invalid OTR_CATCH_UP_MODE %q: must be %q or %q", config.CatchUpMode, CatchUpModeSkip, CatchUpModeThrottle)
+	}
+
+	if config.CatchUpRate < 0 || config.CatchUpByteRate < 0 {
+		return fmt.Errorf("invalid OTR_CATCH_UP_RATE %v or OTR_CATCH_UP_BYTE_RATE %v: can't be negative",
+			config.CatchUpRate, config.CatchUpByteRate)
+	}
+
+	if config.HeartbeatInterval < 0 {
+		return fmt.Errorf("invalid OTR_HEARTBEAT_INTERVAL %v: can't be negative", config.HeartbeatInterval)
+	}
+
+	if config.OplogHeadroomThreshold < 0 || config.OplogHeadroomThreshold > 1 {
+		return fmt.Errorf("invalid OTR_OPLOG_HEADROOM_THRESHOLD %v: must be between 0 and 1", config.OplogHeadroomThreshold)
+	}
+
+	if config.ReplayRate <= 0 {
+		return fmt.Errorf("invalid OTR_REPLAY_RATE %v: must be positive", config.ReplayRate)
+	}
+
+	switch config.CheckpointStore {
+	case CheckpointStoreRedis, CheckpointStoreMongo:
+	case CheckpointStorePostgres:
+		if config.PostgresPersistenceURL == "" {
+			return fmt.Errorf("OTR_CHECKPOINT_STORE=%s requires OTR_PG_PERSISTENCE_URL", CheckpointStorePostgres)
+		}
+	case CheckpointStoreFile:
+		if config.CheckpointDir == "" {
+			return fmt.Errorf("OTR_CHECKPOINT_STORE=%s requires OTR_CHECKPOINT_DIR", CheckpointStoreFile)
+		}
+	default:
+		return fmt.Errorf("invalid OTR_CHECKPOINT_STORE %q: must be %q, %q, %q, or %q", config.CheckpointStore,
+			CheckpointStoreRedis, CheckpointStorePostgres, CheckpointStoreMongo, CheckpointStoreFile)
+	}
+
+	switch config.DedupeMode {
+	case DedupeModeKeys, DedupeModeBuckets, DedupeModeWatermark, DedupeModeOff:
+	default:
+		return fmt.Errorf("invalid OTR_DEDUPE_MODE %q: must be %q, %q, %q, or %q", config.DedupeMode,
+			DedupeModeKeys, DedupeModeBuckets, DedupeModeWatermark, DedupeModeOff)
+	}
+
+	if config.AtomicCheckpoint && config.CheckpointStore != CheckpointStoreRedis {
+		return fmt.Errorf("OTR_ATOMIC_CHECKPOINT requires OTR_CHECKPOINT_STORE=%s", CheckpointStoreRedis)
+	}
+
+	if config.LeaderElection && config.ShardLeases {
+		return fmt.Errorf("OTR_LEADER_ELECTION and OTR_SHARD_LEASES can't be used together")
+	}
+
+	if config.LeaseTTL <= 0 {
+		return fmt.Errorf("invalid OTR_LEASE_TTL %v: must be positive", config.LeaseTTL)
+	}
+
+	if !strings.Contains(config.CheckpointMongoCollection, ".") {
+		return fmt.Errorf("invalid OTR_CHECKPOINT_MONGO_COLLECTION %q: must be database.collection", config.CheckpointMongoCollection)
+	}
+
+	if config.BufferSize < 1 {
+		return fmt.Errorf("invalid OTR_BUFFER_SIZE %d: must be at least 1", config.BufferSize)
+	}
+
+	if config.BufferMaxBytes < 0 {
+		return fmt.Errorf("invalid OTR_BUFFER_MAX_BYTES %d: can't be negative", config.BufferMaxBytes)
+	}
+
 	globalConfig = &config
 	return nil
 }
@@ -2,9 +2,13 @@ package config
 
 import (
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
 )
 
 var envTests = map[string]struct {
@@ -62,19 +66,166 @@ var envTests = map[string]struct {
 		},
 		expectError: true,
 	},
+	"Invalid tail mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_TAIL_MODE": "carrier-pigeon",
+		},
+		expectError: true,
+	},
+	"Invalid DDL event": {
+		env: map[string]string{
+			"OTR_REDIS_URL":  "redis://yyy",
+			"OTR_MONGO_URL":  "mongodb://xxx",
+			"OTR_DDL_EVENTS": "drop,create",
+		},
+		expectError: true,
+	},
+	"Sharded cluster with change streams": {
+		env: map[string]string{
+			"OTR_REDIS_URL":       "redis://yyy",
+			"OTR_MONGO_URL":       "mongodb://xxx",
+			"OTR_TAIL_MODE":       "changestream",
+			"OTR_SHARDED_CLUSTER": "true",
+		},
+		expectError: true,
+	},
+	"Invalid buffer overflow policy": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_BUFFER_OVERFLOW_POLICY": "drop-newest",
+		},
+		expectError: true,
+	},
+	"Invalid catch-up mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL":     "redis://yyy",
+			"OTR_MONGO_URL":     "mongodb://xxx",
+			"OTR_CATCH_UP_MODE": "fast",
+		},
+		expectError: true,
+	},
+	"Negative buffer max bytes": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_BUFFER_MAX_BYTES": "-1",
+		},
+		expectError: true,
+	},
+	"Negative heartbeat interval": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_HEARTBEAT_INTERVAL": "-1s",
+		},
+		expectError: true,
+	},
+	"Invalid oplog headroom threshold": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                "redis://yyy",
+			"OTR_MONGO_URL":                "mongodb://xxx",
+			"OTR_OPLOG_HEADROOM_THRESHOLD": "1.5",
+		},
+		expectError: true,
+	},
+	"Zero replay rate": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_REPLAY_RATE": "0",
+		},
+		expectError: true,
+	},
+	"Invalid checkpoint store": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_CHECKPOINT_STORE": "etcd",
+		},
+		expectError: true,
+	},
+	"Postgres checkpoint store without a URL": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_CHECKPOINT_STORE": "postgres",
+		},
+		expectError: true,
+	},
+	"File checkpoint store without a directory": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_CHECKPOINT_STORE": "file",
+		},
+		expectError: true,
+	},
+	"Atomic checkpoint outside Redis": {
+		env: map[string]string{
+			"OTR_REDIS_URL":         "redis://yyy",
+			"OTR_MONGO_URL":         "mongodb://xxx",
+			"OTR_CHECKPOINT_STORE":  "file",
+			"OTR_CHECKPOINT_DIR":    "/tmp",
+			"OTR_ATOMIC_CHECKPOINT": "true",
+		},
+		expectError: true,
+	},
+	"Invalid dedupe mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_DEDUPE_MODE": "bloom",
+		},
+		expectError: true,
+	},
+	"Invalid lease TTL": {
+		env: map[string]string{
+			"OTR_REDIS_URL":       "redis://yyy",
+			"OTR_MONGO_URL":       "mongodb://xxx",
+			"OTR_LEADER_ELECTION": "true",
+			"OTR_LEASE_TTL":       "0s",
+		},
+		expectError: true,
+	},
+	"Leader election with shard leases": {
+		env: map[string]string{
+			"OTR_REDIS_URL":       "redis://yyy",
+			"OTR_MONGO_URL":       "mongodb://xxx",
+			"OTR_LEADER_ELECTION": "true",
+			"OTR_SHARD_LEASES":    "true",
+		},
+		expectError: true,
+	},
+	"Invalid checkpoint Mongo collection": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                   "redis://yyy",
+			"OTR_MONGO_URL":                   "mongodb://xxx",
+			"OTR_CHECKPOINT_STORE":            "mongo",
+			"OTR_CHECKPOINT_MONGO_COLLECTION": "checkpoints",
+		},
+		expectError: true,
+	},
+}
+
+// clearEnv unsets every OTR_ environment variable, so that tests don't see
+// the variables set by other tests
+func clearEnv() {
+	for _, envPair := range os.Environ() {
+		if strings.HasPrefix(envPair, "OTR_") {
+			// envPair is of the format "KEY=VALUE" so we split on "="
+			os.Unsetenv(strings.SplitN(envPair, "=", 2)[0])
+		}
+	}
 }
 
 // nolint: gocyclo
 func TestParseEnv(t *testing.T) {
 	for name, envTest := range envTests {
 		t.Run(name, func(t *testing.T) {
-			// clear env
-			for _, envPair := range os.Environ() {
-				if strings.HasPrefix(envPair, "OTR_") {
-					// envPair is of the format "KEY=VALUE" so we split on "="
-					os.Unsetenv(strings.SplitN(envPair, "=", 2)[0])
-				}
-			}
+			clearEnv()
 
 			// Set up env
 			for k, v := range envTest.env {
@@ -148,3 +299,133 @@ func checkConfigExpectation(t *testing.T, expectedConfig *oplogtoredisConfigurat
 			expectedConfig.RedisMetadataPrefix, RedisMetadataPrefix())
 	}
 }
+
+func TestDDLEvents(t *testing.T) {
+	tests := map[string]struct {
+		env  *string
+		want []string
+	}{
+		"Default": {
+			want: []string{},
+		},
+		"Subset": {
+			env:  stringPtr(" drop , renameCollection"),
+			want: []string{DDLEventDrop, DDLEventRenameCollection},
+		},
+		"Disabled": {
+			env:  stringPtr(""),
+			want: []string{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			clearEnv()
+			t.Setenv("OTR_REDIS_URL", "redis://yyy")
+			t.Setenv("OTR_MONGO_URL", "mongodb://xxx")
+			if test.env != nil {
+				t.Setenv("OTR_DDL_EVENTS", *test.env)
+			}
+
+			if err := ParseEnv(); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			got := DDLEvents()
+			if strings.Join(got, ",") != strings.Join(test.want, ",") || len(got) != len(test.want) {
+				t.Errorf("DDLEvents() = %#v, wanted %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestMongoReadPref(t *testing.T) {
+	tests := map[string]struct {
+		mode        string
+		tags        string
+		wantMode    readpref.Mode
+		wantTagSets []tag.Set
+		wantNil     bool
+		wantErr     bool
+	}{
+		"Unset": {
+			wantNil: true,
+		},
+		"Secondary": {
+			mode:     "secondary",
+			wantMode: readpref.SecondaryMode,
+		},
+		"Tags": {
+			mode:     "secondaryPreferred",
+			tags:     "dc:east,use:reporting;dc:west;",
+			wantMode: readpref.SecondaryPreferredMode,
+			wantTagSets: []tag.Set{
+				{{Name: "dc", Value: "east"}, {Name: "use", Value: "reporting"}},
+				{{Name: "dc", Value: "west"}},
+				{},
+			},
+		},
+		"Invalid mode": {
+			mode:    "tertiary",
+			wantErr: true,
+		},
+		"Invalid tag": {
+			mode:    "secondary",
+			tags:    "dc",
+			wantErr: true,
+		},
+		"Tags with primary": {
+			mode:    "primary",
+			tags:    "dc:east",
+			wantErr: true,
+		},
+		"Tags without mode": {
+			tags:    "dc:east",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			clearEnv()
+			t.Setenv("OTR_REDIS_URL", "redis://yyy")
+			t.Setenv("OTR_MONGO_URL", "mongodb://xxx")
+			t.Setenv("OTR_MONGO_READ_PREFERENCE", test.mode)
+			t.Setenv("OTR_MONGO_READ_PREFERENCE_TAGS", test.tags)
+
+			err := ParseEnv()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			readPref, err := MongoReadPref()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if test.wantNil {
+				if readPref != nil {
+					t.Errorf("Expected no read preference, got %s", readPref)
+				}
+				return
+			}
+
+			if readPref.Mode() != test.wantMode {
+				t.Errorf("Mode() = %s, wanted %s", readPref.Mode(), test.wantMode)
+			}
+			if !reflect.DeepEqual(readPref.TagSets(), test.wantTagSets) {
+				t.Errorf("TagSets() = %#v, wanted %#v", readPref.TagSets(), test.wantTagSets)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -18,6 +19,17 @@ var metricFilterEnabled = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help:      "Gauge indicating whether the denylist filter is enabled for a particular DB name",
 }, []string{"db"})
 
+// generation is incremented every time an entry is added to or removed from
+// the denylist through the HTTP API.
+var generation uint64
+
+// Generation returns a counter that changes whenever the denylist changes, so
+// that consumers that derive state from the denylist (such as the oplog query
+// filter) can cheaply detect that they need to rebuild it.
+func Generation() uint64 {
+	return atomic.LoadUint64(&generation)
+}
+
 // CollectionEndpoint serves the endpoints for the whole Denylist at /denylist
 func CollectionEndpoint(denylist *sync.Map, syncer *Syncer) func(http.ResponseWriter, *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
@@ -102,6 +114,7 @@ func createDenylistEntry(response http.ResponseWriter, request *http.Request, de
 	}
 
 	denylist.Store(id, true)
+	atomic.AddUint64(&generation, 1)
 	log.Log.Infow("Denylist PUT: Created entry", "id", id)
 	metricFilterEnabled.WithLabelValues(id).Set(1)
 	err := syncer.StoreDenylistEntry(denylist, id)
@@ -131,6 +144,7 @@ func deleteDenylistEntry(response http.ResponseWriter, request *http.Request, de
 	}
 
 	denylist.Delete(id)
+	atomic.AddUint64(&generation, 1)
 	log.Log.Infow("Denylist DELETE: removed entry", "id", id)
 	metricFilterEnabled.WithLabelValues(id).Set(0)
 	err := syncer.DeleteDenylistEntry(denylist, id)
@@ -0,0 +1,191 @@
+// Package lease implements a lease in Redis that at most one holder has at a
+// time, which oplogtoredis uses to elect the one copy of itself that tails the
+// oplog. Each time the lease changes hands, its holder gets a new, higher
+// fencing token, which it can check its writes against so that a holder that
+// lost the lease without noticing can't write anymore.
+package lease
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// This script acquires or extends the lease in KEYS[1] for holder ARGV[1], for
+// ARGV[2] milliseconds. If the lease was free, it increments the fencing token
+// in KEYS[2]. Returns the fencing token if the holder has the lease, or 0 if
+// someone else does.
+var acquireScript = redis.NewScript(`
+	local current = redis.call("GET", KEYS[1])
+	if current == ARGV[1] then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		return tonumber(redis.call("GET", KEYS[2]) or "0")
+	end
+	if current ~= false then
+		return 0
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return redis.call("INCR", KEYS[2])
+`)
+
+// This script releases the lease in KEYS[1] if it's held by ARGV[1]
+var releaseScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// Lease is a lease stored in Redis, under Key, with the fencing token of its
+// current holder under TokenKey
+type Lease struct {
+	client redis.UniversalClient
+	key    string
+	holder string
+	ttl    time.Duration
+}
+
+// New creates a lease stored in key, that holder acquires for ttl at a time.
+// holder must be unique among everything competing for the lease. On Redis
+// Cluster, key is wrapped in a hash tag, so that the lease and its fencing
+// token are in the same slot.
+func New(client redis.UniversalClient, key string, holder string, ttl time.Duration) *Lease {
+	if _, ok := client.(*redis.ClusterClient); ok {
+		key = "{" + key + "}"
+	}
+	return &Lease{client: client, key: key, holder: holder, ttl: ttl}
+}
+
+// Key is the key the lease is stored in
+func (l *Lease) Key() string {
+	return l.key
+}
+
+// TokenKey is the key the fencing token of the lease's current holder is
+// stored in. Writes fenced with a token should only be made while it's the
+// token in TokenKey.
+func (l *Lease) TokenKey() string {
+	return l.key + "Token"
+}
+
+// Acquire acquires the lease, or extends it if we already have it. Returns
+// our fencing token, or 0 if someone else has the lease.
+func (l *Lease) Acquire(ctx context.Context) (int64, error) {
+	return acquireScript.Run(ctx, l.client, []string{l.key, l.TokenKey()},
+		l.holder, strconv.FormatInt(l.ttl.Milliseconds(), 10)).Int64()
+}
+
+// Release releases the lease if we have it, so that another holder can
+// acquire it without waiting for it to expire
+func (l *Lease) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, l.client, []string{l.key}, l.holder).Err()
+}
+
+// Run competes for the lease until stop is closed, trying to acquire it (or
+// extend it) every interval, which must be less than the lease's ttl. It calls
+// elected with our fencing token when we acquire the lease, and demoted when
+// we lose it. These calls are made one at a time, on their own goroutine, so
+// that the lease keeps being renewed while they run. If elected fails, the
+// error is passed to onError and the lease is released, so that another holder
+// (or we, on the next interval) can try again. We count the lease as lost as
+// soon as it may have expired: if we couldn't extend it within ttl of the last
+// time we did. When stop is closed while we have the lease, Run calls demoted
+// and releases it. Errors talking to Redis are passed to onError, and retried
+// on the next interval; onError must be safe for concurrent use.
+func (l *Lease) Run(interval time.Duration, elected func(token int64) error, demoted func(), onError func(error), stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The lease is applied like a single shard of a Shards (see applyShards)
+	wanted := make(chan shardsWanted, 1)
+	applied := make(chan shardsWanted, 1)
+	stopped := make(chan bool)
+	go func() {
+		applyShards(wanted, applied, func(_ int, token int64) error {
+			return elected(token)
+		}, func(int) {
+			demoted()
+		}, onError)
+		close(stopped)
+	}()
+
+	var token int64
+	var renewedAt time.Time
+	sent := shardsWanted{shards: map[int]int64{}}
+
+	// send has us run with token, or stop running if it's 0. When the token
+	// changes, the lease expired and we acquired it again, so whatever we did
+	// with the old token may have been fenced off, and we're demoted and
+	// elected again.
+	send := func() {
+		next := map[int]int64{}
+		if token != 0 {
+			next[0] = token
+		}
+		if sameShards(sent.shards, next) {
+			return
+		}
+
+		sent = shardsWanted{seq: sent.seq + 1, shards: next}
+		select {
+		case <-wanted:
+		default:
+		}
+		wanted <- shardsWanted{seq: sent.seq, shards: copyShards(next)}
+	}
+
+	for {
+		// The lease expires at least ttl after the request started
+		started := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		got, err := l.Acquire(ctx)
+		cancel()
+
+		switch {
+		case err != nil:
+			onError(err)
+			if token != 0 && time.Since(renewedAt) >= l.ttl {
+				token = 0
+			}
+		default:
+			token = got
+			renewedAt = started
+		}
+		send()
+
+	wait:
+		for {
+			select {
+			case <-stop:
+				close(wanted)
+				<-stopped
+				if token != 0 {
+					l.release(interval, onError)
+				}
+				return
+			case running := <-applied:
+				if running.seq == sent.seq && token != 0 && running.shards[0] != token {
+					// elected failed, so we let the lease go
+					token = 0
+					l.release(interval, onError)
+					send()
+				}
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// release releases the lease for Run, passing any error to onError
+func (l *Lease) release(timeout time.Duration, onError func(error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := l.Release(ctx); err != nil {
+		onError(err)
+	}
+}
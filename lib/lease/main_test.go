@@ -0,0 +1,266 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func startMiniredis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	server := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{server.Addr()},
+	})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestAcquire(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+
+	a := New(client, "someprefix.leader", "a", 10*time.Second)
+	b := New(client, "someprefix.leader", "b", 10*time.Second)
+
+	token, err := a.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), token)
+
+	// Extending it keeps the token
+	token, err = a.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), token)
+
+	token, err = b.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), token)
+
+	// Once it expires, the next holder gets a higher token
+	server.FastForward(11 * time.Second)
+	token, err = b.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), token)
+
+	token, err = a.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), token)
+
+	// Releasing someone else's lease does nothing
+	require.NoError(t, a.Release(ctx))
+	require.True(t, server.Exists("someprefix.leader"))
+
+	require.NoError(t, b.Release(ctx))
+	token, err = a.Acquire(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), token)
+
+	stored, err := server.Get(a.TokenKey())
+	require.NoError(t, err)
+	require.Equal(t, "3", stored)
+}
+
+func TestAcquireCluster(t *testing.T) {
+	// miniredis serves every slot of a one-node cluster
+	server := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{server.Addr()},
+	})
+	defer client.Close()
+
+	l := New(client, "someprefix.leader", "a", 10*time.Second)
+	require.Equal(t, "{someprefix.leader}", l.Key())
+	require.Equal(t, "{someprefix.leader}Token", l.TokenKey())
+
+	token, err := l.Acquire(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), token)
+	require.Equal(t, "a", mustGet(t, server, "{someprefix.leader}"))
+}
+
+// recorder records the calls Run makes. While fail is set, elected fails.
+type recorder struct {
+	mutex  sync.Mutex
+	events []string
+	tokens []int64
+	fail   bool
+}
+
+func (r *recorder) elected(token int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.fail {
+		r.events = append(r.events, "failed")
+		return errors.New("failed to start")
+	}
+	r.events = append(r.events, "elected")
+	r.tokens = append(r.tokens, token)
+	return nil
+}
+
+func (r *recorder) demoted() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, "demoted")
+}
+
+func (r *recorder) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.events...)
+}
+
+func TestRunFailover(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	a := New(client, "someprefix.leader", "a", time.Second)
+	b := New(client, "someprefix.leader", "b", time.Second)
+	var aEvents, bEvents recorder
+	ignore := func(error) {}
+
+	stopA := make(chan bool)
+	doneA := make(chan bool)
+	go func() {
+		a.Run(10*time.Millisecond, aEvents.elected, aEvents.demoted, ignore, stopA)
+		close(doneA)
+	}()
+	require.Eventually(t, func() bool { return len(aEvents.get()) == 1 }, time.Second, 5*time.Millisecond)
+
+	stopB := make(chan bool)
+	doneB := make(chan bool)
+	go func() {
+		b.Run(10*time.Millisecond, bEvents.elected, bEvents.demoted, ignore, stopB)
+		close(doneB)
+	}()
+
+	// b stays a standby while a has the lease
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, bEvents.get())
+
+	// Stopping a releases the lease, and b takes over
+	close(stopA)
+	<-doneA
+	require.Equal(t, []string{"elected", "demoted"}, aEvents.get())
+	require.Eventually(t, func() bool { return len(bEvents.get()) == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, []int64{2}, bEvents.tokens)
+
+	// If someone else takes the lease, b is demoted
+	require.NoError(t, server.Set("someprefix.leader", "c"))
+	require.Eventually(t, func() bool { return len(bEvents.get()) == 2 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, []string{"elected", "demoted"}, bEvents.get())
+
+	close(stopB)
+	<-doneB
+	require.Equal(t, []string{"elected", "demoted"}, bEvents.get())
+	require.Equal(t, "c", mustGet(t, server, "someprefix.leader"))
+}
+
+func TestRunRedisDown(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	l := New(client, "someprefix.leader", "a", 100*time.Millisecond)
+	var events recorder
+	errs := make(chan error, 100)
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		l.Run(10*time.Millisecond, events.elected, events.demoted, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}, stop)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return len(events.get()) == 1 }, time.Second, 5*time.Millisecond)
+
+	// Once we can't reach Redis for the lease's ttl, we step down
+	server.Close()
+	require.Eventually(t, func() bool { return len(events.get()) == 2 }, time.Second, 5*time.Millisecond)
+	require.NotEmpty(t, errs)
+
+	close(stop)
+	<-done
+	require.Equal(t, []string{"elected", "demoted"}, events.get())
+}
+
+func TestRunElectedFails(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	l := New(client, "someprefix.leader", "a", time.Second)
+	events := recorder{fail: true}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		l.Run(10*time.Millisecond, events.elected, events.demoted, func(error) {}, stop)
+		close(done)
+	}()
+
+	// The lease is released after each failure, so it's retried with a new
+	// token
+	require.Eventually(t, func() bool { return len(events.get()) >= 2 }, time.Second, 5*time.Millisecond)
+	events.mutex.Lock()
+	events.fail = false
+	events.mutex.Unlock()
+	require.Eventually(t, func() bool {
+		got := events.get()
+		return got[len(got)-1] == "elected"
+	}, time.Second, 5*time.Millisecond)
+	require.Greater(t, events.tokens[0], int64(2))
+	require.Equal(t, "a", mustGet(t, server, "someprefix.leader"))
+
+	close(stop)
+	<-done
+	require.False(t, server.Exists("someprefix.leader"))
+}
+
+func TestRunSlowElected(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	l := New(client, "someprefix.leader", "a", 100*time.Millisecond)
+	other := New(client, "someprefix.leader", "b", 100*time.Millisecond)
+	started := make(chan bool)
+	unblock := make(chan bool)
+	elected := func(int64) error {
+		close(started)
+		<-unblock
+		return nil
+	}
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		l.Run(10*time.Millisecond, elected, func() {}, func(error) {}, stop)
+		close(done)
+	}()
+	<-started
+
+	// The lease keeps being renewed while elected runs for longer than its
+	// ttl
+	for i := 0; i < 5; i++ {
+		server.FastForward(50 * time.Millisecond)
+		time.Sleep(30 * time.Millisecond)
+		token, err := other.Acquire(context.Background())
+		require.NoError(t, err)
+		require.Zero(t, token)
+	}
+	require.Equal(t, "a", mustGet(t, server, "someprefix.leader"))
+
+	close(unblock)
+	close(stop)
+	<-done
+	require.False(t, server.Exists("someprefix.leader"))
+}
+
+func mustGet(t *testing.T, server *miniredis.Miniredis, key string) string {
+	value, err := server.Get(key)
+	require.NoError(t, err)
+	return value
+}
@@ -0,0 +1,370 @@
+package lease
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// This script records that member ARGV[1] is alive for the next ARGV[2]
+// milliseconds in the sorted set KEYS[1], removes the members that haven't
+// done so in time, and returns the members left. It uses Redis' clock, so the
+// members' clocks don't have to agree.
+var heartbeatScript = redis.NewScript(`
+	redis.replicate_commands()
+	local time = redis.call("TIME")
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+	redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return redis.call("ZRANGE", KEYS[1], 0, -1)
+`)
+
+// Shards divides a number of shards between the holders competing for them,
+// with a Lease for each shard. Each holder heartbeats in a set of members,
+// and claims its share of the shards, so that the shards are rebalanced as
+// holders join and leave.
+type Shards struct {
+	client redis.UniversalClient
+	prefix string
+	holder string
+	ttl    time.Duration
+	leases []*Lease
+}
+
+// NewShards creates the leases for n shards, stored under prefix, that holder
+// acquires for ttl at a time. holder must be unique among everything competing
+// for the shards.
+func NewShards(client redis.UniversalClient, prefix string, holder string, n int, ttl time.Duration) *Shards {
+	s := &Shards{client: client, prefix: prefix, holder: holder, ttl: ttl}
+	for i := 0; i < n; i++ {
+		s.leases = append(s.leases, New(client, prefix+"shard."+strconv.Itoa(i), holder, ttl))
+	}
+	return s
+}
+
+// Lease returns the lease of a shard
+func (s *Shards) Lease(shard int) *Lease {
+	return s.leases[shard]
+}
+
+// MembersKey is the key of the sorted set of the holders competing for the
+// shards, scored by when they expire
+func (s *Shards) MembersKey() string {
+	return s.prefix + "members"
+}
+
+// heartbeat records that we're still competing for the shards, and returns
+// every holder that is
+func (s *Shards) heartbeat(timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return heartbeatScript.Run(ctx, s.client, []string{s.MembersKey()},
+		s.holder, strconv.FormatInt(s.ttl.Milliseconds(), 10)).StringSlice()
+}
+
+// share returns how many of n shards holder should have: the shards are split
+// evenly between the members, with the remainder going to the first members
+// in sorted order
+func share(members []string, holder string, n int) int {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+
+	for rank, member := range sorted {
+		if member != holder {
+			continue
+		}
+		if rank < n%len(sorted) {
+			return n/len(sorted) + 1
+		}
+		return n / len(sorted)
+	}
+	return 0
+}
+
+// Run competes for the shards until done is closed, every interval, which must
+// be less than the leases' ttl. Each time, it extends the leases we have,
+// gives up the ones over our share, and acquires free ones up to our share.
+//
+// It calls start with our fencing token for each shard we acquire, and stop
+// for each shard we lose or give up; when a shard's fencing token changes,
+// it's stopped and started again. These calls are made one at a time, on their
+// own goroutine, so that the leases keep being renewed while they run. A shard
+// we give up is only released once it's stopped, so that we've stopped using
+// it by the time another holder can acquire it. If start fails, the shard's
+// lease is released, so that it's retried (by us or another holder) on a later
+// interval. As with Lease.Run, we count a shard as lost as soon as its lease
+// may have expired. When done is closed, Run stops every shard and releases
+// them.
+//
+// Errors talking to Redis and from start are passed to onError, which must be
+// safe for concurrent use.
+func (s *Shards) Run(interval time.Duration, start func(shard int, token int64) error, stop func(shard int), onError func(error), done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wanted := make(chan shardsWanted, 1)
+	applied := make(chan shardsWanted, 1)
+	stopped := make(chan bool)
+	go func() {
+		applyShards(wanted, applied, start, stop, onError)
+		close(stopped)
+	}()
+
+	// held is every lease we have, and giveUp the ones we're waiting to
+	// release. sent is the last set of shards we wanted running, numbered
+	// seq, and running is what was running after the last set was applied.
+	held := map[int]int64{}
+	renewedAt := map[int]time.Time{}
+	giveUp := map[int]bool{}
+	sent := shardsWanted{shards: map[int]int64{}}
+	running := shardsWanted{shards: map[int]int64{}}
+
+	send := func() {
+		next := map[int]int64{}
+		for shard, token := range held {
+			if !giveUp[shard] {
+				next[shard] = token
+			}
+		}
+		if sameShards(sent.shards, next) {
+			return
+		}
+
+		sent = shardsWanted{seq: sent.seq + 1, shards: next}
+		select {
+		case <-wanted:
+		default:
+		}
+		wanted <- shardsWanted{seq: sent.seq, shards: copyShards(next)}
+	}
+
+	forget := func(shard int) {
+		delete(held, shard)
+		delete(renewedAt, shard)
+		delete(giveUp, shard)
+	}
+
+	// releaseStopped releases the shards we're giving up once they've been
+	// stopped. Until the latest set of shards is applied, a shard we're giving
+	// up might still be about to start.
+	releaseStopped := func() {
+		if running.seq != sent.seq {
+			return
+		}
+		for shard := range giveUp {
+			if _, ok := running.shards[shard]; ok {
+				continue
+			}
+			s.release(shard, interval, onError)
+			forget(shard)
+		}
+	}
+
+	for {
+		for _, shard := range s.renew(held, renewedAt, interval, onError) {
+			forget(shard)
+		}
+
+		members, err := s.heartbeat(interval)
+		if err != nil {
+			onError(err)
+		} else if target := share(members, s.holder, len(s.leases)); len(held)-len(giveUp) > target {
+			// Someone joined, so we give up the shards over our share, the
+			// highest ones first
+			var keep []int
+			for shard := range held {
+				if !giveUp[shard] {
+					keep = append(keep, shard)
+				}
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(keep)))
+			for _, shard := range keep[:len(keep)-target] {
+				giveUp[shard] = true
+			}
+		} else {
+			s.acquire(held, renewedAt, target+len(giveUp), interval, onError)
+		}
+
+		send()
+		releaseStopped()
+
+	wait:
+		for {
+			select {
+			case <-done:
+				close(wanted)
+				<-stopped
+				s.leave(interval, onError)
+				return
+			case running = <-applied:
+				if running.seq == sent.seq {
+					// The shards that aren't running failed to start, so we
+					// let them go
+					for shard, token := range sent.shards {
+						if running.shards[shard] != token && held[shard] == token {
+							s.release(shard, interval, onError)
+							forget(shard)
+						}
+					}
+					send()
+				}
+				releaseStopped()
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// shardsWanted is a set of shards, with their fencing tokens, that Run wants
+// running, numbered by seq. It's also used to report which of them are
+// running once they've been applied.
+type shardsWanted struct {
+	seq    int
+	shards map[int]int64
+}
+
+// applyShards starts and stops shards until wanted is closed, and then stops
+// the ones still running. After applying each set from wanted, it reports the
+// shards that are running on applied. Both channels only hold the latest set.
+func applyShards(wanted <-chan shardsWanted, applied chan shardsWanted, start func(shard int, token int64) error, stop func(shard int), onError func(error)) {
+	running := map[int]int64{}
+
+	for next := range wanted {
+		for shard, token := range running {
+			if other, ok := next.shards[shard]; !ok || other != token {
+				stop(shard)
+				delete(running, shard)
+			}
+		}
+
+		for shard, token := range next.shards {
+			if _, ok := running[shard]; ok {
+				continue
+			}
+			if err := start(shard, token); err != nil {
+				onError(err)
+				continue
+			}
+			running[shard] = token
+		}
+
+		select {
+		case <-applied:
+		default:
+		}
+		applied <- shardsWanted{seq: next.seq, shards: copyShards(running)}
+	}
+
+	for shard := range running {
+		stop(shard)
+	}
+}
+
+// renew extends the leases in held, updating their tokens and when they were
+// renewed, and returns the shards we've lost
+func (s *Shards) renew(held map[int]int64, renewedAt map[int]time.Time, timeout time.Duration, onError func(error)) []int {
+	var lost []int
+	for shard, token := range held {
+		// A lease expires at least ttl after the request that acquired or
+		// extended it started
+		started := time.Now()
+		got, err := s.acquireShard(shard, timeout)
+		switch {
+		case err != nil:
+			onError(err)
+			if time.Since(renewedAt[shard]) >= s.ttl {
+				lost = append(lost, shard)
+			}
+		case got == 0:
+			lost = append(lost, shard)
+		default:
+			// If the lease expired and we acquired it again, the token
+			// changed, and whatever we did with the old one may have been
+			// fenced off
+			if got != token {
+				held[shard] = got
+			}
+			renewedAt[shard] = started
+		}
+	}
+	return lost
+}
+
+// acquire acquires free shards until we hold target of them
+func (s *Shards) acquire(held map[int]int64, renewedAt map[int]time.Time, target int, timeout time.Duration, onError func(error)) {
+	for shard := 0; shard < len(s.leases) && len(held) < target; shard++ {
+		if _, ok := held[shard]; ok {
+			continue
+		}
+
+		started := time.Now()
+		got, err := s.acquireShard(shard, timeout)
+		if err != nil {
+			onError(err)
+			return
+		}
+		if got != 0 {
+			held[shard] = got
+			renewedAt[shard] = started
+		}
+	}
+}
+
+func (s *Shards) acquireShard(shard int, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return s.leases[shard].Acquire(ctx)
+}
+
+func (s *Shards) release(shard int, timeout time.Duration, onError func(error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.leases[shard].Release(ctx); err != nil {
+		onError(err)
+	}
+}
+
+// leave releases every shard lease we might still have, and removes us from
+// the members, so that the other holders take over our shards right away
+func (s *Shards) leave(timeout time.Duration, onError func(error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, lease := range s.leases {
+		if err := lease.Release(ctx); err != nil {
+			onError(err)
+		}
+	}
+	if err := s.client.ZRem(ctx, s.MembersKey(), s.holder).Err(); err != nil {
+		onError(err)
+	}
+}
+
+func sameShards(a map[int]int64, b map[int]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for shard, token := range a {
+		if other, ok := b[shard]; !ok || other != token {
+			return false
+		}
+	}
+	return true
+}
+
+func copyShards(shards map[int]int64) map[int]int64 {
+	copied := make(map[int]int64, len(shards))
+	for shard, token := range shards {
+		copied[shard] = token
+	}
+	return copied
+}
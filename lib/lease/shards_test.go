@@ -0,0 +1,162 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShare(t *testing.T) {
+	members := []string{"c", "a", "b"}
+	require.Equal(t, 2, share(members, "a", 5))
+	require.Equal(t, 2, share(members, "b", 5))
+	require.Equal(t, 1, share(members, "c", 5))
+	require.Equal(t, 0, share(members, "d", 5))
+	require.Equal(t, 0, share(members, "c", 2))
+}
+
+// shardRecorder records the shards Run has started and not stopped yet
+type shardRecorder struct {
+	mutex sync.Mutex
+	held  map[int]int64
+	fail  map[int]bool
+}
+
+func (r *shardRecorder) start(shard int, token int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.fail[shard] {
+		return errors.New("failed to start")
+	}
+	if r.held == nil {
+		r.held = map[int]int64{}
+	}
+	r.held[shard] = token
+	return nil
+}
+
+func (r *shardRecorder) stop(shard int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.held, shard)
+}
+
+func (r *shardRecorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.held)
+}
+
+func (r *shardRecorder) shards() map[int]int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return copyShards(r.held)
+}
+
+func TestShardsRebalance(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	a := NewShards(client, "someprefix.", "a", 4, time.Second)
+	b := NewShards(client, "someprefix.", "b", 4, time.Second)
+	var aShards, bShards shardRecorder
+	ignore := func(error) {}
+
+	stopA := make(chan bool)
+	doneA := make(chan bool)
+	go func() {
+		a.Run(10*time.Millisecond, aShards.start, aShards.stop, ignore, stopA)
+		close(doneA)
+	}()
+	require.Eventually(t, func() bool { return aShards.count() == 4 }, time.Second, 5*time.Millisecond)
+
+	// When b joins, a gives up half of the shards, and b acquires them
+	stopB := make(chan bool)
+	doneB := make(chan bool)
+	go func() {
+		b.Run(10*time.Millisecond, bShards.start, bShards.stop, ignore, stopB)
+		close(doneB)
+	}()
+	require.Eventually(t, func() bool { return aShards.count() == 2 && bShards.count() == 2 }, time.Second, 5*time.Millisecond)
+
+	require.Contains(t, aShards.shards(), 0)
+	require.Contains(t, aShards.shards(), 1)
+	require.Equal(t, map[int]int64{2: 2, 3: 2}, bShards.shards())
+
+	// When a leaves, b takes over its shards
+	close(stopA)
+	<-doneA
+	require.Equal(t, 0, aShards.count())
+	require.Eventually(t, func() bool { return bShards.count() == 4 }, time.Second, 5*time.Millisecond)
+
+	members, err := server.ZMembers(b.MembersKey())
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, members)
+
+	close(stopB)
+	<-doneB
+	require.Equal(t, 0, bShards.count())
+	require.False(t, server.Exists("someprefix.shard.0"))
+}
+
+func TestShardsMemberExpires(t *testing.T) {
+	server, client := startMiniredis(t)
+	ctx := context.Background()
+
+	a := NewShards(client, "someprefix.", "a", 4, time.Second)
+	expires := float64(time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond))
+	require.NoError(t, client.ZAdd(ctx, a.MembersKey(), &redis.Z{Score: expires, Member: "gone"}).Err())
+
+	var shards shardRecorder
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		a.Run(10*time.Millisecond, shards.start, shards.stop, func(error) {}, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	require.Eventually(t, func() bool { return shards.count() == 2 }, time.Second, 5*time.Millisecond)
+
+	// Once the other member stops heartbeating, it no longer gets a share
+	require.NoError(t, client.ZAdd(ctx, a.MembersKey(), &redis.Z{Score: 0, Member: "gone"}).Err())
+	require.Eventually(t, func() bool { return shards.count() == 4 }, time.Second, 5*time.Millisecond)
+	members, err := server.ZMembers(a.MembersKey())
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, members)
+}
+
+func TestShardsStartFails(t *testing.T) {
+	server, client := startMiniredis(t)
+
+	a := NewShards(client, "someprefix.", "a", 2, time.Second)
+	shards := shardRecorder{fail: map[int]bool{1: true}}
+	var errs int32
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		a.Run(10*time.Millisecond, shards.start, shards.stop, func(error) { atomic.AddInt32(&errs, 1) }, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// The shard that failed to start is released, and retried
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&errs) >= 2 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, 1, shards.count())
+
+	shards.mutex.Lock()
+	shards.fail = nil
+	shards.mutex.Unlock()
+	require.Eventually(t, func() bool { return shards.count() == 2 }, time.Second, 5*time.Millisecond)
+	require.True(t, server.Exists("someprefix.shard.1"))
+}
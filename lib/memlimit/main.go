@@ -0,0 +1,114 @@
+// Package memlimit determines how much memory oplogtoredis is allowed to use,
+// from the Go runtime's soft memory limit (GOMEMLIMIT) and from the memory
+// limit of the cgroup it's running in (e.g. a container's memory limit).
+package memlimit
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The files the cgroup memory limit is read from, for cgroup v2 and v1
+var cgroupLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// unlimited is the threshold above which a limit is treated as no limit.
+// cgroup v1 reports "no limit" as a huge number (usually 2^63 rounded down to
+// the page size) rather than as "max".
+const unlimited = 1 << 62
+
+// Detect returns the lowest of the GOMEMLIMIT environment variable and the
+// cgroup memory limit, in bytes, or false if neither is set.
+func Detect() (int64, bool) {
+	var limits []int64
+
+	if env := os.Getenv("GOMEMLIMIT"); env != "" {
+		limit, err := ParseGoMemLimit(env)
+		if err == nil && limit > 0 && limit < unlimited {
+			limits = append(limits, limit)
+		}
+	}
+
+	for _, path := range cgroupLimitFiles {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if limit, ok := ParseCgroupLimit(string(contents)); ok {
+			limits = append(limits, limit)
+		}
+	}
+
+	if len(limits) == 0 {
+		return 0, false
+	}
+
+	lowest := limits[0]
+	for _, limit := range limits[1:] {
+		if limit < lowest {
+			lowest = limit
+		}
+	}
+	return lowest, true
+}
+
+// ParseGoMemLimit parses a GOMEMLIMIT value: a number of bytes, with an
+// optional unit suffix (B, KiB, MiB, GiB, or TiB), or "off"
+func ParseGoMemLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "off" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10},
+		{"MiB", 1 << 20},
+		{"GiB", 1 << 30},
+		{"TiB", 1 << 40},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing GOMEMLIMIT")
+	}
+	if n < 0 {
+		return 0, errors.New("GOMEMLIMIT can't be negative")
+	}
+	if n > unlimited/multiplier {
+		return unlimited, nil
+	}
+
+	return n * multiplier, nil
+}
+
+// ParseCgroupLimit parses the contents of a cgroup memory limit file, which
+// is either a number of bytes or "max". Returns false if there's no limit.
+func ParseCgroupLimit(contents string) (int64, bool) {
+	contents = strings.TrimSpace(contents)
+	if contents == "max" {
+		return 0, false
+	}
+
+	limit, err := strconv.ParseInt(contents, 10, 64)
+	if err != nil || limit <= 0 || limit >= unlimited {
+		return 0, false
+	}
+
+	return limit, true
+}
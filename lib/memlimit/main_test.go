@@ -0,0 +1,65 @@
+package memlimit
+
+import (
+	"testing"
+)
+
+func TestParseGoMemLimit(t *testing.T) {
+	tests := map[string]struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		"Bytes":        {value: "1048576", want: 1 << 20},
+		"Bytes suffix": {value: "512B", want: 512},
+		"KiB":          {value: "10KiB", want: 10 << 10},
+		"MiB":          {value: "256MiB", want: 256 << 20},
+		"GiB":          {value: "2GiB", want: 2 << 30},
+		"TiB":          {value: "1TiB", want: 1 << 40},
+		"Off":          {value: "off", want: 0},
+		"Huge":         {value: "9000000TiB", want: unlimited},
+		"Invalid unit": {value: "10MB", wantErr: true},
+		"Negative":     {value: "-1", wantErr: true},
+		"Not a number": {value: "lots", wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseGoMemLimit(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("ParseGoMemLimit(%q) = %d, wanted %d", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseCgroupLimit(t *testing.T) {
+	tests := map[string]struct {
+		contents string
+		want     int64
+		wantOK   bool
+	}{
+		"v2 limit":    {contents: "536870912\n", want: 512 << 20, wantOK: true},
+		"v2 no limit": {contents: "max\n"},
+		"v1 no limit": {contents: "9223372036854771712\n"},
+		"Garbage":     {contents: "???"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := ParseCgroupLimit(test.contents)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("ParseCgroupLimit(%q) = %d, %t, wanted %d, %t", test.contents, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package oplog
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	metricCatchUpProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "catch_up_progress",
+		Help:      "Fraction of the gap a throttled catch-up has replayed, from 0 to 1. 1 when not catching up.",
+	})
+
+	metricCatchUpETA = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "catch_up_eta_seconds",
+		Help:      "Estimated time until a throttled catch-up reaches the end of the oplog. 0 when not catching up.",
+	})
+)
+
+// catchUp throttles the replay of a gap longer than MaxCatchUp (see
+// config.CatchUpMode), from the last processed timestamp to the entry that was
+// at the end of the oplog when we started
+type catchUp struct {
+	from primitive.Timestamp
+	to   primitive.Timestamp
+
+	// entryRate and byteRate are the limits per second, or 0 for no limit
+	entryRate float64
+	byteRate  float64
+
+	started time.Time
+	entries int
+	bytes   int
+}
+
+// startCatchUp returns the throttle for replaying the oplog from from to
+// catchUpTo, or nil if catchUpTo is nil because we're not catching up
+func (tailer *Tailer) startCatchUp(from primitive.Timestamp, catchUpTo *primitive.Timestamp) *catchUp {
+	if catchUpTo == nil {
+		metricCatchUpProgress.Set(1)
+		metricCatchUpETA.Set(0)
+		return nil
+	}
+
+	metricCatchUpProgress.Set(0)
+	return &catchUp{
+		from:      from,
+		to:        *catchUpTo,
+		entryRate: tailer.CatchUpRate,
+		byteRate:  tailer.CatchUpByteRate,
+		started:   time.Now(),
+	}
+}
+
+// record counts an entry that's been read, and returns how long to wait before
+// reading the next one to stay within the rate limits, or whether we've
+// caught up and can stop throttling
+func (c *catchUp) record(ts primitive.Timestamp, size int, now time.Time) (wait time.Duration, caughtUp bool) {
+	if !ts.Before(c.to) {
+		metricCatchUpProgress.Set(1)
+		metricCatchUpETA.Set(0)
+		return 0, true
+	}
+
+	c.entries++
+	c.bytes += size
+
+	// The rates allow this many seconds to have passed since we started
+	var allowed float64
+	if c.entryRate > 0 {
+		allowed = float64(c.entries) / c.entryRate
+	}
+	if c.byteRate > 0 && float64(c.bytes)/c.byteRate > allowed {
+		allowed = float64(c.bytes) / c.byteRate
+	}
+
+	elapsed := now.Sub(c.started)
+	if allowedDuration := time.Duration(allowed * float64(time.Second)); allowedDuration > elapsed {
+		wait = allowedDuration - elapsed
+	}
+
+	// Progress is measured in oplog time, which is all we know about the
+	// entries we haven't read yet
+	progress := 0.0
+	if total := float64(c.to.T) - float64(c.from.T); total > 0 {
+		progress = (float64(ts.T) - float64(c.from.T)) / total
+	}
+	metricCatchUpProgress.Set(progress)
+	if progress > 0 {
+		taken := (elapsed + wait).Seconds()
+		metricCatchUpETA.Set(taken * (1 - progress) / progress)
+	}
+
+	return wait, false
+}
+
+// sleepUnlessStopped sleeps for d, and returns false if it was interrupted by
+// a message on stop
+func sleepUnlessStopped(d time.Duration, stop <-chan bool) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
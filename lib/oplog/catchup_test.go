@@ -0,0 +1,107 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCatchUpRecord(t *testing.T) {
+	started := time.Unix(1000, 0)
+	from := primitive.Timestamp{T: 100}
+	to := primitive.Timestamp{T: 200}
+
+	tests := map[string]struct {
+		entryRate float64
+		byteRate  float64
+		entries   int
+		size      int
+		elapsed   time.Duration
+		wantWait  time.Duration
+	}{
+		"Entry rate": {
+			entryRate: 10,
+			entries:   5,
+			size:      100,
+			wantWait:  500 * time.Millisecond,
+		},
+		"Entry rate, time already passed": {
+			entryRate: 10,
+			entries:   5,
+			size:      100,
+			elapsed:   200 * time.Millisecond,
+			wantWait:  300 * time.Millisecond,
+		},
+		"Byte rate is the tighter limit": {
+			entryRate: 10,
+			byteRate:  1000,
+			entries:   5,
+			size:      1000,
+			wantWait:  5 * time.Second,
+		},
+		"Entry rate is the tighter limit": {
+			entryRate: 10,
+			byteRate:  1000,
+			entries:   5,
+			size:      10,
+			wantWait:  500 * time.Millisecond,
+		},
+		"No limit": {
+			entries: 5,
+			size:    1000,
+		},
+		"Ahead of the limit": {
+			entryRate: 10,
+			entries:   5,
+			size:      100,
+			elapsed:   time.Second,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &catchUp{
+				from:      from,
+				to:        to,
+				entryRate: test.entryRate,
+				byteRate:  test.byteRate,
+				started:   started,
+			}
+
+			var wait time.Duration
+			for i := 0; i < test.entries; i++ {
+				var caughtUp bool
+				wait, caughtUp = c.record(primitive.Timestamp{T: 150}, test.size, started.Add(test.elapsed))
+				if caughtUp {
+					t.Fatal("Expected not to have caught up")
+				}
+			}
+
+			if wait != test.wantWait {
+				t.Errorf("Got wait %s, expected %s", wait, test.wantWait)
+			}
+		})
+	}
+}
+
+func TestCatchUpCaughtUp(t *testing.T) {
+	c := &catchUp{
+		from:      primitive.Timestamp{T: 100},
+		to:        primitive.Timestamp{T: 200, I: 3},
+		entryRate: 1,
+		started:   time.Unix(1000, 0),
+	}
+
+	if _, caughtUp := c.record(primitive.Timestamp{T: 200, I: 2}, 10, c.started); caughtUp {
+		t.Errorf("Expected not to have caught up before the last entry")
+	}
+
+	wait, caughtUp := c.record(primitive.Timestamp{T: 200, I: 3}, 10, c.started)
+	if !caughtUp {
+		t.Errorf("Expected to have caught up at the last entry")
+	}
+	if wait != 0 {
+		t.Errorf("Expected no wait once caught up, got %s", wait)
+	}
+}
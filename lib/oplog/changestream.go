@@ -0,0 +1,423 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Change stream event, as returned by a cluster-wide change stream. See
+// https://www.mongodb.com/docs/manual/reference/change-events/
+type changeEvent struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	WallTime      time.Time           `bson:"wallTime"`
+	Namespace     struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey       bson.Raw `bson:"documentKey"`
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields   bson.Raw `bson:"updatedFields"`
+		RemovedFields   []string `bson:"removedFields"`
+		TruncatedArrays []struct {
+			Field string `bson:"field"`
+		} `bson:"truncatedArrays"`
+	} `bson:"updateDescription"`
+	To struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"to"`
+}
+
+// changeStreamTxState tracks the index of events within a transaction. All the
+// events of a transaction share a clusterTime, so we number consecutive events
+// with the same clusterTime the same way parseRawOplogEntry numbers the
+// operations of an applyOps entry.
+//
+// The numbering only matches the first time we published a transaction if we
+// see the transaction from its start, so the events are checkpointed with the
+// resume token of the last event before their transaction, rather than their
+// own. Resuming from it replays the whole transaction, and its events that
+// were already published are deduplicated.
+type changeStreamTxState struct {
+	lastClusterTime primitive.Timestamp
+	nextTxIdx       uint
+
+	// lastToken is the resume token of the last event
+	lastToken string
+
+	// checkpointToken is the resume token of the last event before the ones
+	// at lastClusterTime, or "" if we don't know it (when we started at an
+	// operation time, which also replays the whole transaction)
+	checkpointToken string
+}
+
+// next records the event at clusterTime with the given resume token, and
+// returns its index in its transaction
+func (state *changeStreamTxState) next(clusterTime primitive.Timestamp, token string) uint {
+	if !clusterTime.Equal(state.lastClusterTime) {
+		state.lastClusterTime = clusterTime
+		state.nextTxIdx = 0
+		state.checkpointToken = state.lastToken
+	}
+	state.lastToken = token
+
+	idx := state.nextTxIdx
+	state.nextTxIdx++
+	return idx
+}
+
+// changeStreamHistoryLost is the server error code returned when a resume
+// token or start time is no longer in the oplog.
+const changeStreamHistoryLost = 286
+
+// tailChangeStreamOnce is the change stream equivalent of tailOnce: it opens a
+// cluster-wide change stream from where we left off, and routes the resulting
+// publications the same way tailOnce does.
+func (tailer *Tailer) tailChangeStreamOnce(out []PublisherBuffers, stop <-chan bool) {
+	startTime, catchUpTo, startTimeErr := tailer.getStartTime(len(out)-1, func() (*primitive.Timestamp, error) {
+		// There's no oplog to look at, so the closest equivalent of "the end of
+		// the oplog" is the current cluster time
+		return currentOperationTime(tailer.MongoClient)
+	})
+
+	if startTimeErr != nil {
+		log.Log.Errorw("Failed to determine change stream start time; aborting tail attempt to retry", "error", startTimeErr)
+		metricTailFailedToStart.WithLabelValues("start_time").Inc()
+		return
+	}
+	throttle := tailer.startCatchUp(startTime, catchUpTo)
+
+	streamOpts := options.ChangeStream()
+	streamOpts.SetMaxAwaitTime(config.MongoQueryTimeout())
+
+	txState := changeStreamTxState{}
+	if token := tailer.resumeTokenFor(startTime, len(out)-1); token != "" {
+		log.Log.Infow("Resuming change stream from stored resume token", "timestamp", startTime)
+		streamOpts.SetResumeAfter(bson.M{"_data": token})
+		txState.lastToken = token
+	} else {
+		log.Log.Infow("Starting change stream at operation time", "timestamp", startTime)
+		streamOpts.SetStartAtOperationTime(&startTime)
+	}
+
+	stream, err := openChangeStream(tailer.MongoClient, streamOpts)
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(changeStreamHistoryLost) {
+		log.Log.Errorw("Change stream resume point is no longer in the oplog. Will start from the current time",
+			"timestamp", startTime,
+			"error", err)
+		metricOplogResumeGap.WithLabelValues("failed").Observe(float64(time.Since(time.Unix(int64(startTime.T), 0)) / time.Second))
+
+		skip := redispub.Skip{Reason: redispub.SkipReasonHistoryLost, From: startTime}
+		if now, err := currentOperationTime(tailer.MongoClient); err == nil {
+			skip.To = *now
+		}
+		tailer.reportSkip(skip)
+
+		stream, err = openChangeStream(tailer.MongoClient, options.ChangeStream().SetMaxAwaitTime(config.MongoQueryTimeout()))
+		throttle = tailer.startCatchUp(startTime, nil)
+		txState = changeStreamTxState{}
+	}
+
+	if err != nil {
+		log.Log.Errorw("Error opening change stream", "error", err)
+		metricTailFailedToStart.WithLabelValues("query").Inc()
+		return
+	}
+	defer closeChangeStream(stream)
+
+	for {
+		select {
+		case <-stop:
+			log.Log.Infof("Received stop; aborting change stream tailing")
+			return
+		default:
+		}
+
+		// TryNext waits for at most MaxAwaitTime for a new event; the context
+		// timeout is just a backstop in case the server doesn't respond.
+		ctx, cancel := context.WithTimeout(context.Background(), 2*config.MongoQueryTimeout())
+		gotResult := stream.TryNext(ctx)
+		cancel()
+
+		if gotResult {
+			if t, i, ok := stream.Current.Lookup("clusterTime").TimestampOK(); ok && throttle != nil {
+				wait, caughtUp := throttle.record(primitive.Timestamp{T: t, I: i}, len(stream.Current), time.Now())
+				if caughtUp {
+					log.Log.Infow("Caught up to the current time; no longer throttling",
+						"timestamp", primitive.Timestamp{T: t, I: i})
+					throttle = nil
+				} else if !sleepUnlessStopped(wait, stop) {
+					log.Log.Infof("Received stop; aborting change stream tailing")
+					return
+				}
+			}
+
+			pubs, sendMetricsData := tailer.processChangeEvent(stream.Current, &txState)
+			sendPublications(tailer.dropPublished(pubs, len(out)), sendMetricsData, out)
+
+			if t, i, ok := stream.Current.Lookup("clusterTime").TimestampOK(); ok {
+				tailer.sendHeartbeats(primitive.Timestamp{T: t, I: i}, txState.checkpointToken, out)
+			}
+		} else if stream.Err() != nil {
+			log.Log.Errorw("Error from change stream", "error", stream.Err())
+			return
+		} else {
+			log.Log.Debug("No new change stream events, will retry")
+		}
+	}
+}
+
+func openChangeStream(client *mongo.Client, streamOpts *options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	return client.Watch(ctx, mongo.Pipeline{}, streamOpts)
+}
+
+func closeChangeStream(stream *mongo.ChangeStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	closeErr := stream.Close(ctx)
+	if closeErr != nil {
+		log.Log.Errorw("Error from closing change stream",
+			"error", closeErr)
+	}
+}
+
+// resumeTokenFor returns the stored resume token for the ordinal whose last
+// processed timestamp is startTime, or "" if there isn't one. getStartTime
+// resumes from the earliest ordinal, so that's the ordinal whose token
+// describes the same position.
+func (tailer *Tailer) resumeTokenFor(startTime primitive.Timestamp, maxOrdinal int) string {
+	for i := 0; i <= maxOrdinal; i++ {
+		checkpoint, err := tailer.checkpoints().Load(i)
+		if err == nil && checkpoint.Timestamp.Equal(startTime) && checkpoint.ResumeToken != "" {
+			return checkpoint.ResumeToken
+		}
+	}
+
+	return ""
+}
+
+// currentOperationTime returns the cluster's current operation time, which is
+// reported on every command response from a replica set or sharded cluster.
+func currentOperationTime(client *mongo.Client) (*primitive.Timestamp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	var result bson.Raw
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	t, i, ok := result.Lookup("operationTime").TimestampOK()
+	if !ok {
+		return nil, errors.New("ping response did not include an operationTime")
+	}
+
+	log.Log.Infow("Got current operation time", "timestamp", t)
+	return &primitive.Timestamp{T: t, I: i}, nil
+}
+
+// processChangeEvent is the change stream equivalent of processEntry
+func (tailer *Tailer) processChangeEvent(rawData bson.Raw, txState *changeStreamTxState) (pubs []*redispub.Publication, sendMetricsData func()) {
+	var event changeEvent
+	err := bson.Unmarshal(rawData, &event)
+	if err != nil {
+		log.Log.Errorw("Error decoding change stream event", "error", err)
+		return
+	}
+
+	if _, denied := tailer.Denylist.Load(event.Namespace.DB); denied {
+		log.Log.Debugw("Skipping change stream event", "database", event.Namespace.DB)
+		metricOplogEntriesFiltered.WithLabelValues(event.Namespace.DB).Add(1)
+		return
+	}
+
+	status := "ignored"
+	database := event.Namespace.DB
+	messageLen := float64(len(rawData))
+	if database == "" {
+		database = "(no database)"
+	}
+
+	sendMetricsData = func() {
+		// TODO: remove these in a future version
+		metricOplogEntriesReceived.WithLabelValues(database, status).Inc()
+		metricOplogEntriesReceivedSize.WithLabelValues(database).Add(messageLen)
+
+		metricOplogEntriesBySize.WithLabelValues(database, status).Observe(messageLen)
+		metricMaxOplogEntryByMinute.Report(messageLen, database, status)
+		metricLastReceivedStaleness.WithLabelValues(readOrdinalLabel).Set(float64(time.Since(time.Unix(int64(event.ClusterTime.T), 0))))
+	}
+
+	resumeToken, _ := event.ID.Lookup("_data").StringValueOK()
+	txIdx := txState.next(event.ClusterTime, resumeToken)
+
+	var entries []oplogEntry
+	if ddlEntry := changeEventToDDLEntry(&event); ddlEntry != nil {
+		entries = tailer.parseDDLEntry(ddlEntry, &txIdx)
+	} else {
+		entry, err := changeEventToOplogEntry(&event, txIdx)
+		if err != nil {
+			status = "error"
+			log.Log.Errorw("Error converting change stream event",
+				"error", err,
+				"operationType", event.OperationType,
+				"database", event.Namespace.DB,
+				"collection", event.Namespace.Coll)
+			return
+		}
+		if entry != nil {
+			tailer.recordNamespace(entry.Database, entry.Collection)
+			entries = append(entries, *entry)
+		}
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		pub, err := processOplogEntry(entry)
+		if err != nil {
+			status = "error"
+			log.Log.Errorw("Error processing change stream event",
+				"op", entry.LogData(),
+				"error", err,
+				"database", entry.Database,
+				"collection", entry.Collection)
+			return nil, sendMetricsData
+		}
+		if pub == nil {
+			continue
+		}
+
+		status = "processed"
+		pub.ResumeToken = txState.checkpointToken
+		pubs = append(pubs, pub)
+	}
+	return
+}
+
+// changeEventToDDLEntry converts a drop, dropDatabase, or rename change event
+// into the oplog command entry for the same command, which parseDDLEntry
+// knows how to handle. Returns nil for other event types.
+func changeEventToDDLEntry(event *changeEvent) *rawOplogEntry {
+	var command bson.D
+	switch event.OperationType {
+	case "drop":
+		command = bson.D{{Key: config.DDLEventDrop, Value: event.Namespace.Coll}}
+	case "dropDatabase":
+		command = bson.D{{Key: config.DDLEventDropDatabase, Value: 1}}
+	case "rename":
+		command = bson.D{
+			{Key: config.DDLEventRenameCollection, Value: event.Namespace.DB + "." + event.Namespace.Coll},
+			{Key: "to", Value: event.To.DB + "." + event.To.Coll},
+		}
+	default:
+		return nil
+	}
+
+	doc, err := bson.Marshal(command)
+	if err != nil {
+		return nil
+	}
+
+	return &rawOplogEntry{
+		Timestamp: event.ClusterTime,
+		WallTime:  event.WallTime.UTC(),
+		Operation: operationCommand,
+		Namespace: event.Namespace.DB + ".$cmd",
+		Doc:       doc,
+	}
+}
+
+// changeEventToOplogEntry converts a change stream event into the oplogEntry
+// that the equivalent oplog entry would have produced, so that
+// processOplogEntry generates an identical publication. Returns nil for event
+// types that have no oplog CRUD equivalent.
+func changeEventToOplogEntry(event *changeEvent, txIdx uint) (*oplogEntry, error) {
+	out := oplogEntry{
+		Timestamp:  event.ClusterTime,
+		WallTime:   event.WallTime.UTC(),
+		Namespace:  event.Namespace.DB + "." + event.Namespace.Coll,
+		Database:   event.Namespace.DB,
+		Collection: event.Namespace.Coll,
+		TxIdx:      txIdx,
+	}
+
+	switch event.OperationType {
+	case "insert":
+		out.Operation = operationInsert
+		out.Data = event.FullDocument
+
+	case "replace":
+		// A replacement is logged in the oplog as an update whose o field is the
+		// new document
+		out.Operation = operationUpdate
+		out.Data = event.FullDocument
+
+	case "update":
+		// Rebuild a v1-style update document, which is all ChangedFields needs:
+		// { $v: 1, $set: { <updated fields> }, $unset: { <removed fields> } }
+		set := bson.D{}
+		updated, err := event.UpdateDescription.UpdatedFields.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range updated {
+			set = append(set, bson.E{Key: elem.Key(), Value: true})
+		}
+		for _, truncated := range event.UpdateDescription.TruncatedArrays {
+			set = append(set, bson.E{Key: truncated.Field, Value: true})
+		}
+
+		unset := bson.D{}
+		for _, field := range event.UpdateDescription.RemovedFields {
+			unset = append(unset, bson.E{Key: field, Value: true})
+		}
+
+		// $set is always included, even if empty, so that UpdateIsReplace
+		// doesn't mistake this for a replacement
+		data, err := bson.Marshal(bson.D{
+			{Key: "$v", Value: 1},
+			{Key: "$set", Value: set},
+			{Key: "$unset", Value: unset},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		out.Operation = operationUpdate
+		out.Data = data
+
+	case "delete":
+		out.Operation = operationRemove
+		out.Data = event.DocumentKey
+
+	default:
+		return nil, nil
+	}
+
+	var err error
+	out.DocID, err = parseID(event.DocumentKey.Lookup("_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,186 @@
+package oplog
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChangeEventToOplogEntry(t *testing.T) {
+	ts := primitive.Timestamp{T: 1234, I: 5}
+	wall := time.Unix(1234, 0).UTC()
+
+	tests := map[string]struct {
+		event          bson.M
+		wantOperation  string
+		wantDocID      interface{}
+		wantFields     []string
+		wantNilEntry   bool
+		wantError      bool
+		wantCollection string
+	}{
+		"Insert": {
+			event: bson.M{
+				"operationType": "insert",
+				"fullDocument":  bson.M{"_id": "someid", "a": 1, "b": 2},
+				"documentKey":   bson.M{"_id": "someid"},
+			},
+			wantOperation: operationInsert,
+			wantDocID:     "someid",
+			wantFields:    []string{"_id", "a", "b"},
+		},
+		"Replace": {
+			event: bson.M{
+				"operationType": "replace",
+				"fullDocument":  bson.M{"_id": "someid", "c": 1},
+				"documentKey":   bson.M{"_id": "someid"},
+			},
+			wantOperation: operationUpdate,
+			wantDocID:     "someid",
+			wantFields:    []string{"_id", "c"},
+		},
+		"Update": {
+			event: bson.M{
+				"operationType": "update",
+				"documentKey":   bson.M{"_id": "someid"},
+				"updateDescription": bson.M{
+					"updatedFields":   bson.M{"a.b": 1, "c": "x"},
+					"removedFields":   bson.A{"d"},
+					"truncatedArrays": bson.A{bson.M{"field": "e", "newSize": 2}},
+				},
+			},
+			wantOperation: operationUpdate,
+			wantDocID:     "someid",
+			wantFields:    []string{"a.b", "c", "d", "e"},
+		},
+		"Update with no changed fields": {
+			event: bson.M{
+				"operationType": "update",
+				"documentKey":   bson.M{"_id": "someid"},
+				"updateDescription": bson.M{
+					"updatedFields": bson.M{},
+					"removedFields": bson.A{},
+				},
+			},
+			wantOperation: operationUpdate,
+			wantDocID:     "someid",
+			wantFields:    []string{},
+		},
+		"Delete": {
+			event: bson.M{
+				"operationType": "delete",
+				"documentKey":   bson.M{"_id": "someid"},
+			},
+			wantOperation: operationRemove,
+			wantDocID:     "someid",
+			wantFields:    []string{},
+		},
+		"Ignored operation type": {
+			event: bson.M{
+				"operationType": "createIndexes",
+			},
+			wantNilEntry: true,
+		},
+		"Missing _id": {
+			event: bson.M{
+				"operationType": "delete",
+				"documentKey":   bson.M{},
+			},
+			wantError: true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			test.event["clusterTime"] = ts
+			test.event["wallTime"] = wall
+			test.event["ns"] = bson.M{"db": "foo", "coll": "bar"}
+
+			var event changeEvent
+			require.NoError(t, bson.Unmarshal(rawBson(t, test.event), &event))
+
+			entry, err := changeEventToOplogEntry(&event, 3)
+			if test.wantError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if test.wantNilEntry {
+				require.Nil(t, entry)
+				return
+			}
+
+			require.Equal(t, test.wantOperation, entry.Operation)
+			require.Equal(t, test.wantDocID, entry.DocID)
+			require.Equal(t, ts, entry.Timestamp)
+			require.Equal(t, wall, entry.WallTime)
+			require.Equal(t, "foo.bar", entry.Namespace)
+			require.Equal(t, "foo", entry.Database)
+			require.Equal(t, "bar", entry.Collection)
+			require.Equal(t, uint(3), entry.TxIdx)
+
+			fields, err := entry.ChangedFields()
+			require.NoError(t, err)
+			sort.Strings(fields)
+			require.Equal(t, test.wantFields, fields)
+		})
+	}
+}
+
+func TestChangeStreamTxIdx(t *testing.T) {
+	state := changeStreamTxState{}
+
+	first := primitive.Timestamp{T: 1, I: 1}
+	second := primitive.Timestamp{T: 1, I: 2}
+
+	require.Equal(t, uint(0), state.next(first, "a"))
+	require.Equal(t, "", state.checkpointToken)
+
+	// The events of a transaction are checkpointed with the token of the
+	// event before it
+	require.Equal(t, uint(0), state.next(second, "b"))
+	require.Equal(t, uint(1), state.next(second, "c"))
+	require.Equal(t, uint(2), state.next(second, "d"))
+	require.Equal(t, "a", state.checkpointToken)
+
+	require.Equal(t, uint(0), state.next(first, "e"))
+	require.Equal(t, "d", state.checkpointToken)
+}
+
+func TestChangeStreamTxIdxResumed(t *testing.T) {
+	// Resuming from a checkpointed token replays the transaction after it
+	// from its start, numbered the same way
+	state := changeStreamTxState{lastToken: "a"}
+	second := primitive.Timestamp{T: 1, I: 2}
+
+	require.Equal(t, uint(0), state.next(second, "b"))
+	require.Equal(t, "a", state.checkpointToken)
+}
+
+func TestChangeEventToDDLEntry(t *testing.T) {
+	event := func(data bson.M) *changeEvent {
+		data["clusterTime"] = primitive.Timestamp{T: 1234}
+		data["ns"] = bson.M{"db": "foo", "coll": "bar"}
+
+		var event changeEvent
+		require.NoError(t, bson.Unmarshal(rawBson(t, data), &event))
+		return &event
+	}
+
+	drop := changeEventToDDLEntry(event(bson.M{"operationType": "drop"}))
+	require.Equal(t, "foo.$cmd", drop.Namespace)
+	require.Equal(t, rawBson(t, bson.D{{Key: "drop", Value: "bar"}}), drop.Doc)
+
+	rename := changeEventToDDLEntry(event(bson.M{"operationType": "rename", "to": bson.M{"db": "baz", "coll": "quux"}}))
+	require.Equal(t, rawBson(t, bson.D{{Key: "renameCollection", Value: "foo.bar"}, {Key: "to", Value: "baz.quux"}}), rename.Doc)
+
+	dropDatabase := changeEventToDDLEntry(event(bson.M{"operationType": "dropDatabase"}))
+	require.Equal(t, rawBson(t, bson.D{{Key: "dropDatabase", Value: 1}}), dropDatabase.Doc)
+
+	require.Nil(t, changeEventToDDLEntry(event(bson.M{"operationType": "insert"})))
+}
@@ -0,0 +1,297 @@
+package oplog
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// parseDDLEntry converts a DDL command entry (a `c` entry on a `<db>.$cmd`
+// namespace) into one oplogEntry per affected collection, so that
+// processOplogEntry publishes a resync message on each of their channels.
+// For a renameCollection, it also returns a remove entry on the old name and
+// an insert entry on the new name for each document of the collection (see
+// renamedDocuments). Returns nil for commands that aren't listed in
+// config.DDLEvents.
+//
+// The entries look like:
+//
+//	{ op: "c", ns: "db.$cmd", o: { drop: "coll" } }
+//	{ op: "c", ns: "db.$cmd", o: { dropDatabase: 1 } }
+//	{ op: "c", ns: "db.$cmd", o: { renameCollection: "db.from", to: "otherdb.to" } }
+func (tailer *Tailer) parseDDLEntry(entry *rawOplogEntry, txIdx *uint) []oplogEntry {
+	database, _ := parseNamespace(entry.Namespace)
+
+	command := ddlCommand(entry)
+	if !ddlEventEnabled(command) {
+		return nil
+	}
+
+	var namespaces []string
+	var renamedDocs []bson.Raw
+	switch command {
+	case config.DDLEventDrop:
+		collection, ok := entry.Doc.Lookup(command).StringValueOK()
+		if !ok {
+			log.Log.Error("Error unmarshalling collection name of drop command")
+			return nil
+		}
+		namespaces = []string{database + "." + collection}
+		tailer.forgetNamespace(database, collection)
+
+	case config.DDLEventDropDatabase:
+		// Since MongoDB 4.2, dropDatabase logs a drop for each collection before
+		// the dropDatabase itself, so this is usually redundant. We publish to
+		// every collection we've seen in the database anyway, for older versions.
+		// The database is already gone by the time we read this, so we can't
+		// list its collections from Mongo; collections last written to before
+		// we started, or past maxSeenNamespaces, are missed.
+		for _, collection := range tailer.seenCollections(database) {
+			namespaces = append(namespaces, database+"."+collection)
+		}
+		tailer.forgetDatabase(database)
+
+	case config.DDLEventRenameCollection:
+		from, okFrom := entry.Doc.Lookup(command).StringValueOK()
+		to, okTo := entry.Doc.Lookup("to").StringValueOK()
+		if !okFrom || !okTo {
+			log.Log.Error("Error unmarshalling collection names of renameCollection command")
+			return nil
+		}
+		namespaces = []string{from, to}
+
+		fromDatabase, fromCollection := parseNamespace(from)
+		tailer.forgetNamespace(fromDatabase, fromCollection)
+		tailer.recordNamespace(parseNamespace(to))
+
+		renamedDocs = tailer.renamedDocuments(to)
+	}
+
+	var ret []oplogEntry
+	for _, namespace := range namespaces {
+		db, collection := parseNamespace(namespace)
+		if _, denied := tailer.Denylist.Load(db); denied {
+			continue
+		}
+
+		// Time-series collections are published under their user-facing name
+		if strings.HasPrefix(collection, bucketsPrefix) {
+			collection = strings.TrimPrefix(collection, bucketsPrefix)
+			namespace = db + "." + collection
+		}
+
+		ret = append(ret, oplogEntry{
+			Operation:  operationCommand,
+			Timestamp:  entry.Timestamp,
+			WallTime:   entry.WallTime,
+			Namespace:  namespace,
+			Database:   db,
+			Collection: collection,
+			Data:       entry.Doc,
+
+			ResyncReason: command,
+
+			TxIdx: *txIdx,
+		})
+		*txIdx++
+	}
+
+	// Stock redis-oplog ignores resync messages, so we also tell it about
+	// each document of a renamed collection: it was removed from the old
+	// collection and inserted into the new one
+	for _, doc := range renamedDocs {
+		ret = append(ret, tailer.renamedDocumentEntries(entry, doc, namespaces[0], namespaces[1], txIdx)...)
+	}
+
+	return ret
+}
+
+// maxRenamedDocuments is the most documents of a renamed collection that we
+// publish remove and insert messages for. Larger collections only get resync
+// messages.
+const maxRenamedDocuments = 10000
+
+// renamedDocuments returns the _ids (as {_id: ...} documents) of the
+// documents in namespace, which a collection was just renamed to. Returns nil
+// if there are more than maxRenamedDocuments of them, or they can't be read.
+func (tailer *Tailer) renamedDocuments(namespace string) []bson.Raw {
+	if tailer.MongoClient == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	database, collection := parseNamespace(namespace)
+	cursor, err := tailer.MongoClient.Database(database).Collection(collection).Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(maxRenamedDocuments+1))
+	if err != nil {
+		log.Log.Errorw("Error reading the documents of a renamed collection; only publishing resync messages",
+			"namespace", namespace, "error", err)
+		return nil
+	}
+	defer closeCursor(cursor)
+
+	var docs []bson.Raw
+	for cursor.Next(ctx) {
+		docs = append(docs, append(bson.Raw{}, cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		log.Log.Errorw("Error reading the documents of a renamed collection; only publishing resync messages",
+			"namespace", namespace, "error", err)
+		return nil
+	}
+
+	if len(docs) > maxRenamedDocuments {
+		log.Log.Warnw("Renamed collection has too many documents to publish; only publishing resync messages",
+			"namespace", namespace, "maxDocuments", maxRenamedDocuments)
+		return nil
+	}
+
+	return docs
+}
+
+// renamedDocumentEntries returns a remove entry for doc on from, and an insert
+// entry for it on to, skipping denylisted databases
+func (tailer *Tailer) renamedDocumentEntries(entry *rawOplogEntry, doc bson.Raw, from string, to string, txIdx *uint) []oplogEntry {
+	docID, err := parseID(doc.Lookup("_id"))
+	if err != nil {
+		return nil
+	}
+
+	var ret []oplogEntry
+	for _, op := range []struct {
+		operation string
+		namespace string
+	}{{operationRemove, from}, {operationInsert, to}} {
+		db, collection := parseNamespace(op.namespace)
+		if _, denied := tailer.Denylist.Load(db); denied {
+			continue
+		}
+
+		ret = append(ret, oplogEntry{
+			DocID:      docID,
+			Operation:  op.operation,
+			Timestamp:  entry.Timestamp,
+			WallTime:   entry.WallTime,
+			Namespace:  op.namespace,
+			Database:   db,
+			Collection: collection,
+			Data:       doc,
+
+			TxIdx: *txIdx,
+		})
+		*txIdx++
+	}
+
+	return ret
+}
+
+func ddlEventEnabled(command string) bool {
+	for _, event := range config.DDLEvents() {
+		if event == command {
+			return true
+		}
+	}
+	return false
+}
+
+// ddlCommand returns the name of the DDL command of a command entry, or "" if
+// it's not a DDL command that we know how to publish
+func ddlCommand(entry *rawOplogEntry) string {
+	elems, err := entry.Doc.Elements()
+	if err != nil || len(elems) == 0 {
+		return ""
+	}
+
+	switch command := elems[0].Key(); command {
+	case config.DDLEventDrop, config.DDLEventDropDatabase, config.DDLEventRenameCollection:
+		return command
+	default:
+		return ""
+	}
+}
+
+// maxSeenNamespaces is the most collections we remember writes to for
+// dropDatabase. Past it, collections we haven't seen before aren't recorded.
+const maxSeenNamespaces = 100000
+
+// recordNamespace remembers that we've seen a write to a collection, so that
+// we know which collections to publish to when its database is dropped. We
+// only need to remember them if dropDatabase is in config.DDLEvents.
+func (tailer *Tailer) recordNamespace(database string, collection string) {
+	if ddlEventEnabled(config.DDLEventDropDatabase) {
+		tailer.addNamespace(database, collection)
+	}
+}
+
+// recordNamespaces records the namespaces of entries parsed from CRUD
+// operations
+func (tailer *Tailer) recordNamespaces(entries []oplogEntry) {
+	if len(entries) == 0 || !ddlEventEnabled(config.DDLEventDropDatabase) {
+		return
+	}
+
+	for i := range entries {
+		tailer.addNamespace(entries[i].Database, entries[i].Collection)
+	}
+}
+
+func (tailer *Tailer) addNamespace(database string, collection string) {
+	if tailer.seenNamespaces[database][collection] {
+		return
+	}
+
+	if tailer.seenNamespaceCount >= maxSeenNamespaces {
+		if !tailer.seenNamespacesFull {
+			log.Log.Warnw("Seen too many collections; dropDatabase won't publish resync messages for collections first written to after this",
+				"maxCollections", maxSeenNamespaces)
+			tailer.seenNamespacesFull = true
+		}
+		return
+	}
+
+	if tailer.seenNamespaces == nil {
+		tailer.seenNamespaces = map[string]map[string]bool{}
+	}
+
+	collections := tailer.seenNamespaces[database]
+	if collections == nil {
+		collections = map[string]bool{}
+		tailer.seenNamespaces[database] = collections
+	}
+
+	collections[collection] = true
+	tailer.seenNamespaceCount++
+}
+
+func (tailer *Tailer) forgetNamespace(database string, collection string) {
+	if tailer.seenNamespaces[database][collection] {
+		delete(tailer.seenNamespaces[database], collection)
+		tailer.seenNamespaceCount--
+		tailer.seenNamespacesFull = false
+	}
+}
+
+func (tailer *Tailer) forgetDatabase(database string) {
+	if collections, ok := tailer.seenNamespaces[database]; ok {
+		tailer.seenNamespaceCount -= len(collections)
+		tailer.seenNamespacesFull = false
+		delete(tailer.seenNamespaces, database)
+	}
+}
+
+// seenCollections returns the collections of database we've seen writes to
+func (tailer *Tailer) seenCollections(database string) []string {
+	collections := []string{}
+	for collection := range tailer.seenNamespaces[database] {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	return collections
+}
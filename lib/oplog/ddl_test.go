@@ -0,0 +1,219 @@
+package oplog
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseDDLEntry(t *testing.T) {
+	ts := primitive.Timestamp{T: 1234}
+	wall := time.Unix(1234, 0).UTC()
+
+	insert := func(namespace string) *rawOplogEntry {
+		return &rawOplogEntry{
+			Timestamp: ts,
+			Operation: operationInsert,
+			Namespace: namespace,
+			Doc:       rawBson(t, bson.M{"_id": "someid"}),
+		}
+	}
+	command := func(namespace string, doc bson.D) *rawOplogEntry {
+		return &rawOplogEntry{
+			Timestamp: ts,
+			WallTime:  wall,
+			Operation: operationCommand,
+			Namespace: namespace,
+			Doc:       rawBson(t, doc),
+		}
+	}
+
+	tests := map[string]struct {
+		ddlEvents  string
+		seen       []string
+		denylist   []string
+		in         *rawOplogEntry
+		wantTarget []string
+	}{
+		"Drop": {
+			in:         command("foo.$cmd", bson.D{{Key: "drop", Value: "Bar"}}),
+			wantTarget: []string{"foo.Bar"},
+		},
+		"Rename": {
+			in: command("foo.$cmd", bson.D{
+				{Key: "renameCollection", Value: "foo.Bar"},
+				{Key: "to", Value: "baz.Quux"},
+				{Key: "stayTemp", Value: false},
+			}),
+			wantTarget: []string{"foo.Bar", "baz.Quux"},
+		},
+		"Rename into a denylisted database": {
+			denylist: []string{"baz"},
+			in: command("foo.$cmd", bson.D{
+				{Key: "renameCollection", Value: "foo.Bar"},
+				{Key: "to", Value: "baz.Quux"},
+			}),
+			wantTarget: []string{"foo.Bar"},
+		},
+		"Drop database": {
+			seen:       []string{"foo.Bar", "foo.Baz", "other.Bar"},
+			in:         command("foo.$cmd", bson.D{{Key: "dropDatabase", Value: 1}}),
+			wantTarget: []string{"foo.Bar", "foo.Baz"},
+		},
+		"Drop database without seen collections": {
+			seen:       []string{"other.Bar"},
+			in:         command("foo.$cmd", bson.D{{Key: "dropDatabase", Value: 1}}),
+			wantTarget: nil,
+		},
+		"Disabled": {
+			ddlEvents:  "dropDatabase",
+			in:         command("foo.$cmd", bson.D{{Key: "drop", Value: "Bar"}}),
+			wantTarget: nil,
+		},
+		"Other commands": {
+			in:         command("foo.$cmd", bson.D{{Key: "create", Value: "Bar"}}),
+			wantTarget: nil,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ddlEvents := test.ddlEvents
+			if ddlEvents == "" {
+				ddlEvents = "drop,dropDatabase,renameCollection"
+			}
+			t.Setenv("OTR_DDL_EVENTS", ddlEvents)
+			require.NoError(t, config.ParseEnv())
+
+			tailer := &Tailer{Denylist: &sync.Map{}}
+			for _, db := range test.denylist {
+				tailer.Denylist.Store(db, true)
+			}
+			for _, namespace := range test.seen {
+				require.Len(t, tailer.parseRawOplogEntry(insert(namespace), nil), 1)
+			}
+
+			entries := tailer.parseRawOplogEntry(test.in, nil)
+
+			var targets []string
+			for i, entry := range entries {
+				targets = append(targets, entry.Namespace)
+
+				require.Equal(t, operationCommand, entry.Operation)
+				require.Equal(t, ts, entry.Timestamp)
+				require.Equal(t, wall, entry.WallTime)
+				require.Equal(t, uint(i), entry.TxIdx)
+
+				pub, err := processOplogEntry(&entry)
+				require.NoError(t, err)
+				require.Equal(t, []string{entry.Namespace}, pub.Channels)
+				require.Equal(t, redispub.ResyncMessage(ddlCommand(test.in)), pub.Msg)
+				require.Equal(t, parallelismKey(entry.Database), pub.ParallelismKey)
+			}
+			require.Equal(t, test.wantTarget, targets)
+		})
+	}
+}
+
+func TestParseDDLEntryOffByDefault(t *testing.T) {
+	require.NoError(t, config.ParseEnv())
+
+	entries := (&Tailer{Denylist: &sync.Map{}}).parseRawOplogEntry(&rawOplogEntry{
+		Operation: operationCommand,
+		Namespace: "foo.$cmd",
+		Doc:       rawBson(t, bson.D{{Key: "drop", Value: "Bar"}}),
+	}, nil)
+	require.Empty(t, entries)
+}
+
+func TestDropDatabaseForgetsCollections(t *testing.T) {
+	t.Setenv("OTR_DDL_EVENTS", "drop,dropDatabase")
+	require.NoError(t, config.ParseEnv())
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	tailer.recordNamespace("foo", "Bar")
+	tailer.recordNamespace("foo", "Baz")
+	require.Equal(t, []string{"Bar", "Baz"}, tailer.seenCollections("foo"))
+
+	dropped := tailer.parseRawOplogEntry(&rawOplogEntry{
+		Operation: operationCommand,
+		Namespace: "foo.$cmd",
+		Doc:       rawBson(t, bson.D{{Key: "drop", Value: "Bar"}}),
+	}, nil)
+	require.Len(t, dropped, 1)
+	require.Equal(t, []string{"Baz"}, tailer.seenCollections("foo"))
+
+	dropped = tailer.parseRawOplogEntry(&rawOplogEntry{
+		Operation: operationCommand,
+		Namespace: "foo.$cmd",
+		Doc:       rawBson(t, bson.D{{Key: "dropDatabase", Value: 1}}),
+	}, nil)
+	require.Len(t, dropped, 1)
+	require.Empty(t, tailer.seenCollections("foo"))
+}
+
+func TestRecordNamespaceOnlyForDropDatabase(t *testing.T) {
+	t.Setenv("OTR_DDL_EVENTS", "drop")
+	require.NoError(t, config.ParseEnv())
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	tailer.recordNamespace("foo", "Bar")
+	require.Empty(t, tailer.seenCollections("foo"))
+}
+
+func TestRecordNamespaceLimit(t *testing.T) {
+	t.Setenv("OTR_DDL_EVENTS", "dropDatabase")
+	require.NoError(t, config.ParseEnv())
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	for i := 0; i < maxSeenNamespaces; i++ {
+		tailer.recordNamespace("foo", strconv.Itoa(i))
+	}
+	tailer.recordNamespace("foo", "0")
+	tailer.recordNamespace("bar", "Baz")
+	require.Len(t, tailer.seenCollections("foo"), maxSeenNamespaces)
+	require.Empty(t, tailer.seenCollections("bar"))
+
+	// Dropping a database makes room for more
+	tailer.forgetDatabase("foo")
+	tailer.recordNamespace("bar", "Baz")
+	require.Equal(t, []string{"Baz"}, tailer.seenCollections("bar"))
+}
+
+func TestRenamedDocumentEntries(t *testing.T) {
+	tailer := &Tailer{Denylist: &sync.Map{}}
+	entry := &rawOplogEntry{
+		Timestamp: primitive.Timestamp{T: 1234},
+		Operation: operationCommand,
+		Namespace: "foo.$cmd",
+	}
+	doc := rawBson(t, bson.M{"_id": "someid"})
+
+	txIdx := uint(2)
+	entries := tailer.renamedDocumentEntries(entry, doc, "foo.Bar", "baz.Quux", &txIdx)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint(4), txIdx)
+
+	remove, err := processOplogEntry(&entries[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo.Bar", "foo.Bar::someid"}, remove.Channels)
+	require.JSONEq(t, `{"e": "r", "d": {"_id": "someid"}, "f": []}`, string(remove.Msg))
+
+	insert, err := processOplogEntry(&entries[1])
+	require.NoError(t, err)
+	require.Equal(t, []string{"baz.Quux", "baz.Quux::someid"}, insert.Channels)
+	require.JSONEq(t, `{"e": "i", "d": {"_id": "someid"}, "f": ["_id"]}`, string(insert.Msg))
+	require.Equal(t, uint(3), insert.TxIdx)
+
+	tailer.Denylist.Store("baz", true)
+	entries = tailer.renamedDocumentEntries(entry, doc, "foo.Bar", "baz.Quux", &txIdx)
+	require.Len(t, entries, 1)
+	require.Equal(t, operationRemove, entries[0].Operation)
+}
@@ -0,0 +1,130 @@
+package oplog
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// We read the oplog with a single cursor, and decode the entries on a pool of
+// workers:
+//
+//	cursor -> decodeEntry (N workers) -> reorder -> finishEntry -> publishers
+//
+// decodeEntry does the expensive, stateless part of processing an entry
+// (unmarshalling it and generating its publications), so it can run in
+// parallel. The reorder stage puts the decoded entries back in the order they
+// were read in before passing them to finishEntry, which handles the parts that
+// depend on the entries before them (transactions and DDL commands). Since
+// every entry goes through finishEntry in oplog order, the publications for
+// each database reach the publishers in oplog order.
+
+// decodeQueueSizePerWorker is how many entries can be waiting to be decoded,
+// per worker, before the cursor stops reading
+const decodeQueueSizePerWorker = 64
+
+// decoder is a pool of workers that decode oplog entries in parallel, and
+// passes them to emit in the order they were added
+type decoder struct {
+	tailer *Tailer
+	emit   func(*decodedEntry)
+
+	nextSeq uint64
+	in      chan *decodedEntry
+	decoded chan *decodedEntry
+
+	workers sync.WaitGroup
+	done    chan struct{}
+}
+
+// startDecoder starts a decoder with the given number of workers. emit is
+// called from a single goroutine.
+func (tailer *Tailer) startDecoder(workers int, emit func(*decodedEntry)) *decoder {
+	if workers < 1 {
+		workers = 1
+	}
+
+	d := &decoder{
+		tailer:  tailer,
+		emit:    emit,
+		in:      make(chan *decodedEntry, workers*decodeQueueSizePerWorker),
+		decoded: make(chan *decodedEntry, workers*decodeQueueSizePerWorker),
+		done:    make(chan struct{}),
+	}
+
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+
+	go func() {
+		d.workers.Wait()
+		close(d.decoded)
+	}()
+
+	go d.reorder()
+
+	return d
+}
+
+// add queues rawData to be decoded. It blocks if the queue is full.
+func (d *decoder) add(rawData bson.Raw) {
+	d.in <- &decodedEntry{seq: d.nextSeq, rawData: rawData}
+	d.nextSeq++
+}
+
+// addPosition queues a position marker for ts, which is emitted (with a nil
+// rawData) after every entry added before it
+func (d *decoder) addPosition(ts primitive.Timestamp) {
+	d.in <- &decodedEntry{seq: d.nextSeq, position: ts}
+	d.nextSeq++
+}
+
+// close waits for every queued entry to be decoded and emitted, and then stops
+// the workers
+func (d *decoder) close() {
+	close(d.in)
+	<-d.done
+}
+
+func (d *decoder) work() {
+	defer d.workers.Done()
+
+	for job := range d.in {
+		if job.rawData == nil {
+			// A position marker; there's nothing to decode
+			d.decoded <- job
+			continue
+		}
+
+		decoded := d.tailer.decodeEntry(job.rawData)
+		decoded.seq = job.seq
+		d.decoded <- decoded
+	}
+}
+
+// reorder emits decoded entries in sequence order. Entries that finish
+// decoding before an earlier entry are held until the earlier entry is done.
+// The number of held entries is bounded by the sizes of the queues.
+func (d *decoder) reorder() {
+	defer close(d.done)
+
+	pending := map[uint64]*decodedEntry{}
+	next := uint64(0)
+
+	for decoded := range d.decoded {
+		pending[decoded.seq] = decoded
+
+		for {
+			entry, ok := pending[next]
+			if !ok {
+				break
+			}
+
+			delete(pending, next)
+			next++
+			d.emit(entry)
+		}
+	}
+}
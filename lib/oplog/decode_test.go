@@ -0,0 +1,235 @@
+package oplog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+)
+
+// testOplogEntries generates n insert entries, spread across databases, with
+// a document of about docSize bytes each
+func testOplogEntries(n int, databases int, docSize int) ([]bson.Raw, error) {
+	entries := make([]bson.Raw, n)
+	for i := range entries {
+		raw, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: 1234, I: uint32(2 * i)},
+			"op": "i",
+			"ns": fmt.Sprintf("db%d.Foo", i%databases),
+			"o": bson.M{
+				"_id":   strconv.Itoa(i),
+				"field": strings.Repeat("x", docSize),
+				"nested": bson.M{
+					"a": i,
+					"b": bson.A{1, 2, 3},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = raw
+	}
+	return entries, nil
+}
+
+func TestDecoderOrder(t *testing.T) {
+	t.Setenv("OTR_DDL_EVENTS", "drop,dropDatabase")
+	require.NoError(t, config.ParseEnv())
+
+	entries, err := testOplogEntries(1000, 4, 10)
+	require.NoError(t, err)
+
+	// A drop in the middle of the inserts, which goes through the sequential
+	// part of processing
+	drop := rawBson(t, bson.M{
+		"ts": primitive.Timestamp{T: 1234, I: 999},
+		"op": "c",
+		"ns": "db1.$cmd",
+		"o":  bson.M{"drop": "Foo"},
+	})
+	entries = append(entries[:500], append([]bson.Raw{drop}, entries[500:]...)...)
+
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	var got []*redispub.Publication
+	d := tailer.startDecoder(8, func(decoded *decodedEntry) {
+		_, pubs, _ := tailer.finishEntry(decoded)
+		got = append(got, pubs...)
+	})
+	for _, entry := range entries {
+		d.add(entry)
+	}
+	d.close()
+
+	require.Len(t, got, len(entries))
+	for i := 1; i < len(got); i++ {
+		require.True(t, got[i-1].OplogTimestamp.Before(got[i].OplogTimestamp))
+	}
+	require.Equal(t, redispub.ResyncMessage(config.DDLEventDrop), got[500].Msg)
+
+	// The drop made the tailer forget db1.Foo, and the inserts after it
+	// recorded it again
+	require.Equal(t, []string{"Foo"}, tailer.seenCollections("db1"))
+}
+
+func TestDecoderPosition(t *testing.T) {
+	require.NoError(t, config.ParseEnv())
+
+	entries, err := testOplogEntries(100, 4, 10)
+	require.NoError(t, err)
+
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	var got []primitive.Timestamp
+	d := tailer.startDecoder(8, func(decoded *decodedEntry) {
+		if decoded.rawData == nil {
+			got = append(got, decoded.position)
+			return
+		}
+		_, pubs, _ := tailer.finishEntry(decoded)
+		for _, pub := range pubs {
+			got = append(got, pub.OplogTimestamp)
+		}
+	})
+	for _, entry := range entries {
+		d.add(entry)
+	}
+	d.addPosition(primitive.Timestamp{T: 1235})
+	d.close()
+
+	// The position marker is emitted after every entry queued before it
+	require.Len(t, got, len(entries)+1)
+	require.Equal(t, primitive.Timestamp{T: 1235}, got[len(entries)])
+}
+
+// countingOplog stands in for the oplog cursor, and counts the entries and
+// bytes read from it
+type countingOplog struct {
+	entries []bson.Raw
+
+	reads int64
+	bytes int64
+}
+
+// read passes every entry of the oplog to f, the way a cursor over the whole
+// oplog would
+func (o *countingOplog) read(f func(entry bson.Raw)) {
+	for _, entry := range o.entries {
+		atomic.AddInt64(&o.reads, 1)
+		atomic.AddInt64(&o.bytes, int64(len(entry)))
+		f(entry)
+	}
+}
+
+// tailOneReaderPerShard tails the way oplogtoredis did before the decoder: a
+// reader per write shard, each reading and processing the whole oplog, and
+// discarding the publications of the other shards. Returns the number of
+// publications kept.
+func tailOneReaderPerShard(oplog *countingOplog, shards int) int64 {
+	var published int64
+	var wg sync.WaitGroup
+	for ordinal := 0; ordinal < shards; ordinal++ {
+		wg.Add(1)
+		go func(ordinal int) {
+			defer wg.Done()
+
+			tailer := &Tailer{Denylist: &sync.Map{}}
+			oplog.read(func(entry bson.Raw) {
+				_, pubs, _ := tailer.processEntry(entry)
+				for _, pub := range pubs {
+					if assignToShard(pub.ParallelismKey, shards) == ordinal {
+						atomic.AddInt64(&published, 1)
+					}
+				}
+			})
+		}(ordinal)
+	}
+	wg.Wait()
+
+	return published
+}
+
+// tailSingleReader tails the way oplogtoredis does now: a single reader, with
+// the entries decoded on a worker per write shard. Returns the number of
+// publications.
+func tailSingleReader(oplog *countingOplog, shards int) int64 {
+	var published int64
+	tailer := &Tailer{Denylist: &sync.Map{}}
+	d := tailer.startDecoder(shards, func(decoded *decodedEntry) {
+		_, pubs, _ := tailer.finishEntry(decoded)
+		published += int64(len(pubs))
+	})
+	oplog.read(d.add)
+	d.close()
+
+	return published
+}
+
+func TestOplogReadsPerShard(t *testing.T) {
+	require.NoError(t, config.ParseEnv())
+
+	entries, err := testOplogEntries(1000, 16, 10)
+	require.NoError(t, err)
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		before := &countingOplog{entries: entries}
+		require.EqualValues(t, len(entries), tailOneReaderPerShard(before, shards))
+
+		after := &countingOplog{entries: entries}
+		require.EqualValues(t, len(entries), tailSingleReader(after, shards))
+
+		require.EqualValues(t, shards*len(entries), before.reads, "shards=%d", shards)
+		require.EqualValues(t, len(entries), after.reads, "shards=%d", shards)
+		require.Equal(t, int64(shards)*after.bytes, before.bytes, "shards=%d", shards)
+	}
+}
+
+// BenchmarkTail compares the two ways of tailing with N write shards: a
+// reader per shard that each read the whole oplog (the old design), and a
+// single reader that decodes entries on N workers. Besides the time, it
+// reports the oplog entries and bytes read per run, which is what Mongo has
+// to send us.
+func BenchmarkTail(b *testing.B) {
+	if err := config.ParseEnv(); err != nil {
+		b.Fatal(err)
+	}
+
+	entries, err := testOplogEntries(10000, 16, 200)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	designs := []struct {
+		name string
+		tail func(oplog *countingOplog, shards int) int64
+	}{
+		{"one-reader-per-shard", tailOneReaderPerShard},
+		{"single-reader", tailSingleReader},
+	}
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		for _, design := range designs {
+			b.Run(fmt.Sprintf("shards=%d/%s", shards, design.name), func(b *testing.B) {
+				oplog := &countingOplog{entries: entries}
+				for n := 0; n < b.N; n++ {
+					if published := design.tail(oplog, shards); published != int64(len(entries)) {
+						b.Fatalf("Published %d entries, expected %d", published, len(entries))
+					}
+				}
+
+				b.ReportMetric(float64(oplog.reads)/float64(b.N), "oplog-entries/op")
+				b.ReportMetric(float64(oplog.bytes)/float64(b.N), "oplog-bytes/op")
+			})
+		}
+	}
+}
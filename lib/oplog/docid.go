@@ -0,0 +1,211 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// encodeDocID converts a document _id (as returned by parseID) into the
+// suffix of the document-specific channel ("<db>.<collection>::<suffix>"),
+// and into the value we send as `d._id` in the message. The message value is
+// encoded the way Meteor's EJSON encodes the same value, so that redis-oplog
+// can decode it and look the document up by _id:
+//
+//   - strings: the string itself
+//   - ObjectIDs: {"$type": "oid", "$value": "<hex>"}, on channel "<hex>"
+//   - numbers: a JSON number (or {"$InfNaN": <sign>} for infinities and NaN),
+//     on a channel named the way Javascript formats the number
+//   - binary data: {"$binary": "<base64>"}, on a channel named by the UUID's
+//     canonical form for UUIDs, or the base64 for other binary data
+//   - dates: {"$date": <milliseconds since the epoch>}
+//   - decimals: {"$type": "Decimal", "$value": "<decimal>"}, on a channel
+//     named by the decimal
+//   - documents: a JSON object of the EJSON encodings of the fields, in their
+//     original order
+//
+// Values without a dedicated channel name (dates, documents, booleans, and
+// null) use the JSON of their EJSON encoding as the channel suffix.
+func encodeDocID(id interface{}) (channel string, ejson interface{}, err error) {
+	ejson, err = docIDToEJSON(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch id := id.(type) {
+	case string:
+		return id, ejson, nil
+
+	case primitive.ObjectID:
+		return id.Hex(), ejson, nil
+
+	case int32:
+		return strconv.FormatInt(int64(id), 10), ejson, nil
+
+	case int64:
+		return strconv.FormatInt(id, 10), ejson, nil
+
+	case int:
+		return strconv.Itoa(id), ejson, nil
+
+	case float64:
+		return formatJSNumber(id), ejson, nil
+
+	case primitive.Binary:
+		if uuid, ok := formatUUID(id); ok {
+			return uuid, ejson, nil
+		}
+		return base64.StdEncoding.EncodeToString(id.Data), ejson, nil
+
+	case primitive.Decimal128:
+		return id.String(), ejson, nil
+	}
+
+	channelJSON, err := json.Marshal(ejson)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "marshalling _id for channel name")
+	}
+
+	return string(channelJSON), ejson, nil
+}
+
+// docIDToEJSON converts a document _id (or a field of a document _id) into a
+// value that encodes to its Meteor EJSON representation when marshalled to
+// JSON
+func docIDToEJSON(id interface{}) (interface{}, error) {
+	switch id := id.(type) {
+	case string, bool, int32, int64, int, nil:
+		return id, nil
+
+	case float64:
+		if math.IsNaN(id) {
+			return map[string]int{"$InfNaN": 0}, nil
+		} else if math.IsInf(id, 1) {
+			return map[string]int{"$InfNaN": 1}, nil
+		} else if math.IsInf(id, -1) {
+			return map[string]int{"$InfNaN": -1}, nil
+		}
+		return id, nil
+
+	case primitive.ObjectID:
+		return map[string]string{
+			"$type":  "oid",
+			"$value": id.Hex(),
+		}, nil
+
+	case primitive.Binary:
+		return map[string]string{
+			"$binary": base64.StdEncoding.EncodeToString(id.Data),
+		}, nil
+
+	case primitive.DateTime:
+		return map[string]int64{"$date": int64(id)}, nil
+
+	case primitive.Decimal128:
+		return map[string]string{
+			"$type":  "Decimal",
+			"$value": id.String(),
+		}, nil
+
+	case primitive.D:
+		doc := make(ejsonDocument, 0, len(id))
+		for _, elem := range id {
+			value, err := docIDToEJSON(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: elem.Key, Value: value})
+		}
+		return doc, nil
+
+	case primitive.A:
+		arr := make([]interface{}, 0, len(id))
+		for _, elem := range id {
+			value, err := docIDToEJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		return arr, nil
+
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedDocIDType, "%T can't be encoded as EJSON", id)
+	}
+}
+
+// ejsonDocument is a document whose fields have already been converted with
+// docIDToEJSON. It marshals to a JSON object with the fields in their original
+// order, since Mongo only matches embedded documents with the same field order.
+type ejsonDocument []bson.E
+
+func (doc ejsonDocument) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, elem := range doc {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(elem.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// formatJSNumber formats a number the way Javascript's String(number) does
+func formatJSNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		// String(-0) is "0"
+		return "0"
+	}
+
+	abs := math.Abs(f)
+	if abs >= 1e21 || abs < 1e-6 {
+		// Exponential notation, e.g. 1e+21 or 1.5e-7
+		formatted := strconv.FormatFloat(f, 'e', -1, 64)
+		parts := strings.SplitN(formatted, "e", 2)
+		sign, exponent := parts[1][:1], strings.TrimLeft(parts[1][1:], "0")
+		return parts[0] + "e" + sign + exponent
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatUUID formats binary data of the UUID subtypes in the canonical UUID
+// form (8-4-4-4-12 hex digits)
+func formatUUID(b primitive.Binary) (string, bool) {
+	if (b.Subtype != bson.TypeBinaryUUID && b.Subtype != bson.TypeBinaryUUIDOld) || len(b.Data) != 16 {
+		return "", false
+	}
+
+	h := hex.EncodeToString(b.Data)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], true
+}
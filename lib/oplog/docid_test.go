@@ -0,0 +1,149 @@
+package oplog
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEncodeDocID(t *testing.T) {
+	objectID, err := primitive.ObjectIDFromHex("deadbeefdeadbeefdeadbeef")
+	require.NoError(t, err)
+
+	uuid := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+	decimal, err := primitive.ParseDecimal128("1.50")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		id          interface{}
+		wantChannel string
+		wantJSON    string
+	}{
+		"String": {
+			id:          "someid",
+			wantChannel: "someid",
+			wantJSON:    `"someid"`,
+		},
+		"ObjectID": {
+			id:          objectID,
+			wantChannel: "deadbeefdeadbeefdeadbeef",
+			wantJSON:    `{"$type":"oid","$value":"deadbeefdeadbeefdeadbeef"}`,
+		},
+		"Int32": {
+			id:          int32(-12),
+			wantChannel: "-12",
+			wantJSON:    `-12`,
+		},
+		"Int64": {
+			id:          int64(1234567890123),
+			wantChannel: "1234567890123",
+			wantJSON:    `1234567890123`,
+		},
+		"Double": {
+			id:          1.5,
+			wantChannel: "1.5",
+			wantJSON:    `1.5`,
+		},
+		"Integral double": {
+			id:          float64(12),
+			wantChannel: "12",
+			wantJSON:    `12`,
+		},
+		"Large double": {
+			id:          1e21,
+			wantChannel: "1e+21",
+			wantJSON:    `1e+21`,
+		},
+		"Small double": {
+			id:          1.5e-7,
+			wantChannel: "1.5e-7",
+			wantJSON:    `1.5e-7`,
+		},
+		"NaN": {
+			id:          math.NaN(),
+			wantChannel: "NaN",
+			wantJSON:    `{"$InfNaN":0}`,
+		},
+		"Infinity": {
+			id:          math.Inf(-1),
+			wantChannel: "-Infinity",
+			wantJSON:    `{"$InfNaN":-1}`,
+		},
+		"UUID": {
+			id:          primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: uuid},
+			wantChannel: "12345678-9abc-def0-1234-56789abcdef0",
+			wantJSON:    `{"$binary":"EjRWeJq83vASNFZ4mrze8A=="}`,
+		},
+		"Legacy UUID": {
+			id:          primitive.Binary{Subtype: bson.TypeBinaryUUIDOld, Data: uuid},
+			wantChannel: "12345678-9abc-def0-1234-56789abcdef0",
+			wantJSON:    `{"$binary":"EjRWeJq83vASNFZ4mrze8A=="}`,
+		},
+		"Binary": {
+			id:          primitive.Binary{Subtype: bson.TypeBinaryGeneric, Data: []byte("test")},
+			wantChannel: "dGVzdA==",
+			wantJSON:    `{"$binary":"dGVzdA=="}`,
+		},
+		"Date": {
+			id:          primitive.NewDateTimeFromTime(time.Unix(1234, 0)),
+			wantChannel: `{"$date":1234000}`,
+			wantJSON:    `{"$date":1234000}`,
+		},
+		"Decimal": {
+			id:          decimal,
+			wantChannel: "1.50",
+			wantJSON:    `{"$type":"Decimal","$value":"1.50"}`,
+		},
+		"Boolean": {
+			id:          true,
+			wantChannel: "true",
+			wantJSON:    `true`,
+		},
+		"Document": {
+			id:          bson.D{{Key: "z", Value: int32(1)}, {Key: "a", Value: objectID}},
+			wantChannel: `{"z":1,"a":{"$type":"oid","$value":"deadbeefdeadbeefdeadbeef"}}`,
+			wantJSON:    `{"z":1,"a":{"$type":"oid","$value":"deadbeefdeadbeefdeadbeef"}}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Round-trip the _id through BSON, so that we test the types parseID
+			// actually produces
+			raw, err := bson.Marshal(bson.D{{Key: "_id", Value: test.id}})
+			require.NoError(t, err)
+			id, err := parseID(bson.Raw(raw).Lookup("_id"))
+			require.NoError(t, err)
+
+			channel, ejson, err := encodeDocID(id)
+			require.NoError(t, err)
+			require.Equal(t, test.wantChannel, channel)
+
+			encoded, err := json.Marshal(ejson)
+			require.NoError(t, err)
+			require.Equal(t, test.wantJSON, string(encoded))
+
+			// The same _id always gets the same channel
+			channelAgain, _, err := encodeDocID(id)
+			require.NoError(t, err)
+			require.Equal(t, channel, channelAgain)
+		})
+	}
+}
+
+func TestEncodeDocIDUnsupported(t *testing.T) {
+	for _, id := range []interface{}{
+		primitive.Timestamp{T: 1234},
+		primitive.MinKey{},
+		primitive.JavaScript("function() {}"),
+		bson.D{{Key: "ts", Value: primitive.Timestamp{T: 1234}}},
+	} {
+		_, _, err := encodeDocID(id)
+		require.ErrorIs(t, err, ErrUnsupportedDocIDType, "%T", id)
+	}
+}
@@ -0,0 +1,97 @@
+package oplog
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+var metricHeartbeats = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "heartbeats",
+	Help:      "Number of times the position of the oplog was sent to every write shard as a heartbeat",
+})
+
+// sendHeartbeats sends the position of the entry we just read to every write
+// shard, at most once per HeartbeatInterval, so that their checkpoints keep up
+// with the oplog even when its entries are filtered out or don't produce
+// publications for them. It must be called after the entry's publications are
+// sent, so that each shard receives the heartbeat after them.
+//
+// Entries that the oplog query filters out (denylisted databases, system
+// collections, and so on) never reach us, so while the cursor only skips over
+// those, the position comes from sampleIdlePosition instead.
+func (tailer *Tailer) sendHeartbeats(ts primitive.Timestamp, resumeToken string, out []PublisherBuffers) {
+	if tailer.HeartbeatInterval <= 0 || ts.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(tailer.lastHeartbeat) < tailer.HeartbeatInterval {
+		return
+	}
+	tailer.lastHeartbeat = now
+
+	for i, buffers := range out {
+		if len(tailer.resumePositions) == len(out) && !tailer.resumePositions[i].Before(ts) {
+			// The shard's checkpoint is still ahead of this position (see
+			// dropPublished), and must not move backwards
+			continue
+		}
+
+		pub := &redispub.Publication{
+			OplogTimestamp: ts,
+			WallTime:       time.Unix(int64(ts.T), 0),
+			ResumeToken:    resumeToken,
+			ParallelismKey: i,
+			Heartbeat:      true,
+		}
+		for _, buffer := range buffers {
+			buffer.Send(pub)
+		}
+	}
+	metricHeartbeats.Inc()
+}
+
+// sampleIdlePosition returns the timestamp of the newest entry in the oplog,
+// or a zero timestamp if heartbeats are disabled or it can't be read. It's
+// called before reading from a cursor that last returned nothing: if that
+// read then times out without a result, every entry up to the sampled
+// timestamp was filtered out by the query.
+//
+// That only holds if the sample and the cursor read the same member's oplog,
+// with the same oplog visibility, so we only sample with a primary read
+// preference (see idleSamplingSupported). With other read preferences, the
+// sample could come from a member that's further ahead than the cursor's, and
+// we'd skip the entries the cursor hadn't returned yet.
+func (tailer *Tailer) sampleIdlePosition(oplogCollection *mongo.Collection) primitive.Timestamp {
+	if tailer.HeartbeatInterval <= 0 || !idleSamplingSupported(oplogCollection.Database().ReadPreference()) {
+		return primitive.Timestamp{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	ts, err := newestOplogTimestamp(ctx, oplogCollection)
+	if err != nil {
+		log.Log.Warnw("Failed to read the end of the oplog for a heartbeat", "error", err)
+		return primitive.Timestamp{}
+	}
+
+	return ts
+}
+
+// idleSamplingSupported returns whether reads with readPref are guaranteed to
+// go to the same member as the oplog cursor: the primary
+func idleSamplingSupported(readPref *readpref.ReadPref) bool {
+	return readPref == nil || readPref.Mode() == readpref.PrimaryMode
+}
@@ -0,0 +1,52 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestSendHeartbeats(t *testing.T) {
+	out := make([]PublisherBuffers, 2)
+	for i := range out {
+		buffer, err := redispub.NewBuffer(redispub.BufferOpts{Size: 10, OverflowPolicy: config.BufferOverflowBlock})
+		require.NoError(t, err)
+		defer buffer.Close()
+		out[i] = PublisherBuffers{buffer}
+	}
+
+	tailer := &Tailer{HeartbeatInterval: time.Hour}
+
+	tailer.sendHeartbeats(primitive.Timestamp{T: 100}, "", out)
+	for i := range out {
+		require.Equal(t, 1, out[i][0].Len())
+		pub := <-out[i][0].Out()
+		require.True(t, pub.Heartbeat)
+		require.Equal(t, primitive.Timestamp{T: 100}, pub.OplogTimestamp)
+	}
+
+	// At most one heartbeat per interval
+	tailer.sendHeartbeats(primitive.Timestamp{T: 101}, "", out)
+	require.Equal(t, 0, out[0][0].Len())
+
+	// Shards that are still ahead of the position don't get one
+	tailer.lastHeartbeat = time.Time{}
+	tailer.resumePositions = []primitive.Timestamp{{T: 90}, {T: 110}}
+	tailer.sendHeartbeats(primitive.Timestamp{T: 102}, "", out)
+	require.Equal(t, 1, out[0][0].Len())
+	require.Equal(t, 0, out[1][0].Len())
+}
+
+func TestIdleSamplingSupported(t *testing.T) {
+	require.True(t, idleSamplingSupported(nil))
+	require.True(t, idleSamplingSupported(readpref.Primary()))
+	require.False(t, idleSamplingSupported(readpref.PrimaryPreferred()))
+	require.False(t, idleSamplingSupported(readpref.Secondary()))
+	require.False(t, idleSamplingSupported(readpref.SecondaryPreferred()))
+	require.False(t, idleSamplingSupported(readpref.Nearest()))
+}
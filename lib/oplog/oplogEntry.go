@@ -36,6 +36,11 @@ type oplogEntry struct {
 	Database   string
 	Collection string
 
+	// ResyncReason is set for entries that affect a whole collection rather
+	// than a single document (see parseDDLEntry and parseBucketEntry). A resync
+	// message with this reason is published for them.
+	ResyncReason string
+
 	TxIdx uint
 }
 
@@ -54,6 +59,12 @@ func (op *oplogEntry) IsRemove() bool {
 	return op.Operation == operationRemove
 }
 
+// Returns whether this oplogEntry affects a whole collection, and should be
+// published as a resync message
+func (op *oplogEntry) IsResync() bool {
+	return op.ResyncReason != ""
+}
+
 // Returns whether this is an oplog update format v2 update (new in MongoDB 5.0)
 func (op *oplogEntry) IsV2Update() bool {
 	dataVersionRaw := op.Data.Lookup("$v")
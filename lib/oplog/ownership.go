@@ -0,0 +1,52 @@
+package oplog
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ownsShard returns whether we publish the write shard ordinal (see
+// Tailer.OwnedShards)
+func (tailer *Tailer) ownsShard(ordinal int) bool {
+	if tailer.OwnedShards == nil {
+		return true
+	}
+	for _, owned := range tailer.OwnedShards {
+		if owned == ordinal {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsDatabase returns whether we publish the write shard that the
+// publications for database are routed to. Every publication for a database
+// goes to the same write shard (see parallelismKey).
+func (tailer *Tailer) ownsDatabase(database string) bool {
+	if tailer.OwnedShards == nil || tailer.writeShards == 0 {
+		return true
+	}
+	return tailer.ownsShard(assignToShard(parallelismKey(database), tailer.writeShards))
+}
+
+// earliestPosition returns the earliest of the positions of the write shards
+// we publish. The other shards' positions don't matter to us, since their
+// owners resume from them.
+func (tailer *Tailer) earliestPosition(positions []primitive.Timestamp) primitive.Timestamp {
+	var earliest primitive.Timestamp
+	found := false
+	for ordinal, position := range positions {
+		if !tailer.ownsShard(ordinal) {
+			continue
+		}
+		if !found || position.Before(earliest) {
+			earliest = position
+			found = true
+		}
+	}
+
+	if !found {
+		// We don't own any of them, so it doesn't matter where we start
+		return positions[0]
+	}
+	return earliest
+}
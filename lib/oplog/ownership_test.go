@@ -0,0 +1,48 @@
+package oplog
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEarliestPosition(t *testing.T) {
+	positions := []primitive.Timestamp{{T: 100}, {T: 90}, {T: 110}}
+
+	tailer := &Tailer{}
+	require.Equal(t, primitive.Timestamp{T: 90}, tailer.earliestPosition(positions))
+
+	// Shard 1's owner resumes from its checkpoint, so it doesn't hold us back
+	tailer.OwnedShards = []int{0, 2}
+	require.Equal(t, primitive.Timestamp{T: 100}, tailer.earliestPosition(positions))
+
+	tailer.OwnedShards = []int{}
+	require.Equal(t, primitive.Timestamp{T: 100}, tailer.earliestPosition(positions))
+}
+
+func TestDecodeEntryOwnedShards(t *testing.T) {
+	entries, err := testOplogEntries(8, 8, 10)
+	require.NoError(t, err)
+
+	// Every publication for a database goes to the same write shard, so only
+	// the entries for the databases of our shard are decoded
+	tailer := &Tailer{Denylist: &sync.Map{}, OwnedShards: []int{1}, writeShards: 3}
+	decoded := 0
+	for _, entry := range entries {
+		_, pubs, _ := tailer.processEntry(entry)
+		for _, pub := range pubs {
+			require.Equal(t, 1, assignToShard(pub.ParallelismKey, 3))
+		}
+		decoded += len(pubs)
+	}
+	require.NotZero(t, decoded)
+	require.Less(t, decoded, len(entries))
+
+	tailer.OwnedShards = nil
+	for _, entry := range entries {
+		_, pubs, _ := tailer.processEntry(entry)
+		require.Len(t, pubs, 1)
+	}
+}
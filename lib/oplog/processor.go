@@ -10,7 +10,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/tulip/oplogtoredis/lib/log"
 	"github.com/tulip/oplogtoredis/lib/redispub"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var ErrUnsupportedDocIDType = errors.New("unsupported document _id type")
@@ -42,27 +41,15 @@ func processOplogEntry(op *oplogEntry) (*redispub.Publication, error) {
 		return nil, nil
 	}
 
-	var idForChannel string
-	var idForMessage interface{}
-
-	switch id := op.DocID.(type) {
-	case string:
-		idForChannel = id
-		idForMessage = id
-
-	case primitive.ObjectID:
-		idHex := id.Hex()
-		idForChannel = idHex
-		idForMessage = map[string]string{
-			"$type":  "oid",
-			"$value": idHex,
-		}
-
-	default:
-		// We don't know how to handle IDs that aren't strings or ObjectIDs,
-		// because we don't what what the specific channel (the channel for
-		// this specific document) should be.
-		return nil, errors.Wrapf(ErrUnsupportedDocIDType, "expected string or ObjectID, got %T instead", op.DocID)
+	if op.IsResync() {
+		return processResyncEntry(op), nil
+	}
+
+	idForChannel, idForMessage, err := encodeDocID(op.DocID)
+	if err != nil {
+		// We don't know how to handle this _id, because we don't know what the
+		// specific channel (the channel for this specific document) should be.
+		return nil, err
 	}
 
 	changedFields, errCF := op.ChangedFields()
@@ -86,16 +73,6 @@ func processOplogEntry(op *oplogEntry) (*redispub.Publication, error) {
 		return nil, errors.Wrap(err, "marshalling outgoing message")
 	}
 
-	hash := sha256.Sum256([]byte(op.Database))
-	intSlice := hash[len(hash)-8:]
-
-	var hashInt uint64
-
-	err = binary.Read(bytes.NewReader(intSlice), binary.LittleEndian, &hashInt)
-	if err != nil {
-		panic(errors.Wrap(err, "decoding database hash as uint64"))
-	}
-
 	// We need to publish on both the full-collection channel and the
 	// single-document channel
 	return &redispub.Publication{
@@ -112,10 +89,45 @@ func processOplogEntry(op *oplogEntry) (*redispub.Publication, error) {
 		WallTime:       op.WallTime,
 
 		TxIdx:          op.TxIdx,
-		ParallelismKey: int(hashInt),
+		ParallelismKey: parallelismKey(op.Database),
 	}, nil
 }
 
+// processResyncEntry generates the publication for an entry that affects a
+// whole collection: a resync message on the collection's channel. There's no
+// document-specific channel, since every document may have been affected.
+func processResyncEntry(op *oplogEntry) *redispub.Publication {
+	msg := redispub.ResyncMessage(op.ResyncReason)
+	log.Log.Debugw("Sending outgoing message", "message", string(msg))
+
+	return &redispub.Publication{
+		Channels:       []string{op.Namespace},
+		Msg:            msg,
+		OplogTimestamp: op.Timestamp,
+		WallTime:       op.WallTime,
+
+		TxIdx:          op.TxIdx,
+		ParallelismKey: parallelismKey(op.Database),
+	}
+}
+
+// parallelismKey is a hash of the database name. All the publications for a
+// database are written by the same write loop, since a single database is the
+// unit of ordering guarantee.
+func parallelismKey(database string) int {
+	hash := sha256.Sum256([]byte(database))
+	intSlice := hash[len(hash)-8:]
+
+	var hashInt uint64
+
+	err := binary.Read(bytes.NewReader(intSlice), binary.LittleEndian, &hashInt)
+	if err != nil {
+		panic(errors.Wrap(err, "decoding database hash as uint64"))
+	}
+
+	return int(hashInt)
+}
+
 func eventNameForOperation(op *oplogEntry) string {
 	if op.Operation == "d" {
 		return "r"
@@ -197,7 +197,7 @@ func TestProcessOplogEntry(t *testing.T) {
 		},
 		"Unsupported id type": {
 			in: &oplogEntry{
-				DocID:      1234,
+				DocID:      primitive.Timestamp{T: 1234},
 				Operation:  "i",
 				Namespace:  "foo.bar",
 				Database:   "foo",
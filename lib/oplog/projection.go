@@ -0,0 +1,143 @@
+package oplog
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// originalSizeField is the field the projection adds to each oplog entry with
+// the size of the entry before projection
+const originalSizeField = "otrOriginalSize"
+
+var (
+	metricProjectionBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "projection_bytes_saved",
+		Help:      "Bytes of oplog entries that Mongo didn't have to send us because of the oplog query projection",
+	})
+
+	metricProjectionFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "projection_fallbacks",
+		Help:      "Number of times the oplog query projection failed and we fell back to querying full oplog entries",
+	})
+)
+
+// oplogProjection is the projection we use for the oplog query when
+// OTR_OPLOG_PROJECTION is set. It keeps every top-level field we read from an
+// oplog entry, but replaces the values of `o` with null (except for `_id`) for
+// inserts and replacement updates. ChangedFields only needs the top-level keys
+// of those documents, and parseID only needs the _id.
+//
+// Updates that aren't replacements (any update whose `o` has a top-level key
+// starting with `$`, like $set or $v) are left alone, since we need their
+// contents to determine the changed fields. Inserts inside of transactions
+// aren't stripped either, since they're nested inside an applyOps array, and
+// neither are writes to time-series buckets, since parseBucketEntry needs the
+// measurement _ids from the bucket's data.
+var oplogProjection = bson.M{
+	"ts":   1,
+	"wall": 1,
+	"op":   1,
+	"ns":   1,
+	"o2":   1,
+	"t":    1,
+	"h":    1,
+
+	"fromMigrate": 1,
+	"lsid":        1,
+	"txnNumber":   1,
+	"prevOpTime":  1,
+
+	"o": bson.M{
+		"$cond": bson.M{
+			"if": bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{bson.M{"$indexOfBytes": bson.A{"$ns", "." + bucketsPrefix}}, -1}},
+				bson.M{"$or": bson.A{
+					bson.M{"$eq": bson.A{"$op", operationInsert}},
+					bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$op", operationUpdate}},
+						bson.M{"$eq": bson.A{
+							bson.M{"$size": bson.M{"$filter": bson.M{
+								"input": bson.M{"$objectToArray": "$o"},
+								"cond":  bson.M{"$eq": bson.A{bson.M{"$substrBytes": bson.A{"$$this.k", 0, 1}}, "$"}},
+							}}},
+							0,
+						}},
+					}},
+				}},
+			}},
+			"then": bson.M{"$arrayToObject": bson.M{"$map": bson.M{
+				"input": bson.M{"$objectToArray": "$o"},
+				"in": bson.M{
+					"k": "$$this.k",
+					"v": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$$this.k", "_id"}}, "$$this.v", nil}},
+				},
+			}}},
+			"else": "$o",
+		},
+	},
+	originalSizeField: bson.M{"$bsonSize": "$$ROOT"},
+}
+
+// projecting returns whether the oplog query should use oplogProjection
+func (tailer *Tailer) projecting() bool {
+	return config.OplogProjection() && !tailer.projectionUnsupported
+}
+
+// disableProjectionOnError checks whether err is an error returned by the
+// Mongo server because it can't evaluate oplogProjection (e.g. because it's
+// older than MongoDB 4.4). If so, we disable the projection for the lifetime
+// of this Tailer. Returns whether the projection was disabled.
+func (tailer *Tailer) disableProjectionOnError(err error) bool {
+	if err == nil || !tailer.projecting() {
+		return false
+	}
+
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		// Network errors and timeouts have nothing to do with the projection
+		return false
+	}
+
+	// 168 : InvalidPipelineOperator, for an expression the server doesn't
+	//       know (like $bsonSize before 4.4)
+	// 9   : FailedToParse, and
+	// 2   : BadValue, for a projection the server can't parse (servers before
+	//       4.4 don't accept expressions in find projections at all)
+	//
+	// Any other error (like a stepdown or an authorization failure) has
+	// nothing to do with the projection.
+	if !serverErr.HasErrorCode(168) &&
+		!serverErr.HasErrorCodeWithMessage(9, "projection") &&
+		!serverErr.HasErrorCodeWithMessage(2, "projection") {
+		return false
+	}
+
+	log.Log.Warnw("Oplog query projection failed; falling back to querying full oplog entries",
+		"error", err)
+	metricProjectionFallbacks.Inc()
+	tailer.projectionUnsupported = true
+	return true
+}
+
+// reportProjectionSavings records how many bytes the projection saved us for
+// a single oplog entry, if the entry was projected.
+func reportProjectionSavings(rawData bson.Raw) {
+	originalSize, ok := rawData.Lookup(originalSizeField).AsInt64OK()
+	if !ok {
+		return
+	}
+
+	if saved := originalSize - int64(len(rawData)); saved > 0 {
+		metricProjectionBytesSaved.Add(float64(saved))
+	}
+}
@@ -0,0 +1,72 @@
+package oplog
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+)
+
+func TestDisableProjectionOnError(t *testing.T) {
+	t.Setenv("OTR_OPLOG_PROJECTION", "true")
+	require.NoError(t, config.ParseEnv())
+
+	tailer := &Tailer{}
+	require.True(t, tailer.projecting())
+
+	require.False(t, tailer.disableProjectionOnError(nil))
+	require.False(t, tailer.disableProjectionOnError(errors.New("connection reset by peer")))
+	require.True(t, tailer.projecting())
+
+	// Server errors that aren't about the projection don't disable it
+	require.False(t, tailer.disableProjectionOnError(mongo.CommandError{
+		Code:    189,
+		Message: "Primary stepped down while waiting for replication",
+	}))
+	require.False(t, tailer.disableProjectionOnError(mongo.CommandError{
+		Code:    9,
+		Message: "Failed to parse: filter",
+	}))
+	require.True(t, tailer.projecting())
+
+	require.True(t, tailer.disableProjectionOnError(mongo.CommandError{
+		Code:    168,
+		Message: "Unrecognized expression '$bsonSize'",
+	}))
+	require.False(t, tailer.projecting())
+
+	// So does a projection the server can't parse
+	tailer = &Tailer{}
+	require.True(t, tailer.disableProjectionOnError(mongo.CommandError{
+		Code:    2,
+		Message: "Unsupported projection option: o: { $cond: { ... } }",
+	}))
+	require.False(t, tailer.projecting())
+
+	// Once disabled, we don't report any more fallbacks
+	require.False(t, tailer.disableProjectionOnError(mongo.CommandError{Code: 168}))
+}
+
+func TestProjectingDisabledByConfig(t *testing.T) {
+	t.Setenv("OTR_OPLOG_PROJECTION", "false")
+	require.NoError(t, config.ParseEnv())
+
+	require.False(t, (&Tailer{}).projecting())
+}
+
+func TestReportProjectionSavings(t *testing.T) {
+	before := testutil.ToFloat64(metricProjectionBytesSaved)
+
+	// Unprojected entries don't count
+	reportProjectionSavings(rawBson(t, bson.M{"ts": 1}))
+	require.Equal(t, before, testutil.ToFloat64(metricProjectionBytesSaved))
+
+	projected := rawBson(t, bson.M{"op": "i", originalSizeField: int32(1000)})
+	reportProjectionSavings(projected)
+	require.Equal(t, before+float64(1000-len(projected)), testutil.ToFloat64(metricProjectionBytesSaved))
+}
@@ -0,0 +1,207 @@
+package oplog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var metricReplayedEntries = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "replayed_entries",
+	Help:      "Number of oplog entries read by replays requested through the admin API",
+})
+
+// ErrReplayStopped is returned by Replay when it's stopped before reaching the
+// end of the range
+var ErrReplayStopped = errors.New("replay stopped")
+
+// ReplayRange is a range of the oplog to publish again (see Replay)
+type ReplayRange struct {
+	// From and To are the first and last positions to replay. If To is zero,
+	// the replay goes up to the end of the oplog when it starts.
+	From primitive.Timestamp
+	To   primitive.Timestamp
+
+	// Namespaces limits the replay to some databases ("db") and collections
+	// ("db.collection"). If it's empty, everything is replayed.
+	Namespaces []string
+
+	// Rate is the maximum number of entries read per second, or 0 for no limit
+	Rate float64
+}
+
+// ReplayResult is how much of the oplog a replay read and published
+type ReplayResult struct {
+	Entries      int
+	Publications int
+
+	// Last is the position of the last entry read
+	Last primitive.Timestamp
+}
+
+// ParseReplayPosition parses a position in the oplog, as either an RFC3339 time
+// or a timestamp: seconds, optionally followed by a colon and the increment
+// (like Mongo's Timestamp(seconds, increment)). A time matches every entry in
+// its second, so end selects the last of them rather than the first.
+func ParseReplayPosition(position string, end bool) (primitive.Timestamp, error) {
+	if t, err := time.Parse(time.RFC3339, position); err == nil {
+		if t.Unix() < 0 || t.Unix() > int64(^uint32(0)) {
+			return primitive.Timestamp{}, fmt.Errorf("time %q is out of range", position)
+		}
+		ts := primitive.Timestamp{T: uint32(t.Unix())}
+		if end {
+			ts.I = ^uint32(0)
+		}
+		return ts, nil
+	}
+
+	parts := strings.Split(position, ":")
+	if len(parts) > 2 {
+		return primitive.Timestamp{}, fmt.Errorf("invalid position %q: must be an RFC3339 time or seconds[:increment]", position)
+	}
+
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("invalid position %q: must be an RFC3339 time or seconds[:increment]", position)
+	}
+	ts := primitive.Timestamp{T: uint32(seconds)}
+	if len(parts) == 2 {
+		increment, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("invalid increment in position %q", position)
+		}
+		ts.I = uint32(increment)
+	} else if end {
+		ts.I = ^uint32(0)
+	}
+	return ts, nil
+}
+
+// matchesNamespaces returns whether a publication's collection is in one of
+// the namespaces of a replay
+func matchesNamespaces(pub *redispub.Publication, namespaces []string) bool {
+	if len(namespaces) == 0 {
+		return true
+	}
+	if len(pub.Channels) == 0 {
+		return false
+	}
+
+	collection := pub.Channels[0]
+	for _, namespace := range namespaces {
+		if collection == namespace || strings.HasPrefix(collection, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Replay reads a range of the oplog again and sends its publications to out,
+// the same way tailing does, at up to r.Rate entries per second. The
+// publications are marked with id (see redispub.Publication.Replay), so they
+// don't move the checkpoints, and aren't deduplicated against the ones live
+// tailing publishes. Replay uses its own query and tailer state, so live
+// tailing carries on while it runs. Returns once the whole range has been
+// sent, or when stop is closed.
+func Replay(client *mongo.Client, denylist *sync.Map, id string, r ReplayRange, out []PublisherBuffers, stop <-chan bool) (ReplayResult, error) {
+	var result ReplayResult
+	tailer := &Tailer{MongoClient: client, Denylist: denylist}
+	oplogCollection := client.Database("local").Collection("oplog.rs")
+
+	to := r.To
+	if to.IsZero() {
+		queryContext, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+		var last rawOplogEntry
+		err := oplogCollection.FindOne(queryContext, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": -1})).Decode(&last)
+		cancel()
+		if err != nil {
+			return result, errors.Wrap(err, "finding the end of the oplog")
+		}
+		to = last.Timestamp
+	}
+
+	filter := oplogQueryFilter(r.From, denylist)
+	filter["ts"] = bson.M{"$gte": r.From, "$lte": to}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cursor, err := oplogCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"$natural": 1}))
+	if err != nil {
+		return result, errors.Wrap(err, "querying the oplog")
+	}
+	defer closeCursor(cursor)
+
+	log.Log.Infow("Starting oplog replay",
+		"id", id,
+		"from", r.From,
+		"to", to,
+		"namespaces", r.Namespaces)
+
+	started := time.Now()
+	for cursor.Next(ctx) {
+		rawData := make(bson.Raw, len(cursor.Current))
+		copy(rawData, cursor.Current)
+
+		result.Entries++
+		metricReplayedEntries.Inc()
+
+		timestamp, pubs, _ := tailer.processEntry(rawData)
+		if timestamp != nil {
+			result.Last = *timestamp
+		}
+
+		var replayed []*redispub.Publication
+		for _, pub := range pubs {
+			if matchesNamespaces(pub, r.Namespaces) {
+				pub.Replay = id
+				replayed = append(replayed, pub)
+			}
+		}
+		sendPublications(replayed, nil, out)
+		result.Publications += len(replayed)
+
+		if r.Rate > 0 {
+			allowed := time.Duration(float64(result.Entries) / r.Rate * float64(time.Second))
+			if !sleepUnlessStopped(allowed-time.Since(started), stop) {
+				return result, ErrReplayStopped
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrReplayStopped
+		}
+		return result, errors.Wrap(err, "reading the oplog")
+	}
+
+	log.Log.Infow("Finished oplog replay",
+		"id", id,
+		"entries", result.Entries,
+		"publications", result.Publications)
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseReplayPosition(t *testing.T) {
+	tests := map[string]struct {
+		position string
+		end      bool
+		want     primitive.Timestamp
+		wantErr  bool
+	}{
+		"Time": {
+			position: "2023-11-14T22:13:20Z",
+			want:     primitive.Timestamp{T: 1700000000},
+		},
+		"Time as the end": {
+			position: "2023-11-14T23:13:20+01:00",
+			end:      true,
+			want:     primitive.Timestamp{T: 1700000000, I: ^uint32(0)},
+		},
+		"Seconds": {
+			position: "1700000000",
+			want:     primitive.Timestamp{T: 1700000000},
+		},
+		"Seconds as the end": {
+			position: "1700000000",
+			end:      true,
+			want:     primitive.Timestamp{T: 1700000000, I: ^uint32(0)},
+		},
+		"Seconds and increment": {
+			position: "1700000000:5",
+			end:      true,
+			want:     primitive.Timestamp{T: 1700000000, I: 5},
+		},
+		"Invalid": {
+			position: "yesterday",
+			wantErr:  true,
+		},
+		"Invalid increment": {
+			position: "1700000000:x",
+			wantErr:  true,
+		},
+		"Before 1970": {
+			position: "1960-01-01T00:00:00Z",
+			wantErr:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseReplayPosition(test.position, test.end)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMatchesNamespaces(t *testing.T) {
+	pub := &redispub.Publication{Channels: []string{"db.Foo", "db.Foo::1"}}
+
+	require.True(t, matchesNamespaces(pub, nil))
+	require.True(t, matchesNamespaces(pub, []string{"db"}))
+	require.True(t, matchesNamespaces(pub, []string{"other", "db.Foo"}))
+	require.False(t, matchesNamespaces(pub, []string{"db.Fo"}))
+	require.False(t, matchesNamespaces(pub, []string{"d"}))
+	require.False(t, matchesNamespaces(pub, []string{"db.Foo.bar"}))
+}
@@ -0,0 +1,276 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+var metricReplicationLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "replication_lag_seconds",
+	Help:      "Gauge indicating how far the members we may be tailing are behind the primary, in seconds (the furthest behind of them)",
+}, []string{"replica_set"})
+
+// Error codes of replSetGetStatus that mean we'll never be able to measure
+// replication lag, so there's no point in retrying
+const (
+	errCodeUnauthorized         = 13
+	errCodeNoReplicationEnabled = 76
+)
+
+// errNoPrimary is returned by replicationLag when the replica set status
+// doesn't include a primary (for example, during an election)
+var errNoPrimary = errors.New("replica set status has no primary")
+
+// MonitorReplicationLag periodically measures how far the replica set members
+// that client's read preference can select are behind the primary, and
+// reports the largest lag in the otr_oplog_replication_lag_seconds metric.
+// The tailer uses the same read preference, so it's reading from one of them.
+//
+// Measuring the lag requires the replSetGetStatus and replSetGetConfig
+// privileges (e.g. from the clusterMonitor role). If the user doesn't have it, or the deployment isn't a
+// replica set, we log it once and stop.
+func MonitorReplicationLag(client *mongo.Client, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replicaSet := ""
+	defer func() {
+		if replicaSet != "" {
+			metricReplicationLag.DeleteLabelValues(replicaSet)
+		}
+	}()
+
+	for {
+		newReplicaSet, lag, err := measureReplicationLag(client)
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == errCodeUnauthorized || cmdErr.Code == errCodeNoReplicationEnabled) {
+			log.Log.Warnw("Can't get the replica set status; replication lag won't be reported",
+				"error", err)
+			return
+		} else if errors.Is(err, errNoPrimary) {
+			log.Log.Debugw("No primary to measure replication lag against")
+		} else if err != nil {
+			log.Log.Errorw("Error measuring replication lag",
+				"error", err)
+		} else {
+			if replicaSet != "" && replicaSet != newReplicaSet {
+				metricReplicationLag.DeleteLabelValues(replicaSet)
+			}
+			replicaSet = newReplicaSet
+			metricReplicationLag.WithLabelValues(replicaSet).Set(lag.Seconds())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// measureReplicationLag returns the name of the replica set that client reads
+// from, and the replication lag of the members its read preference can select
+func measureReplicationLag(client *mongo.Client) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	db := client.Database("admin")
+	runOpts := options.RunCmd().SetReadPreference(db.ReadPreference())
+
+	var status bson.Raw
+	err := db.RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}, runOpts).Decode(&status)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var replSetConfig bson.Raw
+	err = db.RunCommand(ctx, bson.D{{Key: "replSetGetConfig", Value: 1}}, runOpts).Decode(&replSetConfig)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return replicationLag(status, replSetConfig, db.ReadPreference())
+}
+
+// replicaSetMember is a member of the replica set, from replSetGetStatus and
+// replSetGetConfig
+type replicaSetMember struct {
+	name   string
+	state  string
+	optime time.Time
+	self   bool
+	hidden bool
+	tags   tag.Set
+}
+
+// replicationLag computes the replication lag of the members that readPref can
+// select, from a replSetGetStatus response and a replSetGetConfig response,
+// which look like:
+//
+//	{ set: "rs0", members: [
+//	  { name: "mongo1:27017", stateStr: "PRIMARY", optimeDate: ISODate(...) },
+//	  { name: "mongo2:27017", stateStr: "SECONDARY", optimeDate: ISODate(...), self: true },
+//	] }
+//
+//	{ config: { members: [
+//	  { host: "mongo1:27017", hidden: false, tags: {} },
+//	  { host: "mongo2:27017", hidden: false, tags: { dc: "east" } },
+//	] } }
+//
+// The driver doesn't tell us which of those members the tailer's cursor is on,
+// so this is the lag of the one furthest behind. Hidden members can't be
+// selected by read preference, so if the response came from a hidden member,
+// we're connected to it directly and only its lag counts.
+func replicationLag(status bson.Raw, replSetConfig bson.Raw, readPref *readpref.ReadPref) (string, time.Duration, error) {
+	var parsedStatus struct {
+		Set     string `bson:"set"`
+		Members []struct {
+			Name       string    `bson:"name"`
+			StateStr   string    `bson:"stateStr"`
+			OptimeDate time.Time `bson:"optimeDate"`
+			Self       bool      `bson:"self"`
+		} `bson:"members"`
+	}
+	if err := bson.Unmarshal(status, &parsedStatus); err != nil {
+		return "", 0, err
+	}
+
+	var parsedConfig struct {
+		Config struct {
+			Members []struct {
+				Host   string            `bson:"host"`
+				Hidden bool              `bson:"hidden"`
+				Tags   map[string]string `bson:"tags"`
+			} `bson:"members"`
+		} `bson:"config"`
+	}
+	if err := bson.Unmarshal(replSetConfig, &parsedConfig); err != nil {
+		return "", 0, err
+	}
+
+	members := make([]replicaSetMember, 0, len(parsedStatus.Members))
+	for _, statusMember := range parsedStatus.Members {
+		member := replicaSetMember{
+			name:   statusMember.Name,
+			state:  statusMember.StateStr,
+			optime: statusMember.OptimeDate,
+			self:   statusMember.Self,
+		}
+		for _, configMember := range parsedConfig.Config.Members {
+			if configMember.Host == statusMember.Name {
+				member.hidden = configMember.Hidden
+				member.tags = tag.NewTagSetFromMap(configMember.Tags)
+			}
+		}
+		members = append(members, member)
+	}
+
+	var primaryOptime time.Time
+	hasPrimary := false
+	for _, member := range members {
+		if member.state == "PRIMARY" {
+			primaryOptime = member.optime
+			hasPrimary = true
+		}
+	}
+	if !hasPrimary {
+		return "", 0, errNoPrimary
+	}
+
+	selected := selectableMembers(members, readPref)
+	for _, member := range members {
+		if member.self && member.hidden {
+			selected = []replicaSetMember{member}
+		}
+	}
+	if len(selected) == 0 {
+		return "", 0, errors.New("no replica set member matches the read preference")
+	}
+
+	var lag time.Duration
+	for _, member := range selected {
+		// The primary's optime in the status is as of its last heartbeat, so
+		// a member can appear to be slightly ahead of it
+		if memberLag := primaryOptime.Sub(member.optime); memberLag > lag {
+			lag = memberLag
+		}
+	}
+
+	return parsedStatus.Set, lag, nil
+}
+
+// selectableMembers returns the members that readPref can select, following
+// the driver's server selection rules (except for maxStalenessSeconds)
+func selectableMembers(members []replicaSetMember, readPref *readpref.ReadPref) []replicaSetMember {
+	var primaries, secondaries []replicaSetMember
+	for _, member := range members {
+		if member.hidden {
+			continue
+		}
+		switch member.state {
+		case "PRIMARY":
+			primaries = append(primaries, member)
+		case "SECONDARY":
+			secondaries = append(secondaries, member)
+		}
+	}
+
+	if readPref == nil {
+		return primaries
+	}
+
+	switch readPref.Mode() {
+	case readpref.PrimaryPreferredMode:
+		if len(primaries) > 0 {
+			return primaries
+		}
+		return matchTagSets(secondaries, readPref.TagSets())
+	case readpref.SecondaryMode:
+		return matchTagSets(secondaries, readPref.TagSets())
+	case readpref.SecondaryPreferredMode:
+		if matched := matchTagSets(secondaries, readPref.TagSets()); len(matched) > 0 {
+			return matched
+		}
+		return primaries
+	case readpref.NearestMode:
+		return matchTagSets(append(primaries, secondaries...), readPref.TagSets())
+	default:
+		return primaries
+	}
+}
+
+// matchTagSets returns the members matching the first of tagSets that any
+// member matches. An empty tag set matches every member.
+func matchTagSets(members []replicaSetMember, tagSets []tag.Set) []replicaSetMember {
+	if len(tagSets) == 0 {
+		return members
+	}
+
+	for _, tagSet := range tagSets {
+		var matched []replicaSetMember
+		for _, member := range members {
+			if member.tags.ContainsAll(tagSet) {
+				matched = append(matched, member)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+
+	return nil
+}
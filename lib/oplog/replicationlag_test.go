@@ -0,0 +1,158 @@
+package oplog
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+func TestReplicationLag(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	members := bson.A{
+		bson.M{"name": "mongo1:27017", "stateStr": "PRIMARY", "optimeDate": now},
+		bson.M{"name": "mongo2:27017", "stateStr": "SECONDARY", "optimeDate": now.Add(-3 * time.Second), "self": true},
+		bson.M{"name": "mongo3:27017", "stateStr": "SECONDARY", "optimeDate": now.Add(-time.Minute)},
+	}
+	configMembers := bson.A{
+		bson.M{"host": "mongo1:27017", "tags": bson.M{"dc": "east"}},
+		bson.M{"host": "mongo2:27017", "tags": bson.M{"dc": "east"}},
+		bson.M{"host": "mongo3:27017", "tags": bson.M{"dc": "west"}},
+	}
+
+	tests := map[string]struct {
+		members       bson.A
+		configMembers bson.A
+		readPref      *readpref.ReadPref
+		wantLag       time.Duration
+		wantErr       error
+		wantAnyErr    bool
+	}{
+		"Primary": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Primary(),
+			wantLag:       0,
+		},
+		"No read preference": {
+			members:       members,
+			configMembers: configMembers,
+			wantLag:       0,
+		},
+		"Secondary": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Secondary(),
+			wantLag:       time.Minute,
+		},
+		"Secondary with tags": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Secondary(readpref.WithTagSets(tag.NewTagSetsFromMaps([]map[string]string{{"dc": "east"}})...)),
+			wantLag:       3 * time.Second,
+		},
+		"Secondary with fallback tags": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Secondary(readpref.WithTagSets(tag.NewTagSetsFromMaps([]map[string]string{{"dc": "north"}, {"dc": "west"}})...)),
+			wantLag:       time.Minute,
+		},
+		"Secondary preferred with no matching secondary": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.SecondaryPreferred(readpref.WithTagSets(tag.NewTagSetsFromMaps([]map[string]string{{"dc": "north"}})...)),
+			wantLag:       0,
+		},
+		"Nearest": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Nearest(readpref.WithTagSets(tag.NewTagSetsFromMaps([]map[string]string{{"dc": "east"}})...)),
+			wantLag:       3 * time.Second,
+		},
+		"Hidden secondary": {
+			members: members,
+			configMembers: bson.A{
+				bson.M{"host": "mongo1:27017"},
+				bson.M{"host": "mongo2:27017"},
+				bson.M{"host": "mongo3:27017", "hidden": true},
+			},
+			readPref: readpref.Secondary(),
+			wantLag:  3 * time.Second,
+		},
+		"Connected to a hidden member": {
+			members: members,
+			configMembers: bson.A{
+				bson.M{"host": "mongo1:27017"},
+				bson.M{"host": "mongo2:27017", "hidden": true},
+				bson.M{"host": "mongo3:27017"},
+			},
+			wantLag: 3 * time.Second,
+		},
+		"Ahead of primary's heartbeat": {
+			members: bson.A{
+				bson.M{"name": "mongo1:27017", "stateStr": "PRIMARY", "optimeDate": now},
+				bson.M{"name": "mongo2:27017", "stateStr": "SECONDARY", "optimeDate": now.Add(time.Second), "self": true},
+			},
+			configMembers: bson.A{
+				bson.M{"host": "mongo1:27017"},
+				bson.M{"host": "mongo2:27017"},
+			},
+			readPref: readpref.Secondary(),
+			wantLag:  0,
+		},
+		"No primary": {
+			members: bson.A{
+				bson.M{"name": "mongo2:27017", "stateStr": "SECONDARY", "optimeDate": now, "self": true},
+			},
+			configMembers: bson.A{
+				bson.M{"host": "mongo2:27017"},
+			},
+			readPref: readpref.Secondary(),
+			wantErr:  errNoPrimary,
+		},
+		"No matching member": {
+			members:       members,
+			configMembers: configMembers,
+			readPref:      readpref.Secondary(readpref.WithTagSets(tag.NewTagSetsFromMaps([]map[string]string{{"dc": "north"}})...)),
+			wantAnyErr:    true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			status, err := bson.Marshal(bson.M{"set": "rs0", "members": test.members, "ok": 1})
+			if err != nil {
+				t.Fatalf("Error marshalling status: %s", err)
+			}
+			replSetConfig, err := bson.Marshal(bson.M{"config": bson.M{"members": test.configMembers}, "ok": 1})
+			if err != nil {
+				t.Fatalf("Error marshalling config: %s", err)
+			}
+
+			replicaSet, lag, err := replicationLag(status, replSetConfig, test.readPref)
+			if test.wantErr != nil || test.wantAnyErr {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+					t.Errorf("Got error %s, wanted %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if replicaSet != "rs0" {
+				t.Errorf("Got replica set %s, wanted rs0", replicaSet)
+			}
+			if lag != test.wantLag {
+				t.Errorf("Got lag %s, wanted %s", lag, test.wantLag)
+			}
+		})
+	}
+}
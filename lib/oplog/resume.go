@@ -0,0 +1,68 @@
+package oplog
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+)
+
+var metricAlreadyPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "already_published",
+	Help:      "Publications skipped on resume because their write shard had already published them, partitioned by ordinal",
+}, []string{"ordinal"})
+
+// checkpoints returns the store the write shards' checkpoints are read from
+func (tailer *Tailer) checkpoints() redispub.CheckpointStore {
+	if tailer.Checkpoints != nil {
+		return tailer.Checkpoints
+	}
+	return redispub.NewRedisCheckpointStore(tailer.RedisClients[0], tailer.RedisPrefix)
+}
+
+// dropPublished removes the publications that their write shard already
+// published before we resumed. We resume reading the oplog from the earliest
+// shard's last processed timestamp, so until we're past every shard's, the
+// shards that were further ahead would otherwise publish some entries twice.
+// Only entries strictly before a shard's checkpoint are dropped: the
+// checkpoint doesn't record an index in the transaction, so a batch may have
+// stopped partway through the transaction at the checkpoint's timestamp. Its
+// entries are left for the publisher's dedupe to tell apart.
+func (tailer *Tailer) dropPublished(pubs []*redispub.Publication, shards int) []*redispub.Publication {
+	positions := tailer.resumePositions
+	if len(positions) != shards || len(pubs) == 0 {
+		return pubs
+	}
+
+	kept := make([]*redispub.Publication, 0, len(pubs))
+	for _, pub := range pubs {
+		if pub != nil {
+			ordinal := assignToShard(pub.ParallelismKey, shards)
+			if pub.OplogTimestamp.Before(positions[ordinal]) {
+				metricAlreadyPublished.WithLabelValues(strconv.Itoa(ordinal)).Inc()
+				continue
+			}
+		}
+		kept = append(kept, pub)
+	}
+
+	// Stop checking once we're past every shard's position
+	last := pubs[len(pubs)-1]
+	if last != nil {
+		caughtUp := true
+		for _, position := range positions {
+			if last.OplogTimestamp.Before(position) {
+				caughtUp = false
+				break
+			}
+		}
+		if caughtUp {
+			tailer.resumePositions = nil
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,38 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDropPublished(t *testing.T) {
+	pub := func(shard int, t uint32) *redispub.Publication {
+		return &redispub.Publication{
+			ParallelismKey: shard,
+			OplogTimestamp: primitive.Timestamp{T: t},
+		}
+	}
+
+	tailer := &Tailer{
+		resumePositions: []primitive.Timestamp{{T: 100}, {T: 105}},
+	}
+
+	// Shard 1 already published everything before 105. What it published at
+	// 105 is left to dedupe, since it may have been part of a transaction.
+	pubs := []*redispub.Publication{pub(0, 101), pub(1, 101), pub(1, 104)}
+	require.Equal(t, []*redispub.Publication{pubs[0]}, tailer.dropPublished(pubs, 2))
+	require.NotNil(t, tailer.resumePositions)
+
+	// Once we've reached every shard's position, nothing is dropped
+	pubs = []*redispub.Publication{pub(1, 105), pub(0, 105)}
+	require.Equal(t, pubs, tailer.dropPublished(pubs, 2))
+	require.Nil(t, tailer.resumePositions)
+
+	tailer.resumePositions = []primitive.Timestamp{{T: 100}, {T: 105}}
+	pubs = []*redispub.Publication{pub(1, 106)}
+	require.Equal(t, pubs, tailer.dropPublished(pubs, 2))
+	require.Nil(t, tailer.resumePositions)
+}
@@ -0,0 +1,146 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var metricRollbacks = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "rollbacks",
+	Help:      "Number of times the last processed oplog entry was found to have been rolled back on resume",
+})
+
+// checkRollback checks that the entry we're resuming from is still in the
+// oplog. After a failover, the new primary rolls back the writes the old
+// primary hadn't replicated yet, and we may already have published them. If
+// the entry was rolled back, checkRollback publishes resync messages on the
+// channels we've published to since the point the oplog was rolled back to,
+// and returns that point to resume from instead of startTime.
+func (tailer *Tailer) checkRollback(oplogCollection *mongo.Collection, startTime primitive.Timestamp, maxOrdinal int) primitive.Timestamp {
+	term, hash, ok := tailer.checkpointAt(startTime, maxOrdinal)
+	if !ok {
+		// We're not resuming from a checkpoint
+		return startTime
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	var entry rawOplogEntry
+	err := oplogCollection.FindOne(ctx, bson.M{"ts": startTime}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		var first rawOplogEntry
+		err = oplogCollection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": 1})).Decode(&first)
+		if err == nil && startTime.Before(first.Timestamp) {
+			// The entry fell out of the oplog rather than being rolled back
+			// (see checkHistoryLost)
+			return startTime
+		}
+	} else if err == nil {
+		if !checkpointReplaced(term, hash, &entry) {
+			return startTime
+		}
+	}
+	if err != nil {
+		log.Log.Warnw("Error looking up the last processed oplog entry; can't tell whether it was rolled back",
+			"timestamp", startTime,
+			"error", err)
+		return startTime
+	}
+
+	// Find the newest entry that wasn't rolled back. Entries written after
+	// the rollback have a higher term than the ones before it.
+	filter := bson.M{"ts": bson.M{"$lt": startTime}}
+	if term != 0 {
+		filter = bson.M{"ts": bson.M{"$lte": startTime}, "t": bson.M{"$lte": term}}
+	}
+	var common rawOplogEntry
+	err = oplogCollection.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"$natural": -1})).Decode(&common)
+	if err != nil {
+		log.Log.Errorw("Last processed oplog entry was rolled back, but we couldn't find the point the oplog was rolled back to; resuming from the last processed entry",
+			"timestamp", startTime,
+			"error", err)
+		common.Timestamp = startTime
+	}
+
+	channels := tailer.recentChannels(common.Timestamp, maxOrdinal)
+
+	log.Log.Errorw("Last processed oplog entry was rolled back; publishing resync messages and resuming from the point the oplog was rolled back to",
+		"timestamp", startTime,
+		"rolledBackTo", common.Timestamp,
+		"channels", channels)
+	metricRollbacks.Inc()
+
+	tailer.reportSkip(redispub.Skip{
+		Reason:   redispub.SkipReasonRollback,
+		From:     common.Timestamp,
+		To:       startTime,
+		Channels: channels,
+	})
+
+	// The shards that were ahead published rolled-back entries too, so
+	// they can't skip anything
+	tailer.rolledBackUntil = startTime
+	tailer.resumePositions = nil
+	return common.Timestamp
+}
+
+// checkpointAt returns the term and hash recorded in the checkpoint of the
+// ordinal whose last processed timestamp is startTime, or false if there isn't
+// one (getStartTime resumes from the earliest ordinal)
+func (tailer *Tailer) checkpointAt(startTime primitive.Timestamp, maxOrdinal int) (term int64, hash int64, ok bool) {
+	for i := 0; i <= maxOrdinal; i++ {
+		checkpoint, err := tailer.checkpoints().Load(i)
+		if err == nil && checkpoint.Timestamp.Equal(startTime) {
+			return checkpoint.Term, checkpoint.Hash, true
+		}
+	}
+	return 0, 0, false
+}
+
+// checkpointReplaced returns whether entry, which has the timestamp of the
+// checkpoint, is a different entry than the one the checkpoint was written
+// for. Checkpoints written by older versions don't record the term and hash,
+// so they can only be checked for existence.
+func checkpointReplaced(term int64, hash int64, entry *rawOplogEntry) bool {
+	if term == 0 && hash == 0 {
+		return false
+	}
+	return entry.Term != term || entry.Hash != hash
+}
+
+// recentChannels returns the collection channels that any publisher published
+// to at or after since
+func (tailer *Tailer) recentChannels(since primitive.Timestamp, maxOrdinal int) []string {
+	seen := map[string]bool{}
+	for i := 0; i <= maxOrdinal; i++ {
+		channels, err := redispub.RecentChannels(tailer.RedisClients[0], tailer.RedisPrefix, i, since)
+		if err != nil {
+			log.Log.Errorw("Error reading recently published channels", "ordinal", i, "error", err)
+			continue
+		}
+		for _, channel := range channels {
+			seen[channel] = true
+		}
+	}
+
+	channels := make([]string, 0, len(seen))
+	for channel := range seen {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
@@ -0,0 +1,81 @@
+package oplog
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckpointReplaced(t *testing.T) {
+	tests := map[string]struct {
+		term  int64
+		hash  int64
+		entry bson.M
+		want  bool
+	}{
+		"Same term": {
+			term:  2,
+			entry: bson.M{"ts": primitive.Timestamp{T: 100, I: 1}, "t": int64(2)},
+			want:  false,
+		},
+		"Different term": {
+			term:  2,
+			entry: bson.M{"ts": primitive.Timestamp{T: 100, I: 1}, "t": int64(3)},
+			want:  true,
+		},
+		"Different hash": {
+			hash:  1234,
+			entry: bson.M{"ts": primitive.Timestamp{T: 100, I: 1}, "h": int64(5678)},
+			want:  true,
+		},
+		"Checkpoint without term or hash": {
+			entry: bson.M{"ts": primitive.Timestamp{T: 100, I: 1}, "t": int64(3)},
+			want:  false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var entry rawOplogEntry
+			if err := bson.Unmarshal(rawBson(t, test.entry), &entry); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := checkpointReplaced(test.term, test.hash, &entry); got != test.want {
+				t.Errorf("checkpointReplaced() = %t, wanted %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFinishEntryRecordsTerm(t *testing.T) {
+	tailer := &Tailer{Denylist: &sync.Map{}}
+	entry := func(i uint32) bson.Raw {
+		return rawBson(t, bson.M{
+			"ts": primitive.Timestamp{T: 100, I: i},
+			"t":  int64(5),
+			"op": "i",
+			"ns": "db.Foo",
+			"o":  bson.M{"_id": "someid"},
+		})
+	}
+
+	_, pubs, _ := tailer.processEntry(entry(1))
+	require.Len(t, pubs, 1)
+	require.Equal(t, int64(5), pubs[0].OplogTerm)
+	require.False(t, pubs[0].AfterRollback)
+
+	// Entries up to the rolled-back checkpoint are marked, so that they get
+	// different dedupe keys than the rolled-back entries
+	tailer.rolledBackUntil = primitive.Timestamp{T: 100, I: 2}
+	_, pubs, _ = tailer.processEntry(entry(2))
+	require.Len(t, pubs, 1)
+	require.True(t, pubs[0].AfterRollback)
+
+	_, pubs, _ = tailer.processEntry(entry(3))
+	require.Len(t, pubs, 1)
+	require.False(t, pubs[0].AfterRollback)
+}
@@ -0,0 +1,55 @@
+package oplog
+
+import (
+	"context"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reportSkip tells subscribers on every Redis server that we're knowingly
+// skipping oplog entries (or that entries we published were rolled back), so
+// that they re-query (see redispub.ReportSkip)
+func (tailer *Tailer) reportSkip(skip redispub.Skip) {
+	log.Log.Warnw("Publishing a resync message so that subscribers re-query",
+		"reason", skip.Reason,
+		"from", skip.From,
+		"to", skip.To)
+	redispub.CountSkip(skip)
+
+	for i, client := range tailer.RedisClients {
+		if err := redispub.ReportSkip(client, tailer.RedisPrefix, skip); err != nil {
+			log.Log.Errorw("Error reporting skipped oplog entries",
+				"clientIndex", i,
+				"error", err)
+		}
+	}
+}
+
+// checkHistoryLost reports a skip if the oplog no longer goes back as far as
+// startTime, because the entries after it have been overwritten
+func (tailer *Tailer) checkHistoryLost(oplogCollection *mongo.Collection, startTime primitive.Timestamp) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	var first rawOplogEntry
+	err := oplogCollection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": 1})).Decode(&first)
+	if err != nil {
+		log.Log.Warnw("Error reading the first oplog entry; can't tell whether the resume point is still in the oplog",
+			"error", err)
+		return
+	}
+
+	if startTime.Before(first.Timestamp) {
+		tailer.reportSkip(redispub.Skip{
+			Reason: redispub.SkipReasonHistoryLost,
+			From:   startTime,
+			To:     first.Timestamp,
+		})
+	}
+}
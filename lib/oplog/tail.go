@@ -6,12 +6,14 @@ package oplog
 import (
 	"context"
 	"errors"
-	"strconv"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/denylist"
 	"github.com/tulip/oplogtoredis/lib/log"
 	"github.com/tulip/oplogtoredis/lib/redispub"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -32,6 +34,68 @@ type Tailer struct {
 	RedisPrefix  string
 	MaxCatchUp   time.Duration
 	Denylist     *sync.Map
+
+	// Checkpoints is where the write shards' checkpoints are read from when
+	// resuming. Defaults to Redis, under RedisPrefix.
+	Checkpoints redispub.CheckpointStore
+
+	// ThrottleCatchUp makes the tailer replay a gap longer than MaxCatchUp at
+	// up to CatchUpRate entries and CatchUpByteRate bytes per second (0 for no
+	// limit), instead of starting from the end of the oplog
+	ThrottleCatchUp bool
+	CatchUpRate     float64
+	CatchUpByteRate float64
+
+	// HeartbeatInterval is how often the position of the oplog is sent to
+	// every write shard (see sendHeartbeats). 0 disables heartbeats.
+	HeartbeatInterval time.Duration
+
+	// DecodeWorkers is the number of goroutines that decode oplog entries in
+	// parallel. Defaults to 1.
+	DecodeWorkers int
+
+	// ChangeStream makes the tailer read a cluster-wide change stream instead
+	// of tailing local.oplog.rs directly.
+	ChangeStream bool
+
+	// OwnedShards are the write shards this tailer publishes, or nil for all
+	// of them. The write shards it doesn't publish should have no buffers in
+	// the PublisherBuffers passed to Tail. CRUD entries for the databases of
+	// the other shards aren't decoded, and it resumes from the earliest
+	// checkpoint of its own shards.
+	OwnedShards []int
+
+	// writeShards is the number of write shards Tail was started with
+	writeShards int
+
+	// projectionUnsupported is set once the oplog query projection has failed,
+	// so that we stop trying to use it
+	projectionUnsupported bool
+
+	// pendingTxns holds the operations of multi-entry transactions that
+	// haven't been committed yet, keyed by txnKey
+	pendingTxns map[string]*pendingTxn
+
+	// seenNamespaces holds the collections we've seen writes to, by database,
+	// so that we know which collections are affected by a dropDatabase. It
+	// holds at most maxSeenNamespaces collections, counted by
+	// seenNamespaceCount; seenNamespacesFull is set once we've logged that
+	// it's full.
+	seenNamespaces     map[string]map[string]bool
+	seenNamespaceCount int
+	seenNamespacesFull bool
+
+	// rolledBackUntil is the last processed timestamp of the last rollback
+	// checkRollback detected. Publications up to it are marked AfterRollback.
+	rolledBackUntil primitive.Timestamp
+
+	// resumePositions are the last processed timestamps of the write shards
+	// we resumed from, or nil once every shard is past its own (see
+	// dropPublished)
+	resumePositions []primitive.Timestamp
+
+	// lastHeartbeat is when sendHeartbeats last sent a heartbeat
+	lastHeartbeat time.Time
 }
 
 // Raw oplog entry from Mongo
@@ -42,6 +106,23 @@ type rawOplogEntry struct {
 	Namespace string              `bson:"ns"`
 	Doc       bson.Raw            `bson:"o"`
 	Update    bson.Raw            `bson:"o2"`
+
+	// Term and Hash identify the entry along with its timestamp. Entries
+	// written after a rollback can reuse the timestamp of an entry that was
+	// rolled back, but not its term. Hash is only set before MongoDB 4.2.
+	Term int64 `bson:"t"`
+	Hash int64 `bson:"h"`
+
+	// FromMigrate is set on writes made by the chunk migration process of a
+	// sharded cluster, as opposed to writes made by a client
+	FromMigrate bool `bson:"fromMigrate"`
+
+	// Set on the entries of transactions: the session ID and transaction
+	// number of the transaction, and the timestamp of the previous entry of
+	// the transaction (prevOpTime.ts), which is zero for the first entry
+	LSID          bson.Raw            `bson:"lsid,omitempty"`
+	TxnNumber     int64               `bson:"txnNumber,omitempty"`
+	PrevTimestamp primitive.Timestamp `bson:"-"`
 }
 
 // Parsed Cursor Result
@@ -49,6 +130,7 @@ type cursorResultStatus struct {
 	GotResult       bool
 	DidTimeout      bool
 	DidLosePosition bool
+	WasInterrupted  bool
 }
 
 const requeryDuration = time.Second
@@ -136,19 +218,26 @@ var (
 	}, []string{"reason"})
 )
 
+// readOrdinalLabel is the ordinal label of metricLastReceivedStaleness. There
+// used to be one oplog reader per OTR_READ_PARALLELISM, each with its own
+// ordinal; now there's always a single reader, but we keep the label so that
+// existing dashboards and alerts keep working.
+const readOrdinalLabel = "0"
+
 func init() {
 	prometheus.MustRegister(metricMaxOplogEntryByMinute)
 }
 
-// PublisherChannels represents a collection of intake channels for a set of Redis Publishers.
+// PublisherBuffers represents a collection of intake buffers for a set of Redis Publishers.
 // When multiple redis URLs are specified via OTR_REDIS_URL, each one produce a redis client,
-// publisher coroutine, and intake channel. Since we want every message to go to all redis
-// destinations, the tailer should send each message to all channels in the array.
-type PublisherChannels []chan<- *redispub.Publication
+// publisher coroutine, and intake buffer. Since we want every message to go to all redis
+// destinations, the tailer should send each message to all buffers in the array.
+type PublisherBuffers []*redispub.Buffer
 
 // Tail begins tailing the oplog. It doesn't return unless it receives a message
 // on the stop channel, in which case it wraps up its work and then returns.
-func (tailer *Tailer) Tail(out []PublisherChannels, stop <-chan bool, readOrdinal, readParallelism int) {
+func (tailer *Tailer) Tail(out []PublisherBuffers, stop <-chan bool) {
+	tailer.writeShards = len(out)
 	childStopC := make(chan bool)
 	wasStopped := false
 
@@ -158,11 +247,16 @@ func (tailer *Tailer) Tail(out []PublisherChannels, stop <-chan bool, readOrdina
 		childStopC <- true
 	}()
 
+	tailOnce := tailer.tailOnce
+	if tailer.ChangeStream {
+		tailOnce = tailer.tailChangeStreamOnce
+	}
+
 	consecutivePrematureStops := 0
 	for {
 		log.Log.Info("Starting oplog tailing")
 		tailStart := time.Now()
-		tailer.tailOnce(out, childStopC, readOrdinal, readParallelism)
+		tailOnce(out, childStopC)
 		log.Log.Info("Oplog tailing ended")
 
 		if wasStopped {
@@ -206,10 +300,13 @@ func prematureStopIsError(streak int) bool {
 	return streak >= maxConsecutivePrematureStops
 }
 
-// this accepts an array of PublisherChannels instances whose size is equal to the degree of write-parallelism.
-// Each incoming message will be routed to one of the PublisherChannels instances based on its parallelism key
-// (hash of the database name), then sent to every channel within that PublisherChannels instance.
-func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOrdinal, readParallelism int) {
+// this accepts an array of PublisherBuffers instances whose size is equal to the degree of write-parallelism.
+// Each incoming message will be routed to one of the PublisherBuffers instances based on its parallelism key
+// (hash of the database name), then sent to every buffer within that PublisherBuffers instance.
+//
+// The entries are read with a single cursor, and decoded on a pool of
+// tailer.DecodeWorkers goroutines (see decoder).
+func (tailer *Tailer) tailOnce(out []PublisherBuffers, stop <-chan bool) {
 	session, err := tailer.MongoClient.StartSession()
 	if err != nil {
 		log.Log.Errorw("Failed to start Mongo session", "error", err)
@@ -219,7 +316,7 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 
 	oplogCollection := session.Client().Database("local").Collection("oplog.rs")
 
-	startTime, startTimeErr := tailer.getStartTime(len(out)-1, func() (*primitive.Timestamp, error) {
+	startTime, catchUpTo, startTimeErr := tailer.getStartTime(len(out)-1, func() (*primitive.Timestamp, error) {
 		// Get the timestamp of the last entry in the oplog (as a position to
 		// start from if we don't have a last-written timestamp from Redis)
 		var entry rawOplogEntry
@@ -254,8 +351,29 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 		metricTailFailedToStart.WithLabelValues("start_time").Inc()
 		return
 	}
+	startTime = tailer.checkRollback(oplogCollection, startTime, len(out)-1)
+	throttle := tailer.startCatchUp(startTime, catchUpTo)
+	tailer.checkHistoryLost(oplogCollection, startTime)
+
+	// queryGeneration is the denylist generation the current query's filter was
+	// built from. When the denylist changes, we rebuild the query.
+	var queryGeneration uint64
+	issueQuery := func(from primitive.Timestamp) (*mongo.Cursor, error) {
+		queryGeneration = denylist.Generation()
+		filter := oplogQueryFilter(from, tailer.Denylist)
+
+		if !tailer.projecting() {
+			return issueOplogFindQuery(oplogCollection, filter, nil)
+		}
+
+		cursor, err := issueOplogFindQuery(oplogCollection, filter, oplogProjection)
+		if tailer.disableProjectionOnError(err) {
+			return issueOplogFindQuery(oplogCollection, filter, nil)
+		}
+		return cursor, err
+	}
 
-	query, queryErr := issueOplogFindQuery(oplogCollection, startTime)
+	query, queryErr := issueQuery(startTime)
 
 	if queryErr != nil {
 		log.Log.Errorw("Error issuing initial tail query", "error", queryErr)
@@ -263,7 +381,30 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 		return
 	}
 
+	// Wait for every entry we've read to be published before returning, so
+	// that the next attempt (which picks up from lastTimestamp) doesn't race
+	// with this one
+	entries := tailer.startDecoder(tailer.DecodeWorkers, func(decoded *decodedEntry) {
+		if decoded.rawData == nil {
+			tailer.sendHeartbeats(decoded.position, "", out)
+			return
+		}
+
+		_, pubs, sendMetricsData := tailer.finishEntry(decoded)
+		sendPublications(tailer.dropPublished(pubs, len(out)), sendMetricsData, out)
+
+		if t, i, ok := decoded.rawData.Lookup("ts").TimestampOK(); ok {
+			tailer.sendHeartbeats(primitive.Timestamp{T: t, I: i}, "", out)
+		}
+	})
+	defer entries.close()
+
 	lastTimestamp := startTime
+
+	// idle is true when the last read from the cursor returned nothing, in
+	// which case we sample the end of the oplog before the next read (see
+	// sampleIdlePosition)
+	idle := true
 	for {
 		select {
 		case <-stop:
@@ -274,7 +415,33 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 
 		for {
 			var rawData bson.Raw
-			status, err := readNextFromCursor(query)
+			if denylist.Generation() != queryGeneration {
+				// The denylist changed, so the namespace filter in our query
+				// is out of date. Pick up from where we left off with a new
+				// query.
+				log.Log.Info("Denylist changed, re-issuing tail query")
+				closeCursor(query)
+
+				query, queryErr = issueQuery(lastTimestamp)
+
+				if queryErr != nil {
+					log.Log.Errorw("Error issuing tail query", "error", queryErr)
+					return
+				}
+			}
+
+			var idlePosition primitive.Timestamp
+			if idle {
+				idlePosition = tailer.sampleIdlePosition(oplogCollection)
+			}
+
+			// Check the denylist between empty batches too, since the
+			// entries it now excludes (or no longer excludes) may be all
+			// that's being written
+			status, err := readNextFromCursor(query, func() bool {
+				return denylist.Generation() != queryGeneration
+			})
+			idle = !status.GotResult
 
 			if status.GotResult {
 				decodeErr := query.Decode(&rawData)
@@ -283,42 +450,28 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 					continue
 				}
 
-				ts, pubs, sendMetricsData := tailer.processEntry(rawData, readOrdinal)
+				reportProjectionSavings(rawData)
 
-				if ts != nil {
-					lastTimestamp = *ts
+				if t, i, ok := rawData.Lookup("ts").TimestampOK(); ok {
+					lastTimestamp = primitive.Timestamp{T: t, I: i}
 				}
 
-				// we only want to send metrics data once for the whole batch
-				metricsDataSent := false
-
-				for _, pub := range pubs {
-					if pub != nil {
-						inIdx := assignToShard(pub.ParallelismKey, readParallelism)
-						if inIdx != readOrdinal {
-							// discard this publication
-							continue
-						}
-
-						// send metrics data only if we didnt discard all the publications due to sharding
-						if !metricsDataSent && sendMetricsData != nil {
-							metricsDataSent = true
-							sendMetricsData()
-						}
-
-						// determine which shard this message should route to
-						// inIdx and outIdx may be different if there are different #s of read and write routines
-						outIdx := assignToShard(pub.ParallelismKey, len(out))
-						// get the set of publisher channels for that shard
-						pubChans := out[outIdx]
-						// send the message to each channel on that shard
-						for _, pubChan := range pubChans {
-							pubChan <- pub
-						}
-					} else {
-						log.Log.Error("Nil Redis publication")
+				if throttle != nil {
+					wait, caughtUp := throttle.record(lastTimestamp, len(rawData), time.Now())
+					if caughtUp {
+						log.Log.Infow("Caught up to the end of the oplog; no longer throttling",
+							"timestamp", lastTimestamp)
+						throttle = nil
+					} else if !sleepUnlessStopped(wait, stop) {
+						log.Log.Infof("Received stop; aborting oplog tailing")
+						return
 					}
 				}
+
+				entries.add(rawData)
+			} else if status.WasInterrupted {
+				// The denylist changed; the query is re-issued above
+				continue
 			} else if status.DidTimeout {
 
 				// Didn't get any messages for a while, keep trying.
@@ -326,7 +479,15 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 				// timeout after our timeout duration, and we'll create a new one.
 				log.Log.Debug("Oplog cursor timed out, will retry")
 
-				query, queryErr = issueOplogFindQuery(oplogCollection, lastTimestamp)
+				if lastTimestamp.Before(idlePosition) {
+					// Everything up to idlePosition was either read or
+					// filtered out by the query, so it's safe to checkpoint
+					// there and to resume the query from there
+					entries.addPosition(idlePosition)
+					lastTimestamp = idlePosition
+				}
+
+				query, queryErr = issueQuery(lastTimestamp)
 
 				if queryErr != nil {
 					log.Log.Errorw("Error issuing tail query", "error", queryErr)
@@ -337,7 +498,7 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 			} else if status.DidLosePosition {
 				// Our cursor expired. Make a new cursor to pick up from where we
 				// left off.
-				query, queryErr = issueOplogFindQuery(oplogCollection, lastTimestamp)
+				query, queryErr = issueQuery(lastTimestamp)
 
 				if queryErr != nil {
 					log.Log.Errorw("Error issuing tail query", "error", queryErr)
@@ -351,6 +512,10 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 
 				closeCursor(query)
 
+				// If the projection is what failed, the next attempt will query
+				// without it
+				tailer.disableProjectionOnError(err)
+
 				return
 			} else {
 				log.Log.Errorw("Got no data from cursor, but also no error. This is unexpected; restarting query")
@@ -363,6 +528,33 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 	}
 }
 
+// sendPublications routes each publication to the write shard chosen by its
+// parallelism key, and sends it to every channel on that shard.
+func sendPublications(pubs []*redispub.Publication, sendMetricsData func(), out []PublisherBuffers) {
+	// we only want to send metrics data once for the whole batch
+	metricsDataSent := false
+
+	for _, pub := range pubs {
+		if pub != nil {
+			if !metricsDataSent && sendMetricsData != nil {
+				metricsDataSent = true
+				sendMetricsData()
+			}
+
+			// determine which shard this message should route to
+			outIdx := assignToShard(pub.ParallelismKey, len(out))
+			// get the set of publisher buffers for that shard
+			buffers := out[outIdx]
+			// send the message to each buffer on that shard
+			for _, buffer := range buffers {
+				buffer.Send(pub)
+			}
+		} else {
+			log.Log.Error("Nil Redis publication")
+		}
+	}
+}
+
 // readNextFromCursor gets the next item from the cursor.
 // err returns the last error seen by the Cursor (or context), or nil if no error has occurred.
 //
@@ -375,11 +567,25 @@ func (tailer *Tailer) tailOnce(out []PublisherChannels, stop <-chan bool, readOr
 //	   We handle this by just retrying the query
 //	-> DidLosePostion (See comment below)
 //	   We handle this by creating a new cursor
-func readNextFromCursor(cursor *mongo.Cursor) (status cursorResultStatus, err error) {
+//	-> WasInterrupted // Did interrupt return true after an empty batch?
+//
+// Like Cursor.Next, it keeps fetching batches until it gets a result, but it
+// calls interrupt after each empty one, so that the caller can give up on the
+// cursor without waiting for a result or a timeout.
+func readNextFromCursor(cursor *mongo.Cursor, interrupt func() bool) (status cursorResultStatus, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
 	defer cancel()
 
-	status.GotResult = cursor.Next(ctx)
+	for {
+		status.GotResult = cursor.TryNext(ctx)
+		if status.GotResult || cursor.Err() != nil || cursor.ID() == 0 {
+			break
+		}
+		if interrupt() {
+			status.WasInterrupted = true
+			return
+		}
+	}
 	err = cursor.Err()
 
 	if err != nil {
@@ -411,17 +617,69 @@ func readNextFromCursor(cursor *mongo.Cursor) (status cursorResultStatus, err er
 	return
 }
 
-func issueOplogFindQuery(c *mongo.Collection, startTime primitive.Timestamp) (*mongo.Cursor, error) {
+func issueOplogFindQuery(c *mongo.Collection, filter bson.M, projection bson.M) (*mongo.Cursor, error) {
 	queryOpts := &options.FindOptions{}
 	queryOpts.SetSort(bson.M{"$natural": 1})
 	queryOpts.SetCursorType(options.TailableAwait)
+	if projection != nil {
+		queryOpts.SetProjection(projection)
+	}
 
 	queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
 	defer queryContextCancel()
 
-	return c.Find(queryContext, bson.M{
-		"ts": bson.M{"$gt": startTime},
-	}, queryOpts)
+	return c.Find(queryContext, filter, queryOpts)
+}
+
+// oplogQueryFilter builds the filter for the oplog query. Besides selecting
+// entries after startTime, it excludes namespaces that processOplogEntry and
+// the denylist would discard anyway, so that Mongo doesn't send them to us in
+// the first place:
+//
+//   - every namespace in a denylisted database
+//   - the config database
+//   - system.* collections, except for time-series buckets
+//   - writes from chunk migrations (fromMigrate)
+//
+// admin.$cmd is never excluded, because it holds transactions (which may touch
+// databases that aren't denylisted). The operations inside a transaction are
+// still filtered client-side by unmarshalEntryMetadata.
+func oplogQueryFilter(startTime primitive.Timestamp, denylist *sync.Map) bson.M {
+	excluded := []string{}
+	denylist.Range(func(key interface{}, value interface{}) bool {
+		db, ok := key.(string)
+		if !ok {
+			return true
+		}
+
+		pattern := "^" + regexp.QuoteMeta(db) + `\.`
+		if db == "admin" {
+			// Everything but admin.$cmd
+			pattern += `($|[^$]|\$($|[^c]|c($|[^m]|m($|[^d]|d.))))`
+		}
+
+		excluded = append(excluded, pattern)
+		return true
+	})
+
+	// Sort the denylist patterns so the filter is deterministic
+	sort.Strings(excluded)
+
+	// The system.* pattern matches every system collection except time-series
+	// buckets. Like the admin pattern above, it's spelled out without a
+	// negative lookahead so that it's also a valid Go regexp.
+	excluded = append(excluded, `^config\.`, `^[^.]+\.system\.($|[^b]|b($|[^u])|bu($|[^c])|buc($|[^k])|buck($|[^e])|bucke($|[^t])|bucket($|[^s])|buckets($|[^.]))`)
+
+	patterns := make(bson.A, len(excluded))
+	for i, pattern := range excluded {
+		patterns[i] = primitive.Regex{Pattern: pattern}
+	}
+
+	return bson.M{
+		"ts":          bson.M{"$gt": startTime},
+		"ns":          bson.M{"$nin": patterns},
+		"fromMigrate": bson.M{"$ne": true},
+	}
 }
 
 func closeCursor(cursor *mongo.Cursor) {
@@ -439,25 +697,124 @@ func closeCursor(cursor *mongo.Cursor) {
 //
 // The timestamp of the entry is returned so that tailOnce knows the timestamp of the last entry it read, even if it
 // ignored it or failed at some later step.
-func (tailer *Tailer) processEntry(rawData bson.Raw, readOrdinal int) (timestamp *primitive.Timestamp, pubs []*redispub.Publication, sendMetricsData func()) {
-	result := tailer.unmarshalEntryMetadata(rawData)
+func (tailer *Tailer) processEntry(rawData bson.Raw) (timestamp *primitive.Timestamp, pubs []*redispub.Publication, sendMetricsData func()) {
+	return tailer.finishEntry(tailer.decodeEntry(rawData))
+}
+
+// decodedEntry is an oplog entry that's been through decodeEntry
+type decodedEntry struct {
+	// seq is the position of the entry in the order it was read in
+	seq uint64
+
+	rawData bson.Raw
+
+	// position is the oplog position of a marker queued by addPosition, which
+	// has no rawData
+	position primitive.Timestamp
+
+	// entry is nil if the entry was filtered out or couldn't be unmarshalled
+	entry *rawOplogEntry
+
+	// parsed is true if entry is a CRUD operation, in which case entries,
+	// pubs, and errs are already filled in. Other entries (commands) depend on
+	// the entries before them, so they're parsed by finishEntry.
+	parsed  bool
+	entries []oplogEntry
+	pubs    []*redispub.Publication
+	errs    []entryError
+}
+
+type entryError struct {
+	err error
+	op  *oplogEntry
+}
+
+// decodeEntry does the part of processing an entry that doesn't depend on the
+// entries before it: unmarshalling it, and for CRUD operations, generating its
+// publications. It only reads the tailer's Denylist, so it's safe to run on
+// several goroutines at once.
+func (tailer *Tailer) decodeEntry(rawData bson.Raw) *decodedEntry {
+	decoded := &decodedEntry{rawData: rawData}
+
+	decoded.entry = tailer.unmarshalEntryMetadata(rawData)
+	if decoded.entry == nil {
+		return decoded
+	}
+
+	switch decoded.entry.Operation {
+	case operationInsert, operationUpdate, operationRemove:
+		decoded.parsed = true
+		if database, _ := parseNamespace(decoded.entry.Namespace); !tailer.ownsDatabase(database) {
+			return decoded
+		}
+
+		txIdx := uint(0)
+		decoded.entries = parseCRUDEntry(decoded.entry, &txIdx)
+		decoded.pubs, decoded.errs = processOplogEntries(decoded.entries)
+	}
+
+	return decoded
+}
+
+// finishEntry does the rest of processing an entry that's been through
+// decodeEntry. Entries must be passed to finishEntry in the order they were
+// read from the oplog.
+func (tailer *Tailer) finishEntry(decoded *decodedEntry) (timestamp *primitive.Timestamp, pubs []*redispub.Publication, sendMetricsData func()) {
+	result := decoded.entry
 	if result == nil {
 		return
 	}
 
 	timestamp = &result.Timestamp
 
-	entries := tailer.parseRawOplogEntry(result, nil)
+	entries := decoded.entries
+	errs := decoded.errs
+	pubs = decoded.pubs
+	if decoded.parsed {
+		tailer.recordNamespaces(entries)
+	} else {
+		entries = tailer.parseRawOplogEntry(result, nil)
+		pubs, errs = processOplogEntries(entries)
+	}
 	log.Log.Debugw("Received oplog entry", "entry", result, "processTime", time.Now().UnixMilli())
 
+	// Publications for this entry carry its term and hash into the checkpoint
+	// (see checkRollback)
+	term, _ := decoded.rawData.Lookup("t").Int64OK()
+	hash, _ := decoded.rawData.Lookup("h").Int64OK()
+	for _, pub := range pubs {
+		if pub.OplogTimestamp == result.Timestamp {
+			pub.OplogTerm = term
+			pub.OplogHash = hash
+		}
+		if !tailer.rolledBackUntil.Before(pub.OplogTimestamp) {
+			pub.AfterRollback = true
+		}
+	}
+
 	status := "ignored"
 	database := "(no database)"
-	messageLen := float64(len(rawData))
+	messageLen := float64(len(decoded.rawData))
 
 	if len(entries) > 0 {
 		database = entries[0].Database
 	}
 
+	if errs != nil {
+		status = "error"
+
+		for _, ent := range errs {
+			log.Log.Errorw("Error processing oplog entry",
+				"op", ent.op,
+				"error", ent.err,
+				"database", ent.op.Database,
+				"collection", ent.op.Collection,
+			)
+		}
+	} else if len(entries) > 0 {
+		status = "processed"
+	}
+
 	sendMetricsData = func() {
 		// TODO: remove these in a future version
 		metricOplogEntriesReceived.WithLabelValues(database, status).Inc()
@@ -465,21 +822,20 @@ func (tailer *Tailer) processEntry(rawData bson.Raw, readOrdinal int) (timestamp
 
 		metricOplogEntriesBySize.WithLabelValues(database, status).Observe(messageLen)
 		metricMaxOplogEntryByMinute.Report(messageLen, database, status)
-		metricLastReceivedStaleness.WithLabelValues(strconv.Itoa(readOrdinal)).Set(float64(time.Since(time.Unix(int64(timestamp.T), 0))))
+		metricLastReceivedStaleness.WithLabelValues(readOrdinalLabel).Set(float64(time.Since(time.Unix(int64(timestamp.T), 0))))
 	}
 
-	type errEntry struct {
-		err error
-		op  *oplogEntry
-	}
+	return
+}
 
-	var errs []errEntry
+// processOplogEntries generates the publications for entries
+func processOplogEntries(entries []oplogEntry) (pubs []*redispub.Publication, errs []entryError) {
 	for i := range entries {
 		entry := &entries[i]
 		pub, err := processOplogEntry(entry)
 
 		if err != nil {
-			errs = append(errs, errEntry{
+			errs = append(errs, entryError{
 				err: err,
 				op:  entry,
 			})
@@ -488,40 +844,40 @@ func (tailer *Tailer) processEntry(rawData bson.Raw, readOrdinal int) (timestamp
 		}
 	}
 
-	if errs != nil {
-		status = "error"
-
-		for _, ent := range errs {
-			log.Log.Errorw("Error processing oplog entry",
-				"op", ent.op,
-				"error", ent.err,
-				"database", ent.op.Database,
-				"collection", ent.op.Collection,
-			)
-		}
-	} else if len(entries) > 0 {
-		status = "processed"
-	}
-
 	return
 }
 
-// Gets the primitive.Timestamp from which we should start tailing
+// Gets the primitive.Timestamp from which we should start tailing. If
+// tailer.ThrottleCatchUp is set and the last processed timestamp is more than
+// MaxCatchUp ago, it also returns the timestamp of the last oplog entry, which
+// is where the throttled catch-up ends; otherwise that's nil.
 //
 // We take the function to get the timestamp of the last oplog entry (as a
-// fallback if we don't have a latest timestamp from Redis) as an arg instead
-// of using tailer.mongoClient directly so we can unit test this function
-func (tailer *Tailer) getStartTime(maxOrdinal int, getTimestampOfLastOplogEntry func() (*primitive.Timestamp, error)) (primitive.Timestamp, error) {
-	var redisErr error
+// fallback if we don't have a latest timestamp from the checkpoint store) as an
+// arg instead of using tailer.mongoClient directly so we can unit test this
+// function
+func (tailer *Tailer) getStartTime(maxOrdinal int, getTimestampOfLastOplogEntry func() (*primitive.Timestamp, error)) (primitive.Timestamp, *primitive.Timestamp, error) {
+	var storeErr error
+
+	// skip is set if starting from the end of the oplog skips entries we
+	// haven't processed
+	var skip *redispub.Skip
+
+	// Only set if we resume from the checkpoints
+	tailer.resumePositions = nil
 
 	for tries := 0; tries < config.ResumeTsReadRetries(); tries++ {
-		// Get the earliest "last processed time" for each shard. This assumes that the number of shards is constant.
-		// Note: assign to the outer redisErr (with =, not :=) so the post-loop handler can see a persistent failure.
-		var ts primitive.Timestamp
-		var tsTime time.Time
-		ts, tsTime, redisErr = redispub.FirstLastProcessedTimestamp(tailer.RedisClients[0], tailer.RedisPrefix, maxOrdinal)
+		// Get the "last processed time" of each write shard. We resume from
+		// the earliest one we publish, and skip the publications that the shards that are
+		// further ahead have already published (see dropPublished).
+		// Note: assign to the outer storeErr (with =, not :=) so the post-loop handler can see a persistent failure.
+		var positions []primitive.Timestamp
+		positions, storeErr = redispub.ResumePositions(tailer.checkpoints(), maxOrdinal+1)
+
+		if storeErr == nil {
+			ts := tailer.earliestPosition(positions)
+			tsTime := time.Unix(int64(ts.T), 0)
 
-		if redisErr == nil {
 			gapSeconds := time.Since(tsTime) / time.Second
 
 			// we have a last write time, check that it's not too far in the past
@@ -530,61 +886,85 @@ func (tailer *Tailer) getStartTime(maxOrdinal int, getTimestampOfLastOplogEntry
 					"timestamp", tsTime.Unix(),
 					"age_seconds", gapSeconds)
 				metricOplogResumeGap.WithLabelValues("success").Observe(float64(gapSeconds))
-				return ts, nil
+				tailer.resumePositions = positions
+				return ts, nil, nil
+			}
+
+			if tailer.ThrottleCatchUp {
+				end, mongoErr := getTimestampOfLastOplogEntry()
+				if mongoErr != nil {
+					return ts, nil, mongoErr
+				}
+
+				log.Log.Warnw("Found last processed timestamp, but it was too far in the past. Will replay the oplog from it at a limited rate",
+					"timestamp", tsTime.Unix(),
+					"age_seconds", gapSeconds,
+					"catchUpTo", end.T)
+				metricOplogResumeGap.WithLabelValues("throttled").Observe(float64(gapSeconds))
+				tailer.resumePositions = positions
+				return ts, end, nil
 			}
 
 			log.Log.Errorw("Found last processed timestamp, but it was too far in the past. Will start from end of oplog",
 				"timestamp", tsTime.Unix(),
 				"age_seconds", gapSeconds)
 			metricOplogResumeGap.WithLabelValues("failed").Observe(float64(gapSeconds))
+			skip = &redispub.Skip{Reason: redispub.SkipReasonGapTooLarge, From: ts}
 			break
-		} else if errors.Is(redisErr, redis.Nil) {
-			log.Log.Errorw("No last processed timestamp found in Redis. Will start from end of oplog.",
+		} else if errors.Is(storeErr, redispub.ErrNoCheckpoint) {
+			log.Log.Errorw("No last processed timestamp found in the checkpoint store. Will start from end of oplog.",
 				"attempt", tries)
 			break
 		} else {
-			log.Log.Warnw("Error querying Redis for last processed timestamp. Will retry.",
+			log.Log.Warnw("Error querying the checkpoint store for last processed timestamp. Will retry.",
 				"attempt", tries,
-				"error", redisErr)
+				"error", storeErr)
 			time.Sleep(config.ResumeTsReadRetryDelay() * time.Duration(tries))
 		}
 	}
 
-	// A genuine read failure (as opposed to redis.Nil, which means there's simply no
-	// resume point yet) means we couldn't reach Redis. Falling back to the end of the
-	// oplog here would silently skip every entry written since our last processed
-	// timestamp, so instead we return the error and let the caller restart and retry.
-	// If we can't read from Redis, we can't write to it either, so retrying is correct.
+	// A genuine read failure (as opposed to ErrNoCheckpoint, which means there's simply
+	// no resume point yet) means we couldn't reach the checkpoint store. Falling back to
+	// the end of the oplog here would silently skip every entry written since our last
+	// processed timestamp, so instead we return the error and let the caller restart and
+	// retry. If we can't read from the store, we can't write to it either, so retrying
+	// is correct.
 	//
 	// The OTR_RESUME_FROM_END_ON_FAILURE escape hatch overrides this: if set, we fall
 	// back to the end of the oplog (the pre-retry behavior) rather than blocking
 	// startup, accepting the risk of skipping entries.
-	if redisErr != nil && !errors.Is(redisErr, redis.Nil) {
+	if storeErr != nil && !errors.Is(storeErr, redispub.ErrNoCheckpoint) {
 		if !config.ResumeFromEndOnFailure() {
 			metricOplogResumeGap.WithLabelValues("failed").Observe(0) // zero because we failed to get the timestamp
-			log.Log.Errorw("Error querying Redis for last processed timestamp after exhausting retries; "+
+			log.Log.Errorw("Error querying the checkpoint store for last processed timestamp after exhausting retries; "+
 				"aborting tail attempt so it can be retried rather than skipping oplog entries",
-				"error", redisErr)
-			return primitive.Timestamp{}, redisErr
+				"error", storeErr)
+			return primitive.Timestamp{}, nil, storeErr
 		}
 
-		log.Log.Errorw("Error querying Redis for last processed timestamp after exhausting retries; "+
+		log.Log.Errorw("Error querying the checkpoint store for last processed timestamp after exhausting retries; "+
 			"OTR_RESUME_FROM_END_ON_FAILURE is set, so falling back to the end of the oplog "+
 			"(this may skip oplog entries)",
-			"error", redisErr)
+			"error", storeErr)
 		metricOplogResumeGap.WithLabelValues("failed").Observe(0) // zero because we failed to get the timestamp
+		skip = &redispub.Skip{Reason: redispub.SkipReasonResumeFailure}
 	}
 
 	mongoOplogEndTimestamp, mongoErr := getTimestampOfLastOplogEntry()
 	if mongoErr == nil {
+		if skip != nil {
+			skip.To = *mongoOplogEndTimestamp
+			tailer.reportSkip(*skip)
+		}
+
 		log.Log.Infow("Starting tailing from end of oplog",
 			"timestamp", mongoOplogEndTimestamp.T)
-		return *mongoOplogEndTimestamp, nil
+		return *mongoOplogEndTimestamp, nil, nil
 	}
 
 	log.Log.Errorw("Got error when asking for last operation timestamp in the oplog. Returning current time.",
 		"error", mongoErr)
-	return primitive.Timestamp{T: uint32(time.Now().Unix())}, mongoErr
+	return primitive.Timestamp{T: uint32(time.Now().Unix())}, nil, mongoErr
 }
 
 func parseID(idRaw bson.RawValue) (id interface{}, err error) {
@@ -616,6 +996,14 @@ func (tailer *Tailer) unmarshalEntryMetadata(rawData bson.Raw) *rawOplogEntry {
 		}
 	}
 
+	// Chunk migrations copy documents to the recipient shard and delete them
+	// from the donor shard. The documents haven't actually changed, so we
+	// don't want to publish anything for them.
+	if fromMigrate, ok := rawData.Lookup("fromMigrate").BooleanOK(); ok && fromMigrate {
+		log.Log.Debugw("Skipping oplog entry from chunk migration", "namespace", result.Namespace)
+		return nil
+	}
+
 	// filter if db is in denylist
 	if len(result.Namespace) > 0 && result.Namespace != "admin.$cmd" {
 		db, _ := parseNamespace(result.Namespace)
@@ -673,6 +1061,34 @@ func (tailer *Tailer) unmarshalEntryMetadata(rawData bson.Raw) *rawOplogEntry {
 		}
 	}
 
+	lsidLookup, err := rawData.LookupErr("lsid")
+	if err == nil {
+		result.LSID, ok = lsidLookup.DocumentOK()
+		if !ok {
+			log.Log.Error("Error unmarshalling oplog lsid entry")
+			return nil
+		}
+	}
+
+	txnNumberLookup, err := rawData.LookupErr("txnNumber")
+	if err == nil {
+		result.TxnNumber, ok = txnNumberLookup.AsInt64OK()
+		if !ok {
+			log.Log.Error("Error unmarshalling oplog txnNumber entry")
+			return nil
+		}
+	}
+
+	prevTsLookup, err := rawData.LookupErr("prevOpTime", "ts")
+	if err == nil {
+		t, i, ok := prevTsLookup.TimestampOK()
+		if !ok {
+			log.Log.Error("Error unmarshalling oplog prevOpTime entry")
+			return nil
+		}
+		result.PrevTimestamp = primitive.Timestamp{T: t, I: i}
+	}
+
 	return &result
 }
 
@@ -685,63 +1101,20 @@ func (tailer *Tailer) parseRawOplogEntry(entry *rawOplogEntry, txIdx *uint) []op
 
 	switch entry.Operation {
 	case operationInsert, operationUpdate, operationRemove:
-		out := oplogEntry{
-			Operation: entry.Operation,
-			Timestamp: entry.Timestamp,
-			WallTime:  entry.WallTime,
-			Namespace: entry.Namespace,
-			Data:      entry.Doc,
-
-			TxIdx: *txIdx,
-		}
-
-		*txIdx++
-
-		out.Database, out.Collection = parseNamespace(out.Namespace)
-
-		var errID error
-		if out.Operation == operationUpdate {
-			out.DocID, errID = parseID(entry.Update.Lookup("_id"))
-		} else {
-			out.DocID, errID = parseID(entry.Doc.Lookup("_id"))
-		}
-		if errID != nil {
-			return nil
-		}
-
-		return []oplogEntry{out}
+		entries := parseCRUDEntry(entry, txIdx)
+		tailer.recordNamespaces(entries)
+		return entries
 
 	case operationCommand:
-		if entry.Namespace != "admin.$cmd" {
-			return nil
+		if ddlCommand(entry) != "" {
+			return tailer.parseDDLEntry(entry, txIdx)
 		}
 
-		applyOpsLookup, err := entry.Doc.LookupErr("applyOps")
-		if err != nil {
-			list, errList := entry.Doc.Elements()
-			if errList != nil {
-				log.Log.Debugf("applyOps key not found in command entry: %v, doc error: %v", err, errList)
-				return nil
-			}
-			keys := []string{}
-			for _, rawElem := range list {
-				keys = append(keys, rawElem.Key())
-			}
-			log.Log.Debugf("applyOps key not found in command entry, ignoring. Keys: %v", strings.Join(keys, ", "))
-			return nil
-		}
-
-		applyOpsValues, ok := applyOpsLookup.ArrayOK()
-		if !ok {
-			log.Log.Error("Failed to access transaction data as array")
+		if entry.Namespace != "admin.$cmd" {
 			return nil
 		}
 
-		applyOpsArray, err := applyOpsValues.Values()
-		if err != nil {
-			log.Log.Errorf("Getting transaction ops array: %v", err)
-			return nil
-		}
+		applyOpsArray := tailer.transactionOps(entry)
 
 		var ret []oplogEntry
 		for _, rawEntry := range applyOpsArray {
@@ -765,6 +1138,41 @@ func (tailer *Tailer) parseRawOplogEntry(entry *rawOplogEntry, txIdx *uint) []op
 	}
 }
 
+// parseCRUDEntry converts an insert, update, or remove rawOplogEntry to
+// oplogEntries. Unlike parseRawOplogEntry, it doesn't touch any of the
+// tailer's state, so it's safe to call from several goroutines at once.
+func parseCRUDEntry(entry *rawOplogEntry, txIdx *uint) []oplogEntry {
+	if database, collection := parseNamespace(entry.Namespace); strings.HasPrefix(collection, bucketsPrefix) {
+		return parseBucketEntry(entry, database, strings.TrimPrefix(collection, bucketsPrefix), txIdx)
+	}
+
+	out := oplogEntry{
+		Operation: entry.Operation,
+		Timestamp: entry.Timestamp,
+		WallTime:  entry.WallTime,
+		Namespace: entry.Namespace,
+		Data:      entry.Doc,
+
+		TxIdx: *txIdx,
+	}
+
+	*txIdx++
+
+	out.Database, out.Collection = parseNamespace(out.Namespace)
+
+	var errID error
+	if out.Operation == operationUpdate {
+		out.DocID, errID = parseID(entry.Update.Lookup("_id"))
+	} else {
+		out.DocID, errID = parseID(entry.Doc.Lookup("_id"))
+	}
+	if errID != nil {
+		return nil
+	}
+
+	return []oplogEntry{out}
+}
+
 // Parses op.Namespace into (database, collection)
 func parseNamespace(namespace string) (string, string) {
 	namespaceParts := strings.SplitN(namespace, ".", 2)
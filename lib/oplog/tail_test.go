@@ -2,6 +2,7 @@ package oplog
 
 import (
 	"errors"
+	"regexp"
 	"strconv"
 	"sync"
 	"testing"
@@ -16,6 +17,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/redispub"
 )
 
 func encodeMongoTimestamp(ts primitive.Timestamp) string {
@@ -70,6 +72,13 @@ func TestGetStartTime(t *testing.T) {
 		// end-of-oplog fallback. On a persistent Redis read failure it must NOT, since
 		// that would silently skip oplog entries.
 		expectMongoFallback bool
+		// throttleCatchUp sets Tailer.ThrottleCatchUp, and expectedCatchUpTo is
+		// where the throttled catch-up should end
+		throttleCatchUp   bool
+		expectedCatchUpTo *primitive.Timestamp
+		// expectedSkip is the reason of the skip getStartTime should record,
+		// if any
+		expectedSkip string
 	}{
 		"Start time is in Redis": {
 			redisTimestamp: mongoTS(notTooOld),
@@ -80,6 +89,20 @@ func TestGetStartTime(t *testing.T) {
 			mongoEndOfOplog:     mongoTS(notTooOld),
 			expectedResult:      mongoTS(notTooOld),
 			expectMongoFallback: true,
+			expectedSkip:        redispub.SkipReasonGapTooLarge,
+		},
+		"Start time is in redis, but too old, with throttled catch-up": {
+			redisTimestamp:      mongoTS(tooOld),
+			mongoEndOfOplog:     mongoTS(notTooOld),
+			throttleCatchUp:     true,
+			expectedResult:      mongoTS(tooOld),
+			expectedCatchUpTo:   &primitive.Timestamp{T: uint32(notTooOld.Unix())},
+			expectMongoFallback: true,
+		},
+		"Start time is in Redis, with throttled catch-up": {
+			redisTimestamp:  mongoTS(notTooOld),
+			throttleCatchUp: true,
+			expectedResult:  mongoTS(notTooOld),
 		},
 		"Start time not in Redis": {
 			// We use tooOld here to make sure we're not applying any kind
@@ -122,6 +145,7 @@ func TestGetStartTime(t *testing.T) {
 			resumeFromEndOnFailure: true,
 			expectedResult:         mongoTS(tooOld),
 			expectMongoFallback:    true,
+			expectedSkip:           redispub.SkipReasonResumeFailure,
 		},
 	}
 
@@ -154,7 +178,9 @@ func TestGetStartTime(t *testing.T) {
 				return false
 			})
 
-			require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.0", encodeMongoTimestamp(test.redisTimestamp)))
+			if !test.redisTimestamp.IsZero() {
+				require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.0", encodeMongoTimestamp(test.redisTimestamp)))
+			}
 
 			redisClient := []redis.UniversalClient{redis.NewUniversalClient(&redis.UniversalOptions{
 				Addrs: []string{redisServer.Addr()},
@@ -165,10 +191,12 @@ func TestGetStartTime(t *testing.T) {
 				RedisPrefix:  "someprefix.",
 				MaxCatchUp:   maxCatchUp,
 				Denylist:     &sync.Map{},
+
+				ThrottleCatchUp: test.throttleCatchUp,
 			}
 
 			mongoFallbackCalled := false
-			actualResult, err := tailer.getStartTime(0, func() (*primitive.Timestamp, error) {
+			actualResult, catchUpTo, err := tailer.getStartTime(0, func() (*primitive.Timestamp, error) {
 				mongoFallbackCalled = true
 				if test.mongoEndOfOplogErr != nil {
 					return nil, test.mongoEndOfOplogErr
@@ -185,6 +213,15 @@ func TestGetStartTime(t *testing.T) {
 
 			require.Equal(t, test.expectMongoFallback, mongoFallbackCalled,
 				"unexpected use of the Mongo end-of-oplog fallback")
+			require.Equal(t, test.expectedCatchUpTo, catchUpTo)
+
+			skips, _ := redisServer.List(redispub.SkipsKey("someprefix."))
+			if test.expectedSkip == "" {
+				require.Empty(t, skips)
+			} else {
+				require.Len(t, skips, 1)
+				require.Contains(t, skips[0], `"reason":"`+test.expectedSkip+`"`)
+			}
 
 			// On a persistent Redis read failure we must not return a usable start
 			// time at all, so skip the timestamp comparison for that case.
@@ -273,7 +310,7 @@ func TestParseRawOplogEntry(t *testing.T) {
 				WallTime:  time.Unix(1234, 0).UTC(),
 				Operation: "c",
 				Namespace: "foo.$cmd",
-				Doc:       rawBson(t, map[string]interface{}{"drop": "Foo"}),
+				Doc:       rawBson(t, map[string]interface{}{"create": "Foo"}),
 			},
 			want: nil,
 		},
@@ -478,6 +515,76 @@ func TestParseNamespace(t *testing.T) {
 	}
 }
 
+func TestOplogQueryFilter(t *testing.T) {
+	startTime := primitive.Timestamp{T: 1234, I: 5}
+
+	denylist := &sync.Map{}
+	denylist.Store("zzz", true)
+	denylist.Store("a.b", true)
+	denylist.Store("admin", true)
+
+	filter := oplogQueryFilter(startTime, denylist)
+
+	require.Equal(t, bson.M{"$gt": startTime}, filter["ts"])
+	require.Equal(t, bson.M{"$nin": bson.A{
+		primitive.Regex{Pattern: `^a\.b\.`},
+		primitive.Regex{Pattern: `^admin\.($|[^$]|\$($|[^c]|c($|[^m]|m($|[^d]|d.))))`},
+		primitive.Regex{Pattern: `^zzz\.`},
+		primitive.Regex{Pattern: `^config\.`},
+		primitive.Regex{Pattern: `^[^.]+\.system\.($|[^b]|b($|[^u])|bu($|[^c])|buc($|[^k])|buck($|[^e])|bucke($|[^t])|bucket($|[^s])|buckets($|[^.]))`},
+	}}, filter["ns"])
+	require.Equal(t, bson.M{"$ne": true}, filter["fromMigrate"])
+}
+
+func TestOplogQueryFilterPatterns(t *testing.T) {
+	denylist := &sync.Map{}
+	denylist.Store("denied", true)
+	denylist.Store("admin", true)
+
+	patterns := oplogQueryFilter(primitive.Timestamp{}, denylist)["ns"].(bson.M)["$nin"].(bson.A)
+
+	excluded := func(ns string) bool {
+		for _, pattern := range patterns {
+			if regexp.MustCompile(pattern.(primitive.Regex).Pattern).MatchString(ns) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := map[string]bool{
+		"denied.foo":                      true,
+		"denied.$cmd":                     true,
+		"config.transactions":             true,
+		"foo.system.indexes":              true,
+		"foo.system.":                     true,
+		"foo.system.b":                    true,
+		"foo.system.bucket":               true,
+		"foo.system.buckets":              true,
+		"foo.system.bucketsx":             true,
+		"foo.system.views":                true,
+		"admin.system.version":            true,
+		"admin.system.users":              true,
+		"admin.foo":                       true,
+		"admin.$cm":                       true,
+		"admin.$cmdx":                     true,
+		"deniedbutnotreally.foo":          false,
+		"foo.bar":                         false,
+		"foo.systemic":                    false,
+		"foo.systemfoo":                   false,
+		"foo.system":                      false,
+		"foo.barsystem.indexes":           false,
+		"foo.system.buckets.measurements": false,
+		"foo.system.buckets.x":            false,
+		"admin.$cmd":                      false,
+		"":                                false,
+	}
+
+	for ns, want := range tests {
+		require.Equalf(t, want, excluded(ns), "namespace %q", ns)
+	}
+}
+
 func TestPrematureStopEscalation(t *testing.T) {
 	// A run that lasted at least minSuccessfulTailDuration resets the streak,
 	// so an isolated premature stop after healthy operation stays a warning.
@@ -501,3 +608,21 @@ func TestPrematureStopEscalation(t *testing.T) {
 	streak = nextPrematureStopStreak(streak, minSuccessfulTailDuration)
 	require.False(t, prematureStopIsError(streak))
 }
+
+func TestUnmarshalEntryMetadataFromMigrate(t *testing.T) {
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	entry := bson.M{
+		"ts": primitive.Timestamp{T: 1234, I: 5},
+		"op": "i",
+		"ns": "foo.bar",
+		"o":  bson.M{"_id": "someid"},
+	}
+	require.NotNil(t, tailer.unmarshalEntryMetadata(rawBson(t, entry)))
+
+	entry["fromMigrate"] = false
+	require.NotNil(t, tailer.unmarshalEntryMetadata(rawBson(t, entry)))
+
+	entry["fromMigrate"] = true
+	require.Nil(t, tailer.unmarshalEntryMetadata(rawBson(t, entry)))
+}
@@ -0,0 +1,276 @@
+package oplog
+
+import (
+	"strings"
+
+	"github.com/tulip/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// bucketsPrefix is the prefix of the collections that hold the data of
+// time-series collections. Writes to a time-series collection `db.name` are
+// logged in the oplog as writes to buckets in `db.system.buckets.name`.
+const bucketsPrefix = "system.buckets."
+
+// resyncReasonTimeSeries is the reason of the resync message we publish for
+// a bucket write that we can't get the affected measurements of
+const resyncReasonTimeSeries = "timeseries"
+
+// A measurement of a time-series collection that was written to by a bucket
+// write
+type bucketMeasurement struct {
+	operation string
+	id        bson.RawValue
+	fields    []string
+}
+
+// parseBucketEntry converts a write to a time-series bucket into entries for
+// the user-facing time-series collection. Where we can tell which measurements
+// were written (inserts of uncompressed buckets, and updates that add
+// measurements to them), there's one entry per measurement, with the
+// measurement's _id. Otherwise, there's a single resync entry for the whole
+// collection. It's published even without config.ResyncMessages, since it's
+// the only notification there is for the write.
+//
+// A bucket looks like:
+//
+//	{
+//	  _id: ObjectId(...),
+//	  control: { version: 1, min: {...}, max: {...} },
+//	  meta: ...,
+//	  data: {
+//	    _id: { "0": <measurement 0 _id>, "1": <measurement 1 _id> },
+//	    temp: { "0": 12, "1": 13 },
+//	  },
+//	}
+//
+// Compressed buckets (control.version 2) store each data field as a binary
+// column instead, which we don't decode.
+func parseBucketEntry(entry *rawOplogEntry, database string, collection string, txIdx *uint) []oplogEntry {
+	base := oplogEntry{
+		Timestamp:  entry.Timestamp,
+		WallTime:   entry.WallTime,
+		Namespace:  database + "." + collection,
+		Database:   database,
+		Collection: collection,
+	}
+
+	measurements, ok := bucketMeasurements(entry)
+	if !ok || len(measurements) == 0 {
+		resync := base
+		resync.Operation = operationCommand
+		resync.Data = entry.Doc
+		resync.ResyncReason = resyncReasonTimeSeries
+		resync.TxIdx = *txIdx
+		*txIdx++
+		return []oplogEntry{resync}
+	}
+
+	ret := make([]oplogEntry, 0, len(measurements))
+	for _, measurement := range measurements {
+		id, err := parseID(measurement.id)
+		if err != nil {
+			continue
+		}
+
+		doc := bson.D{{Key: "_id", Value: measurement.id}}
+		for _, field := range measurement.fields {
+			doc = append(doc, bson.E{Key: field, Value: true})
+		}
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			log.Log.Errorw("Error marshalling time-series measurement", "error", err)
+			continue
+		}
+
+		out := base
+		out.Operation = measurement.operation
+		out.DocID = id
+		out.Data = data
+		out.TxIdx = *txIdx
+		*txIdx++
+
+		ret = append(ret, out)
+	}
+
+	return ret
+}
+
+// bucketMeasurements returns the measurements written by a bucket write, or
+// false if they can't be determined.
+func bucketMeasurements(entry *rawOplogEntry) ([]bucketMeasurement, bool) {
+	switch entry.Operation {
+	case operationInsert:
+		data, ok := entry.Doc.Lookup("data").DocumentOK()
+		if !ok {
+			return nil, false
+		}
+		return measurementsFromColumns(data, operationInsert)
+
+	case operationUpdate:
+		if diff, ok := entry.Doc.Lookup("diff").DocumentOK(); ok {
+			return measurementsFromV2Update(diff)
+		}
+		if set, ok := entry.Doc.Lookup("$set").DocumentOK(); ok {
+			return measurementsFromV1Update(set)
+		}
+
+		// A replacement of the whole bucket. We can't tell which measurements
+		// changed.
+		return nil, false
+
+	default:
+		// Removing a bucket removes all of its measurements, but the oplog
+		// entry only has the bucket's _id
+		return nil, false
+	}
+}
+
+// measurementsFromColumns reads the measurements out of the data field of an
+// uncompressed bucket, where each field is a document mapping the index of
+// the measurement to its value
+func measurementsFromColumns(data bson.Raw, operation string) ([]bucketMeasurement, bool) {
+	ids, ok := data.Lookup("_id").DocumentOK()
+	if !ok {
+		return nil, false
+	}
+
+	idElems, err := ids.Elements()
+	if err != nil {
+		return nil, false
+	}
+
+	columns, err := data.Elements()
+	if err != nil {
+		return nil, false
+	}
+
+	var measurements []bucketMeasurement
+	for _, idElem := range idElems {
+		measurement := bucketMeasurement{
+			operation: operation,
+			id:        idElem.Value(),
+			fields:    []string{},
+		}
+
+		for _, column := range columns {
+			if column.Key() == "_id" {
+				continue
+			}
+
+			values, ok := column.Value().DocumentOK()
+			if !ok {
+				continue
+			}
+			if _, err := values.LookupErr(idElem.Key()); err == nil {
+				measurement.fields = append(measurement.fields, column.Key())
+			}
+		}
+
+		measurements = append(measurements, measurement)
+	}
+
+	return measurements, true
+}
+
+// measurementsFromV2Update reads the measurements added to (or modified in)
+// a bucket by a v2 update, which looks like:
+//
+//	{ $v: 2, diff: { u: { control: ... }, sdata: { s_id: { i: { "2": <id> } }, stemp: { i: { "2": 14 } } } } }
+func measurementsFromV2Update(diff bson.Raw) ([]bucketMeasurement, bool) {
+	sdata, ok := diff.Lookup("sdata").DocumentOK()
+	if !ok {
+		return nil, false
+	}
+
+	idDiff, ok := sdata.Lookup("s_id").DocumentOK()
+	if !ok {
+		return nil, false
+	}
+
+	columns, err := sdata.Elements()
+	if err != nil {
+		return nil, false
+	}
+
+	var measurements []bucketMeasurement
+	for _, section := range []struct {
+		key       string
+		operation string
+	}{{"i", operationInsert}, {"u", operationUpdate}} {
+		ids, ok := idDiff.Lookup(section.key).DocumentOK()
+		if !ok {
+			continue
+		}
+		idElems, err := ids.Elements()
+		if err != nil {
+			return nil, false
+		}
+
+		for _, idElem := range idElems {
+			measurement := bucketMeasurement{
+				operation: section.operation,
+				id:        idElem.Value(),
+				fields:    []string{},
+			}
+
+			for _, column := range columns {
+				if column.Key() == "s_id" || !strings.HasPrefix(column.Key(), "s") {
+					continue
+				}
+
+				columnDiff, ok := column.Value().DocumentOK()
+				if !ok {
+					continue
+				}
+				for _, key := range []string{"i", "u"} {
+					if _, err := columnDiff.LookupErr(key, idElem.Key()); err == nil {
+						measurement.fields = append(measurement.fields, strings.TrimPrefix(column.Key(), "s"))
+						break
+					}
+				}
+			}
+
+			measurements = append(measurements, measurement)
+		}
+	}
+
+	return measurements, true
+}
+
+// measurementsFromV1Update reads the measurements added to a bucket by a v1
+// update, which looks like:
+//
+//	{ $set: { "data._id.2": <id>, "data.temp.2": 14, "control.max.temp": 14 } }
+func measurementsFromV1Update(set bson.Raw) ([]bucketMeasurement, bool) {
+	elems, err := set.Elements()
+	if err != nil {
+		return nil, false
+	}
+
+	var measurements []bucketMeasurement
+	byIndex := map[string]int{}
+	for _, elem := range elems {
+		if index := strings.TrimPrefix(elem.Key(), "data._id."); index != elem.Key() {
+			byIndex[index] = len(measurements)
+			measurements = append(measurements, bucketMeasurement{
+				operation: operationInsert,
+				id:        elem.Value(),
+				fields:    []string{},
+			})
+		}
+	}
+
+	for _, elem := range elems {
+		parts := strings.Split(elem.Key(), ".")
+		if len(parts) != 3 || parts[0] != "data" || parts[1] == "_id" {
+			continue
+		}
+
+		if i, ok := byIndex[parts[2]]; ok {
+			measurements[i].fields = append(measurements[i].fields, parts[1])
+		}
+	}
+
+	return measurements, true
+}
@@ -0,0 +1,182 @@
+package oplog
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseBucketEntry(t *testing.T) {
+	require.NoError(t, config.ParseEnv())
+
+	bucketID := primitive.NewObjectID()
+	id1 := primitive.NewObjectID()
+	id2 := primitive.NewObjectID()
+
+	type measurement struct {
+		operation string
+		id        interface{}
+		fields    []string
+	}
+
+	tests := map[string]struct {
+		in         rawOplogEntry
+		want       []measurement
+		wantResync bool
+	}{
+		"Insert": {
+			in: rawOplogEntry{
+				Operation: operationInsert,
+				Doc: rawBson(t, bson.M{
+					"_id":     bucketID,
+					"control": bson.M{"version": 1},
+					"data": bson.M{
+						"_id":  bson.D{{Key: "0", Value: id1}, {Key: "1", Value: id2}},
+						"temp": bson.M{"0": 12, "1": 13},
+						"wind": bson.M{"1": 5},
+					},
+				}),
+			},
+			want: []measurement{
+				{operationInsert, id1, []string{"_id", "temp"}},
+				{operationInsert, id2, []string{"_id", "temp", "wind"}},
+			},
+		},
+		"Insert of a compressed bucket": {
+			in: rawOplogEntry{
+				Operation: operationInsert,
+				Doc: rawBson(t, bson.M{
+					"_id":     bucketID,
+					"control": bson.M{"version": 2},
+					"data": bson.M{
+						"_id":  primitive.Binary{Subtype: 7, Data: []byte{1, 2, 3}},
+						"temp": primitive.Binary{Subtype: 7, Data: []byte{1, 2, 3}},
+					},
+				}),
+			},
+			wantResync: true,
+		},
+		"V2 update": {
+			in: rawOplogEntry{
+				Operation: operationUpdate,
+				Doc: rawBson(t, bson.M{
+					"$v": 2,
+					"diff": bson.M{
+						"scontrol": bson.M{"smax": bson.M{"u": bson.M{"temp": 14}}},
+						"sdata": bson.M{
+							"s_id":  bson.M{"i": bson.M{"2": id1}},
+							"stemp": bson.M{"i": bson.M{"2": 14}},
+						},
+					},
+				}),
+				Update: rawBson(t, bson.M{"_id": bucketID}),
+			},
+			want: []measurement{
+				{operationInsert, id1, []string{"_id", "temp"}},
+			},
+		},
+		"V1 update": {
+			in: rawOplogEntry{
+				Operation: operationUpdate,
+				Doc: rawBson(t, bson.M{
+					"$v": 1,
+					"$set": bson.D{
+						{Key: "data._id.2", Value: id1},
+						{Key: "data.temp.2", Value: 14},
+						{Key: "data._id.3", Value: id2},
+						{Key: "control.max.temp", Value: 14},
+					},
+				}),
+				Update: rawBson(t, bson.M{"_id": bucketID}),
+			},
+			want: []measurement{
+				{operationInsert, id1, []string{"_id", "temp"}},
+				{operationInsert, id2, []string{"_id"}},
+			},
+		},
+		"Replacement": {
+			in: rawOplogEntry{
+				Operation: operationUpdate,
+				Doc:       rawBson(t, bson.M{"_id": bucketID, "data": bson.M{"_id": bson.M{"0": id1}}}),
+				Update:    rawBson(t, bson.M{"_id": bucketID}),
+			},
+			wantResync: true,
+		},
+		"Remove": {
+			in: rawOplogEntry{
+				Operation: operationRemove,
+				Doc:       rawBson(t, bson.M{"_id": bucketID}),
+			},
+			wantResync: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.in.Namespace = "foo.system.buckets.weather"
+			test.in.Timestamp = primitive.Timestamp{T: 1234}
+
+			entries := (&Tailer{Denylist: &sync.Map{}}).parseRawOplogEntry(&test.in, nil)
+
+			if test.wantResync {
+				require.Len(t, entries, 1)
+				pub, err := processOplogEntry(&entries[0])
+				require.NoError(t, err)
+				require.Equal(t, []string{"foo.weather"}, pub.Channels)
+				require.Equal(t, redispub.ResyncMessage(resyncReasonTimeSeries), pub.Msg)
+				return
+			}
+
+			var got []measurement
+			for i, entry := range entries {
+				require.Equal(t, "foo.weather", entry.Namespace)
+				require.Equal(t, "weather", entry.Collection)
+				require.Equal(t, uint(i), entry.TxIdx)
+
+				fields, err := entry.ChangedFields()
+				require.NoError(t, err)
+				sort.Strings(fields)
+				got = append(got, measurement{entry.Operation, entry.DocID, fields})
+
+				pub, err := processOplogEntry(&entry)
+				require.NoError(t, err)
+				require.Equal(t, "foo.weather", pub.Channels[0])
+			}
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestParseBucketEntryWithoutResyncMessages(t *testing.T) {
+	t.Setenv("OTR_RESYNC_MESSAGES", "false")
+	require.NoError(t, config.ParseEnv())
+
+	entries := (&Tailer{Denylist: &sync.Map{}}).parseRawOplogEntry(&rawOplogEntry{
+		Operation: operationRemove,
+		Namespace: "foo.system.buckets.weather",
+		Doc:       rawBson(t, bson.M{"_id": primitive.NewObjectID()}),
+	}, nil)
+	require.Len(t, entries, 1)
+	require.Equal(t, resyncReasonTimeSeries, entries[0].ResyncReason)
+	require.Equal(t, "foo.weather", entries[0].Namespace)
+}
+
+func TestDropTimeSeriesCollection(t *testing.T) {
+	t.Setenv("OTR_DDL_EVENTS", "drop")
+	require.NoError(t, config.ParseEnv())
+
+	entries := (&Tailer{Denylist: &sync.Map{}}).parseRawOplogEntry(&rawOplogEntry{
+		Operation: operationCommand,
+		Namespace: "foo.$cmd",
+		Doc:       rawBson(t, bson.D{{Key: "drop", Value: "system.buckets.weather"}}),
+	}, nil)
+
+	require.Len(t, entries, 1)
+	require.Equal(t, "foo.weather", entries[0].Namespace)
+}
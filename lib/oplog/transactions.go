@@ -0,0 +1,235 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Transactions that don't fit in a single oplog entry (because they're larger
+// than 16MB), and prepared transactions (which are used for transactions that
+// span multiple shards), are written to the oplog as a chain of entries. The
+// chain starts with zero or more { applyOps: [...], partialTxn: true }
+// entries, and is committed by either:
+//
+//   - a final { applyOps: [...] } entry, for unprepared transactions
+//   - a { applyOps: [...], prepare: true } entry, followed later by a
+//     { commitTransaction: 1 } or { abortTransaction: 1 } entry, for prepared
+//     transactions
+//
+// Every entry in the chain has the lsid and txnNumber of the transaction, and a
+// prevOpTime pointing at the previous entry of the chain (or a zero timestamp
+// for the first entry). We buffer the operations of the chain until it's
+// committed, and then publish them all with the timestamp of the commit entry.
+
+var (
+	metricTransactionChains = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "transaction_chains",
+		Help:      "Multi-entry transactions seen in the oplog, partitioned by outcome (committed, aborted, fetched)",
+	}, []string{"outcome"})
+
+	metricPendingTransactions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "pending_transactions",
+		Help:      "Gauge indicating the number of multi-entry transactions we're waiting to see the commit of",
+	})
+)
+
+// maxTxnChainLength is a backstop against following a corrupt prevOpTime
+// chain forever when fetching a chain from the oplog
+const maxTxnChainLength = 100000
+
+// pendingTxn holds the operations of a multi-entry transaction that hasn't
+// been committed yet
+type pendingTxn struct {
+	// ops are the elements of the applyOps arrays of each entry of the chain,
+	// in order
+	ops []bson.RawValue
+
+	// lastTimestamp is the timestamp of the last entry we buffered, so that we
+	// don't buffer an entry twice if it's read twice
+	lastTimestamp primitive.Timestamp
+}
+
+// txnKey identifies a transaction by its session ID and transaction number.
+// Returns "" for entries that aren't part of a transaction.
+func txnKey(entry *rawOplogEntry) string {
+	if len(entry.LSID) == 0 {
+		return ""
+	}
+
+	return string(entry.LSID) + ":" + strconv.FormatInt(entry.TxnNumber, 10)
+}
+
+// transactionOps determines which transaction operations (the elements of
+// applyOps arrays) should be published for an admin.$cmd entry. It buffers the
+// operations of uncommitted transactions, and returns the operations of the
+// whole transaction when it's committed. Returns nil if there's nothing to
+// publish.
+func (tailer *Tailer) transactionOps(entry *rawOplogEntry) []bson.RawValue {
+	key := txnKey(entry)
+
+	if _, err := entry.Doc.LookupErr("commitTransaction"); err == nil {
+		return tailer.takeTxnChain(key, entry)
+	}
+
+	if _, err := entry.Doc.LookupErr("abortTransaction"); err == nil {
+		if tailer.pendingTxns[key] != nil {
+			delete(tailer.pendingTxns, key)
+			metricPendingTransactions.Dec()
+		}
+		metricTransactionChains.WithLabelValues("aborted").Inc()
+		log.Log.Debugw("Discarding aborted transaction", "txnNumber", entry.TxnNumber)
+		return nil
+	}
+
+	ops, ok := applyOpsValues(entry.Doc)
+	if !ok {
+		return nil
+	}
+
+	partial, _ := entry.Doc.Lookup("partialTxn").BooleanOK()
+	prepare, _ := entry.Doc.Lookup("prepare").BooleanOK()
+	if (partial || prepare) && key != "" {
+		pending := tailer.pendingTxns[key]
+		if pending == nil {
+			if tailer.pendingTxns == nil {
+				tailer.pendingTxns = map[string]*pendingTxn{}
+			}
+			pending = &pendingTxn{}
+			tailer.pendingTxns[key] = pending
+			metricPendingTransactions.Inc()
+		} else if !pending.lastTimestamp.Before(entry.Timestamp) {
+			return nil
+		}
+
+		pending.ops = append(pending.ops, ops...)
+		pending.lastTimestamp = entry.Timestamp
+		return nil
+	}
+
+	// Either a regular single-entry transaction, or the entry that commits a
+	// chain of partialTxn entries
+	return append(tailer.takeTxnChain(key, entry), ops...)
+}
+
+// takeTxnChain returns the buffered operations of the transaction chain that
+// entry commits, and forgets about them. If entry doesn't have a
+// prevOpTime, it's not part of a chain and there are no operations to return.
+// If entry has a prevOpTime, but we haven't seen the rest of the chain (because
+// we started tailing partway through it), we read the chain from the oplog.
+func (tailer *Tailer) takeTxnChain(key string, entry *rawOplogEntry) []bson.RawValue {
+	if pending := tailer.pendingTxns[key]; key != "" && pending != nil {
+		delete(tailer.pendingTxns, key)
+		metricPendingTransactions.Dec()
+		metricTransactionChains.WithLabelValues("committed").Inc()
+		return pending.ops
+	}
+
+	if entry.PrevTimestamp.IsZero() {
+		return nil
+	}
+
+	ops, err := tailer.fetchTxnChain(entry.PrevTimestamp)
+	if err != nil {
+		log.Log.Errorw("Error reading the entries of a multi-entry transaction from the oplog; the transaction won't be published",
+			"error", err,
+			"txnNumber", entry.TxnNumber,
+			"timestamp", entry.Timestamp)
+		return nil
+	}
+
+	metricTransactionChains.WithLabelValues("fetched").Inc()
+	return ops
+}
+
+// fetchTxnChain reads the chain of transaction entries ending at the entry with
+// timestamp last from the oplog, by following prevOpTime, and returns their
+// operations in order.
+func (tailer *Tailer) fetchTxnChain(last primitive.Timestamp) ([]bson.RawValue, error) {
+	if tailer.MongoClient == nil {
+		return nil, errors.New("no Mongo client")
+	}
+
+	oplogCollection := tailer.MongoClient.Database("local").Collection("oplog.rs")
+
+	var chain [][]bson.RawValue
+	for ts := last; !ts.IsZero(); {
+		if len(chain) >= maxTxnChainLength {
+			return nil, errors.New("transaction chain is too long")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+		var rawData bson.Raw
+		err := oplogCollection.FindOne(ctx, bson.M{"ts": ts}).Decode(&rawData)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		doc, ok := rawData.Lookup("o").DocumentOK()
+		if !ok {
+			return nil, errors.New("transaction entry has no o field")
+		}
+
+		ops, ok := applyOpsValues(doc)
+		if !ok {
+			return nil, errors.New("transaction entry has no applyOps")
+		}
+		chain = append(chain, ops)
+
+		t, i, _ := rawData.Lookup("prevOpTime", "ts").TimestampOK()
+		ts = primitive.Timestamp{T: t, I: i}
+	}
+
+	var ops []bson.RawValue
+	for i := len(chain) - 1; i >= 0; i-- {
+		ops = append(ops, chain[i]...)
+	}
+
+	return ops, nil
+}
+
+// applyOpsValues returns the elements of the applyOps array of a command
+// entry's o field
+func applyOpsValues(doc bson.Raw) ([]bson.RawValue, bool) {
+	applyOpsLookup, err := doc.LookupErr("applyOps")
+	if err != nil {
+		list, errList := doc.Elements()
+		if errList != nil {
+			log.Log.Debugf("applyOps key not found in command entry: %v, doc error: %v", err, errList)
+			return nil, false
+		}
+		keys := []string{}
+		for _, rawElem := range list {
+			keys = append(keys, rawElem.Key())
+		}
+		log.Log.Debugf("applyOps key not found in command entry, ignoring. Keys: %v", strings.Join(keys, ", "))
+		return nil, false
+	}
+
+	applyOpsArray, ok := applyOpsLookup.ArrayOK()
+	if !ok {
+		log.Log.Error("Failed to access transaction data as array")
+		return nil, false
+	}
+
+	values, err := applyOpsArray.Values()
+	if err != nil {
+		log.Log.Errorf("Getting transaction ops array: %v", err)
+		return nil, false
+	}
+
+	return values, true
+}
@@ -0,0 +1,138 @@
+package oplog
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMultiEntryTransactions(t *testing.T) {
+	tailer := &Tailer{Denylist: &sync.Map{}}
+	lsid := rawBson(t, bson.M{"id": primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}})
+
+	op := func(operation string, id string) bson.M {
+		entry := bson.M{"op": operation, "ns": "foo.Bar", "o": bson.M{"_id": id}}
+		if operation == operationUpdate {
+			entry["o"] = bson.M{"$v": 1, "$set": bson.M{"a": 1}}
+			entry["o2"] = bson.M{"_id": id}
+		}
+		return entry
+	}
+
+	txnEntry := func(ts uint32, prevTs uint32, txnNumber int64, doc bson.M) *rawOplogEntry {
+		return &rawOplogEntry{
+			Timestamp:     primitive.Timestamp{T: ts},
+			WallTime:      time.Unix(int64(ts), 0).UTC(),
+			Operation:     operationCommand,
+			Namespace:     "admin.$cmd",
+			Doc:           rawBson(t, doc),
+			LSID:          lsid,
+			TxnNumber:     txnNumber,
+			PrevTimestamp: primitive.Timestamp{T: prevTs},
+		}
+	}
+
+	type result struct {
+		DocID     interface{}
+		Timestamp primitive.Timestamp
+		TxIdx     uint
+	}
+	results := func(entries []oplogEntry) []result {
+		ret := []result{}
+		for _, entry := range entries {
+			ret = append(ret, result{entry.DocID, entry.Timestamp, entry.TxIdx})
+		}
+		return ret
+	}
+
+	t.Run("Unprepared", func(t *testing.T) {
+		first := txnEntry(10, 0, 1, bson.M{"applyOps": bson.A{op("i", "a"), op("i", "b")}, "partialTxn": true})
+		second := txnEntry(12, 10, 1, bson.M{"applyOps": bson.A{op("u", "c")}, "partialTxn": true})
+		commit := txnEntry(13, 12, 1, bson.M{"applyOps": bson.A{op("d", "d")}, "count": 4})
+
+		require.Empty(t, tailer.parseRawOplogEntry(first, nil))
+
+		// Operations outside of the transaction are published right away
+		unrelated := &rawOplogEntry{
+			Timestamp: primitive.Timestamp{T: 11},
+			Operation: operationInsert,
+			Namespace: "foo.Bar",
+			Doc:       rawBson(t, bson.M{"_id": "x"}),
+		}
+		require.Equal(t, []result{{"x", primitive.Timestamp{T: 11}, 0}}, results(tailer.parseRawOplogEntry(unrelated, nil)))
+
+		require.Empty(t, tailer.parseRawOplogEntry(second, nil))
+		// Reading an entry of the chain twice doesn't duplicate its operations
+		require.Empty(t, tailer.parseRawOplogEntry(second, nil))
+
+		require.Equal(t, []result{
+			{"a", primitive.Timestamp{T: 13}, 0},
+			{"b", primitive.Timestamp{T: 13}, 1},
+			{"c", primitive.Timestamp{T: 13}, 2},
+			{"d", primitive.Timestamp{T: 13}, 3},
+		}, results(tailer.parseRawOplogEntry(commit, nil)))
+		require.Empty(t, tailer.pendingTxns)
+	})
+
+	t.Run("Prepared", func(t *testing.T) {
+		partial := txnEntry(20, 0, 2, bson.M{"applyOps": bson.A{op("i", "a")}, "partialTxn": true})
+		prepare := txnEntry(21, 20, 2, bson.M{"applyOps": bson.A{op("i", "b")}, "prepare": true})
+		commit := txnEntry(23, 21, 2, bson.M{"commitTransaction": 1, "commitTimestamp": primitive.Timestamp{T: 22}})
+
+		require.Empty(t, tailer.parseRawOplogEntry(partial, nil))
+		require.Empty(t, tailer.parseRawOplogEntry(prepare, nil))
+		require.Equal(t, []result{
+			{"a", primitive.Timestamp{T: 23}, 0},
+			{"b", primitive.Timestamp{T: 23}, 1},
+		}, results(tailer.parseRawOplogEntry(commit, nil)))
+		require.Empty(t, tailer.pendingTxns)
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		prepare := txnEntry(30, 0, 3, bson.M{"applyOps": bson.A{op("i", "a")}, "prepare": true})
+		abort := txnEntry(31, 30, 3, bson.M{"abortTransaction": 1})
+
+		require.Empty(t, tailer.parseRawOplogEntry(prepare, nil))
+		require.Empty(t, tailer.parseRawOplogEntry(abort, nil))
+		require.Empty(t, tailer.pendingTxns)
+	})
+
+	t.Run("Single entry", func(t *testing.T) {
+		entry := txnEntry(40, 0, 4, bson.M{"applyOps": bson.A{op("i", "a"), op("d", "b")}})
+
+		require.Equal(t, []result{
+			{"a", primitive.Timestamp{T: 40}, 0},
+			{"b", primitive.Timestamp{T: 40}, 1},
+		}, results(tailer.parseRawOplogEntry(entry, nil)))
+	})
+
+	t.Run("Commit without the rest of the chain", func(t *testing.T) {
+		// We can't read the chain from the oplog without a Mongo client, so
+		// nothing is published
+		commit := txnEntry(51, 50, 5, bson.M{"commitTransaction": 1})
+		require.Empty(t, tailer.parseRawOplogEntry(commit, nil))
+	})
+}
+
+func TestUnmarshalEntryMetadataTransactionFields(t *testing.T) {
+	tailer := &Tailer{Denylist: &sync.Map{}}
+
+	entry := tailer.unmarshalEntryMetadata(rawBson(t, bson.M{
+		"ts":         primitive.Timestamp{T: 12},
+		"op":         "c",
+		"ns":         "admin.$cmd",
+		"o":          bson.M{"applyOps": bson.A{}, "partialTxn": true},
+		"lsid":       bson.M{"id": "session"},
+		"txnNumber":  int64(7),
+		"prevOpTime": bson.M{"ts": primitive.Timestamp{T: 10}, "t": int64(1)},
+	}))
+
+	require.NotNil(t, entry)
+	require.Equal(t, rawBson(t, bson.M{"id": "session"}), entry.LSID)
+	require.Equal(t, int64(7), entry.TxnNumber)
+	require.Equal(t, primitive.Timestamp{T: 10}, entry.PrevTimestamp)
+}
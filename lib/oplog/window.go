@@ -0,0 +1,211 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	descOplogWindow = prometheus.NewDesc(
+		"otr_oplog_window_seconds",
+		"Gauge indicating the time between the oldest and newest entries of the oplog, in seconds",
+		nil, nil)
+	descCheckpointHeadroom = prometheus.NewDesc(
+		"otr_oplog_checkpoint_headroom_seconds",
+		"Gauge indicating the time between the oldest entry of the oplog and the earliest last processed timestamp, in seconds. If it reaches 0, entries we haven't processed fall out of the oplog.",
+		nil, nil)
+	descCheckpointHeadroomRatio = prometheus.NewDesc(
+		"otr_oplog_checkpoint_headroom_ratio",
+		"Gauge indicating otr_oplog_checkpoint_headroom_seconds as a fraction of otr_oplog_window_seconds: 1 when we're at the newest entry of the oplog, and 0 when we're about to fall out of it",
+		nil, nil)
+)
+
+// WindowSample is a measurement of the oplog window: the timestamps of the
+// oldest and newest entries in the oplog, and of the earliest checkpoint
+type WindowSample struct {
+	First      primitive.Timestamp
+	Last       primitive.Timestamp
+	Checkpoint primitive.Timestamp
+}
+
+// Window is the time between the oldest and newest entries of the oplog
+func (s WindowSample) Window() time.Duration {
+	return timestampDiff(s.Last, s.First)
+}
+
+// Headroom is the time between the oldest entry of the oplog and the
+// checkpoint, which is how far the oplog can roll over before we lose entries
+// we haven't processed
+func (s WindowSample) Headroom() time.Duration {
+	return timestampDiff(s.Checkpoint, s.First)
+}
+
+// HeadroomRatio is Headroom as a fraction of Window, from 0 to 1
+func (s WindowSample) HeadroomRatio() float64 {
+	if s.Window() <= 0 {
+		return 1
+	}
+
+	ratio := s.Headroom().Seconds() / s.Window().Seconds()
+	if ratio > 1 {
+		// The checkpoint was read after the newest entry
+		ratio = 1
+	}
+	return ratio
+}
+
+// timestampDiff returns a - b, or 0 if a is before b
+func timestampDiff(a, b primitive.Timestamp) time.Duration {
+	if a.T < b.T {
+		return 0
+	}
+	return time.Duration(a.T-b.T) * time.Second
+}
+
+// WindowMonitor periodically samples the oplog window, and how close the
+// earliest checkpoint is to falling out of it. It's a prometheus.Collector for
+// the otr_oplog_window_seconds, otr_oplog_checkpoint_headroom_seconds, and
+// otr_oplog_checkpoint_headroom_ratio metrics, which are only reported once
+// there's a sample.
+type WindowMonitor struct {
+	MongoClient *mongo.Client
+	Checkpoints redispub.CheckpointStore
+
+	// WriteParallelism is the number of checkpoints
+	WriteParallelism int
+
+	mutex  sync.Mutex
+	sample *WindowSample
+}
+
+// Run samples the oplog window every interval until stop is closed. Reading
+// the oplog requires access to the local database; if the user doesn't have
+// it, we log it once and stop.
+func (m *WindowMonitor) Run(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sample, err := m.measure()
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == errCodeUnauthorized {
+			log.Log.Warnw("Can't read the oplog; the oplog window won't be reported",
+				"error", err)
+			return
+		} else if err != nil {
+			log.Log.Errorw("Error measuring the oplog window",
+				"error", err)
+		} else {
+			m.mutex.Lock()
+			m.sample = sample
+			m.mutex.Unlock()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample returns the most recent sample, or false if there isn't one yet
+func (m *WindowMonitor) Sample() (WindowSample, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.sample == nil {
+		return WindowSample{}, false
+	}
+	return *m.sample, true
+}
+
+// Describe implements prometheus.Collector
+func (m *WindowMonitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descOplogWindow
+	ch <- descCheckpointHeadroom
+	ch <- descCheckpointHeadroomRatio
+}
+
+// Collect implements prometheus.Collector
+func (m *WindowMonitor) Collect(ch chan<- prometheus.Metric) {
+	sample, ok := m.Sample()
+	if !ok {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(descOplogWindow, prometheus.GaugeValue, sample.Window().Seconds())
+	if !sample.Checkpoint.IsZero() {
+		ch <- prometheus.MustNewConstMetric(descCheckpointHeadroom, prometheus.GaugeValue, sample.Headroom().Seconds())
+		ch <- prometheus.MustNewConstMetric(descCheckpointHeadroomRatio, prometheus.GaugeValue, sample.HeadroomRatio())
+	}
+}
+
+// NewestOplogTimestamp returns the timestamp of the newest entry in the oplog
+// of the replica set client is connected to
+func NewestOplogTimestamp(client *mongo.Client) (primitive.Timestamp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	return newestOplogTimestamp(ctx, client.Database("local").Collection("oplog.rs"))
+}
+
+func newestOplogTimestamp(ctx context.Context, oplogCollection *mongo.Collection) (primitive.Timestamp, error) {
+	var entry rawOplogEntry
+	err := oplogCollection.FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.M{"$natural": -1}).SetProjection(bson.M{"ts": 1})).Decode(&entry)
+	return entry.Timestamp, err
+}
+
+// measure reads the oldest and newest entries of the oplog, and the earliest
+// checkpoint. The checkpoint is zero if there isn't one yet.
+func (m *WindowMonitor) measure() (*WindowSample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	oplogCollection := m.MongoClient.Database("local").Collection("oplog.rs")
+	findEnd := func(direction int) (primitive.Timestamp, error) {
+		var entry rawOplogEntry
+		err := oplogCollection.FindOne(ctx, bson.M{},
+			options.FindOne().SetSort(bson.M{"$natural": direction}).SetProjection(bson.M{"ts": 1})).Decode(&entry)
+		return entry.Timestamp, err
+	}
+
+	sample := &WindowSample{}
+	var err error
+	if sample.First, err = findEnd(1); err != nil {
+		return nil, err
+	}
+	if sample.Last, err = findEnd(-1); err != nil {
+		return nil, err
+	}
+
+	// Ordinals that don't have a checkpoint yet don't hold us back
+	for i := 0; i < m.WriteParallelism; i++ {
+		checkpoint, err := m.Checkpoints.Load(i)
+		if errors.Is(err, redispub.ErrNoCheckpoint) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ts := checkpoint.Timestamp
+		if sample.Checkpoint.IsZero() || ts.Before(sample.Checkpoint) {
+			sample.Checkpoint = ts
+		}
+	}
+
+	return sample, nil
+}
@@ -0,0 +1,72 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWindowSample(t *testing.T) {
+	tests := map[string]struct {
+		sample       WindowSample
+		wantWindow   time.Duration
+		wantHeadroom time.Duration
+		wantRatio    float64
+	}{
+		"Caught up": {
+			sample:       WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}, Checkpoint: primitive.Timestamp{T: 2000}},
+			wantWindow:   1000 * time.Second,
+			wantHeadroom: 1000 * time.Second,
+			wantRatio:    1,
+		},
+		"Behind": {
+			sample:       WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}, Checkpoint: primitive.Timestamp{T: 1100}},
+			wantWindow:   1000 * time.Second,
+			wantHeadroom: 100 * time.Second,
+			wantRatio:    0.1,
+		},
+		"Fell out of the oplog": {
+			sample:       WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}, Checkpoint: primitive.Timestamp{T: 900}},
+			wantWindow:   1000 * time.Second,
+			wantHeadroom: 0,
+			wantRatio:    0,
+		},
+		"Checkpoint read after the newest entry": {
+			sample:       WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}, Checkpoint: primitive.Timestamp{T: 2001}},
+			wantWindow:   1000 * time.Second,
+			wantHeadroom: 1001 * time.Second,
+			wantRatio:    1,
+		},
+		"Single entry": {
+			sample:       WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 1000}, Checkpoint: primitive.Timestamp{T: 1000}},
+			wantWindow:   0,
+			wantHeadroom: 0,
+			wantRatio:    1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.wantWindow, test.sample.Window())
+			require.Equal(t, test.wantHeadroom, test.sample.Headroom())
+			require.InDelta(t, test.wantRatio, test.sample.HeadroomRatio(), 1e-9)
+		})
+	}
+}
+
+func TestWindowMonitorCollect(t *testing.T) {
+	monitor := &WindowMonitor{}
+
+	// Nothing is reported before the first sample
+	require.Equal(t, 0, testutil.CollectAndCount(monitor))
+
+	// The headroom isn't reported until there's a checkpoint
+	monitor.sample = &WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}}
+	require.Equal(t, 1, testutil.CollectAndCount(monitor))
+
+	monitor.sample = &WindowSample{First: primitive.Timestamp{T: 1000}, Last: primitive.Timestamp{T: 2000}, Checkpoint: primitive.Timestamp{T: 1500}}
+	require.Equal(t, 3, testutil.CollectAndCount(monitor))
+}
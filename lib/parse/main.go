@@ -33,6 +33,40 @@ func ParseRedisURL(url string, isSentinel bool) (*redis.UniversalOptions, error)
 
 }
 
+// match against redis-cluster://[something@]something
+var clusterURLMatcher *regexp.Regexp = regexp.MustCompile(`redis-cluster:\/\/(([^@]+)@)?([^/]+)`)
+
+// IsClusterURL returns whether url is a Redis Cluster pseudo-url (see
+// ParseRedisClusterURL)
+func IsClusterURL(url string) bool {
+	return strings.HasPrefix(url, "redis-cluster://")
+}
+
+// ParseRedisClusterURL converts a Redis Cluster pseudo-url into a set of redis
+// cluster connection options. We expect cluster urls to be of the form
+// redis-cluster://[password@]host:port[,host2:port2][,hostN:portN], where the
+// hosts are some of the cluster's nodes, that the rest of the cluster is
+// discovered from. Redis Cluster has no databases other than 0, and as with
+// sentinel urls, there's no tls config.
+func ParseRedisClusterURL(url string) (*redis.ClusterOptions, error) {
+	match := clusterURLMatcher.FindStringSubmatch(url)
+	if match == nil || match[0] != url {
+		return nil, errors.New("Redis Cluster URL did not conform to schema")
+	}
+
+	endpointsList := strings.Split(match[3], ",")
+	for _, endpoint := range endpointsList {
+		if endpointMatcher.FindString(endpoint) != endpoint {
+			return nil, errors.New("Redis Cluster URL Endpoints List did not conform to schema")
+		}
+	}
+
+	return &redis.ClusterOptions{
+		Addrs:    endpointsList,
+		Password: match[2],
+	}, nil
+}
+
 // match against redis-sentinel://[something@]something[/db]
 var urlMatcher *regexp.Regexp = regexp.MustCompile(`redis-sentinel:\/\/(([^@]+)@)?([^/]+)(\/(\d+))?`)
 
@@ -0,0 +1,542 @@
+package redispub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+)
+
+// OverflowResyncReason is the reason of the resync messages a Buffer
+// publishes for the collections it dropped publications for
+const OverflowResyncReason = "overflow"
+
+var metricBufferDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "buffer_dropped",
+	Help:      "Publications dropped because a publication buffer was full",
+})
+
+var metricBufferSpilled = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "buffer_spilled",
+	Help:      "Publications written to disk because a publication buffer was full",
+})
+
+// BufferOpts are the options of NewBuffer
+type BufferOpts struct {
+	// Size is the number of publications the buffer holds in memory
+	Size int
+
+	// MaxBytes is the total size of the messages the buffer holds in memory.
+	// A publication bigger than MaxBytes is still accepted when the buffer is
+	// empty. 0 means there's no limit.
+	MaxBytes int64
+
+	// OverflowPolicy is one of the config.BufferOverflow* constants
+	OverflowPolicy string
+
+	// SpillDir is the directory the spill file is created in, for the spill
+	// policy. Defaults to the system temporary directory.
+	SpillDir string
+
+	// Resync makes the drop-oldest policy queue a resync message for each
+	// collection it drops publications of (see config.ResyncMessages)
+	Resync bool
+}
+
+// Buffer holds the publications for a PublishStream that haven't been
+// published yet. It's full when it holds either opts.Size publications or
+// opts.MaxBytes bytes of messages, and then it applies its overflow policy
+// (see config.BufferOverflowPolicy). Send can be called from several goroutines,
+// but the order of publications is only preserved for a single sender.
+type Buffer struct {
+	opts BufferOpts
+	ch   chan *Publication
+
+	mutex sync.Mutex
+
+	// bytes is the size of the messages in ch, and of the ones the reader
+	// has received but not released yet
+	bytes int64
+
+	// room signals senders waiting for room that the reader released a
+	// publication, and waiting is the number of senders waiting for it
+	room    chan struct{}
+	waiting int
+
+	// fullSince is when Send last found the buffer full, or zero if it found
+	// room the last time it was called
+	fullSince time.Time
+
+	// pendingResyncs are the resync messages that still have to be sent for
+	// the collections we dropped publications for, by collection channel
+	pendingResyncs map[string]*Publication
+
+	// spill holds the publications that didn't fit in ch, for the spill policy
+	spill *spillFile
+
+	// spilled signals refill that there are publications in spill, and
+	// drained is broadcast when refill has emptied it
+	spilled chan struct{}
+	drained *sync.Cond
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// NewBuffer creates a Buffer. Call Close to release its resources once the
+// PublishStream reading from it has stopped.
+func NewBuffer(opts BufferOpts) (*Buffer, error) {
+	b := &Buffer{
+		opts:           opts,
+		ch:             make(chan *Publication, opts.Size),
+		pendingResyncs: map[string]*Publication{},
+		room:           make(chan struct{}, 1),
+		spilled:        make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	b.drained = sync.NewCond(&b.mutex)
+
+	if opts.OverflowPolicy == config.BufferOverflowSpill {
+		spill, err := newSpillFile(opts.SpillDir)
+		if err != nil {
+			return nil, err
+		}
+		b.spill = spill
+
+		go b.refill()
+	} else {
+		close(b.done)
+	}
+
+	return b, nil
+}
+
+// Out is the channel the buffered publications can be read from. The reader
+// must call Release once it's done with each publication, to free up its
+// bytes.
+func (b *Buffer) Out() <-chan *Publication {
+	return b.ch
+}
+
+// Release frees up the room a publication received from Out took in the
+// buffer
+func (b *Buffer) Release(pub *Publication) {
+	b.mutex.Lock()
+	b.bytes -= pubSize(pub)
+	b.mutex.Unlock()
+
+	select {
+	case b.room <- struct{}{}:
+	default:
+	}
+}
+
+// Cap is the number of publications the buffer holds in memory
+func (b *Buffer) Cap() int {
+	return cap(b.ch)
+}
+
+// Len is the number of publications in memory
+func (b *Buffer) Len() int {
+	return len(b.ch)
+}
+
+// MaxBytes is the total size of the messages the buffer holds in memory, or 0
+// if there's no limit
+func (b *Buffer) MaxBytes() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.opts.MaxBytes
+}
+
+// SetMaxBytes changes the total size of the messages the buffer holds in
+// memory. If it shrinks below what the buffer holds, the buffer is full until
+// the reader catches up.
+func (b *Buffer) SetMaxBytes(maxBytes int64) {
+	b.mutex.Lock()
+	b.opts.MaxBytes = maxBytes
+	b.mutex.Unlock()
+
+	// Senders waiting for room may fit now
+	select {
+	case b.room <- struct{}{}:
+	default:
+	}
+}
+
+// Bytes is the total size of the messages in memory
+func (b *Buffer) Bytes() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.bytes
+}
+
+// FullFor returns how long the buffer has been full, or 0 if it isn't full.
+// The buffer counts as full while publications are spilled to disk.
+func (b *Buffer) FullFor() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.fullSince.IsZero() {
+		return 0
+	}
+	if !b.isFull() && b.waiting == 0 && (b.spill == nil || b.spill.count == 0) {
+		// It's drained since Send last found it full
+		return 0
+	}
+	return time.Since(b.fullSince)
+}
+
+// Send adds a publication to the buffer, applying the overflow policy if the
+// buffer is full
+func (b *Buffer) Send(pub *Publication) {
+	b.mutex.Lock()
+
+	if (b.spill == nil || b.spill.count == 0) && b.trySend(pub) {
+		b.fullSince = time.Time{}
+		if len(b.pendingResyncs) > 0 {
+			b.sendPendingResyncs(pub)
+		}
+		b.mutex.Unlock()
+		return
+	}
+
+	if b.fullSince.IsZero() {
+		b.fullSince = time.Now()
+	}
+
+	switch b.opts.OverflowPolicy {
+	case config.BufferOverflowDropOldest:
+		if pub.Heartbeat {
+			// Don't drop a publication to make room for a heartbeat; the
+			// next one will carry the position instead
+			b.mutex.Unlock()
+			return
+		}
+		b.sendDroppingOldest(pub)
+		b.sendPendingResyncs(pub)
+		b.mutex.Unlock()
+
+	case config.BufferOverflowSpill:
+		if err := b.spill.push(pub); err != nil {
+			// Fall back to blocking, after the publications that are already
+			// spilled
+			log.Log.Errorw("Error writing publication to spill file; waiting for room in the buffer instead",
+				"error", err)
+			for b.spill.count > 0 {
+				b.drained.Wait()
+			}
+			b.mutex.Unlock()
+			b.waitAndSend(pub, nil)
+			return
+		}
+
+		metricBufferSpilled.Inc()
+		select {
+		case b.spilled <- struct{}{}:
+		default:
+		}
+		b.mutex.Unlock()
+
+	default:
+		b.mutex.Unlock()
+		b.waitAndSend(pub, nil)
+	}
+}
+
+// Close stops the spill goroutine and removes the spill file. Publications
+// that haven't been read yet are discarded.
+func (b *Buffer) Close() {
+	close(b.closed)
+	<-b.done
+
+	if b.spill != nil {
+		b.spill.remove()
+	}
+}
+
+// pubSize is how much room a publication takes in the buffer
+func pubSize(pub *Publication) int64 {
+	return int64(len(pub.Msg))
+}
+
+// isFull returns whether the buffer has reached either of its limits. The
+// mutex must be held.
+func (b *Buffer) isFull() bool {
+	return len(b.ch) == cap(b.ch) || (b.opts.MaxBytes > 0 && b.bytes >= b.opts.MaxBytes)
+}
+
+// fits returns whether pub fits in the buffer. Any publication fits in an empty
+// buffer, so that a publication bigger than MaxBytes can't block forever. The
+// mutex must be held.
+func (b *Buffer) fits(pub *Publication) bool {
+	if len(b.ch) == cap(b.ch) {
+		return false
+	}
+	return b.opts.MaxBytes <= 0 || b.bytes == 0 || b.bytes+pubSize(pub) <= b.opts.MaxBytes
+}
+
+// trySend adds pub to the buffer if it fits. The mutex must be held, so ch
+// can't fill up between checking for room and sending.
+func (b *Buffer) trySend(pub *Publication) bool {
+	if !b.fits(pub) {
+		return false
+	}
+
+	b.ch <- pub
+	b.bytes += pubSize(pub)
+	return true
+}
+
+// waitAndSend waits for room in the buffer and then adds pub, without holding
+// the mutex while it waits so that FullFor can still be called. Returns false
+// if closed is closed first.
+func (b *Buffer) waitAndSend(pub *Publication, closed <-chan struct{}) bool {
+	for {
+		b.mutex.Lock()
+		sent := b.trySend(pub)
+		if !sent {
+			b.waiting++
+		}
+		b.mutex.Unlock()
+		if sent {
+			return true
+		}
+
+		released := false
+		select {
+		case <-b.room:
+			released = true
+		case <-closed:
+		}
+
+		b.mutex.Lock()
+		b.waiting--
+		b.mutex.Unlock()
+		if !released {
+			return false
+		}
+	}
+}
+
+// sendDroppingOldest sends pub, dropping the oldest publications in the buffer
+// until there's room for it
+func (b *Buffer) sendDroppingOldest(pub *Publication) {
+	for !b.trySend(pub) {
+		select {
+		case oldest := <-b.ch:
+			b.bytes -= pubSize(oldest)
+			b.drop(oldest)
+		default:
+			if b.opts.MaxBytes > 0 {
+				// The buffer is empty, but the reader hasn't released
+				// everything it received yet
+				b.mutex.Unlock()
+				<-b.room
+				b.mutex.Lock()
+			}
+		}
+	}
+}
+
+// drop counts a dropped publication, and queues a resync message for its
+// collection if opts.Resync is set
+func (b *Buffer) drop(pub *Publication) {
+	if pub.Heartbeat {
+		return
+	}
+	metricBufferDropped.Inc()
+
+	if !b.opts.Resync {
+		log.Log.Warnw("Publication buffer is full; dropping publication",
+			"channels", pub.Channels)
+		return
+	}
+	if len(pub.Channels) == 0 {
+		return
+	}
+	channel := pub.Channels[0]
+
+	if _, ok := b.pendingResyncs[channel]; !ok {
+		log.Log.Warnw("Publication buffer is full; dropping publications and sending a resync message",
+			"channel", channel)
+	}
+
+	b.pendingResyncs[channel] = &Publication{
+		Channels:       []string{channel},
+		Msg:            ResyncMessage(OverflowResyncReason),
+		ParallelismKey: pub.ParallelismKey,
+		OverflowResync: true,
+	}
+}
+
+// sendPendingResyncs sends the pending resync messages, with the position of
+// the publication that was just sent (so that the checkpoint doesn't move
+// backwards). Sending a resync message can drop another publication, whose
+// resync message is sent by the next call to Send.
+func (b *Buffer) sendPendingResyncs(after *Publication) {
+	resyncs := b.pendingResyncs
+	b.pendingResyncs = map[string]*Publication{}
+
+	for _, resync := range resyncs {
+		resync.OplogTimestamp = after.OplogTimestamp
+		resync.WallTime = after.WallTime
+		resync.TxIdx = after.TxIdx
+		resync.ResumeToken = after.ResumeToken
+
+		b.sendDroppingOldest(resync)
+	}
+}
+
+// refill moves spilled publications back into the buffer, in order, as room
+// becomes available
+func (b *Buffer) refill() {
+	defer close(b.done)
+
+	for {
+		b.mutex.Lock()
+		count := b.spill.count
+		var pub *Publication
+		var err error
+		if count > 0 {
+			pub, err = b.spill.pop()
+		}
+		b.mutex.Unlock()
+
+		if count == 0 {
+			select {
+			case <-b.spilled:
+				continue
+			case <-b.closed:
+				return
+			}
+		}
+
+		if err != nil {
+			log.Log.Errorw("Error reading publication from spill file; dropping it",
+				"error", err)
+		} else {
+			// Send keeps spilling while this is in flight, because it's
+			// still counted in spill.count, so publications stay in order
+			if !b.waitAndSend(pub, b.closed) {
+				return
+			}
+		}
+
+		b.mutex.Lock()
+		b.spill.done()
+		if b.spill.count == 0 {
+			b.drained.Broadcast()
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// spillFile is a queue of publications in a file on disk. Each publication is
+// written as a 4-byte length followed by its JSON encoding. It's not safe for
+// concurrent use.
+type spillFile struct {
+	file *os.File
+
+	readOffset  int64
+	writeOffset int64
+
+	// count is the number of publications that have been pushed but not
+	// marked done
+	count int
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	file, err := os.CreateTemp(dir, "oplogtoredis-spill-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating spill file")
+	}
+
+	return &spillFile{file: file}, nil
+}
+
+func (s *spillFile) push(pub *Publication) error {
+	data, err := json.Marshal(pub)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	if _, err := s.file.WriteAt(record, s.writeOffset); err != nil {
+		return err
+	}
+
+	s.writeOffset += int64(len(record))
+	s.count++
+	return nil
+}
+
+// pop reads the next publication. It stays counted until done is called.
+func (s *spillFile) pop() (*Publication, error) {
+	var length [4]byte
+	if _, err := s.file.ReadAt(length[:], s.readOffset); err != nil {
+		return nil, s.skipRest(err)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := s.file.ReadAt(data, s.readOffset+4); err != nil {
+		return nil, s.skipRest(err)
+	}
+	s.readOffset += 4 + int64(len(data))
+
+	var pub Publication
+	if err := json.Unmarshal(data, &pub); err != nil {
+		return nil, err
+	}
+	return &pub, nil
+}
+
+// skipRest gives up on the rest of the file after an error that leaves us
+// unable to find the next record. The popped publication stays counted until
+// done is called; the rest are dropped.
+func (s *spillFile) skipRest(err error) error {
+	metricBufferDropped.Add(float64(s.count - 1))
+	s.readOffset = s.writeOffset
+	s.count = 1
+	return err
+}
+
+// done marks the last popped publication as handled. Once every publication
+// has been handled, the file is truncated.
+func (s *spillFile) done() {
+	s.count--
+	if s.count > 0 {
+		return
+	}
+
+	s.readOffset = 0
+	s.writeOffset = 0
+	if err := s.file.Truncate(0); err != nil {
+		log.Log.Errorw("Error truncating spill file", "error", err)
+	}
+}
+
+func (s *spillFile) remove() {
+	if err := s.file.Close(); err != nil {
+		log.Log.Errorw("Error closing spill file", "error", err)
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		log.Log.Errorw("Error removing spill file", "error", err)
+	}
+}
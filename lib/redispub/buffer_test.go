@@ -0,0 +1,315 @@
+package redispub
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testPublication(collection string, i int) *Publication {
+	return &Publication{
+		Channels:       []string{collection, collection + "::" + strconv.Itoa(i)},
+		Msg:            []byte(strconv.Itoa(i)),
+		OplogTimestamp: primitive.Timestamp{T: 1234, I: uint32(i)},
+		WallTime:       time.Unix(1234, 0).UTC(),
+	}
+}
+
+func receive(t *testing.T, buffer *Buffer) *Publication {
+	select {
+	case pub := <-buffer.Out():
+		buffer.Release(pub)
+		return pub
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a publication")
+		return nil
+	}
+}
+
+func TestBufferBlock(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 1, OverflowPolicy: config.BufferOverflowBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	buffer.Send(testPublication("db.Foo", 0))
+	if buffer.FullFor() != 0 {
+		t.Errorf("Expected the buffer not to be full yet")
+	}
+
+	sent := make(chan bool)
+	go func() {
+		buffer.Send(testPublication("db.Foo", 1))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Expected Send to block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if buffer.FullFor() == 0 {
+		t.Errorf("Expected the buffer to be full")
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := receive(t, buffer).OplogTimestamp.I; got != uint32(i) {
+			t.Errorf("Got publication %d, expected %d", got, i)
+		}
+	}
+	<-sent
+
+	if buffer.FullFor() != 0 {
+		t.Errorf("Expected the buffer not to be full once it's drained")
+	}
+}
+
+func TestBufferMaxBytes(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 10, MaxBytes: 15, OverflowPolicy: config.BufferOverflowBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	big := func(i int) *Publication {
+		pub := testPublication("db.Foo", i)
+		pub.Msg = []byte(strings.Repeat("x", 10))
+		return pub
+	}
+
+	buffer.Send(big(0))
+	if buffer.Bytes() != 10 {
+		t.Errorf("Got %d bytes, expected 10", buffer.Bytes())
+	}
+
+	sent := make(chan bool)
+	go func() {
+		buffer.Send(big(1))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Expected Send to block while the buffer is over its byte limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if buffer.FullFor() == 0 {
+		t.Errorf("Expected the buffer to be full")
+	}
+
+	// Receiving isn't enough to make room; the reader has to release the
+	// publication
+	pub := <-buffer.Out()
+	select {
+	case <-sent:
+		t.Fatal("Expected Send to block until the publication is released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	buffer.Release(pub)
+	<-sent
+	if got := receive(t, buffer).OplogTimestamp.I; got != 1 {
+		t.Errorf("Got publication %d, expected 1", got)
+	}
+
+	// A publication bigger than the limit still goes into an empty buffer
+	huge := testPublication("db.Foo", 2)
+	huge.Msg = []byte(strings.Repeat("x", 100))
+	buffer.Send(huge)
+	if got := receive(t, buffer).OplogTimestamp.I; got != 2 {
+		t.Errorf("Got publication %d, expected 2", got)
+	}
+
+	if buffer.Bytes() != 0 {
+		t.Errorf("Got %d bytes, expected 0 once everything is released", buffer.Bytes())
+	}
+}
+
+func TestBufferSetMaxBytes(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 10, MaxBytes: 15, OverflowPolicy: config.BufferOverflowBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	big := func(i int) *Publication {
+		pub := testPublication("db.Foo", i)
+		pub.Msg = []byte(strings.Repeat("x", 10))
+		return pub
+	}
+
+	buffer.Send(big(0))
+	sent := make(chan bool)
+	go func() {
+		buffer.Send(big(1))
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Expected Send to block while the buffer is over its byte limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Raising the limit lets the waiting sender in
+	buffer.SetMaxBytes(20)
+	<-sent
+	if buffer.MaxBytes() != 20 {
+		t.Errorf("Got a limit of %d bytes, expected 20", buffer.MaxBytes())
+	}
+	if buffer.Bytes() != 20 {
+		t.Errorf("Got %d bytes, expected 20", buffer.Bytes())
+	}
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 2, OverflowPolicy: config.BufferOverflowDropOldest, Resync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	buffer.Send(testPublication("db.Foo", 0))
+	buffer.Send(testPublication("db.Bar", 1))
+
+	// Drops db.Foo 0 to make room, and then db.Bar 1 to make room for the
+	// db.Foo resync message
+	buffer.Send(testPublication("db.Baz", 2))
+
+	if buffer.FullFor() == 0 {
+		t.Errorf("Expected the buffer to be full")
+	}
+
+	pub := receive(t, buffer)
+	if pub.OplogTimestamp.I != 2 {
+		t.Errorf("Got publication %d, expected 2", pub.OplogTimestamp.I)
+	}
+
+	resync := receive(t, buffer)
+	if string(resync.Msg) != string(ResyncMessage(OverflowResyncReason)) || resync.Channels[0] != "db.Foo" || !resync.OverflowResync {
+		t.Errorf("Expected a resync message for db.Foo, got %#v", resync)
+	}
+	if resync.OplogTimestamp != pub.OplogTimestamp {
+		t.Errorf("Expected the resync message to have the timestamp of the last publication, got %v", resync.OplogTimestamp)
+	}
+
+	// The db.Bar resync message is sent with the next publication
+	buffer.Send(testPublication("db.Baz", 3))
+	if got := receive(t, buffer).OplogTimestamp.I; got != 3 {
+		t.Errorf("Got publication %d, expected 3", got)
+	}
+	resync = receive(t, buffer)
+	if resync.Channels[0] != "db.Bar" || !resync.OverflowResync {
+		t.Errorf("Expected a resync message for db.Bar, got %#v", resync)
+	}
+
+	if buffer.FullFor() != 0 {
+		t.Errorf("Expected the buffer not to be full once it's drained")
+	}
+}
+
+func TestBufferDropOldestWithoutResync(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 2, OverflowPolicy: config.BufferOverflowDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	buffer.Send(testPublication("db.Foo", 0))
+	buffer.Send(testPublication("db.Bar", 1))
+	buffer.Send(testPublication("db.Baz", 2))
+
+	// Only db.Foo 0 is dropped, since there's no resync message to make
+	// room for
+	for _, want := range []uint32{1, 2} {
+		if got := receive(t, buffer).OplogTimestamp.I; got != want {
+			t.Errorf("Got publication %d, expected %d", got, want)
+		}
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected no resync messages, got %d more publications", buffer.Len())
+	}
+}
+
+func TestBufferDropOldestHeartbeat(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{Size: 1, OverflowPolicy: config.BufferOverflowDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	buffer.Send(testPublication("db.Foo", 0))
+
+	// A heartbeat doesn't make room for itself by dropping a publication
+	buffer.Send(&Publication{OplogTimestamp: primitive.Timestamp{T: 1234, I: 1}, Heartbeat: true})
+	if got := receive(t, buffer).OplogTimestamp.I; got != 0 {
+		t.Errorf("Got publication %d, expected 0", got)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected the heartbeat to be discarded")
+	}
+}
+
+func TestBufferSpill(t *testing.T) {
+	buffer, err := NewBuffer(BufferOpts{
+		Size:           2,
+		OverflowPolicy: config.BufferOverflowSpill,
+		SpillDir:       t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	for i := 0; i < 10; i++ {
+		buffer.Send(testPublication("db.Foo", i))
+	}
+
+	if buffer.FullFor() == 0 {
+		t.Errorf("Expected the buffer to be full")
+	}
+
+	for i := 0; i < 10; i++ {
+		pub := receive(t, buffer)
+		expected := testPublication("db.Foo", i)
+		if pub.OplogTimestamp != expected.OplogTimestamp || string(pub.Msg) != string(expected.Msg) ||
+			pub.Channels[1] != expected.Channels[1] || !pub.WallTime.Equal(expected.WallTime) {
+			t.Errorf("Got %#v, expected %#v", pub, expected)
+		}
+	}
+
+	// Once the spill file is drained, publications go straight to the buffer
+	// again
+	deadline := time.Now().Add(time.Second)
+	for buffer.FullFor() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the buffer not to be full once it's drained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	buffer.Send(testPublication("db.Foo", 10))
+	if got := receive(t, buffer).OplogTimestamp.I; got != 10 {
+		t.Errorf("Got publication %d, expected 10", got)
+	}
+}
+
+func TestFormatKeyOverflowResync(t *testing.T) {
+	pub := testPublication("db.Foo", 1)
+	resync := &Publication{
+		Channels:       []string{"db.Foo"},
+		OplogTimestamp: pub.OplogTimestamp,
+		OverflowResync: true,
+	}
+
+	if formatKey(pub, "prefix::") == formatKey(resync, "prefix::") {
+		t.Errorf("Expected the resync message to have a different dedupe key than the publication it was sent with")
+	}
+}
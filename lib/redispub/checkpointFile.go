@@ -0,0 +1,171 @@
+package redispub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileCheckpoints is the content of a FileCheckpointStore's file
+type fileCheckpoints struct {
+	// WriteParallelism is 0 if it hasn't been recorded
+	WriteParallelism int                `json:"writeParallelism,omitempty"`
+	Checkpoints      map[int]Checkpoint `json:"checkpoints"`
+}
+
+// FileCheckpointStore keeps the checkpoints in a JSON file. Every save
+// replaces the file atomically and fsyncs it before returning, so the
+// checkpoints survive a crash, but the file must be on a persistent volume
+// that only one oplogtoredis writes to.
+type FileCheckpointStore struct {
+	path string
+
+	mutex  sync.Mutex
+	stored fileCheckpoints
+}
+
+// NewFileCheckpointStore creates a FileCheckpointStore that keeps the
+// checkpoints for metadataPrefix in a file in dir, and reads the checkpoints
+// already in it
+func NewFileCheckpointStore(dir string, metadataPrefix string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileCheckpointStore{
+		path:   filepath.Join(dir, url.PathEscape(metadataPrefix)+"checkpoints.json"),
+		stored: fileCheckpoints{Checkpoints: map[int]Checkpoint{}},
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.stored); err != nil {
+		return nil, err
+	}
+	if s.stored.Checkpoints == nil {
+		s.stored.Checkpoints = map[int]Checkpoint{}
+	}
+	return s, nil
+}
+
+// Load implements CheckpointStore
+func (s *FileCheckpointStore) Load(ordinal int) (Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	checkpoint, ok := s.stored.Checkpoints[ordinal]
+	if !ok {
+		return Checkpoint{}, ErrNoCheckpoint
+	}
+	return checkpoint, nil
+}
+
+// Save implements CheckpointStore
+func (s *FileCheckpointStore) Save(ordinal int, checkpoint Checkpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.stored.Checkpoints[ordinal]
+	if existed && !checkpoint.newerThan(previous) {
+		return nil
+	}
+	s.stored.Checkpoints[ordinal] = checkpoint
+	if err := s.write(); err != nil {
+		// Keep what's in memory the same as what's on disk
+		if existed {
+			s.stored.Checkpoints[ordinal] = previous
+		} else {
+			delete(s.stored.Checkpoints, ordinal)
+		}
+		return err
+	}
+	return nil
+}
+
+// LoadWriteParallelism implements CheckpointStore
+func (s *FileCheckpointStore) LoadWriteParallelism() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stored.WriteParallelism == 0 {
+		return 0, ErrNoCheckpoint
+	}
+	return s.stored.WriteParallelism, nil
+}
+
+// SaveWriteParallelism implements CheckpointStore. The checkpoints and the
+// write parallelism are written in a single write of the file.
+func (s *FileCheckpointStore) SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.stored
+	s.stored = fileCheckpoints{
+		WriteParallelism: writeParallelism,
+		Checkpoints:      make(map[int]Checkpoint, len(previous.Checkpoints)),
+	}
+	for ordinal, checkpoint := range previous.Checkpoints {
+		s.stored.Checkpoints[ordinal] = checkpoint
+	}
+	for ordinal, checkpoint := range checkpoints {
+		s.stored.Checkpoints[ordinal] = checkpoint
+	}
+
+	if err := s.write(); err != nil {
+		s.stored = previous
+		return err
+	}
+	return nil
+}
+
+// write replaces the file with s.stored: it writes a temporary file, fsyncs
+// it, renames it over the file, and fsyncs the directory so the rename is
+// durable too. Must be called with the mutex held.
+func (s *FileCheckpointStore) write() error {
+	data, err := json.Marshal(s.stored)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// Close implements CheckpointStore
+func (s *FileCheckpointStore) Close() error {
+	return nil
+}
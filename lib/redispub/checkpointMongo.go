@@ -0,0 +1,184 @@
+package redispub
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// mongoCheckpointTimeout bounds each operation of MongoCheckpointStore
+const mongoCheckpointTimeout = 10 * time.Second
+
+// mongoCheckpoint is a checkpoint document. Its _id is the key the checkpoint
+// has in Redis.
+type mongoCheckpoint struct {
+	ID          string              `bson:"_id"`
+	Timestamp   primitive.Timestamp `bson:"ts"`
+	Term        int64               `bson:"t"`
+	Hash        int64               `bson:"h"`
+	ResumeToken string              `bson:"resumeToken,omitempty"`
+}
+
+// mongoWriteParallelism is the document that records the write parallelism
+type mongoWriteParallelism struct {
+	ID               string `bson:"_id"`
+	WriteParallelism int    `bson:"writeParallelism"`
+}
+
+// MongoCheckpointStore keeps the checkpoints in a Mongo collection, with a
+// majority write concern so that they survive a failover
+type MongoCheckpointStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	prefix     string
+}
+
+// NewMongoCheckpointStore connects to the Mongo cluster at url, and keeps the
+// checkpoints in collection, which is "database.collection"
+func NewMongoCheckpointStore(url string, collection string, metadataPrefix string) (*MongoCheckpointStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	// config.ParseEnv checks that it's "database.collection"
+	namespace := strings.SplitN(collection, ".", 2)
+	return &MongoCheckpointStore{
+		client: client,
+		collection: client.Database(namespace[0]).Collection(namespace[1],
+			options.Collection().SetWriteConcern(writeconcern.New(writeconcern.WMajority(), writeconcern.J(true)))),
+		prefix: metadataPrefix,
+	}, nil
+}
+
+func (s *MongoCheckpointStore) checkpointID(ordinal int) string {
+	return s.prefix + "lastProcessedEntry." + strconv.Itoa(ordinal)
+}
+
+func (s *MongoCheckpointStore) writeParallelismID() string {
+	return s.prefix + "writeParallelism"
+}
+
+// Load implements CheckpointStore
+func (s *MongoCheckpointStore) Load(ordinal int) (Checkpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	var doc mongoCheckpoint
+	err := s.collection.FindOne(ctx, bson.M{"_id": s.checkpointID(ordinal)}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Checkpoint{}, ErrNoCheckpoint
+	} else if err != nil {
+		return Checkpoint{}, err
+	}
+
+	return Checkpoint{
+		Timestamp:   doc.Timestamp,
+		Term:        doc.Term,
+		Hash:        doc.Hash,
+		ResumeToken: doc.ResumeToken,
+	}, nil
+}
+
+// Save implements CheckpointStore. The replacement only matches the stored
+// checkpoint if it's older; otherwise the upsert tries to insert a second
+// document with the same _id, which fails with a duplicate key error.
+func (s *MongoCheckpointStore) Save(ordinal int, checkpoint Checkpoint) error {
+	err := s.save(ordinal, checkpoint, olderCheckpointFilter(checkpoint))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// olderCheckpointFilter matches the checkpoints that checkpoint is newer than
+// (see Checkpoint.newerThan)
+func olderCheckpointFilter(checkpoint Checkpoint) bson.M {
+	olderTimestamp := bson.M{"ts": bson.M{"$lt": checkpoint.Timestamp}}
+	if checkpoint.Term == 0 {
+		return olderTimestamp
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{"t": bson.M{"$ne": 0, "$lt": checkpoint.Term}},
+		bson.M{"t": bson.M{"$in": bson.A{0, checkpoint.Term}}, "ts": bson.M{"$lt": checkpoint.Timestamp}},
+	}}
+}
+
+// save upserts the checkpoint, replacing the stored one if it matches filter
+func (s *MongoCheckpointStore) save(ordinal int, checkpoint Checkpoint, filter bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	id := s.checkpointID(ordinal)
+	query := bson.M{"_id": id}
+	for key, value := range filter {
+		query[key] = value
+	}
+
+	_, err := s.collection.ReplaceOne(ctx, query, mongoCheckpoint{
+		ID:          id,
+		Timestamp:   checkpoint.Timestamp,
+		Term:        checkpoint.Term,
+		Hash:        checkpoint.Hash,
+		ResumeToken: checkpoint.ResumeToken,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// LoadWriteParallelism implements CheckpointStore
+func (s *MongoCheckpointStore) LoadWriteParallelism() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	var doc mongoWriteParallelism
+	err := s.collection.FindOne(ctx, bson.M{"_id": s.writeParallelismID()}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrNoCheckpoint
+	}
+	return doc.WriteParallelism, err
+}
+
+// SaveWriteParallelism implements CheckpointStore. The writes aren't in a
+// transaction, so that the store also works on standalone servers; the
+// checkpoints are written first, so stopping in between is safe.
+func (s *MongoCheckpointStore) SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error {
+	for i, checkpoint := range checkpoints {
+		if err := s.save(i, checkpoint, nil); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	id := s.writeParallelismID()
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": id}, mongoWriteParallelism{
+		ID:               id,
+		WriteParallelism: writeParallelism,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Close implements CheckpointStore
+func (s *MongoCheckpointStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoCheckpointTimeout)
+	defer cancel()
+
+	return s.client.Disconnect(ctx)
+}
@@ -0,0 +1,143 @@
+package redispub
+
+import (
+	"database/sql"
+	"errors"
+
+	// Registers the "postgres" driver
+	_ "github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PostgresCheckpointStore keeps the checkpoints in a Postgres database, in the
+// otr_checkpoints and otr_checkpoint_parallelism tables. Several oplogtoredis
+// deployments can share the tables, as long as they use different prefixes.
+type PostgresCheckpointStore struct {
+	db     *sql.DB
+	prefix string
+}
+
+// NewPostgresCheckpointStore connects to the Postgres database at url, and
+// creates the tables if they don't exist
+func NewPostgresCheckpointStore(url string, metadataPrefix string) (*PostgresCheckpointStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS otr_checkpoints (
+		prefix VARCHAR(255) NOT NULL,
+		ordinal INTEGER NOT NULL,
+		t BIGINT NOT NULL,
+		i BIGINT NOT NULL,
+		term BIGINT NOT NULL,
+		hash BIGINT NOT NULL,
+		resume_token TEXT NOT NULL,
+		PRIMARY KEY (prefix, ordinal)
+	);
+	CREATE TABLE IF NOT EXISTS otr_checkpoint_parallelism (
+		prefix VARCHAR(255) PRIMARY KEY,
+		write_parallelism INTEGER NOT NULL
+	);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresCheckpointStore{db: db, prefix: metadataPrefix}, nil
+}
+
+// Load implements CheckpointStore
+func (s *PostgresCheckpointStore) Load(ordinal int) (Checkpoint, error) {
+	var checkpoint Checkpoint
+	var t, i int64
+	err := s.db.QueryRow("SELECT t, i, term, hash, resume_token FROM otr_checkpoints WHERE prefix=$1 AND ordinal=$2;",
+		s.prefix, ordinal).Scan(&t, &i, &checkpoint.Term, &checkpoint.Hash, &checkpoint.ResumeToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Checkpoint{}, ErrNoCheckpoint
+	} else if err != nil {
+		return Checkpoint{}, err
+	}
+
+	checkpoint.Timestamp = primitive.Timestamp{T: uint32(t), I: uint32(i)}
+	return checkpoint, nil
+}
+
+// sqlExecer is what *sql.DB and *sql.Tx have in common
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+const upsertCheckpoint = `INSERT INTO otr_checkpoints (prefix, ordinal, t, i, term, hash, resume_token)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (prefix, ordinal) DO UPDATE SET
+		t=EXCLUDED.t, i=EXCLUDED.i, term=EXCLUDED.term, hash=EXCLUDED.hash, resume_token=EXCLUDED.resume_token`
+
+// newerCheckpoint is the condition for replacing a checkpoint in Save (see
+// Checkpoint.newerThan)
+const newerCheckpoint = `
+	WHERE CASE
+		WHEN EXCLUDED.term <> 0 AND otr_checkpoints.term <> 0 AND EXCLUDED.term <> otr_checkpoints.term
+			THEN EXCLUDED.term > otr_checkpoints.term
+		ELSE (EXCLUDED.t, EXCLUDED.i) > (otr_checkpoints.t, otr_checkpoints.i)
+	END`
+
+// save writes the checkpoint, but if onlyNewer is set, only if it's newer
+// than the stored one
+func (s *PostgresCheckpointStore) save(db sqlExecer, ordinal int, checkpoint Checkpoint, onlyNewer bool) error {
+	query := upsertCheckpoint
+	if onlyNewer {
+		query += newerCheckpoint
+	}
+
+	_, err := db.Exec(query+";",
+		s.prefix, ordinal, int64(checkpoint.Timestamp.T), int64(checkpoint.Timestamp.I),
+		checkpoint.Term, checkpoint.Hash, checkpoint.ResumeToken)
+	return err
+}
+
+// Save implements CheckpointStore
+func (s *PostgresCheckpointStore) Save(ordinal int, checkpoint Checkpoint) error {
+	return s.save(s.db, ordinal, checkpoint, true)
+}
+
+// LoadWriteParallelism implements CheckpointStore
+func (s *PostgresCheckpointStore) LoadWriteParallelism() (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT write_parallelism FROM otr_checkpoint_parallelism WHERE prefix=$1;", s.prefix).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNoCheckpoint
+	}
+	return n, err
+}
+
+// SaveWriteParallelism implements CheckpointStore. The checkpoints and the
+// write parallelism are written in a single transaction.
+func (s *PostgresCheckpointStore) SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for i, checkpoint := range checkpoints {
+		if err := s.save(tx, i, checkpoint, false); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO otr_checkpoint_parallelism (prefix, write_parallelism) VALUES ($1, $2)
+		ON CONFLICT (prefix) DO UPDATE SET write_parallelism=EXCLUDED.write_parallelism;`,
+		s.prefix, writeParallelism)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close implements CheckpointStore
+func (s *PostgresCheckpointStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,166 @@
+package redispub
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNoCheckpoint is returned by a CheckpointStore when there's no checkpoint,
+// or no write parallelism, stored yet
+var ErrNoCheckpoint = errors.New("no checkpoint stored")
+
+// Checkpoint is the position of the last publication a write shard published,
+// which it resumes from when oplogtoredis restarts
+type Checkpoint struct {
+	Timestamp primitive.Timestamp
+
+	// Term and Hash identify the oplog entry at Timestamp (see
+	// Publication.OplogTerm). They're zero if they weren't recorded.
+	Term int64
+	Hash int64
+
+	// ResumeToken is only set in change stream mode
+	ResumeToken string
+}
+
+// newerThan returns whether c is a later position than current: by term, if
+// both have one, and then by timestamp. The scripts that save checkpoints in
+// Redis compare them the same way (see checkpointComparisonLua).
+func (c Checkpoint) newerThan(current Checkpoint) bool {
+	if c.Term != 0 && current.Term != 0 && c.Term != current.Term {
+		return c.Term > current.Term
+	}
+	return current.Timestamp.Before(c.Timestamp)
+}
+
+// CheckpointStore is where the checkpoints of the write shards are kept (see
+// config.CheckpointStore). Its methods can be called from several goroutines
+// at once.
+type CheckpointStore interface {
+	// Load returns the checkpoint of the write shard with the given ordinal,
+	// or ErrNoCheckpoint if it doesn't have one
+	Load(ordinal int) (Checkpoint, error)
+
+	// Save replaces the checkpoint of the write shard with the given ordinal,
+	// unless the stored one is at least as new (see Checkpoint.newerThan), so
+	// that several copies of oplogtoredis publishing the same entries can't
+	// move it backwards
+	Save(ordinal int, checkpoint Checkpoint) error
+
+	// LoadWriteParallelism returns the write parallelism the checkpoints were
+	// saved with, or ErrNoCheckpoint if it hasn't been recorded
+	LoadWriteParallelism() (int, error)
+
+	// SaveWriteParallelism records the write parallelism the checkpoints are
+	// saved with. If checkpoints isn't nil, it first replaces the checkpoint
+	// of every write shard with them, one per ordinal, so that if we stop in
+	// between, we start over from the old checkpoints. Unlike Save, it
+	// replaces them even with older ones.
+	SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error
+
+	// Close releases the store's connections
+	Close() error
+}
+
+// RedisCheckpointStore keeps the checkpoints in Redis, under the metadata
+// prefix. This is where they've always been kept, so it reads the checkpoints
+// written by older versions. On Redis Cluster, each write shard's checkpoint
+// is kept under its hash tag (see shardKeyPrefix).
+type RedisCheckpointStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisCheckpointStore creates a RedisCheckpointStore. Closing it doesn't
+// close the client.
+func NewRedisCheckpointStore(client redis.UniversalClient, metadataPrefix string) *RedisCheckpointStore {
+	return &RedisCheckpointStore{client: client, prefix: metadataPrefix}
+}
+
+// Load implements CheckpointStore
+func (s *RedisCheckpointStore) Load(ordinal int) (Checkpoint, error) {
+	ts, term, hash, err := LastProcessedEntry(s.client, s.prefix, ordinal)
+	if errors.Is(err, redis.Nil) {
+		return Checkpoint{}, ErrNoCheckpoint
+	} else if err != nil {
+		return Checkpoint{}, err
+	}
+
+	token, err := LastProcessedResumeToken(s.client, s.prefix, ordinal)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Checkpoint{}, err
+	}
+
+	return Checkpoint{Timestamp: ts, Term: term, Hash: hash, ResumeToken: token}, nil
+}
+
+// This script saves the checkpoint ARGV[1] (see encodeCheckpoint) in KEYS[1],
+// and the resume token ARGV[2] in KEYS[2] (or deletes it if ARGV[2] is ""),
+// if the checkpoint is newer than the one in KEYS[1]
+var saveCheckpointScript = redis.NewScript(checkpointComparisonLua + `
+	if not newerCheckpoint(ARGV[1], redis.call("GET", KEYS[1])) then
+		return 0
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1])
+	if ARGV[2] ~= "" then
+		redis.call("SET", KEYS[2], ARGV[2])
+	else
+		redis.call("DEL", KEYS[2])
+	end
+	return 1
+`)
+
+// Save implements CheckpointStore
+func (s *RedisCheckpointStore) Save(ordinal int, checkpoint Checkpoint) error {
+	return saveCheckpointScript.Run(context.Background(), s.client,
+		[]string{
+			ordinalKey(s.client, s.prefix, "lastProcessedEntry", ordinal),
+			ordinalKey(s.client, s.prefix, "lastProcessedResumeToken", ordinal),
+		},
+		encodeCheckpoint(checkpoint.Timestamp, checkpoint.Term, checkpoint.Hash), checkpoint.ResumeToken).Err()
+}
+
+func (s *RedisCheckpointStore) save(ctx context.Context, pipe redis.Pipeliner, ordinal int, checkpoint Checkpoint) {
+	pipe.Set(ctx, ordinalKey(s.client, s.prefix, "lastProcessedEntry", ordinal), encodeCheckpoint(checkpoint.Timestamp, checkpoint.Term, checkpoint.Hash), 0)
+	// A checkpoint without a resume token mustn't be read back with the
+	// token of an older one
+	tokenKey := ordinalKey(s.client, s.prefix, "lastProcessedResumeToken", ordinal)
+	if checkpoint.ResumeToken != "" {
+		pipe.Set(ctx, tokenKey, checkpoint.ResumeToken, 0)
+	} else {
+		pipe.Del(ctx, tokenKey)
+	}
+}
+
+// LoadWriteParallelism implements CheckpointStore
+func (s *RedisCheckpointStore) LoadWriteParallelism() (int, error) {
+	n, err := s.client.Get(context.Background(), s.prefix+"writeParallelism").Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNoCheckpoint
+	}
+	return n, err
+}
+
+// SaveWriteParallelism implements CheckpointStore. The checkpoints and the
+// write parallelism are written in a single transaction, except on Redis
+// Cluster, where it's split into one per slot.
+func (s *RedisCheckpointStore) SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error {
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, checkpoint := range checkpoints {
+			s.save(ctx, pipe, i, checkpoint)
+		}
+		pipe.Set(ctx, s.prefix+"writeParallelism", writeParallelism, 0)
+		return nil
+	})
+	return err
+}
+
+// Close implements CheckpointStore
+func (s *RedisCheckpointStore) Close() error {
+	return nil
+}
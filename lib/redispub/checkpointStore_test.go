@@ -0,0 +1,214 @@
+package redispub
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testCheckpointStore checks the behavior every CheckpointStore must have.
+// open must return a store with no checkpoints.
+func testCheckpointStore(t *testing.T, open func() CheckpointStore) {
+	t.Run("Empty", func(t *testing.T) {
+		store := open()
+		defer store.Close()
+
+		_, err := store.Load(0)
+		require.Equal(t, ErrNoCheckpoint, err)
+		_, err = store.LoadWriteParallelism()
+		require.Equal(t, ErrNoCheckpoint, err)
+	})
+
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		store := open()
+		defer store.Close()
+
+		first := Checkpoint{Timestamp: primitive.Timestamp{T: 100, I: 2}, Term: 3, Hash: -4, ResumeToken: "8263"}
+		require.NoError(t, store.Save(1, first))
+
+		loaded, err := store.Load(1)
+		require.NoError(t, err)
+		require.Equal(t, first, loaded)
+
+		_, err = store.Load(0)
+		require.Equal(t, ErrNoCheckpoint, err)
+
+		second := Checkpoint{Timestamp: primitive.Timestamp{T: 101, I: 1}, Term: 3, Hash: 5, ResumeToken: "8264"}
+		require.NoError(t, store.Save(1, second))
+
+		loaded, err = store.Load(1)
+		require.NoError(t, err)
+		require.Equal(t, second, loaded)
+
+		// A checkpoint without a resume token doesn't keep the old one
+		third := Checkpoint{Timestamp: primitive.Timestamp{T: 102, I: 1}, Term: 3}
+		require.NoError(t, store.Save(1, third))
+
+		loaded, err = store.Load(1)
+		require.NoError(t, err)
+		require.Equal(t, third, loaded)
+	})
+
+	t.Run("OnlyNewer", func(t *testing.T) {
+		store := open()
+		defer store.Close()
+
+		current := Checkpoint{Timestamp: primitive.Timestamp{T: 100, I: 2}, Term: 3, ResumeToken: "8263"}
+		require.NoError(t, store.Save(0, current))
+
+		// Older and equal checkpoints don't replace it
+		for _, older := range []Checkpoint{
+			{Timestamp: primitive.Timestamp{T: 100, I: 1}, Term: 3},
+			{Timestamp: primitive.Timestamp{T: 100, I: 2}, Term: 3},
+			{Timestamp: primitive.Timestamp{T: 200}, Term: 2},
+			{Timestamp: primitive.Timestamp{T: 99}},
+		} {
+			require.NoError(t, store.Save(0, older))
+			loaded, err := store.Load(0)
+			require.NoError(t, err)
+			require.Equal(t, current, loaded)
+		}
+
+		// A higher term does, even at an earlier timestamp (after a rollback)
+		newer := Checkpoint{Timestamp: primitive.Timestamp{T: 90}, Term: 4}
+		require.NoError(t, store.Save(0, newer))
+		loaded, err := store.Load(0)
+		require.NoError(t, err)
+		require.Equal(t, newer, loaded)
+
+		// Without a term, timestamps are compared
+		newer = Checkpoint{Timestamp: primitive.Timestamp{T: 91}}
+		require.NoError(t, store.Save(0, newer))
+		loaded, err = store.Load(0)
+		require.NoError(t, err)
+		require.Equal(t, newer, loaded)
+	})
+
+	t.Run("WriteParallelism", func(t *testing.T) {
+		store := open()
+		defer store.Close()
+
+		require.NoError(t, store.Save(0, Checkpoint{Timestamp: primitive.Timestamp{T: 100}}))
+		require.NoError(t, store.Save(1, Checkpoint{Timestamp: primitive.Timestamp{T: 90}}))
+
+		require.NoError(t, store.SaveWriteParallelism(2, nil))
+		n, err := store.LoadWriteParallelism()
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		// Recording it alone doesn't touch the checkpoints
+		loaded, err := store.Load(0)
+		require.NoError(t, err)
+		require.Equal(t, primitive.Timestamp{T: 100}, loaded.Timestamp)
+
+		rewritten := Checkpoint{Timestamp: primitive.Timestamp{T: 90}, ResumeToken: "8262"}
+		require.NoError(t, store.SaveWriteParallelism(3, []Checkpoint{rewritten, rewritten, rewritten}))
+		n, err = store.LoadWriteParallelism()
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		for i := 0; i < 3; i++ {
+			loaded, err := store.Load(i)
+			require.NoError(t, err)
+			require.Equal(t, rewritten, loaded)
+		}
+	})
+
+	t.Run("ResumePositions", func(t *testing.T) {
+		store := open()
+		defer store.Close()
+
+		_, err := ResumePositions(store, 2)
+		require.Equal(t, ErrNoCheckpoint, err)
+
+		require.NoError(t, store.Save(0, Checkpoint{Timestamp: primitive.Timestamp{T: 100}}))
+		require.NoError(t, store.Save(1, Checkpoint{Timestamp: primitive.Timestamp{T: 90}}))
+
+		positions, err := ResumePositions(store, 2)
+		require.NoError(t, err)
+		require.Equal(t, []primitive.Timestamp{{T: 100}, {T: 90}}, positions)
+
+		positions, err = ResumePositions(store, 3)
+		require.NoError(t, err)
+		require.Equal(t, []primitive.Timestamp{{T: 90}, {T: 90}, {T: 90}}, positions)
+	})
+}
+
+func TestRedisCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, func() CheckpointStore {
+		redisServer, redisClient := startMiniredis()
+		t.Cleanup(redisServer.Close)
+		return NewRedisCheckpointStore(redisClient, "someprefix.")
+	})
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, func() CheckpointStore {
+		store, err := NewFileCheckpointStore(t.TempDir(), "someprefix::")
+		require.NoError(t, err)
+		return store
+	})
+}
+
+func TestFileCheckpointStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := Checkpoint{Timestamp: primitive.Timestamp{T: 100, I: 2}, Term: 3, Hash: 4}
+
+	store, err := NewFileCheckpointStore(dir, "someprefix::")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(1, checkpoint))
+	require.NoError(t, store.SaveWriteParallelism(2, nil))
+	require.NoError(t, store.Close())
+
+	store, err = NewFileCheckpointStore(dir, "someprefix::")
+	require.NoError(t, err)
+	loaded, err := store.Load(1)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint, loaded)
+	n, err := store.LoadWriteParallelism()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// Other prefixes have their own file
+	other, err := NewFileCheckpointStore(dir, "otherprefix::")
+	require.NoError(t, err)
+	_, err = other.Load(1)
+	require.Equal(t, ErrNoCheckpoint, err)
+}
+
+// uniquePrefix returns a metadata prefix that isn't used by other test runs
+// against the same database
+func uniquePrefix() string {
+	return fmt.Sprintf("test%d::", time.Now().UnixNano())
+}
+
+// Set OTR_TEST_PG_URL to a Postgres database to run this test
+func TestPostgresCheckpointStore(t *testing.T) {
+	url := os.Getenv("OTR_TEST_PG_URL")
+	if url == "" {
+		t.Skip("OTR_TEST_PG_URL isn't set")
+	}
+
+	testCheckpointStore(t, func() CheckpointStore {
+		store, err := NewPostgresCheckpointStore(url, uniquePrefix())
+		require.NoError(t, err)
+		return store
+	})
+}
+
+// Set OTR_TEST_MONGO_URL to a Mongo cluster to run this test
+func TestMongoCheckpointStore(t *testing.T) {
+	url := os.Getenv("OTR_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("OTR_TEST_MONGO_URL isn't set")
+	}
+
+	testCheckpointStore(t, func() CheckpointStore {
+		store, err := NewMongoCheckpointStore(url, "oplogtoredis_test.checkpoints", uniquePrefix())
+		require.NoError(t, err)
+		return store
+	})
+}
@@ -0,0 +1,36 @@
+package redispub
+
+import (
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// isCluster returns whether client talks to a Redis Cluster
+func isCluster(client redis.UniversalClient) bool {
+	_, ok := client.(*redis.ClusterClient)
+	return ok
+}
+
+// shardKeyPrefix returns the prefix of the keys a write shard's publishDedupe
+// script touches: its dedupe records, its checkpoint, and its fencing key. On
+// Redis Cluster, it ends with the ordinal as a hash tag, so that all of them
+// are in the same slot, and each batch can be published with a single script
+// in order. The shard's keys then live on the node that serves its slot, so
+// the publishing load is spread over up to WriteParallelism nodes.
+func shardKeyPrefix(client redis.UniversalClient, metadataPrefix string, ordinal int) string {
+	if isCluster(client) {
+		return metadataPrefix + "{" + strconv.Itoa(ordinal) + "}"
+	}
+	return metadataPrefix
+}
+
+// ordinalKey returns the key of a write shard's metadata called name:
+// metadataPrefix+name+"."+ordinal, or on Redis Cluster, name under the
+// shard's hash tag (see shardKeyPrefix)
+func ordinalKey(client redis.UniversalClient, metadataPrefix string, name string, ordinal int) string {
+	if isCluster(client) {
+		return shardKeyPrefix(client, metadataPrefix, ordinal) + name
+	}
+	return metadataPrefix + name + "." + strconv.Itoa(ordinal)
+}
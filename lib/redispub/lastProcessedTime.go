@@ -2,10 +2,12 @@ package redispub
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/tulip/oplogtoredis/lib/log"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -19,35 +21,131 @@ import (
 // If oplogtoredis has not processed any messages, returns redis.Nil as an
 // error.
 func LastProcessedTimestamp(redisClient redis.UniversalClient, metadataPrefix string, ordinal int) (primitive.Timestamp, time.Time, error) {
-	str, err := redisClient.Get(context.Background(), metadataPrefix+"lastProcessedEntry."+strconv.Itoa(ordinal)).Result()
+	ts, _, _, err := LastProcessedEntry(redisClient, metadataPrefix, ordinal)
 	if err != nil {
 		return primitive.Timestamp{}, time.Unix(0, 0), err
 	}
 
-	ts, err := decodeMongoTimestamp(str)
+	time := mongoTimestampToTime(ts)
+	return ts, time, nil
+}
+
+// LastProcessedEntry returns the position of the last oplog entry that
+// oplogtoredis processed: its timestamp, and the term and hash of the entry
+// (see Publication.OplogTerm), which are zero if they weren't recorded.
+//
+// If oplogtoredis has not processed any messages, returns redis.Nil as an
+// error.
+func LastProcessedEntry(redisClient redis.UniversalClient, metadataPrefix string, ordinal int) (ts primitive.Timestamp, term int64, hash int64, err error) {
+	str, err := redisClient.Get(context.Background(), ordinalKey(redisClient, metadataPrefix, "lastProcessedEntry", ordinal)).Result()
 	if err != nil {
-		return primitive.Timestamp{}, time.Unix(0, 0), err
+		return primitive.Timestamp{}, 0, 0, err
 	}
 
-	time := mongoTimestampToTime(ts)
-	return ts, time, nil
+	return decodeCheckpoint(str)
 }
 
-// FirstLastProcessedTimestamp runs LastProcessedTimestamp for each ordinal up to the provided count,
-// then returns the earliest such timestamp obtained. If any ordinal produces an error, that error is returned.
-func FirstLastProcessedTimestamp(redisClient redis.UniversalClient, metadataPrefix string, maxOrdinal int) (primitive.Timestamp, time.Time, error) {
-	var minTs primitive.Timestamp
-	var minTime time.Time
-	for i := 0; i <= maxOrdinal; i++ {
-		ts, time, err := LastProcessedTimestamp(redisClient, metadataPrefix, i)
-		if err != nil {
-			return ts, time, err
+// ResumePositions returns the timestamp each of the writeParallelism write
+// ordinals should resume from: its own checkpoint. An ordinal that doesn't
+// have one resumes from the earliest of the others. If no ordinal has one,
+// returns ErrNoCheckpoint as an error.
+//
+// Databases are assigned to ordinals by hashing their names, so they move
+// between ordinals when the write parallelism changes. If the checkpoints were
+// saved with a different write parallelism, every ordinal resumes from the
+// earliest of the old checkpoints, and the checkpoints are rewritten for the
+// new write parallelism. Otherwise, the checkpoints are left alone.
+func ResumePositions(store CheckpointStore, writeParallelism int) ([]primitive.Timestamp, error) {
+	stored, err := store.LoadWriteParallelism()
+	recorded := true
+	if errors.Is(err, ErrNoCheckpoint) {
+		// Written by a version that didn't record the write parallelism, so
+		// assume it hasn't changed
+		stored = writeParallelism
+		recorded = false
+	} else if err != nil {
+		return nil, err
+	}
+
+	checkpoints := make([]*Checkpoint, stored)
+	var earliest *Checkpoint
+	for i := range checkpoints {
+		checkpoint, err := store.Load(i)
+		if errors.Is(err, ErrNoCheckpoint) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		checkpoints[i] = &checkpoint
+		if earliest == nil || checkpoint.Timestamp.Before(earliest.Timestamp) {
+			earliest = &checkpoint
+		}
+	}
+
+	if earliest == nil {
+		return nil, ErrNoCheckpoint
+	}
+
+	positions := make([]primitive.Timestamp, writeParallelism)
+	for i := range positions {
+		switch {
+		case stored != writeParallelism:
+			positions[i] = earliest.Timestamp
+		case checkpoints[i] == nil:
+			log.Log.Warnw("No last processed timestamp for write ordinal; resuming it from the earliest of the others",
+				"ordinal", i,
+				"timestamp", earliest.Timestamp)
+			positions[i] = earliest.Timestamp
+		default:
+			positions[i] = checkpoints[i].Timestamp
 		}
+	}
+
+	if stored != writeParallelism {
+		log.Log.Warnw("Write parallelism changed; resuming every write ordinal from the earliest checkpoint",
+			"oldWriteParallelism", stored,
+			"writeParallelism", writeParallelism,
+			"timestamp", earliest.Timestamp)
 
-		if i == 0 || ts.Before(minTs) {
-			minTs = ts
-			minTime = time
+		rewritten := make([]Checkpoint, writeParallelism)
+		for i := range rewritten {
+			rewritten[i] = *earliest
+		}
+		if err := store.SaveWriteParallelism(writeParallelism, rewritten); err != nil {
+			return nil, err
+		}
+	} else if !recorded {
+		if err := store.SaveWriteParallelism(writeParallelism, nil); err != nil {
+			return nil, err
 		}
 	}
-	return minTs, minTime, nil
+
+	return positions, nil
+}
+
+// LastProcessedResumeToken returns the change stream resume token that was
+// stored alongside the last processed timestamp for the given ordinal. The
+// token is only written when oplogtoredis is running in change stream mode.
+//
+// If no token has been stored, returns redis.Nil as an error.
+func LastProcessedResumeToken(redisClient redis.UniversalClient, metadataPrefix string, ordinal int) (string, error) {
+	return redisClient.Get(context.Background(), ordinalKey(redisClient, metadataPrefix, "lastProcessedResumeToken", ordinal)).Result()
+}
+
+// RecentChannels returns the collection channels that the publisher with the
+// given ordinal published to at or after since, to within a second. Channels
+// are only remembered for recentChannelsRetention.
+func RecentChannels(redisClient redis.UniversalClient, metadataPrefix string, ordinal int, since primitive.Timestamp) ([]string, error) {
+	return redisClient.ZRangeByScore(context.Background(), recentChannelsKey(redisClient, metadataPrefix, ordinal), &redis.ZRangeBy{
+		Min: strconv.FormatUint(uint64(since.T), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+// recentChannelsKey is the key of the sorted set of the collection channels
+// a publisher has published to, scored by the time (in oplog seconds) of the
+// last publication on each of them
+func recentChannelsKey(redisClient redis.UniversalClient, metadataPrefix string, ordinal int) string {
+	return ordinalKey(redisClient, metadataPrefix, "recentChannels", ordinal)
 }
@@ -88,3 +88,82 @@ func TestLastProcessedTimestampRedisError(t *testing.T) {
 		t.Errorf("Expected TCP error, got: %s", err)
 	}
 }
+
+func TestResumePositions(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.0", encodeMongoTimestamp(primitive.Timestamp{T: 100, I: 1})))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.2", encodeMongoTimestamp(primitive.Timestamp{T: 90, I: 1})))
+
+	// Ordinal 1 doesn't have a checkpoint, so it resumes from the earliest
+	positions, err := ResumePositions(NewRedisCheckpointStore(redisClient, "someprefix."), 3)
+	require.NoError(t, err)
+	require.Equal(t, []primitive.Timestamp{{T: 100, I: 1}, {T: 90, I: 1}, {T: 90, I: 1}}, positions)
+
+	stored, err := redisServer.Get("someprefix.writeParallelism")
+	require.NoError(t, err)
+	require.Equal(t, "3", stored)
+}
+
+// countingCheckpointStore counts the calls to SaveWriteParallelism
+type countingCheckpointStore struct {
+	CheckpointStore
+	saves int
+}
+
+func (s *countingCheckpointStore) SaveWriteParallelism(writeParallelism int, checkpoints []Checkpoint) error {
+	s.saves++
+	return s.CheckpointStore.SaveWriteParallelism(writeParallelism, checkpoints)
+}
+
+func TestResumePositionsParallelismUnchanged(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	require.NoError(t, redisServer.Set("someprefix.writeParallelism", "2"))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.0", encodeMongoTimestamp(primitive.Timestamp{T: 100, I: 1})))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.1", encodeMongoTimestamp(primitive.Timestamp{T: 90, I: 1})))
+
+	store := &countingCheckpointStore{CheckpointStore: NewRedisCheckpointStore(redisClient, "someprefix.")}
+	positions, err := ResumePositions(store, 2)
+	require.NoError(t, err)
+	require.Equal(t, []primitive.Timestamp{{T: 100, I: 1}, {T: 90, I: 1}}, positions)
+
+	// Nothing is rewritten
+	require.Equal(t, 0, store.saves)
+	ts, _, err := LastProcessedTimestamp(redisClient, "someprefix.", 0)
+	require.NoError(t, err)
+	require.Equal(t, primitive.Timestamp{T: 100, I: 1}, ts)
+}
+
+func TestResumePositionsParallelismChanged(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	require.NoError(t, redisServer.Set("someprefix.writeParallelism", "2"))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.0", encodeMongoTimestamp(primitive.Timestamp{T: 100, I: 1})))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry.1", encodeMongoTimestamp(primitive.Timestamp{T: 90, I: 1})))
+
+	positions, err := ResumePositions(NewRedisCheckpointStore(redisClient, "someprefix."), 3)
+	require.NoError(t, err)
+	require.Equal(t, []primitive.Timestamp{{T: 90, I: 1}, {T: 90, I: 1}, {T: 90, I: 1}}, positions)
+
+	// The checkpoints are rewritten for the new write parallelism
+	for i := 0; i < 3; i++ {
+		ts, _, err := LastProcessedTimestamp(redisClient, "someprefix.", i)
+		require.NoError(t, err)
+		require.Equal(t, primitive.Timestamp{T: 90, I: 1}, ts)
+	}
+	stored, err := redisServer.Get("someprefix.writeParallelism")
+	require.NoError(t, err)
+	require.Equal(t, "3", stored)
+}
+
+func TestResumePositionsNoRecord(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	_, err := ResumePositions(NewRedisCheckpointStore(redisClient, "someprefix."), 2)
+	require.Equal(t, ErrNoCheckpoint, err)
+}
@@ -1,9 +1,13 @@
 package redispub
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -26,6 +30,39 @@ func decodeMongoTimestamp(ts string) (primitive.Timestamp, error) {
 	return primitive.Timestamp{T: uint32(i >> 32), I: uint32(i)}, nil
 }
 
+// Converts the position of an oplog entry into the string stored as a
+// checkpoint: the encoded timestamp, followed by the term and hash of the entry
+// if they're known. A checkpoint without them is just the encoded timestamp,
+// like the checkpoints written by older versions.
+func encodeCheckpoint(ts primitive.Timestamp, term int64, hash int64) string {
+	if term == 0 && hash == 0 {
+		return encodeMongoTimestamp(ts)
+	}
+	return fmt.Sprintf("%s:%d:%d", encodeMongoTimestamp(ts), term, hash)
+}
+
+// Converts a string written by encodeCheckpoint back into the timestamp, term,
+// and hash of the entry
+func decodeCheckpoint(checkpoint string) (ts primitive.Timestamp, term int64, hash int64, err error) {
+	parts := strings.Split(checkpoint, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return ts, 0, 0, errors.Errorf("invalid checkpoint %q", checkpoint)
+	}
+
+	ts, err = decodeMongoTimestamp(parts[0])
+	if err != nil || len(parts) == 1 {
+		return ts, 0, 0, err
+	}
+
+	if term, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return ts, 0, 0, err
+	}
+	if hash, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return ts, 0, 0, err
+	}
+	return ts, term, hash, nil
+}
+
 // Returns a time.Time from a primitive.Timestamp
 func mongoTimestampToTime(ts primitive.Timestamp) time.Time {
 	return time.Unix(int64(ts.T), 0)
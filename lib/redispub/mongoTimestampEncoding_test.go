@@ -104,6 +104,53 @@ func TestDecodeMongoTimestamp(t *testing.T) {
 	}
 }
 
+func TestCheckpointEncoding(t *testing.T) {
+	tests := map[string]struct {
+		ts      primitive.Timestamp
+		term    int64
+		hash    int64
+		encoded string
+	}{
+		"Timestamp only": {
+			ts:      primitive.Timestamp{T: 1, I: 2},
+			encoded: "4294967298",
+		},
+		"Term": {
+			ts:      primitive.Timestamp{T: 1, I: 2},
+			term:    5,
+			encoded: "4294967298:5:0",
+		},
+		"Term and hash": {
+			ts:      primitive.Timestamp{T: 1, I: 2},
+			term:    5,
+			hash:    -1234,
+			encoded: "4294967298:5:-1234",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := encodeCheckpoint(test.ts, test.term, test.hash); got != test.encoded {
+				t.Errorf("encodeCheckpoint() = %q, wanted %q", got, test.encoded)
+			}
+
+			ts, term, hash, err := decodeCheckpoint(test.encoded)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %s", err)
+			}
+			if ts != test.ts || term != test.term || hash != test.hash {
+				t.Errorf("decodeCheckpoint(%q) = %v, %d, %d", test.encoded, ts, term, hash)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"1:2", "1:x:0", "x:1:2", "1:2:3:4"} {
+		if _, _, _, err := decodeCheckpoint(invalid); err == nil {
+			t.Errorf("Expected an error decoding %q", invalid)
+		}
+	}
+}
+
 func TestMongoTimestampToTime(t *testing.T) {
 	tests := map[string]struct {
 		in   primitive.Timestamp
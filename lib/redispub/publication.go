@@ -9,7 +9,8 @@ import (
 // Publication represents a message to be sent to Redis about an
 // oplog entry.
 type Publication struct {
-	// The channels to send the message to
+	// The channels to send the message to. The first channel is always the
+	// channel of the collection the message is about.
 	Channels []string
 
 	// Msg is the message to send.
@@ -20,13 +21,50 @@ type Publication struct {
 	// see https://docs.mongodb.com/manual/reference/bson-types/#timestamps
 	OplogTimestamp primitive.Timestamp
 
+	// OplogTerm and OplogHash are the term (t) and hash (h) of the oplog
+	// entry, if the entry's timestamp is OplogTimestamp. They're recorded in
+	// the checkpoint, so that we can tell on resume whether the entry was
+	// rolled back and replaced. They're zero when tailing a change stream.
+	OplogTerm int64
+	OplogHash int64
+
 	// WallTime is the database server wall time of the oplog entry.
 	WallTime time.Time
 
 	// TxIdx is the index of the operation within a transaction. Used to supplement OplogTimestamp in a transaction.
 	TxIdx uint
 
+	// ResumeToken is the `_data` of the change stream resume token for the event
+	// this publication was generated from. It's empty when tailing the oplog
+	// directly.
+	ResumeToken string
+
 	// ParallelismKey is a number representing which parallel write loop will process this message.
 	// It is a hash of the database name, assuming that a single database is the unit of ordering guarantee.
 	ParallelismKey int
+
+	// OverflowResync is set on the resync messages a Buffer publishes for the
+	// collections it dropped publications for. They're given the timestamp of
+	// the publication that caused the drop, so their dedupe key also includes
+	// their channel, to tell them apart from that publication.
+	OverflowResync bool
+
+	// Heartbeat is set on publications that only carry the position of the
+	// oplog to the checkpoint, for when the entries read since the last
+	// publication didn't produce any publications for this write shard. They
+	// have no channels or message, and aren't published.
+	Heartbeat bool
+
+	// Replay is the ID of the replay that generated the publication, or empty
+	// for publications from tailing the oplog. Replayed publications don't
+	// move the checkpoint, and their dedupe key also includes the ID, so that
+	// they're published again even if the original publications were
+	// published recently.
+	Replay string
+
+	// AfterRollback is set on the publications for entries the new primary
+	// wrote after a rollback, whose timestamps may already have been used by
+	// the rolled-back entries we published. Their dedupe key also includes
+	// OplogTerm, so that they aren't mistaken for those.
+	AfterRollback bool
 }
@@ -27,28 +27,218 @@ type PublishOpts struct {
 	FlushInterval    time.Duration
 	DedupeExpiration time.Duration
 	MetadataPrefix   string
+
+	// Registerer is used to register the per-publisher metrics. It defaults to
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+
+	// Checkpoints is where the position of the last published message is
+	// saved. It defaults to the Redis server we publish to, under
+	// MetadataPrefix.
+	Checkpoints CheckpointStore
+
+	// DedupeMode is how publications are deduplicated against the ones other
+	// copies of oplogtoredis publish: one of the config.DedupeMode* constants.
+	// Defaults to config.DedupeModeKeys.
+	DedupeMode string
+
+	// Fencing makes the publishDedupe script refuse to publish, or to move
+	// the checkpoint, once the lease the token was issued for has changed
+	// hands. The zero value disables it. On Redis Cluster, where the lease's
+	// token is in another slot than the write shard's keys, or when it's in
+	// another Redis altogether (see Fencing.Elsewhere), it refuses once a copy
+	// with a higher token has published to the write shard instead.
+	Fencing Fencing
+
+	// AtomicCheckpoint makes the publishDedupe script save the checkpoint of
+	// every batch in the Redis server we publish to, along with the batch,
+	// instead of saving it every FlushInterval. Checkpoints is ignored.
+	AtomicCheckpoint bool
 }
 
-// This script checks whether the keys in KEYS are set. If a key is set, it does
-// nothing. If not, it sets the key, using ARGV[1] as the expiration, and then
-// publishes the corresponding message from ARGV to the channels from ARGV.
-// The keys, messages, and channels are interleaved in ARGV, so for key KEYS[i],
-// the message is at ARGV[2 + (i-1)*2] and the channels are at ARGV[3 + (i-1)*2].
-// Because the first ARGV is the expiration, there's an offset between KEYS and
-// ARGV indices which is the reason for the (i-1).
+// Fencing is a fencing token (see lease.Lease), and the key of the current
+// token to check it against
+type Fencing struct {
+	Key   string
+	Token int64
+
+	// Elsewhere is set when Key is in another Redis than the one we publish
+	// to, such as a Redis destination other than the first
+	Elsewhere bool
+}
+
+// ErrFenced is returned when a batch isn't published because its fencing
+// token is no longer current
+var ErrFenced = errors.New("fencing token is no longer current")
+
+// checkpointComparisonLua defines the Lua functions that compare checkpoints
+// the way Checkpoint.newerThan does, for the scripts that save them
+const checkpointComparisonLua = `
+	-- The timestamps are 64-bit integers, which Lua numbers can't represent
+	-- exactly, so they're compared as decimal strings. Returns -1, 0, or 1.
+	local function compareTimestamps(a, b)
+		if #a ~= #b then
+			return #a < #b and -1 or 1
+		end
+		if a == b then
+			return 0
+		end
+		return a < b and -1 or 1
+	end
+
+	-- Terms are only compared if both positions have one. Returns -1, 0, or 1.
+	local function compareTerms(a, b)
+		a = tonumber(a) or 0
+		b = tonumber(b) or 0
+		if a == 0 or b == 0 or a == b then
+			return 0
+		end
+		return a < b and -1 or 1
+	end
+
+	-- Compares checkpoints ("ts[:term:hash]") by term, and then by timestamp
+	local function newerCheckpoint(new, current)
+		if current == false then
+			return true
+		end
+		local newTs, newTerm = string.match(new, "^(%d+):?(-?%d*)")
+		local currentTs, currentTerm = string.match(current, "^(%d+):?(-?%d*)")
+		if currentTs == nil then
+			return true
+		end
+
+		local c = compareTerms(newTerm, currentTerm)
+		if c == 0 then
+			c = compareTimestamps(newTs, currentTs)
+		end
+		return c > 0
+	end
+`
+
+// This script publishes each message that hasn't been published yet (by us or
+// another copy of oplogtoredis) to its channels. ARGV[1] is the expiration of
+// the dedupe records, ARGV[2] is the number of publications, n, ARGV[3] is
+// the fencing token (see PublishOpts.Fencing), or "", and ARGV[4] is how it's
+// checked. For publication i, KEYS[i] is where its dedupe record is kept, and
+// ARGV holds the message at ARGV[5 + (i-1)*3], the channels at
+// ARGV[6 + (i-1)*3], and how to dedupe it at ARGV[7 + (i-1)*3]. Because the
+// first four ARGV are the expiration, n, and the token and how it's checked,
+// there's an offset between KEYS and ARGV indices which is the reason for the
+// (i-1).
 // The channels are a single string with channels separated by '$' characters.
+// How to dedupe a publication is one of (see PublishOpts.DedupeMode):
+//
+//   - "k": KEYS[i] is a key that's set (with the expiration) once it's
+//     published.
+//   - "b:<member>": KEYS[i] is a set (with the expiration) that member is
+//     added to once it's published.
+//   - "w:<position>": KEYS[i] is the position of the last publication of the
+//     ordinal (see dedupePosition). It's only published if position is after
+//     it.
+//   - "n": it's published without any dedupe.
+//
+// If there's a fencing token, KEYS[n+1] is what it's checked against, and the
+// script fails with a FENCED error, without publishing anything, if it's
+// stale. How it's checked is one of:
+//
+//   - "current": KEYS[n+1] is the key of the current token, and the token is
+//     stale unless the two match.
+//   - "highest": KEYS[n+1] is the highest token that has published with the
+//     write shard's keys (see fencingKey). The token is stale if it's lower,
+//     and replaces it if it's higher.
+//
+// All the KEYS are expected to be in the same slot on Redis Cluster (see
+// shardKeyPrefix).
+//
+// With PublishOpts.AtomicCheckpoint, the script also saves the checkpoint of
+// the batch, so that it's never ahead of or behind what was published. Then
+// there are three more KEYS (after the fencing token's): the checkpoint, the
+// resume token, and the recent channels (see recentChannelsKey), and ARGV continues after the publications
+// with the checkpoint (see encodeCheckpoint), the resume token (or ""), the
+// batch's collection channels (separated by '$'), their score in the recent
+// channels, and the score up to which recent channels are forgotten. The
+// checkpoint is only replaced by a newer one (see newerCheckpoint), so that
+// several copies of oplogtoredis publishing the same entries can't move it
+// backwards.
+//
 // Returns an array of integers, where 1 means published and 0 means duplicate.
-var publishDedupe = redis.NewScript(`
+var publishDedupe = redis.NewScript(checkpointComparisonLua + `
+	-- Compares dedupe positions ("ts:term:txIdx") by term, then by timestamp,
+	-- and then by index in the transaction
+	local function newerPosition(new, current)
+		if current == false then
+			return true
+		end
+		local newTs, newTerm, newIdx = string.match(new, "^(%d+):(-?%d+):(%d+)$")
+		local currentTs, currentTerm, currentIdx = string.match(current, "^(%d+):(-?%d+):(%d+)$")
+		if currentTs == nil then
+			return true
+		end
+
+		local c = compareTerms(newTerm, currentTerm)
+		if c == 0 then
+			c = compareTimestamps(newTs, currentTs)
+		end
+		if c == 0 then
+			return tonumber(newIdx) > tonumber(currentIdx)
+		end
+		return c > 0
+	end
+
 	local results = {}
 	local expiration = ARGV[1]
+	local n = tonumber(ARGV[2])
+	local fencingToken = ARGV[3]
+	local fencing = ARGV[4]
+
+	-- extraKeys is the index of the last KEYS before the checkpoint's
+	local extraKeys = n
+	if fencingToken ~= "" then
+		extraKeys = n + 1
+		local stale
+		if fencing == "highest" then
+			local highest = tonumber(redis.call("GET", KEYS[extraKeys]) or "0")
+			stale = tonumber(fencingToken) < highest
+			if tonumber(fencingToken) > highest then
+				redis.call("SET", KEYS[extraKeys], fencingToken)
+			end
+		else
+			stale = redis.call("GET", KEYS[extraKeys]) ~= fencingToken
+		end
+		if stale then
+			return redis.error_reply("FENCED fencing token " .. fencingToken .. " is no longer current")
+		end
+	end
 
-	for i = 1, #KEYS do
+	for i = 1, n do
 		local key = KEYS[i]
-		local msg = ARGV[2 + (i-1)*2]
-		local channels = ARGV[3 + (i-1)*2]
+		local msg = ARGV[5 + (i-1)*3]
+		local channels = ARGV[6 + (i-1)*3]
+		local dedupe = ARGV[7 + (i-1)*3]
+		local mode = string.sub(dedupe, 1, 1)
+		local arg = string.sub(dedupe, 3)
+
+		local new = false
+		if mode == "k" then
+			if redis.call("GET", key) == false then
+				redis.call("SETEX", key, expiration, 1)
+				new = true
+			end
+		elseif mode == "b" then
+			if redis.call("SADD", key, arg) == 1 then
+				redis.call("EXPIRE", key, expiration)
+				new = true
+			end
+		elseif mode == "w" then
+			if newerPosition(arg, redis.call("GET", key)) then
+				redis.call("SET", key, arg)
+				new = true
+			end
+		else
+			new = true
+		end
 
-		if redis.call("GET", key) == false then
-			redis.call("SETEX", key, expiration, 1)
+		if new then
 			for w in string.gmatch(channels, "([^$]+)") do
 				redis.call("PUBLISH", w, msg)
 			end
@@ -58,6 +248,35 @@ var publishDedupe = redis.NewScript(`
 		end
 	end
 
+	if #KEYS > extraKeys then
+		local checkpointKey = KEYS[extraKeys + 1]
+		local resumeTokenKey = KEYS[extraKeys + 2]
+		local recentChannelsKey = KEYS[extraKeys + 3]
+		local checkpoint = ARGV[5 + n*3]
+		local resumeToken = ARGV[6 + n*3]
+		local collections = ARGV[7 + n*3]
+		local score = ARGV[8 + n*3]
+		local forgetUpTo = ARGV[9 + n*3]
+
+		if newerCheckpoint(checkpoint, redis.call("GET", checkpointKey)) then
+			redis.call("SET", checkpointKey, checkpoint)
+			if resumeToken ~= "" then
+				redis.call("SET", resumeTokenKey, resumeToken)
+			else
+				redis.call("DEL", resumeTokenKey)
+			end
+		end
+
+		local recorded = false
+		for w in string.gmatch(collections, "([^$]+)") do
+			redis.call("ZADD", recentChannelsKey, score, w)
+			recorded = true
+		end
+		if recorded then
+			redis.call("ZREMRANGEBYSCORE", recentChannelsKey, "-inf", forgetUpTo)
+		end
+	end
+
 	return results
 `)
 
@@ -113,21 +332,25 @@ var metricOplogEntryStaleness = promauto.NewHistogramVec(prometheus.HistogramOpt
 	Buckets:   []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 3, 5, 7, 10, 20, 50, 100},
 }, []string{"ordinal", "status"})
 
-// PublishStream reads Publications from the given channel and publishes them
+// PublishStream reads Publications from the given buffer and publishes them
 // to Redis.
-func PublishStream(client redis.UniversalClient, in <-chan *Publication, opts *PublishOpts, stop <-chan bool, ordinal int, clientIndex int) {
+func PublishStream(client redis.UniversalClient, buffer *Buffer, opts *PublishOpts, stop <-chan bool, ordinal int, clientIndex int) {
 
 	// Start up a background goroutine for periodically updating the last-processed
-	// timestamp
-	timestampC := make(chan primitive.Timestamp)
-	go periodicallyUpdateTimestamp(client, timestampC, opts, ordinal)
-
-	// Redis expiration is in integer seconds, so we have to convert the
-	// time.Duration
-	dedupeExpirationSeconds := int(opts.DedupeExpiration.Seconds())
+	// timestamp, unless the publishDedupe script does it
+	timestampC := make(chan checkpoint)
+	if !opts.AtomicCheckpoint {
+		go periodicallyUpdateTimestamp(client, timestampC, opts, ordinal)
+	}
 
 	publishFn := func(batch []*Publication) error {
-		return publishBatch(batch, client, opts.MetadataPrefix, dedupeExpirationSeconds, ordinal)
+		return publishBatch(withoutHeartbeats(batch), nil, client, opts, ordinal)
+	}
+
+	// With AtomicCheckpoint, batches are published with their heartbeats, since
+	// a batch of heartbeats still moves the checkpoint
+	atomicPublishFn := func(batch []*Publication) error {
+		return publishBatch(withoutHeartbeats(batch), batchCheckpoint(batch), client, opts, ordinal)
 	}
 
 	metricSendFailed := metricSentMessages.WithLabelValues("failed")
@@ -144,7 +367,17 @@ func PublishStream(client redis.UniversalClient, in <-chan *Publication, opts *P
 	//		-	under normal operation, this will cycle rapidly
 	var lastSeenPub *Publication = nil
 
-	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	// pendingSkip covers the batches we gave up on that we haven't been able
+	// to report yet (see ReportSkip). Since Redis was failing when we gave up,
+	// we report them once a publish succeeds again.
+	var pendingSkip *Skip
+
+	registerer := opts.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	metricOldestMessageAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace:   "otr",
 		Subsystem:   "redispub",
 		Name:        "oldest_message_age",
@@ -156,6 +389,12 @@ func PublishStream(client redis.UniversalClient, in <-chan *Publication, opts *P
 		}
 		return math.Max(time.Since(lastSeenPub.WallTime).Seconds(), 0)
 	})
+	registerer.MustRegister(metricOldestMessageAge)
+	// Unregister when we stop, so that a publisher with the same labels can be
+	// started later (e.g. when a shard is removed and re-added)
+	defer registerer.Unregister(metricOldestMessageAge)
+
+	in := buffer.Out()
 
 	// main publisher loop:
 	for {
@@ -207,24 +446,109 @@ func PublishStream(client redis.UniversalClient, in <-chan *Publication, opts *P
 		log.Log.Debugw("Batch size", "len(batch)", len(batch))
 		metricStalenessPreRetries.WithLabelValues(strconv.Itoa(ordinal)).Set(time.Since(batch[0].WallTime).Seconds())
 
-		err := publishBatchWithRetries(batch, 30, time.Second, publishFn)
+		toPublish := withoutHeartbeats(batch)
+		var err error
+		switch {
+		case opts.AtomicCheckpoint:
+			err = publishBatchWithRetries(batch, 30, time.Second, atomicPublishFn)
+		case len(toPublish) == 0 && opts.Fencing.Key != "":
+			// A batch of heartbeats still moves the checkpoint, so it's
+			// checked against the fencing token with an empty publication
+			err = publishBatchWithRetries(batch, 30, time.Second, publishFn)
+		default:
+			err = publishBatchWithRetries(toPublish, 30, time.Second, publishFn)
+		}
 		log.Log.Debugw("Published to", "ordinal", ordinal, "clientIndex", clientIndex)
 
-		if err != nil {
-			metricSendFailed.Add(float64(len(batch)))
+		if err == ErrFenced {
+			// Another instance has taken over, and publishes from its own
+			// checkpoint, so this batch isn't lost
+			log.Log.Warnw("Dropping batch: our leader lease was taken over",
+				"batchSize", len(batch))
+		} else if err != nil {
+			metricSendFailed.Add(float64(len(toPublish)))
 			log.Log.Errorw("Permanent error while trying to publish message; giving up",
 				"error", err,
 				"batchSize", len(batch))
+
+			skip := skippedBatch(batch)
+			CountSkip(skip)
+			pendingSkip = mergeSkips(pendingSkip, skip)
 		} else {
-			metricSendSuccess.Add(float64(len(batch)))
+			metricSendSuccess.Add(float64(len(toPublish)))
 
 			// We want to make sure we do this *after* we've successfully published
 			// the messages
-			timestampC <- batch[len(batch)-1].OplogTimestamp
+			if cp := batchCheckpoint(batch); cp != nil && !opts.AtomicCheckpoint {
+				timestampC <- *cp
+			}
+
+			if pendingSkip != nil {
+				if err := ReportSkip(client, opts.MetadataPrefix, *pendingSkip); err != nil {
+					log.Log.Errorw("Error reporting skipped publications; will retry after the next batch",
+						"error", err)
+				} else {
+					pendingSkip = nil
+				}
+			}
+		}
+
+		// The batch's messages no longer count against the buffer's byte
+		// limit once we're done with them
+		for _, published := range batch {
+			buffer.Release(published)
 		}
 	}
 }
 
+// withoutHeartbeats returns the publications of a batch that actually have to
+// be published. Heartbeats only move the checkpoint.
+func withoutHeartbeats(batch []*Publication) []*Publication {
+	for i, p := range batch {
+		if !p.Heartbeat {
+			continue
+		}
+
+		pubs := append([]*Publication{}, batch[:i]...)
+		for _, p := range batch[i+1:] {
+			if !p.Heartbeat {
+				pubs = append(pubs, p)
+			}
+		}
+		return pubs
+	}
+	return batch
+}
+
+// lastTailed returns the last publication of a batch that came from tailing
+// the oplog, rather than from a replay, or nil if there isn't one. Its position
+// is the checkpoint for the batch.
+func lastTailed(batch []*Publication) *Publication {
+	for i := len(batch) - 1; i >= 0; i-- {
+		if batch[i].Replay == "" {
+			return batch[i]
+		}
+	}
+	return nil
+}
+
+// batchCheckpoint returns the checkpoint to save once a batch is published, or
+// nil if it doesn't move the checkpoint (see lastTailed)
+func batchCheckpoint(batch []*Publication) *checkpoint {
+	last := lastTailed(batch)
+	if last == nil {
+		return nil
+	}
+
+	return &checkpoint{
+		timestamp:   last.OplogTimestamp,
+		term:        last.OplogTerm,
+		hash:        last.OplogHash,
+		resumeToken: last.ResumeToken,
+		channels:    collectionChannels(batch),
+	}
+}
+
 func publishBatchWithRetries(batch []*Publication, maxRetries int, sleepTime time.Duration, publishFn func(batch []*Publication) error) error {
 	if len(batch) == 0 {
 		return nil
@@ -234,7 +558,10 @@ func publishBatchWithRetries(batch []*Publication, maxRetries int, sleepTime tim
 	for retries < maxRetries {
 		err := publishFn(batch)
 
-		if err != nil {
+		if err == ErrFenced {
+			// Retrying won't help
+			return err
+		} else if err != nil {
 			log.Log.Errorw("Error publishing message, will retry",
 				"error", err,
 				"retryNumber", retries)
@@ -252,23 +579,59 @@ func publishBatchWithRetries(batch []*Publication, maxRetries int, sleepTime tim
 	return errors.Errorf("sending message (retried %v times)", maxRetries)
 }
 
-func publishBatch(batch []*Publication, client redis.UniversalClient, prefix string, dedupeExpirationSeconds int, ordinal int) error {
+// publishBatch publishes a batch with the publishDedupe script. If cp isn't
+// nil, the script also saves it as the ordinal's checkpoint.
+func publishBatch(batch []*Publication, cp *checkpoint, client redis.UniversalClient, opts *PublishOpts, ordinal int) error {
 	start := time.Now()
 	ordinalStr := strconv.Itoa(ordinal)
+	prefix := opts.MetadataPrefix
+	keyPrefix := shardKeyPrefix(client, prefix, ordinal)
+
+	// Redis expiration is in integer seconds, so we have to convert the
+	// time.Duration
+	dedupeExpirationSeconds := int(opts.DedupeExpiration.Seconds())
+
+	var fencingToken, fencing string
+	if opts.Fencing.Key != "" {
+		fencingToken = strconv.FormatInt(opts.Fencing.Token, 10)
+		fencing = "current"
+		if isCluster(client) || opts.Fencing.Elsewhere {
+			fencing = "highest"
+		}
+	}
 
-	keys := make([]string, len(batch))
-	args := make([]interface{}, 0, 1+len(batch)*2)
-	args = append(args, dedupeExpirationSeconds)
+	keys := make([]string, len(batch), len(batch)+4)
+	args := make([]interface{}, 0, 4+len(batch)*3+5)
+	args = append(args, dedupeExpirationSeconds, len(batch), fencingToken, fencing)
 
 	for i, p := range batch {
 		if p == nil {
 			log.Log.Warn("got nil publication in batch")
 			continue
 		}
-		keys[i] = formatKey(p, prefix)
+		var dedupe string
+		keys[i], dedupe = dedupeRecord(p, keyPrefix, opts.DedupeMode, ordinal)
 		// The channels are a single string with channels separated by '$' characters.
 		// See the publishDedupe script for details.
-		args = append(args, p.Msg, strings.Join(p.Channels, "$"))
+		args = append(args, p.Msg, strings.Join(p.Channels, "$"), dedupe)
+	}
+
+	if fencingToken != "" {
+		keys = append(keys, fencingKey(client, opts, ordinal))
+	}
+
+	if cp != nil {
+		score := float64(cp.timestamp.T)
+		keys = append(keys,
+			ordinalKey(client, prefix, "lastProcessedEntry", ordinal),
+			ordinalKey(client, prefix, "lastProcessedResumeToken", ordinal),
+			recentChannelsKey(client, prefix, ordinal))
+		args = append(args,
+			encodeCheckpoint(cp.timestamp, cp.term, cp.hash),
+			cp.resumeToken,
+			strings.Join(cp.channels, "$"),
+			strconv.FormatFloat(score, 'f', 0, 64),
+			strconv.FormatFloat(score-recentChannelsRetention.Seconds(), 'f', 0, 64))
 	}
 
 	res, err := publishDedupe.Run(
@@ -281,6 +644,9 @@ func publishBatch(batch []*Publication, client redis.UniversalClient, prefix str
 	if err != nil {
 		redisCommandDuration.WithLabelValues(ordinalStr).Observe(time.Since(start).Seconds())
 		redisBatchSize.WithLabelValues("failed", ordinalStr).Observe(float64(len(batch)))
+		if strings.HasPrefix(err.Error(), "FENCED ") {
+			return ErrFenced
+		}
 		return err
 	}
 	redisBatchSize.WithLabelValues("sent", ordinalStr).Observe(float64(len(batch)))
@@ -312,8 +678,96 @@ func publishBatch(batch []*Publication, client redis.UniversalClient, prefix str
 	return nil
 }
 
+// fencingKey returns the key the publishDedupe script checks a batch's
+// fencing token against: the lease's token, or on Redis Cluster or when the
+// lease is in another Redis, the highest token that has published to the
+// write shard, under its hash tag
+func fencingKey(client redis.UniversalClient, opts *PublishOpts, ordinal int) string {
+	if isCluster(client) || opts.Fencing.Elsewhere {
+		return shardKeyPrefix(client, opts.MetadataPrefix, ordinal) + "fence::" + opts.Fencing.Key
+	}
+	return opts.Fencing.Key
+}
+
+// dedupeRecord returns the key the publishDedupe script records that a
+// publication was published in, and how it records it (see config.DedupeMode).
+// With config.DedupeModeWatermark, the publications that can share a position
+// (see dedupeSuffix) are recorded in keys. The keys are under prefix, which is
+// the write shard's key prefix (see shardKeyPrefix).
+func dedupeRecord(p *Publication, prefix string, mode string, ordinal int) (string, string) {
+	switch mode {
+	case config.DedupeModeBuckets:
+		return fmt.Sprintf("%vprocessedBucket::%v", prefix, p.OplogTimestamp.T),
+			fmt.Sprintf("b:%v::%v%v", p.OplogTimestamp.I, p.TxIdx, dedupeSuffix(p))
+	case config.DedupeModeWatermark:
+		if dedupeSuffix(p) == "" {
+			return prefix + "publishedWatermark." + strconv.Itoa(ordinal), "w:" + dedupePosition(p)
+		}
+	case config.DedupeModeOff:
+		return formatKey(p, prefix), "n"
+	}
+	return formatKey(p, prefix), "k"
+}
+
+// dedupePosition is the position of a publication in the oplog, as compared
+// by the publishDedupe script: its timestamp, term, and index in the
+// transaction
+func dedupePosition(p *Publication) string {
+	return fmt.Sprintf("%v:%v:%v", encodeMongoTimestamp(p.OplogTimestamp), p.OplogTerm, p.TxIdx)
+}
+
+// dedupeSuffix distinguishes the publications that can have the same oplog
+// position as another one: resync messages for a buffer overflow, replays,
+// and publications after a rollback. It's empty for the others.
+func dedupeSuffix(p *Publication) string {
+	if p.OverflowResync {
+		return fmt.Sprintf("::resync::%v", p.Channels[0])
+	}
+	if p.Replay != "" {
+		return fmt.Sprintf("::replay::%v", p.Replay)
+	}
+	if p.AfterRollback {
+		return fmt.Sprintf("::term::%v", p.OplogTerm)
+	}
+	return ""
+}
+
 func formatKey(p *Publication, prefix string) string {
-	return fmt.Sprintf("%vprocessed::%v::%v", prefix, encodeMongoTimestamp(p.OplogTimestamp), p.TxIdx)
+	return fmt.Sprintf("%vprocessed::%v::%v%v", prefix, encodeMongoTimestamp(p.OplogTimestamp), p.TxIdx, dedupeSuffix(p))
+}
+
+// checkpoint is the position of the last successfully published message, as
+// sent from PublishStream to periodicallyUpdateTimestamp.
+type checkpoint struct {
+	timestamp primitive.Timestamp
+	term      int64
+	hash      int64
+
+	// resumeToken is only set in change stream mode
+	resumeToken string
+
+	// channels are the collection channels of the publications up to this
+	// checkpoint since the previous one
+	channels []string
+}
+
+// recentChannelsRetention is how long, in oplog time, the collection channels
+// we published to are remembered. If a rollback is detected on resume, resync
+// messages are published on the channels we published to after the point
+// the oplog was rolled back to.
+const recentChannelsRetention = 24 * time.Hour
+
+// collectionChannels returns the distinct collection channels of a batch
+func collectionChannels(batch []*Publication) []string {
+	var channels []string
+	seen := map[string]bool{}
+	for _, p := range batch {
+		if len(p.Channels) > 0 && !seen[p.Channels[0]] {
+			seen[p.Channels[0]] = true
+			channels = append(channels, p.Channels[0])
+		}
+	}
+	return channels
 }
 
 // Periodically updates the last-processed-entry timestamp in Redis.
@@ -321,29 +775,75 @@ func formatKey(p *Publication, prefix string) string {
 // channel, and this function throttles that to only update occasionally.
 //
 // This blocks forever; it should be run in a goroutine
-func periodicallyUpdateTimestamp(client redis.UniversalClient, timestamps <-chan primitive.Timestamp, opts *PublishOpts, ordinal int) {
+func periodicallyUpdateTimestamp(client redis.UniversalClient, timestamps <-chan checkpoint, opts *PublishOpts, ordinal int) {
 	var lastFlush time.Time
-	var mostRecentTimestamp primitive.Timestamp
+	var mostRecent checkpoint
 	var needFlush bool
 
+	checkpoints := opts.Checkpoints
+	if checkpoints == nil {
+		checkpoints = NewRedisCheckpointStore(client, opts.MetadataPrefix)
+	}
+
+	// channels are the collection channels published to since the last flush
+	channels := map[string]bool{}
+
 	flush := func() {
 		if needFlush {
-			client.Set(context.Background(), opts.MetadataPrefix+"lastProcessedEntry."+strconv.Itoa(ordinal), encodeMongoTimestamp(mostRecentTimestamp), 0)
+			ctx := context.Background()
+
+			// On errors, we retry after another FlushInterval
 			lastFlush = time.Now()
+
+			// Record the channels first, so that the checkpoint never covers
+			// publications whose channels aren't recorded
+			if len(channels) > 0 {
+				key := recentChannelsKey(client, opts.MetadataPrefix, ordinal)
+				score := float64(mostRecent.timestamp.T)
+				members := make([]*redis.Z, 0, len(channels))
+				for channel := range channels {
+					members = append(members, &redis.Z{Score: score, Member: channel})
+				}
+
+				_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.ZAdd(ctx, key, members...)
+					pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatFloat(score-recentChannelsRetention.Seconds(), 'f', 0, 64))
+					return nil
+				})
+				if err != nil {
+					log.Log.Errorw("Error recording recently published channels; will retry", "error", err)
+					return
+				}
+				channels = map[string]bool{}
+			}
+
+			err := checkpoints.Save(ordinal, Checkpoint{
+				Timestamp:   mostRecent.timestamp,
+				Term:        mostRecent.term,
+				Hash:        mostRecent.hash,
+				ResumeToken: mostRecent.resumeToken,
+			})
+			if err != nil {
+				log.Log.Errorw("Error saving checkpoint; will retry", "error", err)
+				return
+			}
 			needFlush = false
 		}
 	}
 
 	for {
 		select {
-		case timestamp, ok := <-timestamps:
+		case cp, ok := <-timestamps:
 			if !ok {
 				// channel got closed
 				return
 			}
 
-			mostRecentTimestamp = timestamp
+			mostRecent = cp
 			needFlush = true
+			for _, channel := range cp.channels {
+				channels[channel] = true
+			}
 
 			if time.Since(lastFlush) > opts.FlushInterval {
 				flush()
@@ -1,19 +1,23 @@
 package redispub
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
+	miniredisv2 "github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/tulip/oplogtoredis/lib/config"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // We don't test PublishStream here -- it requires a real Redis server because
 // miniredis doesn't support PUBLISH and its lua support is spotty. It gets
-// tested in integration tests.
+// tested in integration tests. The publishDedupe script is tested with
+// miniredis v2, which supports both.
 
 func TestPublishBatchWithRetriesImmediateSuccess(t *testing.T) {
 	batch := []*Publication{{
@@ -113,7 +117,7 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 	})
 
 	// Start up the periodic updater
-	timestampC := make(chan primitive.Timestamp)
+	timestampC := make(chan checkpoint)
 	waitGroup := sync.WaitGroup{}
 	waitGroup.Add(1)
 
@@ -133,7 +137,7 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 	}
 
 	// Write something
-	timestampC <- primitive.Timestamp{I: 1}
+	timestampC <- checkpoint{timestamp: primitive.Timestamp{I: 1}}
 	time.Sleep(testSpeed / 4) // t = 0.25
 
 	// Key should be set
@@ -141,14 +145,14 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 
 	// Wait less FlushInterval and write something
 	time.Sleep(testSpeed / 2) // t = 0.75
-	timestampC <- primitive.Timestamp{I: 2}
+	timestampC <- checkpoint{timestamp: primitive.Timestamp{I: 2}}
 
 	// Key should not have updated
 	redisServer.CheckGet(t, key, "1")
 
 	// Wait FlushInterval and write something
 	time.Sleep(testSpeed / 2) // t = 1.25
-	timestampC <- primitive.Timestamp{I: 3}
+	timestampC <- checkpoint{timestamp: primitive.Timestamp{I: 3}}
 	time.Sleep(testSpeed / 4) // t = 1.5
 
 	// Key should have been updated
@@ -156,7 +160,7 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 
 	// Wait less than FlushInterval and write something
 	time.Sleep(testSpeed / 4) // t = 1.75
-	timestampC <- primitive.Timestamp{I: 4}
+	timestampC <- checkpoint{timestamp: primitive.Timestamp{I: 4}}
 
 	// Key should not have been updated (making sure that when it *was* updated, we reset the timer)
 	redisServer.CheckGet(t, key, "3")
@@ -181,3 +185,468 @@ func TestEmptyPublicationBatch(t *testing.T) {
 		t.Errorf("Got unexpected error: %s", err)
 	}
 }
+
+func TestPeriodicallyUpdateTimestampResumeToken(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer redisServer.Close()
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+
+	timestampC := make(chan checkpoint)
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(1)
+
+	go func() {
+		periodicallyUpdateTimestamp(redisClient, timestampC, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+		}, 3)
+		waitGroup.Done()
+	}()
+
+	timestampC <- checkpoint{timestamp: primitive.Timestamp{I: 7}, resumeToken: "8263A1B2C3"}
+	close(timestampC)
+	waitGroup.Wait()
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry.3", "7")
+	redisServer.CheckGet(t, "someprefix.lastProcessedResumeToken.3", "8263A1B2C3")
+
+	token, err := LastProcessedResumeToken(redisClient, "someprefix.", 3)
+	if err != nil {
+		t.Errorf("Got unexpected error: %s", err)
+	}
+	if token != "8263A1B2C3" {
+		t.Errorf("Incorrect resume token. Got %s, expected 8263A1B2C3", token)
+	}
+}
+
+func TestPeriodicallyUpdateTimestampRollbackInfo(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer redisServer.Close()
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+
+	timestampC := make(chan checkpoint)
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(1)
+
+	go func() {
+		periodicallyUpdateTimestamp(redisClient, timestampC, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+		}, 0)
+		waitGroup.Done()
+	}()
+
+	ts := primitive.Timestamp{T: 100, I: 7}
+	timestampC <- checkpoint{timestamp: ts, term: 3, channels: []string{"db.Foo", "db.Bar"}}
+	close(timestampC)
+	waitGroup.Wait()
+
+	gotTS, term, hash, err := LastProcessedEntry(redisClient, "someprefix.", 0)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if gotTS != ts || term != 3 || hash != 0 {
+		t.Errorf("Got checkpoint %v:%d:%d, expected %v:3:0", gotTS, term, hash, ts)
+	}
+
+	channels, err := RecentChannels(redisClient, "someprefix.", 0, primitive.Timestamp{T: 100})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if len(channels) != 2 || channels[0] != "db.Bar" || channels[1] != "db.Foo" {
+		t.Errorf("Got recent channels %v, expected [db.Bar db.Foo]", channels)
+	}
+
+	channels, err = RecentChannels(redisClient, "someprefix.", 0, primitive.Timestamp{T: 101})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if len(channels) != 0 {
+		t.Errorf("Got recent channels %v, expected none", channels)
+	}
+}
+
+func TestFormatKeyAfterRollback(t *testing.T) {
+	pub := &Publication{OplogTimestamp: primitive.Timestamp{T: 100, I: 1}, OplogTerm: 2}
+	rolledBack := &Publication{OplogTimestamp: primitive.Timestamp{T: 100, I: 1}, OplogTerm: 3, AfterRollback: true}
+
+	if formatKey(pub, "prefix::") != "prefix::processed::429496729601::0" {
+		t.Errorf("Unexpected dedupe key %s", formatKey(pub, "prefix::"))
+	}
+	if formatKey(pub, "prefix::") == formatKey(rolledBack, "prefix::") {
+		t.Errorf("Expected a publication after a rollback to have a different dedupe key than a rolled-back one with the same timestamp")
+	}
+}
+
+func TestWithoutHeartbeats(t *testing.T) {
+	pubs := []*Publication{
+		{OplogTimestamp: primitive.Timestamp{T: 1}},
+		{OplogTimestamp: primitive.Timestamp{T: 2}},
+	}
+	heartbeat := &Publication{OplogTimestamp: primitive.Timestamp{T: 3}, Heartbeat: true}
+
+	got := withoutHeartbeats(pubs)
+	if len(got) != 2 || &got[0] != &pubs[0] {
+		t.Errorf("Expected a batch without heartbeats to be returned as is, got %v", got)
+	}
+
+	got = withoutHeartbeats([]*Publication{pubs[0], heartbeat, pubs[1], heartbeat})
+	if len(got) != 2 || got[0] != pubs[0] || got[1] != pubs[1] {
+		t.Errorf("Expected the heartbeats to be removed, got %v", got)
+	}
+
+	if got = withoutHeartbeats([]*Publication{heartbeat}); len(got) != 0 {
+		t.Errorf("Expected an empty batch, got %v", got)
+	}
+}
+
+func TestReplayedPublications(t *testing.T) {
+	tailed := &Publication{OplogTimestamp: primitive.Timestamp{T: 100, I: 1}}
+	replayed := &Publication{OplogTimestamp: primitive.Timestamp{T: 50, I: 1}, Replay: "abc"}
+
+	if formatKey(tailed, "prefix::") == formatKey(&Publication{OplogTimestamp: tailed.OplogTimestamp, Replay: "abc"}, "prefix::") {
+		t.Errorf("Expected a replayed publication to have a different dedupe key than the original")
+	}
+
+	// Replayed publications don't move the checkpoint
+	if got := lastTailed([]*Publication{tailed, replayed}); got != tailed {
+		t.Errorf("Expected the checkpoint to be the tailed publication, got %v", got)
+	}
+	if got := lastTailed([]*Publication{replayed}); got != nil {
+		t.Errorf("Expected no checkpoint for a batch of replayed publications, got %v", got)
+	}
+}
+
+func TestPublishBatchAtomicCheckpoint(t *testing.T) {
+	redisServer := miniredisv2.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+	defer redisClient.Close()
+
+	publish := func(pubs []*Publication, cp *checkpoint) {
+		if err := publishBatch(pubs, cp, redisClient, &PublishOpts{MetadataPrefix: "someprefix.", DedupeExpiration: time.Minute}, 1); err != nil {
+			t.Fatalf("Error publishing batch: %s", err)
+		}
+	}
+	checkpointAt := func() string {
+		value, err := redisServer.Get("someprefix.lastProcessedEntry.1")
+		if err != nil {
+			t.Fatalf("Error reading checkpoint: %s", err)
+		}
+		return value
+	}
+
+	pub := &Publication{
+		Channels:       []string{"db.coll", "db.coll::id"},
+		Msg:            []byte("msg"),
+		OplogTimestamp: primitive.Timestamp{T: 100, I: 1},
+		OplogTerm:      2,
+	}
+	publish([]*Publication{pub}, &checkpoint{
+		timestamp:   pub.OplogTimestamp,
+		term:        2,
+		resumeToken: "8264",
+		channels:    []string{"db.coll"},
+	})
+
+	if !redisServer.Exists(formatKey(pub, "someprefix.")) {
+		t.Errorf("Expected the dedupe key to be set")
+	}
+	if got, want := checkpointAt(), encodeCheckpoint(pub.OplogTimestamp, 2, 0); got != want {
+		t.Errorf("Expected checkpoint %q, got %q", want, got)
+	}
+	if token, _ := redisServer.Get("someprefix.lastProcessedResumeToken.1"); token != "8264" {
+		t.Errorf("Expected resume token 8264, got %q", token)
+	}
+	if channels, _ := RecentChannels(redisClient, "someprefix.", 1, primitive.Timestamp{}); len(channels) != 1 || channels[0] != "db.coll" {
+		t.Errorf("Expected db.coll to be recorded as a recent channel, got %v", channels)
+	}
+
+	// An older checkpoint from the same term doesn't move it backwards
+	publish(nil, &checkpoint{timestamp: primitive.Timestamp{T: 99, I: 7}, term: 2, resumeToken: "8263"})
+	if got, want := checkpointAt(), encodeCheckpoint(pub.OplogTimestamp, 2, 0); got != want {
+		t.Errorf("Expected checkpoint %q, got %q", want, got)
+	}
+	if token, _ := redisServer.Get("someprefix.lastProcessedResumeToken.1"); token != "8264" {
+		t.Errorf("Expected resume token 8264, got %q", token)
+	}
+
+	// A checkpoint from a later term replaces it, even with an earlier
+	// timestamp (after a rollback)
+	publish(nil, &checkpoint{timestamp: primitive.Timestamp{T: 95, I: 1}, term: 3})
+	if got, want := checkpointAt(), encodeCheckpoint(primitive.Timestamp{T: 95, I: 1}, 3, 0); got != want {
+		t.Errorf("Expected checkpoint %q, got %q", want, got)
+	}
+
+	// Timestamps are compared exactly, without a term
+	publish(nil, &checkpoint{timestamp: primitive.Timestamp{T: 4000000000, I: 2}})
+	publish(nil, &checkpoint{timestamp: primitive.Timestamp{T: 4000000000, I: 1}})
+	if got, want := checkpointAt(), encodeCheckpoint(primitive.Timestamp{T: 4000000000, I: 2}, 0, 0); got != want {
+		t.Errorf("Expected checkpoint %q, got %q", want, got)
+	}
+}
+
+func TestPublishBatchDedupeModes(t *testing.T) {
+	first := &Publication{Channels: []string{"db.coll"}, Msg: []byte("1"), OplogTimestamp: primitive.Timestamp{T: 100, I: 1}, OplogTerm: 2}
+	txn := &Publication{Channels: []string{"db.coll"}, Msg: []byte("2"), OplogTimestamp: primitive.Timestamp{T: 100, I: 1}, OplogTerm: 2, TxIdx: 1}
+	second := &Publication{Channels: []string{"db.coll"}, Msg: []byte("3"), OplogTimestamp: primitive.Timestamp{T: 100, I: 2}, OplogTerm: 2}
+	replayed := &Publication{Channels: []string{"db.coll"}, Msg: []byte("4"), OplogTimestamp: primitive.Timestamp{T: 50, I: 1}, Replay: "abc"}
+
+	tests := map[string]struct {
+		mode string
+
+		// want is the messages published by publishing first, txn, and
+		// second, then the same again, then replayed
+		want []string
+	}{
+		"Keys":      {mode: config.DedupeModeKeys, want: []string{"1", "2", "3", "4"}},
+		"Buckets":   {mode: config.DedupeModeBuckets, want: []string{"1", "2", "3", "4"}},
+		"Watermark": {mode: config.DedupeModeWatermark, want: []string{"1", "2", "3", "4"}},
+		"Off":       {mode: config.DedupeModeOff, want: []string{"1", "2", "3", "1", "2", "3", "4"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			redisServer := miniredisv2.RunT(t)
+			redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+				Addrs: []string{redisServer.Addr()},
+			})
+			defer redisClient.Close()
+
+			ctx := context.Background()
+			sub := redisClient.Subscribe(ctx, "db.coll")
+			defer sub.Close()
+			if _, err := sub.Receive(ctx); err != nil {
+				t.Fatalf("Error subscribing: %s", err)
+			}
+
+			for _, batch := range [][]*Publication{{first, txn, second}, {first, txn, second}, {replayed}} {
+				if err := publishBatch(batch, nil, redisClient, &PublishOpts{MetadataPrefix: "someprefix.", DedupeExpiration: time.Minute, DedupeMode: test.mode}, 0); err != nil {
+					t.Fatalf("Error publishing batch: %s", err)
+				}
+			}
+
+			var got []string
+			for {
+				msg, err := sub.ReceiveTimeout(ctx, 100*time.Millisecond)
+				if err != nil {
+					break
+				}
+				got = append(got, msg.(*redis.Message).Payload)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Expected messages %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("Expected messages %v, got %v", test.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPublishBatchWatermarkAfterRollback(t *testing.T) {
+	redisServer := miniredisv2.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+	defer redisClient.Close()
+
+	publish := func(pub *Publication) {
+		if err := publishBatch([]*Publication{pub}, nil, redisClient, &PublishOpts{MetadataPrefix: "someprefix.", DedupeExpiration: time.Minute, DedupeMode: config.DedupeModeWatermark}, 0); err != nil {
+			t.Fatalf("Error publishing batch: %s", err)
+		}
+	}
+	watermark := func() string {
+		value, _ := redisServer.Get("someprefix.publishedWatermark.0")
+		return value
+	}
+
+	old := &Publication{Channels: []string{"db.coll"}, OplogTimestamp: primitive.Timestamp{T: 100, I: 1}, OplogTerm: 2}
+	publish(old)
+	if want := dedupePosition(old); watermark() != want {
+		t.Errorf("Expected watermark %q, got %q", want, watermark())
+	}
+
+	// An earlier entry from a later term is after it
+	newer := &Publication{Channels: []string{"db.coll"}, OplogTimestamp: primitive.Timestamp{T: 90, I: 1}, OplogTerm: 3}
+	publish(newer)
+	if want := dedupePosition(newer); watermark() != want {
+		t.Errorf("Expected watermark %q, got %q", want, watermark())
+	}
+
+	// A later entry from an earlier term isn't
+	publish(&Publication{Channels: []string{"db.coll"}, OplogTimestamp: primitive.Timestamp{T: 110, I: 1}, OplogTerm: 2})
+	if want := dedupePosition(newer); watermark() != want {
+		t.Errorf("Expected watermark %q, got %q", want, watermark())
+	}
+}
+
+func TestPublishBatchFenced(t *testing.T) {
+	redisServer := miniredisv2.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+	defer redisClient.Close()
+
+	opts := &PublishOpts{
+		MetadataPrefix:   "someprefix.",
+		DedupeExpiration: time.Minute,
+		Fencing:          Fencing{Key: "someprefix.leaderToken", Token: 2},
+	}
+	publish := func(ts uint32) error {
+		pub := &Publication{Channels: []string{"db.coll"}, Msg: []byte("asdf"), OplogTimestamp: primitive.Timestamp{T: ts}}
+		return publishBatch([]*Publication{pub}, batchCheckpoint([]*Publication{pub}), redisClient, opts, 0)
+	}
+
+	if err := redisServer.Set("someprefix.leaderToken", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(100); err != nil {
+		t.Fatalf("Error publishing with the current token: %s", err)
+	}
+
+	// Once another instance has taken over, nothing is published or
+	// checkpointed
+	if err := redisServer.Set("someprefix.leaderToken", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(101); err != ErrFenced {
+		t.Errorf("Expected ErrFenced, got %v", err)
+	}
+	if redisServer.Exists(formatKey(&Publication{OplogTimestamp: primitive.Timestamp{T: 101}}, "someprefix.")) {
+		t.Error("Expected the fenced publication not to be recorded")
+	}
+	checkpoint, err := NewRedisCheckpointStore(redisClient, "someprefix.").Load(0)
+	if err != nil {
+		t.Fatalf("Error loading checkpoint: %s", err)
+	}
+	if checkpoint.Timestamp.T != 100 {
+		t.Errorf("Expected the checkpoint to stay at 100, got %d", checkpoint.Timestamp.T)
+	}
+
+	// Fenced errors aren't retried
+	calls := 0
+	err = publishBatchWithRetries([]*Publication{{}}, 5, 0, func([]*Publication) error {
+		calls++
+		return ErrFenced
+	})
+	if err != ErrFenced || calls != 1 {
+		t.Errorf("Expected one call returning ErrFenced, got %d calls returning %v", calls, err)
+	}
+}
+
+func TestPublishBatchFencedElsewhere(t *testing.T) {
+	redisServer := miniredisv2.RunT(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+	defer redisClient.Close()
+
+	// The lease's token isn't in this Redis
+	opts := &PublishOpts{
+		MetadataPrefix:   "someprefix.",
+		DedupeExpiration: time.Minute,
+		Fencing:          Fencing{Key: "someprefix.leaderToken", Elsewhere: true},
+	}
+	publish := func(batch []*Publication, token int64) error {
+		opts.Fencing.Token = token
+		return publishBatch(batch, nil, redisClient, opts, 0)
+	}
+	pub := func(ts uint32) []*Publication {
+		return []*Publication{{Channels: []string{"db.coll"}, Msg: []byte("asdf"), OplogTimestamp: primitive.Timestamp{T: ts}}}
+	}
+
+	if err := publish(pub(100), 2); err != nil {
+		t.Fatalf("Error publishing batch: %s", err)
+	}
+	if got, _ := redisServer.Get("someprefix.fence::someprefix.leaderToken"); got != "2" {
+		t.Errorf("Expected highest token 2, got %q", got)
+	}
+
+	// A batch of heartbeats is checked with an empty batch, which is enough
+	// for a new holder to fence off the old one
+	if err := publish(nil, 3); err != nil {
+		t.Fatalf("Error checking an empty batch: %s", err)
+	}
+	if err := publish(nil, 2); err != ErrFenced {
+		t.Errorf("Expected ErrFenced for an empty batch, got %v", err)
+	}
+	if err := publish(pub(101), 2); err != ErrFenced {
+		t.Errorf("Expected ErrFenced, got %v", err)
+	}
+	if redisServer.Exists(formatKey(pub(101)[0], "someprefix.")) {
+		t.Error("Expected the fenced publication not to be recorded")
+	}
+}
+
+func TestPublishBatchCluster(t *testing.T) {
+	// miniredis serves every slot of a one-node cluster, which is enough to
+	// check which keys are used
+	redisServer := miniredisv2.RunT(t)
+	redisClient := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{redisServer.Addr()},
+	})
+	defer redisClient.Close()
+
+	opts := &PublishOpts{
+		MetadataPrefix:   "someprefix.",
+		DedupeExpiration: time.Minute,
+		Fencing:          Fencing{Key: "{someprefix.shard.3}Token", Token: 2},
+	}
+	publish := func(ts uint32, token int64) error {
+		pub := &Publication{Channels: []string{"db.coll"}, Msg: []byte("asdf"), OplogTimestamp: primitive.Timestamp{T: ts}}
+		opts.Fencing.Token = token
+		return publishBatch([]*Publication{pub}, batchCheckpoint([]*Publication{pub}), redisClient, opts, 3)
+	}
+
+	if err := publish(100, 2); err != nil {
+		t.Fatalf("Error publishing batch: %s", err)
+	}
+
+	// Everything the batch touched is under the write shard's hash tag
+	pub := &Publication{OplogTimestamp: primitive.Timestamp{T: 100}}
+	for _, key := range []string{
+		formatKey(pub, "someprefix.{3}"),
+		"someprefix.{3}lastProcessedEntry",
+		"someprefix.{3}recentChannels",
+		"someprefix.{3}fence::{someprefix.shard.3}Token",
+	} {
+		if !redisServer.Exists(key) {
+			t.Errorf("Expected %s to be set", key)
+		}
+	}
+	checkpoint, err := NewRedisCheckpointStore(redisClient, "someprefix.").Load(3)
+	if err != nil {
+		t.Fatalf("Error loading checkpoint: %s", err)
+	}
+	if checkpoint.Timestamp.T != 100 {
+		t.Errorf("Expected checkpoint 100, got %d", checkpoint.Timestamp.T)
+	}
+
+	// Once a higher token has published to the write shard, a lower one is
+	// fenced off
+	if err := publish(101, 3); err != nil {
+		t.Fatalf("Error publishing with a higher token: %s", err)
+	}
+	if err := publish(102, 2); err != ErrFenced {
+		t.Errorf("Expected ErrFenced, got %v", err)
+	}
+	if redisServer.Exists(formatKey(&Publication{OplogTimestamp: primitive.Timestamp{T: 102}}, "someprefix.{3}")) {
+		t.Error("Expected the fenced publication not to be recorded")
+	}
+}
@@ -0,0 +1,36 @@
+package redispub
+
+import (
+	"encoding/json"
+)
+
+// ResyncEvent is the event name of resync messages. A resync message tells
+// subscribers of a channel that they may have missed changes (for example,
+// because the collection was dropped), and should re-query instead of
+// applying incremental changes.
+const ResyncEvent = "resync"
+
+// ResyncMessage builds a resync message. It has the same shape as the
+// messages redis-oplog expects for document changes, with an empty document
+// and field list, plus the reason for the resync:
+//
+//	{"e": "resync", "d": {}, "f": [], "r": "<reason>"}
+func ResyncMessage(reason string) []byte {
+	msg, err := json.Marshal(struct {
+		Event  string            `json:"e"`
+		Doc    map[string]string `json:"d"`
+		Fields []string          `json:"f"`
+		Reason string            `json:"r"`
+	}{
+		Event:  ResyncEvent,
+		Doc:    map[string]string{},
+		Fields: []string{},
+		Reason: reason,
+	})
+	if err != nil {
+		// Marshalling a struct of strings can't fail
+		panic(err)
+	}
+
+	return msg
+}
@@ -0,0 +1,23 @@
+package redispub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResyncMessage(t *testing.T) {
+	require.JSONEq(t, `{"e":"resync","d":{},"f":[],"r":"drop"}`, string(ResyncMessage("drop")))
+
+	// Resync messages must be decodable the same way as regular messages
+	var msg struct {
+		Event  string                 `json:"e"`
+		Doc    map[string]interface{} `json:"d"`
+		Fields []string               `json:"f"`
+	}
+	require.NoError(t, json.Unmarshal(ResyncMessage("drop"), &msg))
+	require.Equal(t, ResyncEvent, msg.Event)
+	require.Empty(t, msg.Doc)
+	require.Empty(t, msg.Fields)
+}
@@ -0,0 +1,194 @@
+package redispub
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The reasons oplogtoredis knowingly skips oplog entries, which are sent as
+// the reason of the resync messages for the skip
+const (
+	// SkipReasonGapTooLarge is when the last processed timestamp was more than
+	// OTR_MAX_CATCH_UP ago, so we started from the end of the oplog
+	SkipReasonGapTooLarge = "gap-too-large"
+
+	// SkipReasonResumeFailure is when we couldn't read the last processed
+	// timestamp, and OTR_RESUME_FROM_END_ON_FAILURE made us start from the end
+	// of the oplog
+	SkipReasonResumeFailure = "resume-failure"
+
+	// SkipReasonPublishFailure is when a batch of publications still failed
+	// after all its retries
+	SkipReasonPublishFailure = "publish-failure"
+
+	// SkipReasonHistoryLost is when the last processed timestamp has already
+	// fallen out of the oplog
+	SkipReasonHistoryLost = "history-lost"
+
+	// SkipReasonRollback is when the last processed entry was rolled back
+	// after a failover, so we may have published writes that never happened
+	SkipReasonRollback = "rollback"
+)
+
+// maxSkipRecords is how many skips are kept in the skips list in Redis
+const maxSkipRecords = 100
+
+var metricSkips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "skips",
+	Help:      "Number of times oplog entries were knowingly skipped, partitioned by reason",
+}, []string{"reason"})
+
+var metricSkippedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "skipped_seconds",
+	Help:      "Total length of the ranges of the oplog that were knowingly skipped, in oplog time, partitioned by reason",
+}, []string{"reason"})
+
+// Skip describes a range of oplog entries that oplogtoredis knowingly didn't
+// publish
+type Skip struct {
+	Reason string
+
+	// From and To are the first and last skipped positions. From is zero if
+	// it's unknown.
+	From primitive.Timestamp
+	To   primitive.Timestamp
+
+	// Channels are the collection channels of the skipped publications, if
+	// they're known. If they aren't, the resync message is published on the
+	// control channel instead.
+	Channels []string
+}
+
+// skipRecord is how a Skip is stored in the skips list in Redis
+type skipRecord struct {
+	Reason   string    `json:"reason"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to"`
+	Time     time.Time `json:"time"`
+	Channels []string  `json:"channels,omitempty"`
+}
+
+// ControlChannel is the channel that resync messages are published on when
+// the affected collections aren't known. Subscribers that receive a resync
+// message on it should re-run all their queries.
+func ControlChannel(metadataPrefix string) string {
+	return metadataPrefix + "control"
+}
+
+// SkipsKey is the key of the Redis list that holds the most recent skips,
+// newest first, as JSON
+func SkipsKey(metadataPrefix string) string {
+	return metadataPrefix + "skips"
+}
+
+// CountSkip records a skip in the metrics. It should be called once per skip,
+// regardless of how many Redis servers it's reported to.
+func CountSkip(skip Skip) {
+	metricSkips.WithLabelValues(skip.Reason).Inc()
+	if !skip.From.IsZero() && skip.To.T > skip.From.T {
+		metricSkippedSeconds.WithLabelValues(skip.Reason).Add(float64(skip.To.T - skip.From.T))
+	}
+}
+
+// ReportSkip adds a skip to the skips list, and publishes a resync message for
+// it on each affected collection channel (or on the control channel if they
+// aren't known). The resync message is only published with
+// config.ResyncMessages, except for rollbacks: subscribers were told about
+// writes that no longer exist, so they're always told to re-query.
+func ReportSkip(client redis.UniversalClient, metadataPrefix string, skip Skip) error {
+	ctx := context.Background()
+
+	record := skipRecord{
+		Reason:   skip.Reason,
+		To:       encodeMongoTimestamp(skip.To),
+		Time:     time.Now().UTC(),
+		Channels: skip.Channels,
+	}
+	if !skip.From.IsZero() {
+		record.From = encodeMongoTimestamp(skip.From)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encoding skip")
+	}
+
+	channels := skip.Channels
+	if len(channels) == 0 {
+		channels = []string{ControlChannel(metadataPrefix)}
+	}
+	msg := ResyncMessage(skip.Reason)
+
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, SkipsKey(metadataPrefix), data)
+		pipe.LTrim(ctx, SkipsKey(metadataPrefix), 0, maxSkipRecords-1)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "recording skip")
+	}
+
+	if !config.ResyncMessages() && skip.Reason != SkipReasonRollback {
+		return nil
+	}
+
+	for _, channel := range channels {
+		if err := client.Publish(ctx, channel, msg).Err(); err != nil {
+			return errors.Wrap(err, "publishing resync message for skip")
+		}
+	}
+	return nil
+}
+
+// skippedBatch returns the Skip for a batch of publications that couldn't be
+// published
+func skippedBatch(batch []*Publication) Skip {
+	skip := Skip{
+		Reason:   SkipReasonPublishFailure,
+		From:     batch[0].OplogTimestamp,
+		To:       batch[len(batch)-1].OplogTimestamp,
+		Channels: collectionChannels(batch),
+	}
+	sort.Strings(skip.Channels)
+
+	return skip
+}
+
+// mergeSkips combines two skips of failed batches into one that covers both
+func mergeSkips(a *Skip, b Skip) *Skip {
+	if a == nil {
+		return &b
+	}
+
+	merged := *a
+	if b.From.Before(merged.From) {
+		merged.From = b.From
+	}
+	if merged.To.Before(b.To) {
+		merged.To = b.To
+	}
+
+	seen := map[string]bool{}
+	merged.Channels = nil
+	for _, channel := range append(append([]string{}, a.Channels...), b.Channels...) {
+		if !seen[channel] {
+			seen[channel] = true
+			merged.Channels = append(merged.Channels, channel)
+		}
+	}
+	sort.Strings(merged.Channels)
+
+	return &merged
+}
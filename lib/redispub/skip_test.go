@@ -0,0 +1,94 @@
+package redispub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tulip/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReportSkipRecordsSkip(t *testing.T) {
+	require.NoError(t, config.ParseEnv())
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	skip := Skip{
+		Reason: SkipReasonGapTooLarge,
+		From:   primitive.Timestamp{T: 100, I: 1},
+		To:     primitive.Timestamp{T: 200, I: 2},
+	}
+
+	// miniredis doesn't support PUBLISH, so we can only check that the skip
+	// was recorded before the resync message was published
+	err := ReportSkip(redisClient, "someprefix.", skip)
+	require.Error(t, err)
+
+	records, err := redisServer.List("someprefix.skips")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	var record skipRecord
+	require.NoError(t, json.Unmarshal([]byte(records[0]), &record))
+	require.Equal(t, SkipReasonGapTooLarge, record.Reason)
+	require.Equal(t, encodeMongoTimestamp(skip.From), record.From)
+	require.Equal(t, encodeMongoTimestamp(skip.To), record.To)
+	require.Empty(t, record.Channels)
+}
+
+func TestReportSkipWithoutResync(t *testing.T) {
+	t.Setenv("OTR_RESYNC_MESSAGES", "false")
+	require.NoError(t, config.ParseEnv())
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Without resync messages, nothing is published, so miniredis' lack of
+	// PUBLISH doesn't matter
+	require.NoError(t, ReportSkip(redisClient, "someprefix.", Skip{Reason: SkipReasonGapTooLarge}))
+
+	records, err := redisServer.List("someprefix.skips")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestReportRollbackWithoutResync(t *testing.T) {
+	t.Setenv("OTR_RESYNC_MESSAGES", "false")
+	require.NoError(t, config.ParseEnv())
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Rollbacks are always published, so this fails on miniredis' lack of
+	// PUBLISH
+	err := ReportSkip(redisClient, "someprefix.", Skip{Reason: SkipReasonRollback, Channels: []string{"db.Foo"}})
+	require.Error(t, err)
+}
+
+func TestSkippedBatch(t *testing.T) {
+	batch := []*Publication{
+		{Channels: []string{"db.Foo", "db.Foo::1"}, OplogTimestamp: primitive.Timestamp{T: 100, I: 1}},
+		{Channels: []string{"db.Bar", "db.Bar::2"}, OplogTimestamp: primitive.Timestamp{T: 100, I: 2}},
+		{Channels: []string{"db.Foo", "db.Foo::3"}, OplogTimestamp: primitive.Timestamp{T: 101, I: 1}},
+	}
+
+	skip := skippedBatch(batch)
+	require.Equal(t, Skip{
+		Reason:   SkipReasonPublishFailure,
+		From:     primitive.Timestamp{T: 100, I: 1},
+		To:       primitive.Timestamp{T: 101, I: 1},
+		Channels: []string{"db.Bar", "db.Foo"},
+	}, skip)
+
+	later := skippedBatch([]*Publication{
+		{Channels: []string{"db.Baz", "db.Baz::4"}, OplogTimestamp: primitive.Timestamp{T: 105, I: 1}},
+	})
+	require.Equal(t, &Skip{
+		Reason:   SkipReasonPublishFailure,
+		From:     primitive.Timestamp{T: 100, I: 1},
+		To:       primitive.Timestamp{T: 105, I: 1},
+		Channels: []string{"db.Bar", "db.Baz", "db.Foo"},
+	}, mergeSkips(&skip, later))
+}
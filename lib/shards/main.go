@@ -0,0 +1,123 @@
+// Package shards discovers the shards of a sharded MongoDB cluster, so that
+// oplogtoredis can tail each shard's oplog directly.
+package shards
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Shard is a shard of a sharded cluster, as described by a document in the
+// config.shards collection
+type Shard struct {
+	// ID is the name of the shard, e.g. "shard01"
+	ID string `bson:"_id"`
+
+	// Host is the shard's connection string, in the form
+	// "<replica set name>/<host>:<port>,<host>:<port>,..."
+	Host string `bson:"host"`
+
+	// Draining is set while the shard is being removed from the cluster
+	Draining bool `bson:"draining"`
+}
+
+// List reads the shards of the cluster from the config.shards collection.
+// client must be connected to a mongos.
+func List(ctx context.Context, client *mongo.Client) ([]Shard, error) {
+	cursor, err := client.Database("config").Collection("shards").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "querying config.shards")
+	}
+
+	var shards []Shard
+	err = cursor.All(ctx, &shards)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding config.shards")
+	}
+
+	return shards, nil
+}
+
+// MongoURL builds a URL for connecting directly to a shard's replica set, by
+// replacing the hosts in the URL used to connect to the mongos with the hosts
+// of the shard. Credentials and options are carried over, since the shards of
+// a cluster share its users.
+//
+// mongodb+srv:// URLs are converted to mongodb:// URLs (the shard's hosts are
+// listed explicitly), and get the options that SRV URLs imply: tls=true and,
+// unless specified otherwise, authSource=admin.
+func MongoURL(mongosURL string, shard Shard) (string, error) {
+	replicaSet := ""
+	hosts := shard.Host
+	if slash := strings.Index(shard.Host, "/"); slash >= 0 {
+		replicaSet = shard.Host[:slash]
+		hosts = shard.Host[slash+1:]
+	}
+	if hosts == "" {
+		return "", errors.Errorf("shard %s has no hosts in %q", shard.ID, shard.Host)
+	}
+
+	var rest string
+	srv := false
+	switch {
+	case strings.HasPrefix(mongosURL, "mongodb://"):
+		rest = strings.TrimPrefix(mongosURL, "mongodb://")
+	case strings.HasPrefix(mongosURL, "mongodb+srv://"):
+		rest = strings.TrimPrefix(mongosURL, "mongodb+srv://")
+		srv = true
+	default:
+		return "", errors.New(`Mongo URL scheme must be "mongodb" or "mongodb+srv"`)
+	}
+
+	// rest is [userinfo@]hosts[/[database][?options]]
+	authority := rest
+	path := ""
+	if idx := strings.IndexAny(rest, "/?"); idx >= 0 {
+		authority = rest[:idx]
+		path = rest[idx:]
+	}
+
+	userinfo := ""
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo = authority[:at+1]
+	}
+
+	database := path
+	rawQuery := ""
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		database = path[:idx]
+		rawQuery = path[idx+1:]
+	}
+	if database == "" {
+		database = "/"
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing Mongo URL options")
+	}
+
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+	}
+	if srv {
+		if query.Get("tls") == "" && query.Get("ssl") == "" {
+			query.Set("tls", "true")
+		}
+		if query.Get("authSource") == "" {
+			query.Set("authSource", "admin")
+		}
+	}
+
+	shardURL := "mongodb://" + userinfo + hosts + database
+	if encoded := query.Encode(); encoded != "" {
+		shardURL += "?" + encoded
+	}
+
+	return shardURL, nil
+}
@@ -4,32 +4,27 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	stdlog "log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 
 	"github.com/tulip/oplogtoredis/lib/config"
 	"github.com/tulip/oplogtoredis/lib/denylist"
 	"github.com/tulip/oplogtoredis/lib/log"
-	"github.com/tulip/oplogtoredis/lib/oplog"
 	"github.com/tulip/oplogtoredis/lib/parse"
 	"github.com/tulip/oplogtoredis/lib/redispub"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
@@ -37,23 +32,15 @@ import (
 func main() {
 	defer log.Sync()
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplayCommand(os.Args[2:]))
+	}
+
 	err := config.ParseEnv()
 	if err != nil {
 		panic("Error parsing environment variables: " + err.Error())
 	}
 
-	writeParallelism := config.WriteParallelism()
-	// each array of redis clients holds one client for each destination (regular redis, sentinel)
-	// the aggregated array holds one such array for every write-parallelism shard
-	aggregatedRedisClients := make([][]redis.UniversalClient, writeParallelism)
-	// make one PublisherChannels for each parallel writer
-	aggregatedRedisPubs := make([]oplog.PublisherChannels, writeParallelism)
-	// one stopper channel corresponds to each writer, so it uses the same 2D array structure.
-	stopRedisPubs := make([][]chan bool, writeParallelism)
-
-	bufferSize := 10000
-	waitGroup := sync.WaitGroup{}
-
 	syncer, err := denylist.NewSyncer(config.PostgresPersistenceURL())
 	if err != nil {
 		panic("Error setting up persistent denylist: " + err.Error())
@@ -63,127 +50,44 @@ func main() {
 		panic("Error loading persistent denylist: " + err.Error())
 	}
 
-	// this loop starts one writer shard on each pass. Repeat it a number of times equal to the write parallelism level.
-	for i := 0; i < writeParallelism; i++ {
-		redisClients, err := createRedisClients()
-		if err != nil {
-			panic(fmt.Sprintf("[%d] Error initializing Redis client: %s", i, err.Error()))
-		}
-		defer func(ordinal int) {
-			for _, redisClient := range redisClients {
-				redisCloseErr := redisClient.Close()
-				if redisCloseErr != nil {
-					log.Log.Errorw("Error closing Redis client",
-						"error", redisCloseErr,
-						"i", ordinal)
-				}
-			}
-		}(i)
-		log.Log.Infow("Initialized connection to Redis", "i", i)
-
-		aggregatedRedisClients[i] = redisClients
-		clientsSize := len(redisClients)
-
-		// each writer shard is going to make multiple writer coroutines, one for each redis destination,
-		// so we create one PublisherChannels for this shard and put each coroutine's intake channel in it.
-		// these will all be aggregated in the aggregatedRedisPubs 2D array and passed to the tailer.
-		redisPubsAggregationEntry := make(oplog.PublisherChannels, clientsSize)
-		stopRedisPubsEntry := make([]chan bool, clientsSize)
-
-		for j := 0; j < clientsSize; j++ {
-			redisClient := redisClients[j]
-
-			redisPubs := make(chan *redispub.Publication, bufferSize)
-			redisPubsAggregationEntry[j] = redisPubs
-
-			stopRedisPub := make(chan bool)
-			stopRedisPubsEntry[j] = stopRedisPub
-
-			waitGroup.Add(1)
-
-			// We create two goroutines:
-			//
-			// The oplog.Tail goroutine reads messages from the oplog, and generates the
-			// messages that we need to write to redis. It then writes them to a
-			// buffered channel.
-			//
-			// The redispub.PublishStream goroutine reads messages from the buffered channel
-			// and sends them to Redis.
-			//
-			// TODO PERF: Use a leaky buffer (https://github.com/tulip/oplogtoredis/issues/2)
-			go func(ordinal int, clientIndex int) {
-				redispub.PublishStream(redisClient, redisPubs, &redispub.PublishOpts{
-					FlushInterval:    config.TimestampFlushInterval(),
-					DedupeExpiration: config.RedisDedupeExpiration(),
-					MetadataPrefix:   config.RedisMetadataPrefix(),
-				}, stopRedisPub, ordinal, clientIndex)
-				log.Log.Infow("Redis publisher completed", "ordinal", ordinal, "clientIndex", clientIndex)
-				waitGroup.Done()
-			}(i, j)
-			log.Log.Info("Started up processing goroutines")
-
-			promauto.NewGaugeFunc(prometheus.GaugeOpts{
-				Namespace:   "otr",
-				Name:        "buffer_available",
-				Help:        "Gauge indicating the available space in the buffer of oplog entries waiting to be written to redis.",
-				ConstLabels: prometheus.Labels{"ordinal": strconv.Itoa(i), "clientIndex": strconv.Itoa(j)},
-			}, func() float64 {
-				return float64(bufferSize - len(redisPubs))
-			})
+	pipelines := newPipelineSet()
+	tail := &tailing{pipelines: pipelines, denylist: denylist}
 
-		}
+	// With leader election or shard leases, we only publish the write shards
+	// we hold a lease on
+	var coordinator coordination
+	stopCoordination := make(chan bool)
+	coordinationDone := make(chan bool)
 
-		// aggregate
-		aggregatedRedisPubs[i] = redisPubsAggregationEntry
-		stopRedisPubs[i] = stopRedisPubsEntry
+	switch {
+	case config.LeaderElection():
+		coordinator, err = newElection()
+	case config.ShardLeases():
+		coordinator, err = newShardOwnership()
+	}
+	if err != nil {
+		panic("Error setting up leases: " + err.Error())
 	}
 
-	readParallelism := config.ReadParallelism()
+	if coordinator != nil {
+		defer coordinator.close()
 
-	stopOplogTails := make([]chan bool, readParallelism)
-	aggregatedMongoSessions := make([]*mongo.Client, readParallelism)
-	for i := 0; i < readParallelism; i++ {
-		mongoSession, err := createMongoClient()
+		go func() {
+			coordinator.run(tail.setShards, stopCoordination)
+			close(coordinationDone)
+		}()
+	} else {
+		err = tail.setShards(allShards(redispub.Fencing{}))
 		if err != nil {
-			panic(fmt.Sprintf("[%d] Error initializing oplog tailer: %s", i, err.Error()))
+			panic(err.Error())
 		}
-		defer func(i int) {
-			mongoCloseCtx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
-			defer cancel()
-
-			mongoCloseErr := mongoSession.Disconnect(mongoCloseCtx)
-			if mongoCloseErr != nil {
-				log.Log.Errorw("Error closing Mongo client", "i", i, "error", mongoCloseErr)
-			}
-		}(i)
-		log.Log.Infow("Initialized connection to Mongo", "i", i)
-		aggregatedMongoSessions[i] = mongoSession
-
-		stopOplogTail := make(chan bool)
-		stopOplogTails[i] = stopOplogTail
-
-		waitGroup.Add(1)
-		go func(i int) {
-			tailer := oplog.Tailer{
-				MongoClient:  mongoSession,
-				RedisClients: aggregatedRedisClients[0], // the tailer coroutine needs a redis client for determining start timestamp
-				// it doesn't really matter which one since this isn't a meaningful amount of load, so just take the first one
-				RedisPrefix: config.RedisMetadataPrefix(),
-				MaxCatchUp:  config.MaxCatchUp(),
-				Denylist:    denylist,
-			}
-			// pass all intake channels to the tailer, which will route messages accordingly
-			tailer.Tail(aggregatedRedisPubs, stopOplogTail, i, readParallelism)
-
-			log.Log.Info("Oplog tailer completed")
-			waitGroup.Done()
-		}(i)
+		close(coordinationDone)
 	}
 
 	var shuttingDown bool
 
 	// Start one more goroutine for the HTTP server
-	httpServer := makeHTTPServer(aggregatedRedisClients, aggregatedMongoSessions, denylist, syncer)
+	httpServer := makeHTTPServer(pipelines, coordinator, denylist, syncer)
 	go func() {
 		httpErr := httpServer.ListenAndServe()
 		if shuttingDown {
@@ -212,30 +116,125 @@ func main() {
 	log.Log.Warnf("Exiting cleanly due to signal %s. Interrupt again to force unclean shutdown.", sig)
 	signal.Reset()
 
-	for _, stopOplogTail := range stopOplogTails {
-		stopOplogTail <- true
+	err = httpServer.Shutdown(context.Background())
+	if err != nil {
+		log.Log.Errorw("Error shutting down HTTP server",
+			"error", err)
 	}
-	for _, stopRedisPubEntry := range stopRedisPubs {
-		for _, stopRedisPub := range stopRedisPubEntry {
-			stopRedisPub <- true
+
+	// Stopping the coordinator stops tailing, and releases our leases so that
+	// the other copies can take over right away
+	close(stopCoordination)
+	<-coordinationDone
+	if err := tail.setShards(nil); err != nil {
+		log.Log.Errorw("Error stopping tailing", "error", err)
+	}
+}
+
+// tailing tails the oplog and publishes the write shards we hold, which can
+// change while we're running. There's a single pipeline (or one per shard,
+// with OTR_SHARDED_CLUSTER) however many write shards we publish: as they
+// change, only their publishers are started and stopped (see
+// pipeline.setShards).
+type tailing struct {
+	pipelines *pipelineSet
+	denylist  *sync.Map
+
+	// mutex guards stop, which stops tailing, or is nil if we aren't
+	mutex sync.Mutex
+	stop  func()
+}
+
+// setShards changes the write shards we publish. Tailing starts when there
+// are some, and stops when there are none anymore.
+func (t *tailing) setShards(shards shardSet) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch {
+	case len(shards) == 0:
+		if t.stop != nil {
+			t.stop()
+			t.stop = nil
 		}
+		return t.pipelines.setShards(nil)
+	case t.stop != nil:
+		return t.pipelines.setShards(shards)
 	}
 
-	err = httpServer.Shutdown(context.Background())
+	if err := t.pipelines.setShards(shards); err != nil {
+		return err
+	}
+	stop, err := startTailing(t.pipelines, t.denylist)
 	if err != nil {
-		log.Log.Errorw("Error shutting down HTTP server",
-			"error", err)
+		t.pipelines.setShards(nil)
+		return err
+	}
+	t.stop = stop
+	return nil
+}
+
+// startTailing starts the pipelines that tail the oplog and publish the
+// set's write shards to Redis, adding them to pipelines, and returns a
+// function that stops them
+func startTailing(pipelines *pipelineSet, denylist *sync.Map) (func(), error) {
+	if !config.ShardedCluster() {
+		err := pipelines.start("", config.MongoURL(), config.RedisMetadataPrefix(), denylist, prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, err
+		}
+		return pipelines.stopAll, nil
+	}
+
+	// In a sharded cluster, MongoURL points at a mongos. We use it to
+	// discover the shards, and tail each shard's oplog with its own
+	// pipeline.
+	mongosClient, err := createMongoClient(config.MongoURL())
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to mongos")
 	}
+	log.Log.Info("Initialized connection to mongos")
+	pipelines.setMongosClient(mongosClient)
+
+	stopShardWatcher := make(chan bool)
+	shardWatcherDone := make(chan bool)
+	go func() {
+		watchShards(mongosClient, pipelines, denylist, stopShardWatcher)
+		close(shardWatcherDone)
+	}()
+
+	return func() {
+		// Stop the shard watcher first, so that it doesn't start new pipelines
+		// while we're stopping the existing ones
+		close(stopShardWatcher)
+		<-shardWatcherDone
+		pipelines.stopAll()
 
-	waitGroup.Wait()
+		pipelines.setMongosClient(nil)
+		mongoCloseCtx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
+		defer cancel()
+
+		mongoCloseErr := mongosClient.Disconnect(mongoCloseCtx)
+		if mongoCloseErr != nil {
+			log.Log.Errorw("Error closing mongos client", "error", mongoCloseErr)
+		}
+	}, nil
 }
 
 // Connects to mongo
-func createMongoClient() (*mongo.Client, error) {
+func createMongoClient(mongoURL string) (*mongo.Client, error) {
 	clientOptions := options.Client()
-	clientOptions.ApplyURI(config.MongoURL())
+	clientOptions.ApplyURI(mongoURL)
+
+	readPref, err := config.MongoReadPref()
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Mongo read preference")
+	}
+	if readPref != nil {
+		clientOptions.SetReadPreference(readPref)
+	}
 
-	err := clientOptions.Validate()
+	err = clientOptions.Validate()
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing Mongo URL")
 	}
@@ -275,22 +274,12 @@ func createRedisClients() ([]redis.UniversalClient, error) {
 	var ret []redis.UniversalClient
 
 	for _, url := range config.RedisURL() {
-		clientOptions, err := parse.ParseRedisURL(url, strings.HasPrefix(url, "redis-sentinel://"))
+		client, err := createRedisClient(url)
 		if err != nil {
-			return nil, errors.Wrap(err, "parsing redis url")
-		}
-		log.Log.Info("Parsed redis url: ", clientOptions)
-
-		if clientOptions.TLSConfig != nil {
-			clientOptions.TLSConfig = &tls.Config{
-				InsecureSkipVerify: false,
-				MinVersion:         tls.VersionTLS12,
+			for _, created := range ret {
+				created.Close()
 			}
-		}
-		client := redis.NewUniversalClient(clientOptions)
-		_, err = client.Ping(context.Background()).Result()
-		if err != nil {
-			return nil, errors.Wrap(err, "pinging redis")
+			return nil, err
 		}
 		ret = append(ret, client)
 	}
@@ -298,19 +287,94 @@ func createRedisClients() ([]redis.UniversalClient, error) {
 	return ret, nil
 }
 
-func makeHTTPServer(aggregatedClients [][]redis.UniversalClient, aggregatedMongos []*mongo.Client, denylistMap *sync.Map, syncer *denylist.Syncer) *http.Server {
+// Connects to the Redis at url
+func createRedisClient(url string) (redis.UniversalClient, error) {
+	if parse.IsClusterURL(url) {
+		return createRedisClusterClient(url)
+	}
+
+	clientOptions, err := parse.ParseRedisURL(url, strings.HasPrefix(url, "redis-sentinel://"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing redis url")
+	}
+	log.Log.Info("Parsed redis url: ", clientOptions)
+
+	if clientOptions.TLSConfig != nil {
+		clientOptions.TLSConfig = &tls.Config{
+			InsecureSkipVerify: false,
+			MinVersion:         tls.VersionTLS12,
+		}
+	}
+	client := redis.NewUniversalClient(clientOptions)
+	_, err = client.Ping(context.Background()).Result()
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "pinging redis")
+	}
+	return client, nil
+}
+
+// Connects to the Redis Cluster at url. NewUniversalClient would only create
+// a cluster client for several addresses, so it's created directly.
+func createRedisClusterClient(url string) (redis.UniversalClient, error) {
+	clusterOptions, err := parse.ParseRedisClusterURL(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing redis cluster url")
+	}
+	log.Log.Info("Parsed redis cluster url: ", clusterOptions.Addrs)
+
+	client := redis.NewClusterClient(clusterOptions)
+	_, err = client.Ping(context.Background()).Result()
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "pinging redis cluster")
+	}
+	return client, nil
+}
+
+// Creates the store the checkpoints under metadataPrefix are kept in (see
+// config.CheckpointStore). The Redis store uses redisClient.
+func createCheckpointStore(metadataPrefix string, redisClient redis.UniversalClient) (redispub.CheckpointStore, error) {
+	switch config.CheckpointStore() {
+	case config.CheckpointStorePostgres:
+		store, err := redispub.NewPostgresCheckpointStore(config.PostgresPersistenceURL(), metadataPrefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to the Postgres checkpoint store")
+		}
+		return store, nil
+	case config.CheckpointStoreMongo:
+		store, err := redispub.NewMongoCheckpointStore(config.CheckpointMongoURL(), config.CheckpointMongoCollection(), metadataPrefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to the Mongo checkpoint store")
+		}
+		return store, nil
+	case config.CheckpointStoreFile:
+		store, err := redispub.NewFileCheckpointStore(config.CheckpointDir(), metadataPrefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening the checkpoint file")
+		}
+		return store, nil
+	default:
+		return redispub.NewRedisCheckpointStore(redisClient, metadataPrefix), nil
+	}
+}
+
+func makeHTTPServer(pipelines *pipelineSet, coordinator coordination, denylistMap *sync.Map, syncer *denylist.Syncer) *http.Server {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		redisClients := pipelines.redisClients()
+		if coordinator != nil {
+			redisClients = append(redisClients, coordinator.redisClient())
+		}
+
 		redisOK := true
-		for _, clients := range aggregatedClients {
-			for _, redis := range clients {
-				redisErr := redis.Ping(context.Background()).Err()
-				redisOK = (redisOK && (redisErr == nil))
-				if !redisOK {
-					log.Log.Errorw("Error connecting to Redis during healthz check",
-						"error", redisErr)
-				}
+		for _, redis := range redisClients {
+			redisErr := redis.Ping(context.Background()).Err()
+			redisOK = (redisOK && (redisErr == nil))
+			if !redisOK {
+				log.Log.Errorw("Error connecting to Redis during healthz check",
+					"error", redisErr)
 			}
 		}
 
@@ -318,8 +382,10 @@ func makeHTTPServer(aggregatedClients [][]redis.UniversalClient, aggregatedMongo
 		defer cancel()
 
 		mongoOK := true
-		for _, mongo := range aggregatedMongos {
-			mongoErr := mongo.Ping(ctx, readpref.Primary())
+		for _, mongo := range pipelines.mongoClients() {
+			// Ping with the client's read preference, so that we're healthy
+			// as long as we can reach a member we'd tail from
+			mongoErr := mongo.Ping(ctx, nil)
 			mongoOK = (mongoOK && (mongoErr == nil))
 			if !mongoOK {
 				log.Log.Errorw("Error connecting to Mongo during healthz check",
@@ -327,16 +393,41 @@ func makeHTTPServer(aggregatedClients [][]redis.UniversalClient, aggregatedMongo
 			}
 		}
 
+		// A full buffer means we're falling behind, but restarting won't help,
+		// so it's reported as degraded rather than as a failure
+		status := "ok"
+		fullFor := pipelines.bufferFullFor()
+		if degradedAfter := config.BufferDegradedAfter(); degradedAfter > 0 && fullFor >= degradedAfter {
+			status = "degraded"
+		}
+
+		// So is getting close to losing oplog entries we haven't processed
+		response := map[string]interface{}{}
+		headroom, measured := pipelines.oplogHeadroom()
+		if threshold := config.OplogHeadroomThreshold(); measured && headroom < threshold {
+			status = "degraded"
+			response["oplogHeadroom"] = headroom
+		}
+
 		if mongoOK && redisOK {
 			w.WriteHeader(http.StatusOK)
 		} else {
+			status = "error"
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 
-		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
-			"mongoOK": mongoOK,
-			"redisOK": redisOK,
-		})
+		// A standby has no pipelines, so it's healthy as long as it can reach
+		// the Redis the leases are in
+		if coordinator != nil {
+			coordinator.describe(response)
+		}
+
+		response["mongoOK"] = mongoOK
+		response["redisOK"] = redisOK
+		response["status"] = status
+		response["bufferFullSeconds"] = fullFor.Seconds()
+
+		jsonErr := json.NewEncoder(w).Encode(response)
 		if jsonErr != nil {
 			log.Log.Errorw("Error writing healthz response",
 				"error", jsonErr)
@@ -352,6 +443,8 @@ func makeHTTPServer(aggregatedClients [][]redis.UniversalClient, aggregatedMongo
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	mux.HandleFunc("/replay", replayEndpoint(newReplayManager(pipelines)))
+
 	mux.HandleFunc("/denylist", denylist.CollectionEndpoint(denylistMap, syncer))
 	mux.Handle("/denylist/", http.StripPrefix("/denylist/", http.HandlerFunc(denylist.SingleEndpoint(denylistMap, syncer))))
 
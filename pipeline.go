@@ -0,0 +1,911 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/memlimit"
+	"github.com/tulip/oplogtoredis/lib/oplog"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A pipeline is everything needed to tail a single replica set's oplog and
+// publish it to Redis: the oplog tailer, the Redis publishers, and the
+// connections they use. Without OTR_SHARDED_CLUSTER there's just one pipeline;
+// with it, there's one pipeline per shard.
+type pipeline struct {
+	// redisClients holds one client for each destination (regular redis,
+	// sentinel), for the tailer and the checkpoint store. The publishers of
+	// each write shard have their own.
+	redisClients []redis.UniversalClient
+	mongoClients []*mongo.Client
+
+	// checkpoints is where the tailer resumes from, and where the publishers
+	// to the first Redis destination save their checkpoints. The publishers
+	// to the other destinations keep theirs in their own Redis.
+	checkpoints    redispub.CheckpointStore
+	metadataPrefix string
+
+	// mutex guards the write shards the pipeline publishes, and out, the
+	// buffers the tailer was last started with. Both change when write shards
+	// are added or removed (see setShards), which only happens on one
+	// goroutine at a time.
+	mutex       sync.Mutex
+	shards      shardSet
+	writeShards map[int]*writeShard
+	out         []oplog.PublisherBuffers
+
+	stopOplogTail  chan bool
+	oplogTailDone  chan bool
+	stopLagMonitor chan bool
+	waitGroup      sync.WaitGroup
+
+	// windowMonitor samples the oplog window, or is nil if
+	// OTR_OPLOG_WINDOW_INTERVAL is 0
+	windowMonitor     *oplog.WindowMonitor
+	stopWindowMonitor chan bool
+
+	// denylist is what the oplog tailer is started with, for replays.
+	// replayMutex guards stoppingReplays, which is set while stopReplays is
+	// closed, so that no replays start until it's replaced.
+	denylist        *sync.Map
+	replayMutex     sync.Mutex
+	stoppingReplays bool
+	stopReplays     chan bool
+	replays         sync.WaitGroup
+
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+}
+
+// writeShard is the publishers of one of the write shards a pipeline
+// publishes, one for each Redis destination, and the buffers the tailer sends
+// them the write shard's publications in
+type writeShard struct {
+	redisClients []redis.UniversalClient
+	buffers      oplog.PublisherBuffers
+	stops        []chan bool
+	waitGroup    sync.WaitGroup
+	collectors   []prometheus.Collector
+}
+
+// startPipeline connects to mongoURL and to Redis, and starts the goroutines
+// that tail the oplog and publish to Redis. Checkpoints are stored under
+// metadataPrefix, and per-pipeline metrics are registered with registerer.
+// Only the write shards in shards are published, which must have at least
+// one; setShards changes them.
+func startPipeline(mongoURL string, metadataPrefix string, denylist *sync.Map, registerer prometheus.Registerer, shards shardSet) (*pipeline, error) {
+	p := &pipeline{
+		metadataPrefix: metadataPrefix,
+		writeShards:    map[int]*writeShard{},
+		registerer:     registerer,
+		denylist:       denylist,
+		stopReplays:    make(chan bool),
+	}
+
+	redisClients, err := createRedisClients()
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing Redis client: %s", err.Error())
+	}
+	log.Log.Info("Initialized connection to Redis")
+	p.redisClients = redisClients
+
+	p.checkpoints, err = createCheckpointStore(metadataPrefix, redisClients[0])
+	if err != nil {
+		p.stop()
+		return nil, fmt.Errorf("Error initializing checkpoint store: %s", err.Error())
+	}
+
+	// Only the write shards we publish get buffers, one per Redis destination
+	bufferMaxBytes := bufferMaxBytes(len(shards) * len(config.RedisURL()))
+	for _, i := range shards.sorted() {
+		if err := p.startWriteShard(i, shards[i], bufferMaxBytes); err != nil {
+			p.stop()
+			return nil, err
+		}
+	}
+	p.shards = shards
+
+	// A single oplog tailer reads the whole oplog, and decodes the entries on
+	// OTR_READ_PARALLELISM workers
+	mongoSession, err := createMongoClient(mongoURL)
+	if err != nil {
+		p.stop()
+		return nil, fmt.Errorf("Error initializing oplog tailer: %s", err.Error())
+	}
+	log.Log.Info("Initialized connection to Mongo")
+	p.mongoClients = append(p.mongoClients, mongoSession)
+
+	p.startTailer()
+
+	if interval := config.ReplicationLagInterval(); interval > 0 {
+		p.stopLagMonitor = make(chan bool)
+
+		p.waitGroup.Add(1)
+		go func() {
+			oplog.MonitorReplicationLag(p.mongoClients[0], interval, p.stopLagMonitor)
+			p.waitGroup.Done()
+		}()
+	}
+
+	if interval := config.OplogWindowInterval(); interval > 0 {
+		p.windowMonitor = &oplog.WindowMonitor{
+			MongoClient:      p.mongoClients[0],
+			Checkpoints:      p.checkpoints,
+			WriteParallelism: config.WriteParallelism(),
+		}
+		registerer.MustRegister(p.windowMonitor)
+		p.collectors = append(p.collectors, p.windowMonitor)
+		p.stopWindowMonitor = make(chan bool)
+
+		p.waitGroup.Add(1)
+		go func() {
+			p.windowMonitor.Run(interval, p.stopWindowMonitor)
+			p.waitGroup.Done()
+		}()
+	}
+
+	return p, nil
+}
+
+// startWriteShard starts the publishers of write shard i, fenced with
+// fencing, and adds it to the pipeline. Its buffers are limited to
+// bufferMaxBytes each.
+func (p *pipeline) startWriteShard(i int, fencing redispub.Fencing, bufferMaxBytes int64) error {
+	redisClients, err := createRedisClients()
+	if err != nil {
+		return fmt.Errorf("[%d] Error initializing Redis client: %s", i, err.Error())
+	}
+	log.Log.Infow("Initialized connection to Redis", "i", i)
+
+	// each writer shard is going to make multiple writer coroutines, one for each redis destination,
+	// so we create one PublisherBuffers for this shard and put each coroutine's intake buffer in it.
+	// these are all aggregated in the out 2D array and passed to the tailer.
+	clientsSize := len(redisClients)
+	ws := &writeShard{
+		redisClients: redisClients,
+		buffers:      make(oplog.PublisherBuffers, 0, clientsSize),
+		stops:        make([]chan bool, 0, clientsSize),
+	}
+
+	for j := 0; j < clientsSize; j++ {
+		redisClient := redisClients[j]
+
+		redisPubs, err := redispub.NewBuffer(redispub.BufferOpts{
+			Size:           config.BufferSize(),
+			MaxBytes:       bufferMaxBytes,
+			OverflowPolicy: config.BufferOverflowPolicy(),
+			SpillDir:       config.BufferSpillDir(),
+			Resync:         config.ResyncMessages(),
+		})
+		if err != nil {
+			p.stopWriteShard(ws)
+			return fmt.Errorf("[%d] Error creating publication buffer: %s", i, err.Error())
+		}
+		ws.buffers = append(ws.buffers, redisPubs)
+
+		stopRedisPub := make(chan bool)
+		ws.stops = append(ws.stops, stopRedisPub)
+
+		ws.waitGroup.Add(1)
+
+		// The oplog tailer reads messages from the oplog, and generates the
+		// messages that we need to write to redis. It then writes them to a
+		// redispub.Buffer, which applies OTR_BUFFER_OVERFLOW_POLICY when it's full.
+		//
+		// The redispub.PublishStream goroutine reads messages from the buffer
+		// and sends them to Redis.
+		//
+		// Every destination is fenced, but only the first one has the
+		// lease's token to check against (see redispub.Fencing)
+		var checkpoints redispub.CheckpointStore
+		publishFencing := fencing
+		if j == 0 {
+			checkpoints = p.checkpoints
+		} else if publishFencing.Key != "" {
+			publishFencing.Elsewhere = true
+		}
+
+		go func(ordinal int, clientIndex int) {
+			redispub.PublishStream(redisClient, redisPubs, &redispub.PublishOpts{
+				FlushInterval:    config.TimestampFlushInterval(),
+				DedupeExpiration: config.RedisDedupeExpiration(),
+				MetadataPrefix:   p.metadataPrefix,
+				Checkpoints:      checkpoints,
+				Fencing:          publishFencing,
+				DedupeMode:       config.DedupeMode(),
+				AtomicCheckpoint: config.AtomicCheckpoint(),
+				Registerer:       p.registerer,
+			}, stopRedisPub, ordinal, clientIndex)
+			log.Log.Infow("Redis publisher completed", "ordinal", ordinal, "clientIndex", clientIndex)
+			ws.waitGroup.Done()
+		}(i, j)
+		log.Log.Info("Started up processing goroutines")
+
+		bufferAvailable := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "otr",
+			Name:        "buffer_available",
+			Help:        "Gauge indicating the available space in the buffer of oplog entries waiting to be written to redis.",
+			ConstLabels: prometheus.Labels{"ordinal": strconv.Itoa(i), "clientIndex": strconv.Itoa(j)},
+		}, func() float64 {
+			return float64(redisPubs.Cap() - redisPubs.Len())
+		})
+		p.registerer.MustRegister(bufferAvailable)
+		ws.collectors = append(ws.collectors, bufferAvailable)
+
+		bufferAvailableBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "otr",
+			Name:        "buffer_available_bytes",
+			Help:        "Gauge indicating the available space, in bytes, in the buffer of oplog entries waiting to be written to redis.",
+			ConstLabels: prometheus.Labels{"ordinal": strconv.Itoa(i), "clientIndex": strconv.Itoa(j)},
+		}, func() float64 {
+			return math.Max(float64(redisPubs.MaxBytes()-redisPubs.Bytes()), 0)
+		})
+		p.registerer.MustRegister(bufferAvailableBytes)
+		ws.collectors = append(ws.collectors, bufferAvailableBytes)
+	}
+
+	p.mutex.Lock()
+	p.writeShards[i] = ws
+	p.mutex.Unlock()
+	return nil
+}
+
+// stopWriteShard stops the publishers of a write shard, waits for them to
+// exit, and closes their connections and buffers. The tailer must not be
+// sending to them anymore.
+func (p *pipeline) stopWriteShard(ws *writeShard) {
+	for _, stopRedisPub := range ws.stops {
+		stopRedisPub <- true
+	}
+	ws.waitGroup.Wait()
+
+	for _, redisClient := range ws.redisClients {
+		if err := redisClient.Close(); err != nil {
+			log.Log.Errorw("Error closing Redis client", "error", err)
+		}
+	}
+	for _, buffer := range ws.buffers {
+		buffer.Close()
+	}
+	for _, collector := range ws.collectors {
+		p.registerer.Unregister(collector)
+	}
+}
+
+// startTailer starts the oplog tailer, sending the publications of each of
+// the pipeline's write shards to its buffers. The write shards we don't
+// publish get no buffers, so the tailer drops their publications.
+func (p *pipeline) startTailer() {
+	writeParallelism := config.WriteParallelism()
+	out := make([]oplog.PublisherBuffers, writeParallelism)
+
+	p.mutex.Lock()
+	for i, ws := range p.writeShards {
+		out[i] = ws.buffers
+	}
+	p.out = out
+	shards := p.shards
+	p.mutex.Unlock()
+
+	p.stopOplogTail = make(chan bool)
+	p.oplogTailDone = make(chan bool)
+	stopOplogTail, oplogTailDone := p.stopOplogTail, p.oplogTailDone
+	go func() {
+		tailer := oplog.Tailer{
+			MongoClient:   p.mongoClients[0],
+			RedisClients:  p.redisClients, // the tailer needs a redis client for determining start timestamp
+			RedisPrefix:   p.metadataPrefix,
+			Checkpoints:   p.checkpoints,
+			MaxCatchUp:    config.MaxCatchUp(),
+			Denylist:      p.denylist,
+			DecodeWorkers: config.ReadParallelism(),
+
+			HeartbeatInterval: config.HeartbeatInterval(),
+
+			ThrottleCatchUp: config.CatchUpMode() == config.CatchUpModeThrottle,
+			CatchUpRate:     config.CatchUpRate(),
+			CatchUpByteRate: config.CatchUpByteRate(),
+
+			ChangeStream: config.TailMode() == config.TailModeChangeStream,
+
+			OwnedShards: shards.owned(writeParallelism),
+		}
+		// pass all intake channels to the tailer, which will route messages accordingly
+		tailer.Tail(out, stopOplogTail)
+
+		log.Log.Info("Oplog tailer completed")
+		close(oplogTailDone)
+	}()
+}
+
+// stopTailer stops the oplog tailer, if it's running, and waits for it to
+// exit
+func (p *pipeline) stopTailer() {
+	if p.stopOplogTail == nil {
+		return
+	}
+
+	p.stopOplogTail <- true
+	<-p.oplogTailDone
+	p.stopOplogTail = nil
+}
+
+// setShards changes the write shards the pipeline publishes, which must have
+// at least one. The publishers of the write shards that were removed, or
+// whose fencing token changed, are stopped, and those of the new ones are
+// started; the others keep running. The tailer is restarted with the new
+// write shards, from the earliest of their checkpoints; it drops what each
+// write shard has already published (see oplog.Tailer.OwnedShards). Running
+// replays are stopped, since they send to the write shards' buffers. If a
+// write shard fails to start, the pipeline is left without it.
+func (p *pipeline) setShards(shards shardSet) error {
+	p.mutex.Lock()
+	unchanged := shards.equal(p.shards)
+	p.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	p.stopReplaying()
+	defer p.resumeReplaying()
+	p.stopTailer()
+
+	p.mutex.Lock()
+	var stopped []*writeShard
+	for i, ws := range p.writeShards {
+		if fencing, ok := shards[i]; !ok || fencing != p.shards[i] {
+			stopped = append(stopped, ws)
+			delete(p.writeShards, i)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, ws := range stopped {
+		p.stopWriteShard(ws)
+	}
+
+	var err error
+	running := shardSet{}
+	bufferMaxBytes := bufferMaxBytes(len(shards) * len(config.RedisURL()))
+	for _, i := range shards.sorted() {
+		p.mutex.Lock()
+		_, ok := p.writeShards[i]
+		p.mutex.Unlock()
+
+		if !ok && err == nil {
+			err = p.startWriteShard(i, shards[i], bufferMaxBytes)
+			ok = err == nil
+		}
+		if ok {
+			running[i] = shards[i]
+		}
+	}
+
+	p.mutex.Lock()
+	p.shards = running
+	p.mutex.Unlock()
+
+	if len(running) > 0 {
+		p.startTailer()
+	}
+	return err
+}
+
+// shardSet is the write shards a pipeline publishes, with the fencing token
+// that its publishes are checked with for each of them
+type shardSet map[int]redispub.Fencing
+
+// allShards returns every write shard, all fenced with fencing
+func allShards(fencing redispub.Fencing) shardSet {
+	shards := shardSet{}
+	for i := 0; i < config.WriteParallelism(); i++ {
+		shards[i] = fencing
+	}
+	return shards
+}
+
+// copy returns a copy of the set
+func (shards shardSet) copy() shardSet {
+	copied := make(shardSet, len(shards))
+	for i, fencing := range shards {
+		copied[i] = fencing
+	}
+	return copied
+}
+
+// equal returns whether two sets have the same write shards, with the same
+// fencing tokens
+func (shards shardSet) equal(other shardSet) bool {
+	if len(shards) != len(other) {
+		return false
+	}
+	for i, fencing := range shards {
+		if otherFencing, ok := other[i]; !ok || otherFencing != fencing {
+			return false
+		}
+	}
+	return true
+}
+
+// sorted returns the write shards in the set, in order
+func (shards shardSet) sorted() []int {
+	sorted := make([]int, 0, len(shards))
+	for i := range shards {
+		sorted = append(sorted, i)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// owned returns the sorted write shards in the set, out of n, or nil if it
+// has all of them (see oplog.Tailer.OwnedShards)
+func (shards shardSet) owned(n int) []int {
+	owned := []int{}
+	for _, i := range shards.sorted() {
+		if i < n {
+			owned = append(owned, i)
+		}
+	}
+	if len(owned) == n {
+		return nil
+	}
+	return owned
+}
+
+// defaultBufferMemory is the total size of the publication buffers when
+// there's no memory limit to size them from
+const defaultBufferMemory = 1 << 30
+
+// bufferMaxBytes returns the byte limit of each of a number of publication
+// buffers: OTR_BUFFER_MAX_BYTES if it's set, and otherwise a share of a quarter
+// of the memory limit. With OTR_SHARDED_CLUSTER, the number of pipelines
+// changes while we're running, so pipelineSet reapportions it between all of
+// their buffers as they're added and removed.
+func bufferMaxBytes(buffers int) int64 {
+	if maxBytes := config.BufferMaxBytes(); maxBytes > 0 {
+		return maxBytes
+	}
+
+	total := int64(defaultBufferMemory)
+	if limit, ok := memlimit.Detect(); ok {
+		total = limit / 4
+	}
+
+	perBuffer := total / int64(buffers)
+	log.Log.Infow("Sized publication buffers from the memory limit",
+		"totalBytes", total,
+		"buffers", buffers,
+		"bytesPerBuffer", perBuffer)
+	return perBuffer
+}
+
+// drainTimeout is how long drain waits for a pipeline to catch up
+const drainTimeout = 5 * time.Minute
+
+// drain waits for the pipeline to publish everything up to the current end of
+// its oplog, so that stopping it doesn't lose anything. It gives up after
+// drainTimeout, or when stop is closed. Returns whether it caught up.
+func (p *pipeline) drain(stop <-chan bool) bool {
+	end, err := oplog.NewestOplogTimestamp(p.mongoClients[0])
+	if err != nil {
+		log.Log.Errorw("Error reading the end of the oplog to drain", "error", err)
+		return false
+	}
+
+	timeout := time.After(drainTimeout)
+	for {
+		if p.checkpointedThrough(end) {
+			return true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-timeout:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// checkpointedThrough returns whether every write shard the pipeline publishes
+// has checkpointed ts. The checkpoints keep up with the oplog through
+// heartbeats even when nothing is published (see OTR_HEARTBEAT_INTERVAL).
+func (p *pipeline) checkpointedThrough(ts primitive.Timestamp) bool {
+	p.mutex.Lock()
+	shards := p.shards.sorted()
+	p.mutex.Unlock()
+
+	for _, i := range shards {
+		checkpoint, err := p.checkpoints.Load(i)
+		if err != nil || checkpoint.Timestamp.Before(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// stop cleanly stops the pipeline's goroutines, waits for them to exit, and
+// then closes its connections. The tailer is stopped before the publishers,
+// so that the publishers can flush everything the tailer sent them.
+func (p *pipeline) stop() {
+	// Replays send to the publishers, so they have to finish first
+	p.stopReplaying()
+
+	if p.stopLagMonitor != nil {
+		close(p.stopLagMonitor)
+	}
+	if p.stopWindowMonitor != nil {
+		close(p.stopWindowMonitor)
+	}
+	p.stopTailer()
+
+	p.mutex.Lock()
+	writeShards := p.writeShards
+	p.writeShards = map[int]*writeShard{}
+	p.shards = nil
+	p.mutex.Unlock()
+	for _, ws := range writeShards {
+		p.stopWriteShard(ws)
+	}
+
+	p.waitGroup.Wait()
+
+	for i, mongoSession := range p.mongoClients {
+		mongoCloseCtx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
+		mongoCloseErr := mongoSession.Disconnect(mongoCloseCtx)
+		cancel()
+		if mongoCloseErr != nil {
+			log.Log.Errorw("Error closing Mongo client", "i", i, "error", mongoCloseErr)
+		}
+	}
+
+	for _, redisClient := range p.redisClients {
+		redisCloseErr := redisClient.Close()
+		if redisCloseErr != nil {
+			log.Log.Errorw("Error closing Redis client",
+				"error", redisCloseErr)
+		}
+	}
+
+	if p.checkpoints != nil {
+		if err := p.checkpoints.Close(); err != nil {
+			log.Log.Errorw("Error closing checkpoint store", "error", err)
+		}
+	}
+
+	for _, collector := range p.collectors {
+		p.registerer.Unregister(collector)
+	}
+}
+
+// stopReplaying stops the running replays and waits for them to finish.
+// Replays can't start again until resumeReplaying is called.
+func (p *pipeline) stopReplaying() {
+	p.replayMutex.Lock()
+	p.stoppingReplays = true
+	p.replayMutex.Unlock()
+	close(p.stopReplays)
+	p.replays.Wait()
+}
+
+// resumeReplaying lets replays start again after stopReplaying
+func (p *pipeline) resumeReplaying() {
+	p.replayMutex.Lock()
+	defer p.replayMutex.Unlock()
+
+	p.stopReplays = make(chan bool)
+	p.stoppingReplays = false
+}
+
+// replay replays a range of the pipeline's oplog (see oplog.Replay) to the
+// write shards it publishes. It's stopped if the pipeline is, or if its write
+// shards change.
+func (p *pipeline) replay(id string, r oplog.ReplayRange) (oplog.ReplayResult, error) {
+	p.replayMutex.Lock()
+	if p.stoppingReplays {
+		p.replayMutex.Unlock()
+		return oplog.ReplayResult{}, oplog.ErrReplayStopped
+	}
+	p.replays.Add(1)
+	stop := p.stopReplays
+	p.replayMutex.Unlock()
+	defer p.replays.Done()
+
+	p.mutex.Lock()
+	out := p.out
+	p.mutex.Unlock()
+
+	return oplog.Replay(p.mongoClients[0], p.denylist, id, r, out, stop)
+}
+
+// buffers returns the publication buffers of the pipeline's write shards
+func (p *pipeline) buffers() []*redispub.Buffer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var buffers []*redispub.Buffer
+	for _, ws := range p.writeShards {
+		buffers = append(buffers, ws.buffers...)
+	}
+	return buffers
+}
+
+// allRedisClients returns the pipeline's Redis clients, including those of
+// its write shards' publishers
+func (p *pipeline) allRedisClients() []redis.UniversalClient {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	clients := append([]redis.UniversalClient{}, p.redisClients...)
+	for _, ws := range p.writeShards {
+		clients = append(clients, ws.redisClients...)
+	}
+	return clients
+}
+
+// pipelineSet is the set of running pipelines, keyed by shard name (or "" when
+// not running against a sharded cluster). It's safe for concurrent use, since
+// the shard watcher adds and removes pipelines while the HTTP server reads
+// them.
+type pipelineSet struct {
+	mutex     sync.Mutex
+	pipelines map[string]*pipeline
+
+	// mongosClient is the connection to the mongos used for shard discovery,
+	// if any. It's included in the healthz check.
+	mongosClient *mongo.Client
+
+	// shards is the write shards every pipeline publishes. shardsMutex is
+	// held while they change, and while a pipeline is started with them, so
+	// that a new pipeline doesn't miss a change.
+	shardsMutex sync.Mutex
+	shards      shardSet
+}
+
+func newPipelineSet() *pipelineSet {
+	return &pipelineSet{pipelines: map[string]*pipeline{}}
+}
+
+func (set *pipelineSet) setMongosClient(client *mongo.Client) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.mongosClient = client
+}
+
+// start starts a pipeline with the write shards the set publishes, which
+// must have at least one, and adds it under name
+func (set *pipelineSet) start(name string, mongoURL string, metadataPrefix string, denylist *sync.Map, registerer prometheus.Registerer) error {
+	set.shardsMutex.Lock()
+	defer set.shardsMutex.Unlock()
+
+	p, err := startPipeline(mongoURL, metadataPrefix, denylist, registerer, set.shards)
+	if err != nil {
+		return err
+	}
+	set.add(name, p)
+	return nil
+}
+
+// setShards changes the write shards the pipelines publish (see
+// pipeline.setShards), including the ones started later. If a write shard
+// fails to start on any pipeline, every pipeline goes back to the write
+// shards it had.
+func (set *pipelineSet) setShards(shards shardSet) error {
+	set.shardsMutex.Lock()
+	defer set.shardsMutex.Unlock()
+
+	previous := set.shards
+	set.shards = shards
+
+	var err error
+	for _, p := range set.all() {
+		if err = p.setShards(shards); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		set.shards = previous
+		for _, p := range set.all() {
+			if revertErr := p.setShards(previous); revertErr != nil {
+				log.Log.Errorw("Error going back to the previous write shards", "error", revertErr)
+			}
+		}
+	}
+
+	set.mutex.Lock()
+	set.resizeBuffers()
+	set.mutex.Unlock()
+	return err
+}
+
+// stop stops the named pipeline and removes it from the set, if there's such
+// a pipeline
+func (set *pipelineSet) stop(name string) {
+	set.shardsMutex.Lock()
+	defer set.shardsMutex.Unlock()
+
+	if p := set.remove(name); p != nil {
+		p.stop()
+	}
+}
+
+func (set *pipelineSet) add(name string, p *pipeline) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.pipelines[name] = p
+	set.resizeBuffers()
+}
+
+// get returns the named pipeline, or nil if there's no such pipeline
+func (set *pipelineSet) get(name string) *pipeline {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	return set.pipelines[name]
+}
+
+// remove removes the named pipeline from the set and returns it, or nil if
+// there's no such pipeline. It does not stop the pipeline.
+func (set *pipelineSet) remove(name string) *pipeline {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	p := set.pipelines[name]
+	delete(set.pipelines, name)
+	if p != nil {
+		set.resizeBuffers()
+	}
+	return p
+}
+
+// resizeBuffers splits the memory for publication buffers between the buffers
+// of every pipeline in the set (see bufferMaxBytes). The mutex must be held.
+func (set *pipelineSet) resizeBuffers() {
+	if config.BufferMaxBytes() > 0 {
+		return
+	}
+
+	var buffers []*redispub.Buffer
+	for _, p := range set.pipelines {
+		buffers = append(buffers, p.buffers()...)
+	}
+	if len(buffers) == 0 {
+		return
+	}
+
+	maxBytes := bufferMaxBytes(len(buffers))
+	for _, buffer := range buffers {
+		buffer.SetMaxBytes(maxBytes)
+	}
+}
+
+// names returns the sorted names of the pipelines in the set
+func (set *pipelineSet) names() []string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	names := make([]string, 0, len(set.pipelines))
+	for name := range set.pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// all returns every pipeline in the set
+func (set *pipelineSet) all() []*pipeline {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	pipelines := make([]*pipeline, 0, len(set.pipelines))
+	for _, p := range set.pipelines {
+		pipelines = append(pipelines, p)
+	}
+	return pipelines
+}
+
+// redisClients returns the Redis clients of every pipeline in the set
+func (set *pipelineSet) redisClients() []redis.UniversalClient {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	var clients []redis.UniversalClient
+	for _, p := range set.pipelines {
+		clients = append(clients, p.allRedisClients()...)
+	}
+	return clients
+}
+
+// mongoClients returns the Mongo clients of every pipeline in the set, plus
+// the mongos client if there is one
+func (set *pipelineSet) mongoClients() []*mongo.Client {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	var clients []*mongo.Client
+	if set.mongosClient != nil {
+		clients = append(clients, set.mongosClient)
+	}
+	for _, p := range set.pipelines {
+		clients = append(clients, p.mongoClients...)
+	}
+	return clients
+}
+
+// bufferFullFor returns the longest time that any pipeline's publication
+// buffer has been full for
+func (set *pipelineSet) bufferFullFor() time.Duration {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	var longest time.Duration
+	for _, p := range set.pipelines {
+		for _, buffer := range p.buffers() {
+			if fullFor := buffer.FullFor(); fullFor > longest {
+				longest = fullFor
+			}
+		}
+	}
+	return longest
+}
+
+// oplogHeadroom returns the lowest checkpoint headroom ratio of any pipeline
+// (see oplog.WindowSample.HeadroomRatio), or false if none has been measured
+func (set *pipelineSet) oplogHeadroom() (float64, bool) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	lowest := 1.0
+	measured := false
+	for _, p := range set.pipelines {
+		if p.windowMonitor == nil {
+			continue
+		}
+		sample, ok := p.windowMonitor.Sample()
+		if !ok || sample.Checkpoint.IsZero() {
+			continue
+		}
+
+		measured = true
+		lowest = math.Min(lowest, sample.HeadroomRatio())
+	}
+	return lowest, measured
+}
+
+// stopAll stops every pipeline in the set, in parallel, and removes them
+func (set *pipelineSet) stopAll() {
+	set.shardsMutex.Lock()
+	defer set.shardsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, name := range set.names() {
+		p := set.remove(name)
+		if p == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			p.stop()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
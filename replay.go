@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/oplog"
+)
+
+// maxReplayHistory is how many finished replays GET /replay lists
+const maxReplayHistory = 10
+
+// The states of a replay
+const (
+	replayRunning = "running"
+	replayDone    = "done"
+	replayFailed  = "failed"
+	replayStopped = "stopped"
+)
+
+// replayRequest is the body of POST /replay. From and To are RFC3339 times or
+// timestamps (see oplog.ParseReplayPosition).
+type replayRequest struct {
+	From       string   `json:"from"`
+	To         string   `json:"to,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Rate       float64  `json:"rate,omitempty"`
+}
+
+// replayStatus is what GET /replay reports about a replay
+type replayStatus struct {
+	ID           string        `json:"id"`
+	Request      replayRequest `json:"request"`
+	State        string        `json:"state"`
+	Error        string        `json:"error,omitempty"`
+	Entries      int           `json:"entries"`
+	Publications int           `json:"publications"`
+	Started      time.Time     `json:"started"`
+	Finished     *time.Time    `json:"finished,omitempty"`
+}
+
+var errReplayRunning = errors.New("a replay is already running")
+
+// replayManager runs the replays requested through the admin API, one at a
+// time, on every pipeline
+type replayManager struct {
+	pipelines *pipelineSet
+
+	mutex   sync.Mutex
+	replays []*replayStatus
+}
+
+func newReplayManager(pipelines *pipelineSet) *replayManager {
+	return &replayManager{pipelines: pipelines}
+}
+
+// start starts a replay in the background, and returns its initial status
+func (m *replayManager) start(request replayRequest, r oplog.ReplayRange) (replayStatus, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, replay := range m.replays {
+		if replay.State == replayRunning {
+			return replayStatus{}, errReplayRunning
+		}
+	}
+
+	status := &replayStatus{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		Request: request,
+		State:   replayRunning,
+		Started: time.Now().UTC(),
+	}
+	m.replays = append(m.replays, status)
+	if len(m.replays) > maxReplayHistory {
+		m.replays = m.replays[len(m.replays)-maxReplayHistory:]
+	}
+
+	go m.run(status, r)
+	return *status, nil
+}
+
+// run replays the range on every pipeline in parallel, and records the result
+// in status
+func (m *replayManager) run(status *replayStatus, r oplog.ReplayRange) {
+	var wg sync.WaitGroup
+	var resultMutex sync.Mutex
+	var firstErr error
+	var total oplog.ReplayResult
+
+	for _, p := range m.pipelines.all() {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+
+			result, err := p.replay(status.ID, r)
+
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			total.Entries += result.Entries
+			total.Publications += result.Publications
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	finished := time.Now().UTC()
+	status.Finished = &finished
+	status.Entries = total.Entries
+	status.Publications = total.Publications
+	switch {
+	case errors.Is(firstErr, oplog.ErrReplayStopped):
+		status.State = replayStopped
+	case firstErr != nil:
+		log.Log.Errorw("Oplog replay failed", "id", status.ID, "error", firstErr)
+		status.State = replayFailed
+		status.Error = firstErr.Error()
+	default:
+		status.State = replayDone
+	}
+}
+
+// list returns the status of the running replay and the most recent finished
+// ones, oldest first
+func (m *replayManager) list() []replayStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	statuses := make([]replayStatus, len(m.replays))
+	for i, replay := range m.replays {
+		statuses[i] = *replay
+	}
+	return statuses
+}
+
+// parseReplayRequest validates a replay request, and converts it to the range
+// to replay
+func parseReplayRequest(request replayRequest) (oplog.ReplayRange, error) {
+	var r oplog.ReplayRange
+	if request.From == "" {
+		return r, errors.New("from is required")
+	}
+
+	var err error
+	if r.From, err = oplog.ParseReplayPosition(request.From, false); err != nil {
+		return r, err
+	}
+	if request.To != "" {
+		if r.To, err = oplog.ParseReplayPosition(request.To, true); err != nil {
+			return r, err
+		}
+		if r.To.Before(r.From) {
+			return r, errors.New("to is before from")
+		}
+	}
+
+	for _, namespace := range request.Namespaces {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			r.Namespaces = append(r.Namespaces, namespace)
+		}
+	}
+
+	if request.Rate < 0 {
+		return r, errors.New("rate can't be negative")
+	}
+	r.Rate = config.ReplayRate()
+	if request.Rate > 0 && request.Rate < r.Rate {
+		r.Rate = request.Rate
+	}
+
+	return r, nil
+}
+
+// requireAdminToken only lets requests through to handler if they have the
+// admin token (see config.AdminToken) as their bearer token
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		token := config.AdminToken()
+		if token == "" {
+			http.Error(response, "the admin API is disabled; set OTR_ADMIN_TOKEN to enable it", http.StatusForbidden)
+			return
+		}
+
+		auth := request.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(response, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler(response, request)
+	}
+}
+
+// replayEndpoint serves /replay: POST starts a replay, and GET lists the
+// running and recent replays
+func replayEndpoint(replays *replayManager) http.HandlerFunc {
+	return requireAdminToken(func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET":
+			writeJSON(response, http.StatusOK, replays.list())
+		case "POST":
+			var body replayRequest
+			if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+				http.Error(response, "invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			r, err := parseReplayRequest(body)
+			if err != nil {
+				http.Error(response, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// A standby (or a copy without write shards) doesn't tail the
+			// oplog, so it has nothing to replay
+			if len(replays.pipelines.all()) == 0 {
+				http.Error(response, "not tailing the oplog; send replays to a copy that is", http.StatusServiceUnavailable)
+				return
+			}
+
+			status, err := replays.start(body, r)
+			if errors.Is(err, errReplayRunning) {
+				http.Error(response, err.Error(), http.StatusConflict)
+				return
+			}
+
+			log.Log.Infow("Replay requested through the admin API",
+				"id", status.ID,
+				"from", body.From,
+				"to", body.To,
+				"namespaces", body.Namespaces,
+				"rate", r.Rate)
+			writeJSON(response, http.StatusAccepted, status)
+		default:
+			http.Error(response, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	})
+}
+
+func writeJSON(response http.ResponseWriter, code int, value interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(code)
+	if err := json.NewEncoder(response).Encode(value); err != nil {
+		log.Log.Errorw("Error writing response", "error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayPollInterval is how often `oplogtoredis replay -wait` checks whether
+// the replay has finished
+const replayPollInterval = 2 * time.Second
+
+// runReplayCommand implements `oplogtoredis replay`, which asks a running
+// oplogtoredis to replay a range of the oplog through the admin API. The admin
+// token is read from OTR_ADMIN_TOKEN. Returns the exit code.
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	addr := flags.String("addr", "http://localhost:9000", "address of the oplogtoredis HTTP server")
+	from := flags.String("from", "", "first position to replay: an RFC3339 time, or seconds[:increment] (required)")
+	to := flags.String("to", "", "last position to replay, in the same format as -from (default: the end of the oplog)")
+	namespaces := flags.String("namespaces", "", "comma-separated databases or db.collection namespaces to replay (default: all)")
+	rate := flags.Float64("rate", 0, "maximum oplog entries per second (default and maximum: the server's OTR_REPLAY_RATE)")
+	wait := flags.Bool("wait", false, "wait for the replay to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: oplogtoredis replay -from <position> [flags]\n\n"+
+			"Replays a range of the oplog on a running oplogtoredis. Set OTR_ADMIN_TOKEN to its admin token.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" {
+		fmt.Fprintln(os.Stderr, "-from is required")
+		flags.Usage()
+		return 2
+	}
+
+	request := replayRequest{From: *from, To: *to, Rate: *rate}
+	for _, namespace := range strings.Split(*namespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			request.Namespaces = append(request.Namespaces, namespace)
+		}
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var status replayStatus
+	if err := callAdminAPI("POST", *addr+"/replay", body, &status); err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting replay:", err)
+		return 1
+	}
+	fmt.Printf("Started replay %s\n", status.ID)
+
+	for *wait && status.State == replayRunning {
+		time.Sleep(replayPollInterval)
+
+		var statuses []replayStatus
+		if err := callAdminAPI("GET", *addr+"/replay", nil, &statuses); err != nil {
+			fmt.Fprintln(os.Stderr, "Error checking replay:", err)
+			return 1
+		}
+
+		found := false
+		for _, s := range statuses {
+			if s.ID == status.ID {
+				status = s
+				found = true
+			}
+		}
+		if !found {
+			fmt.Fprintln(os.Stderr, "The replay is no longer listed by the server")
+			return 1
+		}
+	}
+
+	if *wait {
+		fmt.Printf("Replay %s %s: %d entries read, %d publications sent\n",
+			status.ID, status.State, status.Entries, status.Publications)
+		if status.State != replayDone {
+			if status.Error != "" {
+				fmt.Fprintln(os.Stderr, status.Error)
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// callAdminAPI sends a request to the admin API, and decodes the JSON
+// response into result
+func callAdminAPI(method string, url string, body []byte, result interface{}) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+os.Getenv("OTR_ADMIN_TOKEN"))
+	request.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
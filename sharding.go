@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/shards"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricShardsTailed = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "shards",
+	Name:      "tailed",
+	Help:      "Gauge indicating the number of shards whose oplogs are being tailed.",
+})
+
+var metricShardDiscoveryErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "shards",
+	Name:      "discovery_errors",
+	Help:      "Number of errors encountered while discovering or connecting to shards.",
+})
+
+// watchShards keeps the pipelines in the set in sync with the shards of the
+// cluster: every ShardDiscoveryInterval, it reads config.shards through the
+// mongos, starts a pipeline for each shard that doesn't have one yet, and stops
+// the pipelines of shards that were removed from the cluster once they've
+// published the rest of their oplog. Errors are logged, and retried on the
+// next pass. Every pipeline publishes the set's write shards.
+func watchShards(mongosClient *mongo.Client, pipelines *pipelineSet, denylist *sync.Map, stop <-chan bool) {
+	for {
+		syncShards(mongosClient, pipelines, denylist, stop)
+
+		select {
+		case <-stop:
+			log.Log.Info("Received stop; stopping shard discovery")
+			return
+		case <-time.After(config.ShardDiscoveryInterval()):
+		}
+	}
+}
+
+func syncShards(mongosClient *mongo.Client, pipelines *pipelineSet, denylist *sync.Map, stop <-chan bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	shardList, err := shards.List(ctx, mongosClient)
+	if err != nil {
+		log.Log.Errorw("Error listing shards; will retry", "error", err)
+		metricShardDiscoveryErrors.Inc()
+		return
+	}
+
+	current := map[string]bool{}
+	for _, name := range pipelines.names() {
+		current[name] = true
+	}
+
+	seen := map[string]bool{}
+	for _, shard := range shardList {
+		seen[shard.ID] = true
+		if current[shard.ID] {
+			continue
+		}
+
+		shardURL, err := shards.MongoURL(config.MongoURL(), shard)
+		if err != nil {
+			log.Log.Errorw("Error building connection URL for shard; will retry", "shard", shard.ID, "error", err)
+			metricShardDiscoveryErrors.Inc()
+			continue
+		}
+
+		// Each shard is checkpointed separately, and gets its own dedupe keys,
+		// since two shards can write oplog entries with the same timestamp
+		err = pipelines.start(
+			shard.ID,
+			shardURL,
+			config.RedisMetadataPrefix()+shard.ID+"::",
+			denylist,
+			prometheus.WrapRegistererWith(prometheus.Labels{"shard": shard.ID}, prometheus.DefaultRegisterer),
+		)
+		if err != nil {
+			log.Log.Errorw("Error starting to tail shard; will retry", "shard", shard.ID, "error", err)
+			metricShardDiscoveryErrors.Inc()
+			continue
+		}
+
+		log.Log.Infow("Started tailing shard", "shard", shard.ID, "host", shard.Host)
+	}
+
+	for name := range current {
+		if seen[name] {
+			continue
+		}
+
+		// A shard only disappears from config.shards once its chunks have
+		// moved to other shards, so nothing is written to its oplog anymore.
+		// We may not have published all of it yet, though.
+		p := pipelines.get(name)
+		if p == nil {
+			continue
+		}
+		log.Log.Infow("Shard was removed from the cluster; stopping tailing once it's published", "shard", name)
+		if !p.drain(stop) {
+			log.Log.Warnw("Gave up waiting to publish the rest of a removed shard's oplog", "shard", name)
+		}
+		pipelines.stop(name)
+	}
+
+	metricShardsTailed.Set(float64(len(pipelines.names())))
+}
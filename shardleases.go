@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/tulip/oplogtoredis/lib/config"
+	"github.com/tulip/oplogtoredis/lib/lease"
+	"github.com/tulip/oplogtoredis/lib/log"
+	"github.com/tulip/oplogtoredis/lib/redispub"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricWriteShardsHeld = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "write_shards",
+	Help:      "Gauge indicating the number of write shards this instance holds the lease for.",
+})
+
+var metricWriteShardRebalances = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "lease",
+	Name:      "write_shard_rebalances",
+	Help:      "Number of times the write shards this instance holds the lease for changed.",
+})
+
+// shardOwnership competes for the write shard leases (see config.ShardLeases)
+// in the first Redis in OTR_REDIS_URL
+type shardOwnership struct {
+	client redis.UniversalClient
+	shards *lease.Shards
+
+	mutex sync.Mutex
+	held  []int
+}
+
+func newShardOwnership() (*shardOwnership, error) {
+	client, err := createRedisClient(config.RedisURL()[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &shardOwnership{
+		client: client,
+		shards: lease.NewShards(client, config.RedisMetadataPrefix(), leaseHolder(), config.WriteParallelism(), config.LeaseTTL()),
+	}, nil
+}
+
+// run implements coordination. We tail the oplog once for all the write
+// shards we hold, each with its fencing token. When the write shards we hold
+// change, only the publishers of the ones that changed are started or
+// stopped, and the tailer resumes each one from its own checkpoint.
+func (o *shardOwnership) run(setShards func(shards shardSet) error, stop <-chan bool) {
+	// Only accessed by the calls to start and stopShard, which Shards.Run
+	// makes one at a time
+	held := shardSet{}
+
+	start := func(shard int, token int64) error {
+		log.Log.Infow("Acquired write shard; starting to publish it", "writeShard", shard, "fencingToken", token)
+		held[shard] = redispub.Fencing{Key: o.shards.Lease(shard).TokenKey(), Token: token}
+		if err := setShards(held.copy()); err != nil {
+			delete(held, shard)
+			return errors.Wrapf(err, "starting to publish write shard %d", shard)
+		}
+
+		o.setHeld(held)
+		return nil
+	}
+
+	stopShard := func(shard int) {
+		log.Log.Infow("Gave up write shard; stopping publishing it", "writeShard", shard)
+		delete(held, shard)
+		if err := setShards(held.copy()); err != nil {
+			log.Log.Errorw("Error stopping publishing write shard", "writeShard", shard, "error", err)
+		}
+		o.setHeld(held)
+	}
+
+	onError := func(err error) {
+		log.Log.Errorw("Error with write shard leases; will retry", "error", err)
+		metricLeaseErrors.Inc()
+	}
+
+	log.Log.Infow("Competing for write shard leases", "members", o.shards.MembersKey())
+	o.shards.Run(config.LeaseTTL()/3, start, stopShard, onError, stop)
+}
+
+// setHeld records the write shards we're publishing
+func (o *shardOwnership) setHeld(held shardSet) {
+	ordinals := held.sorted()
+
+	o.mutex.Lock()
+	o.held = ordinals
+	o.mutex.Unlock()
+	metricWriteShardsHeld.Set(float64(len(ordinals)))
+	metricWriteShardRebalances.Inc()
+
+	if len(ordinals) == 0 {
+		log.Log.Warn("Holding no write shards; not tailing the oplog")
+	}
+}
+
+func (o *shardOwnership) redisClient() redis.UniversalClient {
+	return o.client
+}
+
+// describe implements coordination, with the write shards we hold
+func (o *shardOwnership) describe(response map[string]interface{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	response["writeShards"] = append([]int{}, o.held...)
+}
+
+func (o *shardOwnership) close() {
+	if err := o.client.Close(); err != nil {
+		log.Log.Errorw("Error closing write shard lease Redis client", "error", err)
+	}
+}